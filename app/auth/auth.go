@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"strings"
@@ -15,17 +18,23 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// twoFactorWindow is how long a user has to enter their second factor after
+// getting their password right
+const twoFactorWindow = 5 * time.Minute
+
 type Authenticator struct {
 	Manager sessionManager.SessionManager
+	Clock   func() time.Time
 }
 
-func NewAuthenticator(r *http.Request, w http.ResponseWriter, s *sessions.CookieStore) Authenticator {
+func NewAuthenticator(r *http.Request, w http.ResponseWriter, s sessions.Store) Authenticator {
 	return Authenticator{
 		Manager: sessionManager.New(r, w, s),
+		Clock:   time.Now,
 	}
 }
 
-func IsLoggedIn(r *http.Request, s *sessions.CookieStore) (bool, string) {
+func IsLoggedIn(r *http.Request, s sessions.Store) (bool, string) {
 	session, err := s.Get(r, config.SessionCookieName)
 	if err != nil {
 		glog.Error(err)
@@ -45,10 +54,15 @@ func HashPassword(raw string) (string, error) {
 	return string(bytes), nil
 }
 
-func (p *Authenticator) LogUserIn(userEmail string, hashedPassword string, rawPassword string) bool {
+func (p *Authenticator) LogUserIn(userEmail string, hashedPassword string, rawPassword string, remember bool) bool {
 	if valid := checkPassword(rawPassword, hashedPassword); !valid {
 		return false
 	}
+	return p.completeLogin(userEmail, remember)
+}
+
+func (p *Authenticator) completeLogin(userEmail string, remember bool) bool {
+	p.Manager.SetRemember(remember)
 	p.Manager.SetUser(userEmail)
 	if err := p.Manager.Save(); err != nil {
 		glog.Error(err.Error())
@@ -57,13 +71,56 @@ func (p *Authenticator) LogUserIn(userEmail string, hashedPassword string, rawPa
 	return true
 }
 
+// BeginTwoFactorLogin checks the password just like LogUserIn, but rather
+// than logging the user in it holds them until they've entered a second factor.
+func (p *Authenticator) BeginTwoFactorLogin(userEmail string, hashedPassword string, rawPassword string, remember bool) bool {
+	if valid := checkPassword(rawPassword, hashedPassword); !valid {
+		return false
+	}
+	if err := p.Manager.SetPendingUser(userEmail, remember, p.Clock().Unix()); err != nil {
+		glog.Error(err.Error())
+		return false
+	}
+	return true
+}
+
+// PendingUser is whoever got their password right in the last few minutes
+// and still owes us a second factor.
+func (p *Authenticator) PendingUser() (string, bool) {
+	email, _, since := p.Manager.GetPendingUser()
+	if email == "" {
+		return "", false
+	}
+	if p.Clock().Sub(time.Unix(since, 0)) > twoFactorWindow {
+		p.Manager.ClearPendingUser()
+		return "", false
+	}
+	return email, true
+}
+
+// FinishTwoFactorLogin logs the pending user in once their code has checked out
+func (p *Authenticator) FinishTwoFactorLogin() bool {
+	email, ok := p.PendingUser()
+	if !ok {
+		return false
+	}
+	_, remember, _ := p.Manager.GetPendingUser()
+	p.Manager.ClearPendingUser()
+	return p.completeLogin(email, remember)
+}
+
+// CheckPassword is for re-confirming a password outside of logging in
+func CheckPassword(rawPassword, hashedPassword string) bool {
+	return checkPassword(rawPassword, hashedPassword)
+}
+
 func checkPassword(rawPassword, hashedPassword string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(rawPassword))
 	return err == nil
 }
 
 func (p *Authenticator) LogUserOut() {
-	p.Manager.DeleteUser()
+	p.Manager.Destroy()
 }
 
 func NewSigner() *goalone.Sword {
@@ -104,10 +161,15 @@ func NewTSToken(identifier, kind string) string {
 	return string(encoded)
 }
 
+// VerifyTSToken checks the token's signature, then that it's no more than
+// minutes old. Parse alone doesn't check the signature.
 func VerifyTSToken(kind, token string, minutes float64) (string, bool) {
 	decoded, _ := base64.URLEncoding.DecodeString(token)
 	signer := NewTimestampSigner()
-	raw := signer.Parse([]byte(decoded))
+	if _, err := signer.Unsign(decoded); err != nil {
+		return "", false
+	}
+	raw := signer.Parse(decoded)
 	if time.Since(raw.Timestamp).Minutes() > minutes {
 		return "expired", false
 	}
@@ -117,3 +179,61 @@ func VerifyTSToken(kind, token string, minutes float64) (string, bool) {
 	}
 	return split[0], true
 }
+
+// EmailChangeValidTime is how many minutes an email change link works for
+const EmailChangeValidTime = 24 * 60
+
+// NewEmailChangeToken goes in the link sent to the new address, and carries
+// both the old address and the new one
+func NewEmailChangeToken(from, to string) string {
+	return NewTSToken(from+" "+to, "change-email")
+}
+
+func VerifyEmailChangeToken(token string) (string, string, bool) {
+	identifier, valid := VerifyTSToken("change-email", token, EmailChangeValidTime)
+	if !valid {
+		return "", "", false
+	}
+	split := strings.Split(identifier, " ")
+	if len(split) != 2 {
+		return "", "", false
+	}
+	return split[0], split[1], true
+}
+
+const apiTokenPrefix = "pf_"
+
+// NewAPIToken returns a random personal access token along with the hash
+// that gets stored; the raw token is only ever shown to the user once.
+func NewAPIToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		glog.Errorf("API token error: %v", err.Error())
+		return "", "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashAPIToken(token), nil
+}
+
+func HashAPIToken(token string) string {
+	return hashSecret(token)
+}
+
+// hashSecret is for high-entropy random secrets only; passwords get bcrypt
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetBearerToken pulls a personal access token out of the Authorization header
+func GetBearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(header[7:])
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return ""
+	}
+	return token
+}
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
@@ -66,4 +69,121 @@ func TestTokens(t *testing.T) {
 	if !(valid && identifier == "tynanburke@gmail.com") {
 		t.Errorf("Validation failing with valid=%v, ident=%v", valid, identifier)
 	}
+	decoded, _ := base64.URLEncoding.DecodeString(newTSToken)
+	forged := base64.URLEncoding.EncodeToString(append([]byte("someone@else.com"), decoded[len("tynanburke@gmail.com"):]...))
+	if identifier, valid = VerifyTSToken("csrf", forged, 1); valid {
+		t.Errorf("Forged token verified as %v", identifier)
+	}
+	if _, valid = VerifyTSToken("csrf", "", 1); valid {
+		t.Error("Empty token verified")
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	token, hashed, err := NewAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed != HashAPIToken(token) {
+		t.Error("Token hash is not deterministic")
+	}
+	if hashed == token {
+		t.Error("Tokens must not be stored in plaintext")
+	}
+	r, _ := http.NewRequest("GET", "/dashboard", nil)
+	if GetBearerToken(r) != "" {
+		t.Error("Bearer token found without a header")
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if GetBearerToken(r) != token {
+		t.Errorf("Expected %v, got %v", token, GetBearerToken(r))
+	}
+	r.Header.Set("Authorization", "Basic "+token)
+	if GetBearerToken(r) != "" {
+		t.Error("Non-bearer header accepted")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err := TOTPCode(secret, time.Unix(59, 0))
+	if err != nil || code != "287082" {
+		t.Fatalf("Expected 287082, got %v (%v)", code, err)
+	}
+	now := time.Unix(1111111109, 0)
+	code, _ = TOTPCode(secret, now)
+	step, ok := VerifyTOTP(secret, code, now, 0)
+	if !ok {
+		t.Fatal("Current code rejected")
+	}
+	if _, ok := VerifyTOTP(secret, code, now.Add(30*time.Second), 0); !ok {
+		t.Error("Code from one period ago rejected")
+	}
+	if _, ok := VerifyTOTP(secret, code, now.Add(90*time.Second), 0); ok {
+		t.Error("Code from three periods ago accepted")
+	}
+	if _, ok := VerifyTOTP(secret, code, now, step); ok {
+		t.Error("Code accepted twice")
+	}
+	if _, ok := VerifyTOTP(secret, "12345", now, 0); ok {
+		t.Error("Short code accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes(3)
+	if err != nil || len(codes) != 3 || len(hashes) != 3 {
+		t.Fatalf("Got %v codes, %v hashes, %v", len(codes), len(hashes), err)
+	}
+	sloppy := strings.ToUpper(strings.Replace(codes[0], "-", " ", -1))
+	if HashRecoveryCode(sloppy) != hashes[0] {
+		t.Errorf("%v should match %v", sloppy, codes[0])
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("whatever"))
+	r, _ := http.NewRequest("POST", "/auth", nil)
+	w := httptest.NewRecorder()
+	authenticator := NewAuthenticator(r, w, store)
+	now := time.Unix(1500000000, 0)
+	authenticator.Clock = func() time.Time { return now }
+	hashed, _ := HashPassword("password")
+	if authenticator.BeginTwoFactorLogin("a@b.c", hashed, "wrong", false) {
+		t.Error("Bad password accepted")
+	}
+	if !authenticator.BeginTwoFactorLogin("a@b.c", hashed, "password", false) {
+		t.Fatal("Good password rejected")
+	}
+	if _, ok := authenticator.Manager.Session.Values["userEmail"]; ok {
+		t.Error("Logged in before the second factor")
+	}
+	if email, ok := authenticator.PendingUser(); !ok || email != "a@b.c" {
+		t.Errorf("Pending user is %v", email)
+	}
+	now = now.Add(twoFactorWindow + time.Second)
+	if _, ok := authenticator.PendingUser(); ok {
+		t.Error("Pending login didn't expire")
+	}
+	if authenticator.FinishTwoFactorLogin() {
+		t.Error("Expired pending login was finished")
+	}
+}
+
+func TestEmailChangeToken(t *testing.T) {
+	token := NewEmailChangeToken("old@example.com", "new@example.com")
+	from, to, valid := VerifyEmailChangeToken(token)
+	if !valid || from != "old@example.com" || to != "new@example.com" {
+		t.Errorf("Got %v -> %v, valid=%v", from, to, valid)
+	}
+	if _, _, valid := VerifyEmailChangeToken(NewTSToken("old@example.com", "change-email")); valid {
+		t.Error("Token without a new address accepted")
+	}
+	if _, _, valid := VerifyEmailChangeToken(NewToken("old@example.com new@example.com", "change-email")); valid {
+		t.Error("Token that never expires accepted")
+	}
+	if _, valid := VerifyToken("verify-email", token); valid {
+		t.Error("Email change token accepted as a verification token")
+	}
 }
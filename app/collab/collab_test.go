@@ -0,0 +1,349 @@
+package collab
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/websocket"
+)
+
+func mustApply(t *testing.T, op Op, doc string) string {
+	output, err := op.Apply([]rune(doc))
+	if err != nil {
+		t.Fatalf("Applying %v to %q: %v", op, doc, err)
+	}
+	return string(output)
+}
+
+func TestApply(t *testing.T) {
+	op := Op{}.Retain(4).Insert("quick brown").Delete(4).Retain(4)
+	if got := mustApply(t, op, "the slow fox"); got != "the quick brown fox" {
+		t.Errorf("Got %q", got)
+	}
+	if _, err := op.Apply([]rune("too short")); err == nil {
+		t.Error("Op applied to the wrong length of document")
+	}
+	// lengths are in code points, not bytes
+	if got := mustApply(t, Op{}.Retain(1).Delete(1).Retain(1), "a⁂b"); got != "ab" {
+		t.Errorf("Got %q", got)
+	}
+	// the two big retains overflow BaseLen back round to 3
+	maxInt := int(^uint(0) >> 1)
+	if _, err := (Op{{Retain: maxInt}, {Retain: maxInt}, {Retain: 5}}).Apply([]rune("abc")); err == nil {
+		t.Error("Op that overflows its length applied")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	cases := []struct {
+		doc  string
+		a, b Op
+		want string
+	}{
+		{"abc", Op{}.Retain(1).Insert("X").Retain(2), Op{}.Retain(2).Insert("Y").Retain(1), "aXbYc"},
+		// the same place: a's goes first
+		{"abc", Op{}.Retain(1).Insert("X").Retain(2), Op{}.Retain(1).Insert("Y").Retain(2), "aXYbc"},
+		{"abcdef", Op{}.Retain(1).Delete(3).Retain(2), Op{}.Retain(2).Delete(3).Retain(1), "af"},
+		{"abcdef", Op{}.Delete(6), Op{}.Retain(3).Insert("new").Retain(3), "new"},
+		{"", Op{}.Insert("one"), Op{}.Insert("two"), "onetwo"},
+	}
+	for _, c := range cases {
+		aPrime, bPrime, err := Transform(c.a, c.b)
+		if err != nil {
+			t.Fatalf("Transforming %v and %v: %v", c.a, c.b, err)
+		}
+		ab := mustApply(t, bPrime, mustApply(t, c.a, c.doc))
+		ba := mustApply(t, aPrime, mustApply(t, c.b, c.doc))
+		if ab != c.want || ba != c.want {
+			t.Errorf("%q with %v and %v: got %q and %q, want %q", c.doc, c.a, c.b, ab, ba, c.want)
+		}
+	}
+	if _, _, err := Transform(Op{}.Retain(2), Op{}.Retain(3)); err == nil {
+		t.Error("Transformed ops for different documents")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	cases := [][2]string{
+		{"", "hello"},
+		{"hello", ""},
+		{"<p>one two</p>", "<p>one and two</p>"},
+		{"same", "same"},
+		{"aaa", "aa"},
+		{"naïve café", "naïve cafés"},
+	}
+	for _, c := range cases {
+		if got := mustApply(t, Diff([]rune(c[0]), []rune(c[1])), c[0]); got != c[1] {
+			t.Errorf("Diff from %q to %q gave %q", c[0], c[1], got)
+		}
+	}
+	if !Diff([]rune("same"), []rune("same")).IsNoop() {
+		t.Error("Diff of the same text should do nothing")
+	}
+}
+
+func TestOpJSON(t *testing.T) {
+	op := Op{}.Retain(3).Insert("hi").Delete(2).Retain(1)
+	data, err := json.Marshal(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[3,"hi",-2,1]` {
+		t.Errorf("Got %s", data)
+	}
+	var back Op
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != len(op) || back.BaseLen() != op.BaseLen() {
+		t.Errorf("Got %v back", back)
+	}
+	for _, bad := range []string{`[0]`, `[1.5]`, `[""]`, `[true]`, `{}`, `[1e300]`, `[-2000000000]`} {
+		if err := json.Unmarshal([]byte(bad), &back); err == nil {
+			t.Errorf("Took %v", bad)
+		}
+	}
+}
+
+/*
+.
+.
+*/
+
+type memStore struct {
+	mu     sync.Mutex
+	bodies map[int]string
+	saves  []string
+	// editors from every save, in order
+	editors [][]string
+}
+
+func (m *memStore) Load(sectionId int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bodies[sectionId], nil
+}
+
+func (m *memStore) Save(sectionId int, body string, editors []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bodies[sectionId] = body
+	m.saves = append(m.saves, body)
+	m.editors = append(m.editors, editors)
+	return nil
+}
+
+func (m *memStore) body(sectionId int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bodies[sectionId]
+}
+
+// hubServer serves section 1's session, with whoever's named in the query
+func hubServer(h *Hub) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		h.Serve(conn, 1, r.URL.Query().Get("name"))
+	}))
+}
+
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+	id   int
+	// messages skipped while expecting others
+	waiting []message
+}
+
+func connect(t *testing.T, server *httptest.Server, name string) (*testClient, message) {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?name="+name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, conn: conn}
+	init := c.expect("init")
+	c.id = init.Client
+	return c, init
+}
+
+func (c *testClient) send(m message) {
+	data, _ := json.Marshal(m)
+	if err := c.conn.WriteMessage(data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect returns the next message of the type, keeping any others that
+// come first for later
+func (c *testClient) expect(kind string) message {
+	for i, m := range c.waiting {
+		if m.Type == kind {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			return m
+		}
+	}
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("Waiting for %v: %v", kind, err)
+		}
+		m := message{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.t.Fatal(err)
+		}
+		if m.Type == kind {
+			return m
+		}
+		c.waiting = append(c.waiting, m)
+	}
+}
+
+func TestSession(t *testing.T) {
+	store := &memStore{bodies: map[int]string{1: "<p>Call me Ishmael.</p>"}}
+	hub := NewHub(store)
+	server := hubServer(hub)
+	defer server.Close()
+
+	ann, init := connect(t, server, "ann@example.com")
+	if init.Body != "<p>Call me Ishmael.</p>" || init.Rev != 0 {
+		t.Fatalf("Got %+v", init)
+	}
+	bob, init := connect(t, server, "bob@example.com")
+	if len(init.Clients) != 2 {
+		t.Errorf("Bob sees %v", init.Clients)
+	}
+	if presence := ann.expect("presence"); len(presence.Clients) != 2 || presence.Clients[1].Name != "bob@example.com" {
+		t.Errorf("Ann sees %v", presence.Clients)
+	}
+
+	// both change the body at revision 0
+	ann.send(message{Type: "op", Rev: 0, Op: Op{}.Retain(3).Insert("Just ").Retain(20)})
+	bob.send(message{Type: "op", Rev: 0, Op: Op{}.Retain(19).Insert(" Please").Retain(4)})
+	annAck := ann.expect("ack")
+	bobAck := bob.expect("ack")
+	if annAck.Rev+bobAck.Rev != 3 {
+		t.Errorf("Acks at %v and %v", annAck.Rev, bobAck.Rev)
+	}
+	// each gets the other's, transformed if need be
+	fromBob := ann.expect("op")
+	fromAnn := bob.expect("op")
+	if fromBob.Client != bob.id || fromAnn.Client != ann.id {
+		t.Errorf("Ops from %v and %v", fromBob.Client, fromAnn.Client)
+	}
+	want := "<p>Just Call me Ishmael. Please</p>"
+	annDoc := mustApply(t, Op{}.Retain(3).Insert("Just ").Retain(20), init.Body)
+	bobDoc := mustApply(t, Op{}.Retain(19).Insert(" Please").Retain(4), init.Body)
+	// whoever was first gets the other's op as it was sent, and the other
+	// one's was transformed on the server
+	if annAck.Rev == 1 {
+		annDoc = mustApply(t, fromBob.Op, annDoc)
+		bobDoc = mustTransformAndApply(t, Op{}.Retain(19).Insert(" Please").Retain(4), fromAnn.Op, bobDoc)
+	} else {
+		bobDoc = mustApply(t, fromAnn.Op, bobDoc)
+		annDoc = mustTransformAndApply(t, Op{}.Retain(3).Insert("Just ").Retain(20), fromBob.Op, annDoc)
+	}
+	if annDoc != want || bobDoc != want {
+		t.Errorf("Ann has %q and Bob has %q", annDoc, bobDoc)
+	}
+
+	bob.send(message{Type: "cursor", Cursor: 7})
+	if cursor := ann.expect("cursor"); cursor.Client != bob.id || cursor.Cursor != 7 {
+		t.Errorf("Got %+v", cursor)
+	}
+
+	// an op from too far in the future gets the body sent again
+	ann.send(message{Type: "op", Rev: 99, Op: Op{}.Retain(1)})
+	if again := ann.expect("init"); again.Body != want || again.Rev != 2 {
+		t.Errorf("Got %+v", again)
+	}
+
+	hub.SaveAll()
+	if store.body(1) != want {
+		t.Errorf("Saved %q", store.body(1))
+	}
+	if len(store.editors) != 1 || strings.Join(store.editors[0], " ") != "ann@example.com bob@example.com" {
+		t.Errorf("Editors %v", store.editors)
+	}
+	// nothing's changed since
+	hub.SaveAll()
+	if len(store.saves) != 1 {
+		t.Errorf("Saved %v times", len(store.saves))
+	}
+
+	bob.conn.Close()
+	if presence := ann.expect("presence"); len(presence.Clients) != 1 {
+		t.Errorf("Ann sees %v after Bob left", presence.Clients)
+	}
+	ann.conn.Close()
+}
+
+// mustTransformAndApply is what a client does with someone else's op while
+// its own is unacknowledged
+func mustTransformAndApply(t *testing.T, mine, theirs Op, doc string) string {
+	_, theirsPrime, err := Transform(mine, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mustApply(t, theirsPrime, doc)
+}
+
+func TestSaveWhenLastLeaves(t *testing.T) {
+	store := &memStore{bodies: map[int]string{1: "draft"}}
+	hub := NewHub(store)
+	server := hubServer(hub)
+	defer server.Close()
+	ann, _ := connect(t, server, "ann@example.com")
+	ann.send(message{Type: "op", Rev: 0, Op: Op{}.Retain(5).Insert(" two")})
+	ann.expect("ack")
+	ann.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for store.body(1) != "draft two" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Never saved; body is %q", store.body(1))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.sessions) != 0 {
+		t.Error("Session kept after everyone left")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	store := &memStore{bodies: map[int]string{1: "one two"}}
+	hub := NewHub(store)
+	server := hubServer(hub)
+	defer server.Close()
+
+	// without a session the form's body is saved as it is
+	if got := hub.Merge(2, "form body", false); got != "form body" {
+		t.Errorf("Got %q", got)
+	}
+
+	ann, _ := connect(t, server, "ann@example.com")
+	ann.send(message{Type: "op", Rev: 0, Op: Op{}.Retain(7).Insert(" three")})
+	ann.expect("ack")
+	// a form that kept up with the session saves the session's body
+	if got := hub.Merge(1, "one two", true); got != "one two three" {
+		t.Errorf("In step, got %q", got)
+	}
+	// one that didn't wins, and the session hears about it
+	if got := hub.Merge(1, "one 2 three", false); got != "one 2 three" {
+		t.Errorf("Out of step, got %q", got)
+	}
+	m := ann.expect("op")
+	if got := mustApply(t, m.Op, "one two three"); got != "one 2 three" || m.Client != 0 || m.Rev != 2 {
+		t.Errorf("Ann got %+v, making %q", m, got)
+	}
+	ann.conn.Close()
+}
@@ -0,0 +1,368 @@
+package collab
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/websocket"
+	"github.com/golang/glog"
+)
+
+// Store is where sections' bodies come from and go back to
+type Store interface {
+	Load(sectionId int) (string, error)
+	// Save writes the body back. editors are whoever's changed it since the
+	// last save.
+	Save(sectionId int, body string, editors []string) error
+}
+
+// historyKept is how many past ops a session remembers. A client further
+// behind than that is sent the whole body again.
+const historyKept = 500
+
+// idleTimeout drops clients that haven't sent anything, not even a
+// heartbeat, for this long
+const idleTimeout = 2 * time.Minute
+
+// message is everything that goes over the socket, both ways:
+//
+//	init     to a client that's joined or fallen behind: Body at Rev, and Clients
+//	op       from a client: Op made at Rev. To the others: Op taking it to Rev, from Client
+//	ack      to the client whose op took the body to Rev
+//	cursor   from a client: where its caret is. To the others: Cursor of Client
+//	presence to everyone when someone joins or leaves: Clients
+//	ping     from a client, to keep the connection open
+//
+// Cursors are offsets into the body's text, as in comment anchors, not into
+// its HTML, so they aren't transformed; clients send them again after every
+// change.
+type message struct {
+	Type    string     `json:"type"`
+	Rev     int        `json:"rev"`
+	Op      Op         `json:"op,omitempty"`
+	Body    string     `json:"body,omitempty"`
+	Client  int        `json:"client,omitempty"`
+	Cursor  int        `json:"cursor"`
+	Clients []Presence `json:"clients,omitempty"`
+}
+
+// Presence is someone in a session, for everyone else's list and carets
+type Presence struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Cursor int    `json:"cursor"`
+}
+
+type client struct {
+	id     int
+	name   string
+	cursor int
+	conn   *websocket.Conn
+	send   chan []byte
+	kick   sync.Once
+}
+
+// deliver queues a message for the client's writer. One that's too far
+// behind is hung up on rather than holding everyone else up.
+func (c *client) deliver(data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		c.kick.Do(func() { go c.conn.Close() })
+	}
+}
+
+func (c *client) writeAll() {
+	for data := range c.send {
+		if err := c.conn.WriteMessage(data); err != nil {
+			c.kick.Do(func() { c.conn.Close() })
+		}
+	}
+}
+
+type session struct {
+	sectionId int
+	mu        sync.Mutex
+	text      []rune
+	// history[i] took the body from revision base+i to base+i+1
+	history []Op
+	base    int
+	clients map[int]*client
+	dirty   bool
+	editors map[string]bool
+	// saveMu keeps saves in order, so an older body never lands last
+	saveMu sync.Mutex
+}
+
+func (s *session) rev() int {
+	return s.base + len(s.history)
+}
+
+func (s *session) presence() []Presence {
+	output := []Presence{}
+	for _, c := range s.clients {
+		output = append(output, Presence{Id: c.id, Name: c.name, Cursor: c.cursor})
+	}
+	sort.Sort(byId(output))
+	return output
+}
+
+type byId []Presence
+
+func (p byId) Len() int           { return len(p) }
+func (p byId) Less(i, j int) bool { return p[i].Id < p[j].Id }
+func (p byId) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// broadcast goes to every client but the one with id except, which can be 0
+// for none
+func (s *session) broadcast(m message, except int) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		glog.Errorf("Error encoding collab message: %v", err.Error())
+		return
+	}
+	for id, c := range s.clients {
+		if id != except {
+			c.deliver(data)
+		}
+	}
+}
+
+func (s *session) sendTo(c *client, m message) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		glog.Errorf("Error encoding collab message: %v", err.Error())
+		return
+	}
+	c.deliver(data)
+}
+
+func (s *session) sendInit(c *client) {
+	s.sendTo(c, message{Type: "init", Rev: s.rev(), Body: string(s.text), Client: c.id, Clients: s.presence()})
+}
+
+// apply transforms op, made at rev, past everything since and applies it
+func (s *session) apply(op Op, rev int) (Op, error) {
+	for _, past := range s.history[rev-s.base:] {
+		var err error
+		if op, _, err = Transform(op, past); err != nil {
+			return nil, err
+		}
+	}
+	text, err := op.Apply(s.text)
+	if err != nil {
+		return nil, err
+	}
+	s.text = text
+	s.history = append(s.history, op)
+	if len(s.history) > historyKept {
+		s.base += len(s.history) - historyKept
+		s.history = append([]Op{}, s.history[len(s.history)-historyKept:]...)
+	}
+	s.dirty = true
+	return op, nil
+}
+
+func (s *session) receive(c *client, data []byte) {
+	m := message{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		glog.Warningf("Bad collab message from %v: %v", c.name, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Type {
+	case "op":
+		if m.Rev < s.base || m.Rev > s.rev() {
+			s.sendInit(c)
+			return
+		}
+		op, err := s.apply(m.Op, m.Rev)
+		if err != nil {
+			glog.Warningf("Collab op from %v on section %v didn't apply: %v", c.name, s.sectionId, err.Error())
+			s.sendInit(c)
+			return
+		}
+		s.editors[c.name] = true
+		s.sendTo(c, message{Type: "ack", Rev: s.rev()})
+		s.broadcast(message{Type: "op", Rev: s.rev(), Op: op, Client: c.id}, c.id)
+	case "cursor":
+		c.cursor = m.Cursor
+		s.broadcast(message{Type: "cursor", Client: c.id, Cursor: m.Cursor}, c.id)
+	}
+}
+
+// save writes the body back if it's changed since last time. If it can't,
+// it'll be tried again next time.
+func (s *session) save(store Store) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	body := string(s.text)
+	editors := []string{}
+	for name := range s.editors {
+		editors = append(editors, name)
+	}
+	sort.Strings(editors)
+	s.dirty = false
+	s.editors = map[string]bool{}
+	s.mu.Unlock()
+	if err := store.Save(s.sectionId, body, editors); err != nil {
+		glog.Errorf("Error saving collab section %v: %v", s.sectionId, err.Error())
+		s.mu.Lock()
+		s.dirty = true
+		for _, name := range editors {
+			s.editors[name] = true
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Hub has a session for every section someone's editing
+type Hub struct {
+	store      Store
+	mu         sync.Mutex
+	sessions   map[int]*session
+	lastClient int
+}
+
+func NewHub(store Store) *Hub {
+	return &Hub{store: store, sessions: make(map[int]*session)}
+}
+
+// join adds a client to the section's session, starting one if need be
+func (h *Hub) join(sectionId int, c *client) (*session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[sectionId]
+	if !ok {
+		body, err := h.store.Load(sectionId)
+		if err != nil {
+			return nil, err
+		}
+		s = &session{
+			sectionId: sectionId,
+			text:      []rune(body),
+			clients:   make(map[int]*client),
+			editors:   make(map[string]bool),
+		}
+		h.sessions[sectionId] = s
+	}
+	h.lastClient++
+	c.id = h.lastClient
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.id] = c
+	s.sendInit(c)
+	s.broadcast(message{Type: "presence", Clients: s.presence()}, c.id)
+	return s, nil
+}
+
+// leave takes the client out of its session, saving and closing the session
+// if it was the last one there
+func (h *Hub) leave(s *session, c *client) {
+	s.mu.Lock()
+	delete(s.clients, c.id)
+	close(c.send)
+	empty := len(s.clients) == 0
+	if !empty {
+		s.broadcast(message{Type: "presence", Clients: s.presence()}, 0)
+	}
+	s.mu.Unlock()
+	if !empty {
+		return
+	}
+	s.save(h.store)
+	h.dropIfIdle(s)
+}
+
+// dropIfIdle forgets a session with nobody in it and nothing to save.
+// Someone may have joined while it was saving.
+func (h *Hub) dropIfIdle(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) == 0 && !s.dirty && h.sessions[s.sectionId] == s {
+		delete(h.sessions, s.sectionId)
+	}
+}
+
+// Serve runs one person's connection to a section's session until it
+// closes. name is who they are to everyone else.
+func (h *Hub) Serve(conn *websocket.Conn, sectionId int, name string) error {
+	c := &client{name: name, conn: conn, send: make(chan []byte, 256)}
+	defer conn.Close()
+	s, err := h.join(sectionId, c)
+	if err != nil {
+		return err
+	}
+	go c.writeAll()
+	defer h.leave(s, c)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		data, err := conn.ReadMessage()
+		if err == websocket.ErrClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.receive(c, data)
+	}
+}
+
+// Merge is for a section saved through the edit form, which might be open
+// in a session too. If the form was in step with the session, the session's
+// body is the one to save. Otherwise the form's body wins, like it would
+// without a session, and everyone in it is sent the change.
+func (h *Hub) Merge(sectionId int, body string, inStep bool) string {
+	h.mu.Lock()
+	s, ok := h.sessions[sectionId]
+	h.mu.Unlock()
+	if !ok {
+		return body
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inStep {
+		return string(s.text)
+	}
+	op := Diff(s.text, []rune(body))
+	if op.IsNoop() {
+		return body
+	}
+	if _, err := s.apply(op, s.rev()); err != nil {
+		glog.Errorf("Error merging form into collab section %v: %v", sectionId, err.Error())
+		return body
+	}
+	s.broadcast(message{Type: "op", Rev: s.rev(), Op: op}, 0)
+	return body
+}
+
+// SaveAll writes back every session's body that's changed, and forgets any
+// left over from a failed save when the last editor left
+func (h *Hub) SaveAll() {
+	h.mu.Lock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+	for _, s := range sessions {
+		s.save(h.store)
+		h.dropIfIdle(s)
+	}
+}
+
+func (h *Hub) SaveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.SaveAll()
+	}
+}
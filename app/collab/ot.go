@@ -0,0 +1,254 @@
+// Package collab lets several people edit a section's body at once. Each
+// section being edited has a session holding the body, which clients change
+// by sending operations (see Op) against the revision they last saw. The
+// session transforms them past anything they missed, applies them, and
+// passes them on. Sessions write the body back through a Store now and then,
+// and when the last editor leaves.
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// maxComponent is the most characters one component can keep or delete,
+// far more than any section, so that adding them up can't overflow
+const maxComponent = 1 << 30
+
+// Component is one step of an Op: exactly one of its fields is set
+type Component struct {
+	Retain int
+	Delete int
+	Insert string
+}
+
+// Op is a change to a whole document. It walks the document from the start,
+// keeping, deleting and inserting as it goes, and has to cover all of it.
+// Lengths are in code points, which is what the editor's JavaScript counts
+// with Array.from. On the wire it's the ot.js format: a positive number
+// keeps that many characters, a negative one deletes that many, and a string
+// is inserted.
+type Op []Component
+
+func (o Op) Retain(n int) Op {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Retain > 0 {
+		o[last].Retain += n
+		return o
+	}
+	return append(o, Component{Retain: n})
+}
+
+func (o Op) Delete(n int) Op {
+	if n <= 0 {
+		return o
+	}
+	if last := len(o) - 1; last >= 0 && o[last].Delete > 0 {
+		o[last].Delete += n
+		return o
+	}
+	return append(o, Component{Delete: n})
+}
+
+// Insert keeps inserts before deletes, so ops that do the same thing look
+// the same
+func (o Op) Insert(s string) Op {
+	if s == "" {
+		return o
+	}
+	last := len(o) - 1
+	if last >= 0 && o[last].Insert != "" {
+		o[last].Insert += s
+		return o
+	}
+	if last >= 0 && o[last].Delete > 0 {
+		if last > 0 && o[last-1].Insert != "" {
+			o[last-1].Insert += s
+			return o
+		}
+		o = append(o, o[last])
+		o[last] = Component{Insert: s}
+		return o
+	}
+	return append(o, Component{Insert: s})
+}
+
+// BaseLen is how long a document the op applies to is
+func (o Op) BaseLen() int {
+	n := 0
+	for _, c := range o {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// IsNoop is whether the op leaves the document as it was
+func (o Op) IsNoop() bool {
+	return len(o) == 0 || (len(o) == 1 && o[0].Retain > 0)
+}
+
+// Apply returns doc with the op's changes made. Each component is checked
+// against what's left of doc as well as the op as a whole, as a client
+// could send lengths that overflow BaseLen.
+func (o Op) Apply(doc []rune) ([]rune, error) {
+	if o.BaseLen() != len(doc) {
+		return nil, fmt.Errorf("op is for a document of %v characters, not %v", o.BaseLen(), len(doc))
+	}
+	output := make([]rune, 0, len(doc))
+	pos := 0
+	for _, c := range o {
+		if c.Retain < 0 || c.Delete < 0 || c.Retain > len(doc)-pos || c.Delete > len(doc)-pos {
+			return nil, fmt.Errorf("op runs past the end of a document of %v characters", len(doc))
+		}
+		switch {
+		case c.Retain > 0:
+			output = append(output, doc[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Delete > 0:
+			pos += c.Delete
+		default:
+			output = append(output, []rune(c.Insert)...)
+		}
+	}
+	return output, nil
+}
+
+var errMismatch = errors.New("ops aren't for the same document")
+
+// Transform takes two ops made at the same time to the same document and
+// returns a' and b', such that a then b' does the same as b then a'. When
+// both insert at the same place, a's insert goes first.
+func Transform(a, b Op) (Op, Op, error) {
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, errMismatch
+	}
+	var aPrime, bPrime Op
+	i, j := 0, 0
+	// the parts of the current components not used up yet
+	var ca, cb Component
+	next := func(o Op, n *int) Component {
+		if *n >= len(o) {
+			return Component{}
+		}
+		*n++
+		return o[*n-1]
+	}
+	ca, cb = next(a, &i), next(b, &j)
+	for {
+		aDone := ca == Component{}
+		bDone := cb == Component{}
+		if aDone && bDone {
+			return aPrime, bPrime, nil
+		}
+		if ca.Insert != "" {
+			aPrime = aPrime.Insert(ca.Insert)
+			bPrime = bPrime.Retain(len([]rune(ca.Insert)))
+			ca = next(a, &i)
+			continue
+		}
+		if cb.Insert != "" {
+			aPrime = aPrime.Retain(len([]rune(cb.Insert)))
+			bPrime = bPrime.Insert(cb.Insert)
+			cb = next(b, &j)
+			continue
+		}
+		if aDone || bDone {
+			return nil, nil, errMismatch
+		}
+		lenA, lenB := ca.Retain+ca.Delete, cb.Retain+cb.Delete
+		n := lenA
+		if lenB < n {
+			n = lenB
+		}
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			aPrime, bPrime = aPrime.Retain(n), bPrime.Retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			aPrime = aPrime.Delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			bPrime = bPrime.Delete(n)
+		}
+		// when both delete the same characters, neither has to any more
+		ca, cb = shorten(ca, n), shorten(cb, n)
+		if ca == (Component{}) {
+			ca = next(a, &i)
+		}
+		if cb == (Component{}) {
+			cb = next(b, &j)
+		}
+	}
+}
+
+// shorten takes n characters off a retain or delete
+func shorten(c Component, n int) Component {
+	if c.Retain > 0 {
+		return Component{Retain: c.Retain - n}
+	}
+	return Component{Delete: c.Delete - n}
+}
+
+// Diff is an op that turns old into new, by replacing whatever's between
+// their common beginning and end
+func Diff(old, new []rune) Op {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	var o Op
+	o = o.Retain(prefix)
+	o = o.Insert(string(new[prefix : len(new)-suffix]))
+	o = o.Delete(len(old) - prefix - suffix)
+	return o.Retain(suffix)
+}
+
+func (o Op) MarshalJSON() ([]byte, error) {
+	parts := make([]interface{}, len(o))
+	for i, c := range o {
+		switch {
+		case c.Retain > 0:
+			parts[i] = c.Retain
+		case c.Delete > 0:
+			parts[i] = -c.Delete
+		default:
+			parts[i] = c.Insert
+		}
+	}
+	return json.Marshal(parts)
+}
+
+func (o *Op) UnmarshalJSON(data []byte) error {
+	var parts []interface{}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	var op Op
+	for _, part := range parts {
+		switch p := part.(type) {
+		case float64:
+			if p == 0 || p > maxComponent || p < -maxComponent || p != float64(int(p)) {
+				return fmt.Errorf("bad op component %v", p)
+			}
+			if p > 0 {
+				op = op.Retain(int(p))
+			} else {
+				op = op.Delete(int(-p))
+			}
+		case string:
+			if p == "" {
+				return errors.New("empty insert in op")
+			}
+			op = op.Insert(p)
+		default:
+			return fmt.Errorf("bad op component %v", part)
+		}
+	}
+	*o = op
+	return nil
+}
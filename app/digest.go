@@ -0,0 +1,57 @@
+package pathfork
+
+import (
+	"fmt"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/messages"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"github.com/golang/glog"
+)
+
+// defaultFeedbackDigestInterval is how often authors hear about new
+// comments unless PATHFORK_FEEDBACK_DIGEST says otherwise
+const defaultFeedbackDigestInterval = 24 * time.Hour
+
+// feedbackDigestInterval reads PATHFORK_FEEDBACK_DIGEST, a duration like
+// "12h". Zero or less turns the digest off.
+func feedbackDigestInterval(getenv func(string) string) (time.Duration, error) {
+	raw := getenv("PATHFORK_FEEDBACK_DIGEST")
+	if raw == "" {
+		return defaultFeedbackDigestInterval, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// sendFeedbackDigests emails each author the comments readers have left
+// since their last digest. Comments that couldn't be sent wait for the
+// next one.
+func sendFeedbackDigests(database *db.DB) {
+	for email, comments := range models.GetUndigestedComments(database) {
+		items := make([]messages.FeedbackItem, len(comments))
+		for i, comment := range comments {
+			items[i] = messages.FeedbackItem{
+				Work:    comment.WorkTitle,
+				Section: comment.SectionTitle,
+				Reader:  comment.AuthorName,
+				Quote:   comment.Quote,
+				Comment: comment.Body,
+				Link:    fmt.Sprintf("%v%v", URLFor("section_view"), comment.SectionId),
+			}
+		}
+		if err := messages.SendFeedbackDigestEmail(email, items); err != nil {
+			glog.Errorf("Error sending feedback digest to %v: %v", email, err.Error())
+			continue
+		}
+		if err := models.MarkCommentsEmailed(database, comments); err != nil {
+			glog.Errorf("Error marking feedback digest sent to %v: %v", email, err.Error())
+		}
+	}
+}
+
+func sendFeedbackDigestsEvery(interval time.Duration, database *db.DB) {
+	for range time.Tick(interval) {
+		sendFeedbackDigests(database)
+	}
+}
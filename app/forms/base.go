@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
+	"time"
 
 	"bitbucket.org/jtyburke/pathfork/app/auth"
 	"bitbucket.org/jtyburke/pathfork/app/config"
@@ -143,6 +145,59 @@ func (sf *StringField) GetName() string {
 	return sf.Name
 }
 
+// NewNumberField is a text field that only takes numbers
+func NewNumberField(label, name string, required bool) *StringField {
+	return &StringField{
+		renderFunc:   basicTextFieldRender,
+		validateFunc: numberFieldValidate,
+		Label:        label,
+		Name:         name,
+		Required:     required,
+		InputType:    "number",
+	}
+}
+
+func numberFieldValidate(sf *StringField) (bool, error) {
+	if v, err := basicTextFieldValidate(sf); !v {
+		return v, err
+	}
+	if len(sf.data) > 0 && sf.data[0] != "" {
+		if _, err := strconv.ParseFloat(sf.data[0], 64); err != nil {
+			err := errors.New("Please enter a number.")
+			sf.Error = err
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// NewDateField is a text field that takes dates as YYYY-MM-DD, which is
+// what browsers send from a date input
+func NewDateField(label, name string, required bool) *StringField {
+	return &StringField{
+		renderFunc:   basicTextFieldRender,
+		validateFunc: dateFieldValidate,
+		Label:        label,
+		Name:         name,
+		Required:     required,
+		InputType:    "date",
+	}
+}
+
+func dateFieldValidate(sf *StringField) (bool, error) {
+	if v, err := basicTextFieldValidate(sf); !v {
+		return v, err
+	}
+	if len(sf.data) > 0 && sf.data[0] != "" {
+		if _, err := time.Parse("2006-01-02", sf.data[0]); err != nil {
+			err := errors.New("Please enter a date like 2016-04-23.")
+			sf.Error = err
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 /*
 ..
 ..
@@ -341,7 +396,11 @@ func (s *SelectField) Render(args ...string) template.HTML {
 	if s.Required {
 		required = "required"
 	}
-	output := fmt.Sprintf(`<label>%v</label><select class="chosen-select form-control" name="%v" multiple="%v" %v>`, s.Label, s.Name, s.Multiple, required)
+	multiple := ""
+	if s.Multiple {
+		multiple = `multiple="true"`
+	}
+	output := fmt.Sprintf(`<label>%v</label><select class="chosen-select form-control" name="%v" %v %v>`, s.Label, s.Name, multiple, required)
 	for i := range s.Options {
 		if s.Options[i]["selected"] == "true" {
 			output += fmt.Sprintf(`<option value="%v" selected="true">%v</option>`, s.Options[i]["value"], s.Options[i]["text"])
@@ -407,6 +466,10 @@ func (f *CSRFField) Render(args ...string) template.HTML {
 }
 
 func (f *CSRFField) Validate() (bool, error) {
+	if f.Manager.IsBearerAuth() {
+		// a Bearer header can't be forged by another site's form
+		return true, nil
+	}
 	value, valid := auth.VerifyTSToken("csrf", f.Value, config.CSRFValidTime)
 	email := f.Manager.GetUserEmail()
 	if !valid || value != email {
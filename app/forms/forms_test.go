@@ -53,3 +53,50 @@ func TestGetCurrentIds(t *testing.T) {
 		t.Errorf("Expected nil string, got %v", ids)
 	}
 }
+
+func TestNumberAndDateFields(t *testing.T) {
+	tests := []struct {
+		Field *StringField
+		Data  string
+		OK    bool
+	}{
+		{NewNumberField("Age", "age", false), "34", true},
+		{NewNumberField("Age", "age", false), "-1.5", true},
+		{NewNumberField("Age", "age", false), "old", false},
+		{NewNumberField("Age", "age", false), "", true},
+		{NewDateField("Born", "born", false), "1203-04-23", true},
+		{NewDateField("Born", "born", false), "23/04/1203", false},
+		{newCheckedTextField("ISBN", "isbn", checkISBN), "978-0-306-40615-7", true},
+		{newCheckedTextField("ISBN", "isbn", checkISBN), "978-0-306-40615-8", false},
+		{newCheckedTextField("ISBN", "isbn", checkISBN), "", true},
+		{newCheckedTextField("Language", "language", checkLanguage), "pt-BR", true},
+		{newCheckedTextField("Language", "language", checkLanguage), "Portuguese (Brazil)", false},
+	}
+	for _, test := range tests {
+		test.Field.SetData(test.Data)
+		if v, _ := test.Field.Validate(); v != test.OK {
+			t.Errorf("%v with %q: validated %v", test.Field.Name, test.Data, v)
+		}
+	}
+}
+
+func TestAddCustomFields(t *testing.T) {
+	form := NewFormWithFields(map[string]FormField{})
+	defs := []*models.FieldDef{
+		{Id: 1, Name: "Eyes", Type: models.FieldSelect, Choices: []string{"Brown", "Grey"}},
+		{Id: 2, Name: "Home", Type: models.FieldReference, RefEntity: "setting"},
+	}
+	refOptions := map[string][]map[string]string{"setting": {{"value": "3", "text": "Lowtown"}}}
+	AddCustomFields(form, defs, map[int]string{1: "Grey"}, refOptions)
+	eyes, ok := form.Fields["field_1"].(*SelectField)
+	if !ok || eyes.Multiple {
+		t.Fatalf("Select field is %#v", form.Fields["field_1"])
+	}
+	if data := eyes.GetData(); len(data) != 1 || data[0] != "Grey" {
+		t.Errorf("Select field wasn't filled in: %v", data)
+	}
+	home := form.Fields["field_2"].(*SelectField)
+	if len(home.Options) != 2 || home.Options[1]["text"] != "Lowtown" {
+		t.Errorf("Reference field has options %v", home.Options)
+	}
+}
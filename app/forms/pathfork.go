@@ -1,8 +1,10 @@
 package forms
 
 import (
+	"errors"
 	"fmt"
 
+	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
 )
 
@@ -40,6 +42,49 @@ func NewSigninForm() *Form {
 	)
 }
 
+// NewTwoFactorForm is shown mid-login, before there's a user to tie a CSRF
+// token to, just like the sign in form
+func NewTwoFactorForm() *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"code": NewBasicTextField("Authentication code", "code", true),
+		},
+	)
+}
+
+func NewTOTPEnableForm(sm sessionManager.SessionManager) *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"code": NewBasicTextField("Code from your app", "code", true),
+			"csrf": NewCSRFField(sm),
+		},
+	)
+}
+
+func NewTOTPDisableForm(sm sessionManager.SessionManager) *Form {
+	passwordField := NewBasicTextField("Password", "password", true)
+	passwordField.InputType = "password"
+	return NewFormWithFields(
+		map[string]FormField{
+			"password": passwordField,
+			"code":     NewBasicTextField("Authentication or recovery code", "code", true),
+			"csrf":     NewCSRFField(sm),
+		},
+	)
+}
+
+func NewChangeEmailForm(sm sessionManager.SessionManager) *Form {
+	passwordField := NewBasicTextField("Current password", "password", true)
+	passwordField.InputType = "password"
+	return NewFormWithFields(
+		map[string]FormField{
+			"newEmail": NewBasicTextField("New email", "newEmail", true),
+			"password": passwordField,
+			"csrf":     NewCSRFField(sm),
+		},
+	)
+}
+
 func NewRequestResetPasswordForm() *Form {
 	return NewFormWithFields(
 		map[string]FormField{
@@ -61,8 +106,13 @@ func NewResetPasswordForm() *Form {
 	)
 }
 
+// NewWorkForm's seriesOptions are the user's series, for the work to be in
+// one of
 func NewWorkForm(characterOptions []map[string]string, settingOptions []map[string]string,
-	sm sessionManager.SessionManager) *Form {
+	seriesOptions []map[string]string, sm sessionManager.SessionManager) *Form {
+	series := NewSelectField("Series", "series", false,
+		append([]map[string]string{{"value": "", "text": "Not in a series"}}, seriesOptions...)...)
+	series.Multiple = false
 	currentCharIds := GetCurrentIds(characterOptions)
 	characters := NewSelectField("Characters", "characters", false, characterOptions...)
 	currentSettingIds := GetCurrentIds(settingOptions)
@@ -71,6 +121,17 @@ func NewWorkForm(characterOptions []map[string]string, settingOptions []map[stri
 		map[string]FormField{
 			"title":             NewBasicTextField("Title", "title", true),
 			"blurb":             NewBasicTextAreaField("Blurb", "blurb", false),
+			"statuses":          NewBasicTextField("Section statuses, in order", "statuses", false),
+			"subtitle":          NewBasicTextField("Subtitle", "subtitle", false),
+			"author":            NewBasicTextField("Author or pen name", "author", false),
+			"series":            series,
+			"seriesNumber":      NewNumberField("Number in series", "seriesNumber", false),
+			"language":          newCheckedTextField("Language", "language", checkLanguage),
+			"isbn":              newCheckedTextField("ISBN", "isbn", checkISBN),
+			"copyrightYear":     NewNumberField("Copyright year", "copyrightYear", false),
+			"dedication":        NewBasicTextAreaField("Dedication", "dedication", false),
+			"acknowledgements":  NewBasicTextAreaField("Acknowledgements", "acknowledgements", false),
+			"aboutAuthor":       NewBasicTextAreaField("About the author", "aboutAuthor", false),
 			"characters":        characters,
 			"currentCharIds":    &HiddenField{Name: "currentCharIds", Value: currentCharIds},
 			"settings":          settings,
@@ -80,6 +141,34 @@ func NewWorkForm(characterOptions []map[string]string, settingOptions []map[stri
 	)
 }
 
+// newCheckedTextField is an optional text field whose value, if there is
+// one, has to get past check
+func newCheckedTextField(label, name string, check func(string) error) *StringField {
+	field := NewBasicTextField(label, name, false)
+	field.validateFunc = func(sf *StringField) (bool, error) {
+		if len(sf.data) > 0 && sf.data[0] != "" {
+			if err := check(sf.data[0]); err != nil {
+				sf.Error = err
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return field
+}
+
+func checkISBN(isbn string) error {
+	_, err := models.NormalizeISBN(isbn)
+	return err
+}
+
+func checkLanguage(tag string) error {
+	if !models.ValidLanguageTag(tag) {
+		return errors.New(`Please use a language code like "en" or "pt-BR".`)
+	}
+	return nil
+}
+
 func NewSectionForm(characterOptions []map[string]string, settingOptions []map[string]string,
 	manager sessionManager.SessionManager) *Form {
 	currentCharIds := GetCurrentIds(characterOptions)
@@ -87,6 +176,12 @@ func NewSectionForm(characterOptions []map[string]string, settingOptions []map[s
 	characters := NewSelectField("Characters", "characters", false, characterOptions...)
 	settings := NewSelectField("Settings", "settings", false, settingOptions...)
 	snippet := &CheckField{Name: "snippet", Label: "This is a snippet"}
+	povOptions := []map[string]string{{"value": "", "text": "None"}}
+	for _, option := range characterOptions {
+		povOptions = append(povOptions, map[string]string{"value": option["value"], "text": option["text"]})
+	}
+	pov := NewSelectField("Point of view", "pov", false, povOptions...)
+	pov.Multiple = false
 	return NewFormWithFields(
 		map[string]FormField{
 			"title":             NewBasicTextField("Section Title", "title", true),
@@ -95,15 +190,136 @@ func NewSectionForm(characterOptions []map[string]string, settingOptions []map[s
 			"characters":        characters,
 			"settings":          settings,
 			"snippet":           snippet,
+			"pov":               pov,
+			"story_time":        NewBasicTextField("Story time", "story_time", false),
+			"story_sort":        NewBasicTextField("Story time sort key", "story_sort", false),
 			"currentCharIds":    &HiddenField{Name: "currentCharIds", Value: currentCharIds},
 			"currentSettingIds": &HiddenField{Name: "currentSettingIds", Value: currentSettingIds},
 			"csrf":              NewCSRFField(manager),
 			"wordCount":         &HiddenField{Name: "wordCount", Value: "0"},
 			"oldWordCount":      &HiddenField{Name: "oldWordCount", Value: "0"},
+			"collab":            &HiddenField{Name: "collab", Value: ""},
+		},
+	)
+}
+
+func NewEventForm(characterOptions, settingOptions, sectionOptions []map[string]string,
+	sm sessionManager.SessionManager) *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"title":             NewBasicTextField("Title", "title", true),
+			"description":       NewBasicTextAreaField("Description", "description", false),
+			"story_time":        NewBasicTextField("Story time", "story_time", false),
+			"story_sort":        NewBasicTextField("Starts (sort key)", "story_sort", false),
+			"story_sort_end":    NewBasicTextField("Ends (sort key)", "story_sort_end", false),
+			"characters":        NewSelectField("Characters", "characters", false, characterOptions...),
+			"settings":          NewSelectField("Settings", "settings", false, settingOptions...),
+			"sections":          NewSelectField("Sections", "sections", false, sectionOptions...),
+			"currentCharIds":    &HiddenField{Name: "currentCharIds", Value: GetCurrentIds(characterOptions)},
+			"currentSettingIds": &HiddenField{Name: "currentSettingIds", Value: GetCurrentIds(settingOptions)},
+			"currentSectionIds": &HiddenField{Name: "currentSectionIds", Value: GetCurrentIds(sectionOptions)},
+			"csrf":              NewCSRFField(sm),
 		},
 	)
 }
 
+// NewRelationshipForm builds the form for one character's side of a
+// relationship; characterOptions are the other characters it can be with
+func NewRelationshipForm(characterOptions, sectionOptions []map[string]string, sm sessionManager.SessionManager) *Form {
+	to := NewSelectField("With", "to", true, characterOptions...)
+	to.Multiple = false
+	sectionSelect := func(name, label string) *SelectField {
+		options := []map[string]string{{"value": "", "text": "None"}}
+		for _, option := range sectionOptions {
+			options = append(options, map[string]string{"value": option["value"], "text": option["text"]})
+		}
+		field := NewSelectField(label, name, false, options...)
+		field.Multiple = false
+		return field
+	}
+	return NewFormWithFields(
+		map[string]FormField{
+			"to":            to,
+			"kind":          NewBasicTextField("Kind of relationship", "kind", true),
+			"directed":      &CheckField{Name: "directed", Label: "It only goes one way"},
+			"notes":         NewBasicTextAreaField("Notes", "notes", false),
+			"start_section": sectionSelect("start_section", "Starts in section"),
+			"end_section":   sectionSelect("end_section", "Ends after section"),
+			"csrf":          NewCSRFField(sm),
+		},
+	)
+}
+
+// NewFieldDefForm is for adding to a user's custom field schema. Entity
+// and type can't change once the field exists, so editing leaves them out.
+func NewFieldDefForm(workOptions []map[string]string, newField bool, sm sessionManager.SessionManager) *Form {
+	works := NewSelectField("Only in work", "work", false,
+		append([]map[string]string{{"value": "", "text": "All works"}}, workOptions...)...)
+	works.Multiple = false
+	fields := map[string]FormField{
+		"name":    NewBasicTextField("Name", "name", true),
+		"choices": NewBasicTextAreaField("Choices, one per line", "choices", false),
+		"order":   NewNumberField("Position", "order", false),
+		"work":    works,
+		"csrf":    NewCSRFField(sm),
+	}
+	if newField {
+		entityOptions := []map[string]string{}
+		for _, entity := range models.FieldEntities {
+			entityOptions = append(entityOptions, map[string]string{"value": entity, "text": entity + "s"})
+		}
+		entity := NewSelectField("For", "entity", true, entityOptions...)
+		entity.Multiple = false
+		typeOptions := []map[string]string{}
+		for _, fieldType := range models.FieldTypes {
+			typeOptions = append(typeOptions, map[string]string{"value": fieldType, "text": fieldType})
+		}
+		fieldType := NewSelectField("Kind", "type", true, typeOptions...)
+		fieldType.Multiple = false
+		refEntity := NewSelectField("Refers to", "ref_entity", false, entityOptions...)
+		refEntity.Multiple = false
+		fields["entity"] = entity
+		fields["type"] = fieldType
+		fields["ref_entity"] = refEntity
+	}
+	return NewFormWithFields(fields)
+}
+
+// AddCustomFields puts a form field on the form for each custom field,
+// filled in from values (keyed by field id). refOptions are the characters
+// and settings a reference field can pick from.
+func AddCustomFields(form *Form, defs []*models.FieldDef, values map[int]string, refOptions map[string][]map[string]string) {
+	for _, def := range defs {
+		var field FormField
+		switch def.Type {
+		case models.FieldNumber:
+			field = NewNumberField(def.Name, def.FormName(), false)
+		case models.FieldDate:
+			field = NewDateField(def.Name, def.FormName(), false)
+		case models.FieldSelect, models.FieldReference:
+			options := []map[string]string{{"value": "", "text": "None"}}
+			if def.Type == models.FieldSelect {
+				for _, choice := range def.Choices {
+					options = append(options, map[string]string{"value": choice, "text": choice})
+				}
+			} else {
+				for _, option := range refOptions[def.RefEntity] {
+					options = append(options, map[string]string{"value": option["value"], "text": option["text"]})
+				}
+			}
+			selectField := NewSelectField(def.Name, def.FormName(), false, options...)
+			selectField.Multiple = false
+			field = selectField
+		default:
+			field = NewBasicTextField(def.Name, def.FormName(), false)
+		}
+		if value, ok := values[def.Id]; ok {
+			field.SetData(value)
+		}
+		form.Fields[def.FormName()] = field
+	}
+}
+
 func NewCharacterForm(sm sessionManager.SessionManager) *Form {
 	return NewFormWithFields(
 		map[string]FormField{
@@ -115,10 +331,91 @@ func NewCharacterForm(sm sessionManager.SessionManager) *Form {
 	)
 }
 
-func NewSettingForm(sm sessionManager.SessionManager) *Form {
+// NewShareLinkForm takes the work's sections, any of which can be shared
+// on their own
+func NewShareLinkForm(sectionOptions []map[string]string, sm sessionManager.SessionManager) *Form {
+	password := NewBasicTextField("Password (optional)", "password", false)
+	password.InputType = "password"
+	return NewFormWithFields(
+		map[string]FormField{
+			"name":     NewBasicTextField("Who's it for?", "name", true),
+			"sections": NewSelectField("Only these sections (leave empty for the whole work)", "sections", false, sectionOptions...),
+			"expires":  NewDateField("Expires on (optional)", "expires", false),
+			"password": password,
+			"csrf":     NewCSRFField(sm),
+		},
+	)
+}
+
+// NewSharePasswordForm is for readers, who aren't logged in, so it has no
+// CSRF token, like the sign in form
+func NewSharePasswordForm() *Form {
+	password := NewBasicTextField("Password", "password", true)
+	password.InputType = "password"
+	return NewFormWithFields(map[string]FormField{"password": password})
+}
+
+// NewCommentForm is for starting or replying to a thread on a section; the
+// quote and offset of a new thread come from the reader's selection
+func NewCommentForm(sm sessionManager.SessionManager) *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"body": NewBasicTextAreaField("Comment", "body", true),
+			"csrf": NewCSRFField(sm),
+		},
+	)
+}
+
+// NewReaderCommentForm is NewCommentForm for readers with a share link, who
+// sign their comments instead of logging in
+func NewReaderCommentForm() *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"name": NewBasicTextField("Your name", "name", true),
+			"body": NewBasicTextAreaField("Comment", "body", true),
+		},
+	)
+}
+
+// NewWorkMemberForm is for the owner inviting someone to a work, or
+// changing what an existing member can do
+func NewWorkMemberForm(sm sessionManager.SessionManager) *Form {
+	roleOptions := []map[string]string{}
+	for _, role := range models.MemberRoles {
+		roleOptions = append(roleOptions, map[string]string{"value": role, "text": role})
+	}
+	role := NewSelectField("Role", "role", true, roleOptions...)
+	role.Multiple = false
+	role.SetData(models.RoleCommenter)
+	return NewFormWithFields(
+		map[string]FormField{
+			"email": NewBasicTextField("Email address", "email", true),
+			"role":  role,
+			"csrf":  NewCSRFField(sm),
+		},
+	)
+}
+
+func NewSeriesForm(sm sessionManager.SessionManager) *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"title": NewBasicTextField("Title", "title", true),
+			"blurb": NewBasicTextAreaField("Blurb", "blurb", false),
+			"csrf":  NewCSRFField(sm),
+		},
+	)
+}
+
+// NewSettingForm takes the places the setting could be inside of
+func NewSettingForm(parentOptions []map[string]string, sm sessionManager.SessionManager) *Form {
+	options := []map[string]string{{"value": "", "text": "Nowhere in particular"}}
+	options = append(options, parentOptions...)
+	parent := NewSelectField("Inside", "parent", false, options...)
+	parent.Multiple = false
 	return NewFormWithFields(
 		map[string]FormField{
 			"name":    NewBasicTextField("Name", "name", true),
+			"parent":  parent,
 			"blurb":   NewBasicTextAreaField("Blurb", "blurb", false),
 			"body":    NewBasicTextAreaField("Body", "body", false),
 			"work_id": &HiddenField{Name: "work_id"},
@@ -134,3 +431,39 @@ func NewDeleteForm(objId int, manager sessionManager.SessionManager) *Form {
 			"csrf": NewCSRFField(manager),
 		})
 }
+
+// NewImageForm is the upload form for a picture of a character, setting,
+// work or section (entity). The file itself is read straight off the
+// request, since there's no form field for files.
+func NewImageForm(entity string, objectId int, sm sessionManager.SessionManager) *Form {
+	return NewFormWithFields(
+		map[string]FormField{
+			"entity":    &HiddenField{Name: "entity", Value: entity},
+			"object_id": &HiddenField{Name: "object_id", Value: fmt.Sprintf("%v", objectId)},
+			"caption":   NewBasicTextField("Caption", "caption", false),
+			"csrf":      NewCSRFField(sm),
+		})
+}
+
+func NewAPITokenForm(sm sessionManager.SessionManager) *Form {
+	scope := NewSelectField("Scope", "scope", true,
+		map[string]string{"value": "read", "text": "Read only", "selected": "true"},
+		map[string]string{"value": "write", "text": "Read and write"},
+	)
+	scope.Multiple = false
+	expires := NewSelectField("Expires", "expires", true,
+		map[string]string{"value": "30", "text": "In 30 days", "selected": "true"},
+		map[string]string{"value": "90", "text": "In 90 days"},
+		map[string]string{"value": "365", "text": "In a year"},
+		map[string]string{"value": "0", "text": "Never"},
+	)
+	expires.Multiple = false
+	return NewFormWithFields(
+		map[string]FormField{
+			"name":    NewBasicTextField("Token name", "name", true),
+			"scope":   scope,
+			"expires": expires,
+			"csrf":    NewCSRFField(sm),
+		},
+	)
+}
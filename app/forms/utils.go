@@ -25,6 +25,22 @@ func WorksToFormOptions(works []*models.Work, selectedWorks ...*models.Work) []m
 	return worksMap
 }
 
+func SeriesToFormOptions(series []*models.Series, selectedSeries ...*models.Series) []map[string]string {
+	seriesMap := make([]map[string]string, len(series))
+	for i, s := range series {
+		seriesMap[i] = map[string]string{
+			"value": fmt.Sprintf("%v", s.Id),
+			"text":  s.Title,
+		}
+		for _, selected := range selectedSeries {
+			if selected.Id == s.Id {
+				seriesMap[i]["selected"] = "true"
+			}
+		}
+	}
+	return seriesMap
+}
+
 func CharsToFormOptions(chars []*models.Character, selectedChars ...*models.Character) []map[string]string {
 	charsMap := make([]map[string]string, len(chars))
 	for i, char := range chars {
@@ -57,6 +73,22 @@ func SettingsToFormOptions(settings []*models.Setting, selectedSettings ...*mode
 	return settingsMap
 }
 
+func SectionsToFormOptions(sections []*models.Section, selectedSections ...*models.Section) []map[string]string {
+	sectionsMap := make([]map[string]string, len(sections))
+	for i, section := range sections {
+		sectionsMap[i] = map[string]string{
+			"value": fmt.Sprintf("%v", section.Id),
+			"text":  section.Title,
+		}
+		for _, selected := range selectedSections {
+			if selected.Id == section.Id {
+				sectionsMap[i]["selected"] = "true"
+			}
+		}
+	}
+	return sectionsMap
+}
+
 func GetCurrentIds(options []map[string]string) string {
 	currentIds := ""
 	for i := range options {
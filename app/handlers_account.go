@@ -0,0 +1,397 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/auth"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/messages"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/sessionStore"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+type APITokensHandler pathforkFrontEndHandler
+
+func (h APITokensHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	if manager.IsBearerAuth() {
+		// tokens can't be used to mint or revoke other tokens
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	tokens := models.GetAPITokensForUser(manager.GetUserEmail(), h.db)
+	page := pages.GetAPITokensPage(manager, tokens)
+	if r.Method == "POST" {
+		switch utils.GetQueryArg(r, "action") {
+		case "create":
+			h.createToken(w, r, manager, page)
+		case "revoke":
+			h.revokeToken(w, r, manager)
+		}
+		http.Redirect(w, r, URLFor("api_tokens"), http.StatusFound)
+		return
+	}
+	if err := h.tr.RenderPage(w, "api_tokens", page); err != nil {
+		glog.Errorf("Error with APITokens page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h APITokensHandler) createToken(w http.ResponseWriter, r *http.Request, manager sessionManager.SessionManager, page pages.WebPage) {
+	page.Form.Populate(r)
+	if !page.Form.Validate() {
+		manager.AddFlash("Please give your token a name.")
+		return
+	}
+	expiresAt := time.Time{}
+	if days, _ := strconv.Atoi(r.FormValue("expires")); days > 0 {
+		expiresAt = time.Now().AddDate(0, 0, days)
+	}
+	raw, token, err := models.NewAPIToken(r.FormValue("name"), r.FormValue("scope"), manager.GetUserEmail(), expiresAt)
+	if err != nil {
+		manager.AddFlash("Sorry, we couldn't make a token right now.")
+		return
+	}
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		if _, err = h.db.Insert(token, tx); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error saving API token: %v", err.Error())
+		manager.AddFlash("Looks like there was a database error saving that token.")
+		return
+	}
+	manager.AddFlash(fmt.Sprintf("Here's your new token. Copy it now, you won't be able to see it again: %v", raw))
+}
+
+func (h APITokensHandler) revokeToken(w http.ResponseWriter, r *http.Request, manager sessionManager.SessionManager) {
+	id, _ := strconv.Atoi(r.FormValue("object_id"))
+	form := forms.NewDeleteForm(id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please try again.")
+		return
+	}
+	token := models.GetAPITokenById(id, h.db)
+	if token == nil || !token.VerifyPermission(manager) {
+		manager.AddFlash("Sorry, we couldn't find that token.")
+		return
+	}
+	if success, err := models.DeleteAPIToken(id, h.db); err != nil || !success {
+		glog.Error(err)
+		manager.AddFlash("Looks like there was a database error revoking that token.")
+		return
+	}
+	manager.AddFlash("OK, that token won't work any more.")
+}
+
+func (h APITokensHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildAPITokensHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return APITokensHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SessionsHandler pathforkFrontEndHandler
+
+func (h SessionsHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	if manager.IsBearerAuth() {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	email := manager.GetUserEmail()
+	currentHash := sessionStore.HashID(manager.Session.ID)
+	if r.Method == "POST" {
+		id, _ := strconv.Atoi(r.FormValue("object_id"))
+		form := forms.NewDeleteForm(id, manager)
+		form.Populate(r)
+		if !form.Validate() {
+			manager.AddFlash("Sorry, that form expired. Please try again.")
+			http.Redirect(w, r, URLFor("sessions"), http.StatusFound)
+			return
+		}
+		action := utils.GetQueryArg(r, "action")
+		// logging out everywhere else has its own action, so a revoke
+		// that's lost its id can't do it by accident
+		if action != "revoke-others" && (action != "revoke" || id == 0) {
+			manager.AddFlash("Sorry, we couldn't find that session.")
+			http.Redirect(w, r, URLFor("sessions"), http.StatusFound)
+			return
+		}
+		tx, err := h.db.DB.Begin()
+		if err == nil {
+			if action == "revoke-others" {
+				err = models.DeleteSessionsForUser(h.db, tx, email, currentHash)
+			} else {
+				err = models.DeleteSessionForUser(h.db, tx, email, id)
+			}
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			glog.Errorf("Error revoking sessions: %v", err.Error())
+			manager.AddFlash("Looks like there was a database error logging that out.")
+		} else {
+			manager.AddFlash("OK, that's been logged out.")
+		}
+		http.Redirect(w, r, URLFor("sessions"), http.StatusFound)
+		return
+	}
+	page := pages.GetSessionsPage(manager, models.GetSessionsForUser(email, currentHash, h.db))
+	if err := h.tr.RenderPage(w, "sessions", page); err != nil {
+		glog.Errorf("Error with Sessions page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h SessionsHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSessionsHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SessionsHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type TwoFactorSetupHandler pathforkFrontEndHandler
+
+func (h TwoFactorSetupHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	// codes are checked against the same clock as they are at login
+	authenticator := auth.NewAuthenticator(r, w, h.sessionStore)
+	manager := authenticator.Manager
+	if manager.IsBearerAuth() {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	user := models.GetUserByEmail(manager.GetUserEmail(), h.db)
+	if user == nil {
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+		return
+	}
+	secret := ""
+	if !user.TOTPEnabled {
+		// the secret lives in the session until the user proves they've
+		// saved it, so abandoning setup leaves nothing behind
+		if secret = manager.GetTOTPSetupSecret(); secret == "" {
+			var err error
+			if secret, err = auth.NewTOTPSecret(); err == nil {
+				err = manager.SetTOTPSetupSecret(secret)
+			}
+			if err != nil {
+				glog.Errorf("Error starting TOTP setup: %v", err.Error())
+				manager.AddFlash("Sorry, we couldn't set up two-factor authentication right now.")
+				http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+				return
+			}
+		}
+	}
+	page := pages.GetTwoFactorSetupPage(manager, user, secret, auth.TOTPURI("Pathfork", user.Email, secret),
+		models.CountRecoveryCodesLeft(user.Email, h.db))
+	if r.Method == "POST" {
+		page.Form.Populate(r)
+		if !page.Form.Validate() {
+			manager.AddFlash("Sorry, that form expired. Please try again.")
+			http.Redirect(w, r, URLFor("two_factor_setup"), http.StatusFound)
+			return
+		}
+		switch utils.GetQueryArg(r, "action") {
+		case "enable":
+			if codes := h.enable(manager, user, secret, r.FormValue("code"), authenticator.Clock()); codes != nil {
+				// the one and only time we show these, so render rather than redirect
+				page = pages.GetTwoFactorSetupPage(manager, user, "", "", len(codes))
+				page.RecoveryCodes = codes
+				break
+			}
+			http.Redirect(w, r, URLFor("two_factor_setup"), http.StatusFound)
+			return
+		case "disable":
+			h.disable(manager, user, r.FormValue("password"), r.FormValue("code"), authenticator.Clock())
+			http.Redirect(w, r, URLFor("two_factor_setup"), http.StatusFound)
+			return
+		}
+	}
+	if err := h.tr.RenderPage(w, "two_factor_setup", page); err != nil {
+		glog.Errorf("Error with TwoFactorSetup page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h TwoFactorSetupHandler) enable(manager sessionManager.SessionManager, user *models.User, secret, code string, now time.Time) []string {
+	if user.TOTPEnabled {
+		return nil
+	}
+	step, ok := auth.VerifyTOTP(secret, code, now, 0)
+	if !ok {
+		manager.AddFlash("Sorry, that code didn't match. Check your phone's clock and try again.")
+		return nil
+	}
+	tx, err := h.db.DB.Begin()
+	if err != nil {
+		glog.Error(err.Error())
+		manager.AddFlash("Looks like there was a database error turning that on.")
+		return nil
+	}
+	codes, err := models.EnableTOTP(h.db, tx, user, secret, step)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		glog.Errorf("Error enabling TOTP: %v", err.Error())
+		manager.AddFlash("Looks like there was a database error turning that on.")
+		return nil
+	}
+	manager.ClearTOTPSetupSecret()
+	glog.Infof("TOTP enabled for %v", user.Email)
+	return codes
+}
+
+func (h TwoFactorSetupHandler) disable(manager sessionManager.SessionManager, user *models.User, password, code string, now time.Time) {
+	if !user.TOTPEnabled {
+		return
+	}
+	if !auth.CheckPassword(password, user.Password) || !models.VerifySecondFactor(h.db, user, code, now) {
+		manager.AddFlash("Sorry, that password or code was wrong.")
+		return
+	}
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		if err = models.DisableTOTP(h.db, tx, user); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error disabling TOTP: %v", err.Error())
+		manager.AddFlash("Looks like there was a database error turning that off.")
+		return
+	}
+	glog.Infof("TOTP disabled for %v", user.Email)
+	manager.AddFlash("OK, two-factor authentication is off.")
+}
+
+func (h TwoFactorSetupHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildTwoFactorSetupHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return TwoFactorSetupHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type ChangeEmailHandler pathforkFrontEndHandler
+
+func (h ChangeEmailHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	if manager.IsBearerAuth() {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	user := models.GetUserByEmail(manager.GetUserEmail(), h.db)
+	if user == nil {
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+		return
+	}
+	page := pages.GetChangeEmailPage(manager, user)
+	if r.Method == "POST" {
+		page.Form.Populate(r)
+		if h.requestChange(manager, page, user, r) {
+			http.Redirect(w, r, URLFor("change_email"), http.StatusFound)
+			return
+		}
+	}
+	if err := h.tr.RenderPage(w, "change_email", page); err != nil {
+		glog.Errorf("Error with ChangeEmail page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+// requestChange sends the confirmation link to the new address. Nothing
+// changes until that link is followed.
+func (h ChangeEmailHandler) requestChange(manager sessionManager.SessionManager, page pages.WebPage, user *models.User, r *http.Request) bool {
+	if !page.Form.Validate() {
+		page.Form.AddError("Please fill in both fields.")
+		return false
+	}
+	if !auth.CheckPassword(r.FormValue("password"), user.Password) {
+		page.Form.AddError("Sorry, that password was wrong.")
+		return false
+	}
+	newEmail := strings.TrimSpace(strings.ToLower(r.FormValue("newEmail")))
+	if newEmail == user.Email {
+		page.Form.AddError("That's already your email address.")
+		return false
+	}
+	if !strings.Contains(newEmail, "@") || strings.ContainsAny(newEmail, " \t") {
+		page.Form.AddError("That doesn't look like an email address.")
+		return false
+	}
+	if models.GetUserByEmail(newEmail, h.db) != nil {
+		page.Form.AddError("Looks like that email's already in use.")
+		return false
+	}
+	if err := messages.SendChangeEmailEmail(user.Email, newEmail); err != nil {
+		glog.Error(err)
+		page.Form.AddError("Looks like something went wrong with our email provider. Please try again later.")
+		return false
+	}
+	glog.Infof("Email change requested from %v to %v", user.Email, newEmail)
+	manager.AddFlash(fmt.Sprintf("OK, follow the link we've sent to %v to finish the change.", newEmail))
+	return true
+}
+
+func (h ChangeEmailHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildChangeEmailHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ChangeEmailHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
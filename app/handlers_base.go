@@ -6,6 +6,7 @@ import (
 
 	"path"
 	"strconv"
+	"time"
 
 	"bitbucket.org/jtyburke/pathfork/app/auth"
 	"bitbucket.org/jtyburke/pathfork/app/db"
@@ -22,12 +23,12 @@ type FrontEndHandler interface {
 	Methods() []string
 }
 
-type FrontEndHandlerBuilder func(*TemplateRenderer, *db.DB, *sessions.CookieStore) FrontEndHandler
+type FrontEndHandlerBuilder func(*TemplateRenderer, *db.DB, sessions.Store) FrontEndHandler
 
 // Wrappers are used to encapsulate handlers for later dependency injection
 // to avoid global variables, a la https://medium.com/@benbjohnson/structuring-applications-in-go-3b04be4ff091
 // https://gist.github.com/tsenart/5fc18c659814c078378d
-func WrapFrontEndHandler(builder FrontEndHandlerBuilder, tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) http.HandlerFunc {
+func WrapFrontEndHandler(builder FrontEndHandlerBuilder, tr *TemplateRenderer, db *db.DB, store sessions.Store) http.HandlerFunc {
 	handler := builder(tr, db, store)
 	return func(w http.ResponseWriter, r *http.Request) {
 		glog.Infof("%v from %v to %v", r.Method, r.RemoteAddr, r.URL)
@@ -46,6 +47,15 @@ func WrapFrontEndHandler(builder FrontEndHandlerBuilder, tr *TemplateRenderer, d
 		}
 		_, public := publicRoutes[r.URL.Path]
 		isLoggedIn, userName := auth.IsLoggedIn(r, store)
+		if !isLoggedIn && auth.GetBearerToken(r) != "" {
+			var status int
+			status, userName = authenticateBearer(r, w, db, store)
+			if status != http.StatusOK {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			isLoggedIn = true
+		}
 		if userName != "" {
 			glog.Infof("User: %v", userName)
 		}
@@ -59,6 +69,32 @@ func WrapFrontEndHandler(builder FrontEndHandlerBuilder, tr *TemplateRenderer, d
 	}
 }
 
+// authenticateBearer checks a personal access token sent in the Authorization
+// header and logs its owner in for the length of the request.
+func authenticateBearer(r *http.Request, w http.ResponseWriter, database *db.DB, store sessions.Store) (int, string) {
+	token := models.GetAPITokenByRaw(auth.GetBearerToken(r), database)
+	if token == nil || token.IsExpired(time.Now()) {
+		glog.Warningf("Bad or expired API token sent from %v to %v", r.RemoteAddr, r.URL)
+		return http.StatusUnauthorized, ""
+	}
+	if !token.Allows(r.Method) {
+		glog.Warningf("API token %v lacks scope for %v to %v", token.Id, r.Method, r.URL)
+		return http.StatusForbidden, ""
+	}
+	tx, err := database.DB.Begin()
+	if err == nil {
+		if err = models.TouchAPIToken(database, tx, token.Id); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Could not record API token use: %v", err.Error())
+	}
+	manager := sessionManager.New(r, w, store)
+	manager.SetBearerUser(token.UserEmail, token.Scope)
+	return http.StatusOK, token.UserEmail
+}
+
 type crudStarterResponse struct {
 	RedirectCode int
 	RedirectStr  string
@@ -95,6 +131,19 @@ func getCrudStarterResponse(r *http.Request, w http.ResponseWriter, db *db.DB, m
 	}
 }
 
+// requireRole forbids a starter response's object to anyone without at
+// least role in its work. Things that aren't in a work are left to their
+// VerifyPermission.
+func requireRole(response crudStarterResponse, manager sessionManager.SessionManager, role string) crudStarterResponse {
+	if response.RedirectCode != 0 || models.HasRole(response.Obj.(models.Verifiable), manager, role) {
+		return response
+	}
+	return crudStarterResponse{
+		RedirectCode: http.StatusForbidden,
+		FlashMsg:     "Sorry, you're not allowed to do that.",
+	}
+}
+
 type crudViewInput struct {
 	GetByIdFunc     func(int, *db.DB) models.Verifiable
 	GetViewPageFunc func(sessionManager.SessionManager, interface{}) pages.WebPage
@@ -164,6 +213,7 @@ func HandleCrudCreate(r *http.Request, w http.ResponseWriter, db *db.DB, tr *Tem
 	return
 }
 
+// crudEditInput's object needs an editor, if it's in a work
 type crudEditInput struct {
 	GetByIdFunc     func(int, *db.DB) models.Verifiable
 	GetEditPageFunc func(sessionManager.SessionManager, *db.DB, interface{}) pages.WebPage
@@ -179,7 +229,7 @@ type crudEditOutput struct {
 
 func HandleCrudEdit(r *http.Request, w http.ResponseWriter, database *db.DB, tr *TemplateRenderer,
 	manager sessionManager.SessionManager, input crudEditInput) (output crudEditOutput) {
-	response := getCrudStarterResponse(r, w, database, manager, input.GetByIdFunc)
+	response := requireRole(getCrudStarterResponse(r, w, database, manager, input.GetByIdFunc), manager, models.RoleEditor)
 	if response.RedirectCode != 0 {
 		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
 		return
@@ -3,7 +3,6 @@ package pathfork
 import (
 	"fmt"
 	"net/http"
-	"path"
 	"strconv"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
@@ -11,6 +10,7 @@ import (
 	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/pages"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
 	"github.com/golang/glog"
 	"github.com/gorilla/sessions"
 )
@@ -31,7 +31,7 @@ func (h CharacterViewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildCharacterViewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildCharacterViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return CharacterViewHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -49,39 +49,54 @@ type CharacterEditHandler pathforkFrontEndHandler
 
 func (h CharacterEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
+	oldName := ""
 	params := crudEditInput{
 		GetByIdFunc:     models.GetCharacterDetail,
 		GetEditPageFunc: pages.GetCharacterEditPage,
 		TemplateName:    "character_edit",
-		SuccessRedirect: func() string {
-			id := path.Base(r.URL.Path)
-			return URLFor("character_view") + id
-		}(),
 		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
 			character := obj.(*models.Character)
+			oldName = character.Name
 			character.Name = r.FormValue("name")
 			character.Blurb = r.FormValue("blurb")
 			character.Body = r.FormValue("body")
+			values, err := readCustomFields(r, page, manager.GetUserEmail(), h.db)
+			if err != nil {
+				return nil, err
+			}
 			tx, err := h.db.DB.Begin()
 			if err == nil {
 				if err := character.Save(tx); err != nil {
 					glog.Errorf("Error saving character on CharacterEditHandler: %v", err.Error())
 					return nil, err
 				}
+				if err := models.SaveFieldValues(h.db, tx, "character", character.Id, values); err != nil {
+					glog.Errorf("Error saving character fields on CharacterEditHandler: %v", err.Error())
+					return nil, err
+				}
+				if oldName != character.Name {
+					if err := models.RecordAlias(h.db, tx, "character", character.Id, oldName, character.Name); err != nil {
+						glog.Errorf("Error saving character alias on CharacterEditHandler: %v", err.Error())
+						return nil, err
+					}
+				}
 				tx.Commit()
 				return character, nil
 			}
 			return nil, err
 		},
 	}
-	HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+	output := HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+	if character, ok := output.Obj.(*models.Character); ok {
+		redirectAfterEdit(w, r, "character", character.Id, oldName, character.Name)
+	}
 }
 
 func (h CharacterEditHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildCharacterEditHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildCharacterEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return CharacterEditHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -117,10 +132,17 @@ func (h CharacterNewHandler) HandleRequest(w http.ResponseWriter, r *http.Reques
 			newChar.Blurb = r.FormValue("blurb")
 			newChar.Body = r.FormValue("body")
 			newChar.UserEmail = manager.GetUserEmail()
+			values, err := readCustomFields(r, page, newChar.UserEmail, h.db)
+			if err != nil {
+				return nil, err
+			}
 			workId, _ := strconv.Atoi(workId)
 			tx, err := h.db.DB.Begin()
 			if err == nil {
 				newId, err := h.db.Insert(newChar, tx)
+				if err == nil {
+					err = models.SaveFieldValues(h.db, tx, "character", newId, values)
+				}
 				if err == nil && workId != 0 {
 					err = models.UpdateWorksCharsRelations(h.db, tx, workId, []int{newId}, []int{})
 					if err != nil {
@@ -144,7 +166,7 @@ func (h CharacterNewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildCharacterNewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildCharacterNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return CharacterNewHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -163,7 +185,8 @@ type CharacterIndexHandler pathforkFrontEndHandler
 func (h CharacterIndexHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
 	characters := models.GetCharactersForUser(manager.GetUserEmail(), h.db)
-	page := pages.GetCharacterIndexPage(manager, characters)
+	fieldId, _ := strconv.Atoi(utils.GetQueryArg(r, "field"))
+	page := pages.GetCharacterIndexPage(manager, h.db, characters, fieldId, utils.GetQueryArg(r, "value"))
 	if err := h.tr.RenderPage(w, "character_index", page); err != nil {
 		glog.Errorf("Error with CharacterIndex page render: %v", err.Error())
 		http.Redirect(w, r, URLFor("dashboard"), 302)
@@ -174,7 +197,7 @@ func (h CharacterIndexHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildCharacterIndexHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildCharacterIndexHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return CharacterIndexHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -205,9 +228,15 @@ func (h CharacterDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Req
 	form.Populate(r)
 	if r.Method == "POST" {
 		if form.Validate() {
-			idToDelete, _ := strconv.Atoi(r.FormValue("object_id"))
-			success, err := models.DeleteCharacter(idToDelete, h.db)
-			if err != nil || !success {
+			tx, err := h.db.DB.Begin()
+			if err == nil {
+				if err = models.TrashCharacter(h.db, tx, character.Id); err == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+			}
+			if err != nil && err != models.ErrAlreadyTrashed {
 				glog.Error(err)
 				http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("character_view"), character.Id), 301)
 				return
@@ -217,7 +246,7 @@ func (h CharacterDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Req
 			return
 		}
 	}
-	manager.AddFlash("OK, that guy won't bother you any more.")
+	manager.AddFlash("OK, that guy's in the trash and won't bother you any more.")
 	http.Redirect(w, r, URLFor("character_index"), 301)
 }
 
@@ -225,7 +254,7 @@ func (h CharacterDeleteHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildCharacterDeleteHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildCharacterDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return CharacterDeleteHandler{
 		tr:           tr,
 		methods:      []string{"POST"},
@@ -0,0 +1,106 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+
+	"bitbucket.org/jtyburke/pathfork/app/collab"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/websocket"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// collabHub has the sections being edited together; InitApp starts it
+var collabHub *collab.Hub
+
+// collabSectionStore is where the hub gets section bodies from and saves
+// them to, the same way the edit form does
+type collabSectionStore struct {
+	db *db.DB
+}
+
+func (s collabSectionStore) Load(sectionId int) (string, error) {
+	section, ok := models.GetSectionById(sectionId, s.db).(*models.Section)
+	if !ok {
+		return "", fmt.Errorf("no section %v", sectionId)
+	}
+	return section.Body, nil
+}
+
+// Save logs an edit for everyone who made one since the last save
+func (s collabSectionStore) Save(sectionId int, body string, editors []string) error {
+	section, ok := models.GetSectionById(sectionId, s.db).(*models.Section)
+	if !ok {
+		return fmt.Errorf("no section %v", sectionId)
+	}
+	oldWordCount := section.WordCount
+	section.Body = body
+	section.WordCount = models.CountWords(body)
+	tx, err := s.db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := section.Save(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := models.ReanchorComments(s.db, tx, section.Id, section.Body); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := models.UpdateWorkWordCount(s.db, tx, section.WorkId, section.WordCount-oldWordCount); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, email := range editors {
+		if err := models.LogActivity(s.db, tx, models.SectionActivity(section, email, models.ActivityEdited)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+.
+.
+*/
+
+// SectionCollabHandler is the WebSocket the section editor talks to while
+// it's open. Only editors get one; everyone else's requests are refused
+// before the upgrade.
+type SectionCollabHandler pathforkFrontEndHandler
+
+func (h SectionCollabHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById), manager, models.RoleEditor)
+	if response.RedirectCode != 0 {
+		http.Error(w, http.StatusText(response.RedirectCode), response.RedirectCode)
+		return
+	}
+	section := response.Obj.(*models.Section)
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		glog.Warningf("Bad collab handshake from %v: %v", r.RemoteAddr, err.Error())
+		return
+	}
+	if err := collabHub.Serve(conn, section.Id, manager.GetUserEmail()); err != nil {
+		glog.Warningf("Collab connection to section %v ended: %v", section.Id, err.Error())
+	}
+}
+
+func (h SectionCollabHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSectionCollabHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SectionCollabHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
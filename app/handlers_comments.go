@@ -0,0 +1,289 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// newCommentFromForm fills in the parts of a comment that come from the
+// comment form: the body, and either the thread it replies to or the text
+// it's anchored to. A reply to a reply goes on the end of the thread. It
+// returns a message for the user if the comment won't do.
+func newCommentFromForm(r *http.Request, section *models.Section, database *db.DB) (*models.Comment, string) {
+	comment := &models.Comment{
+		SectionId: section.Id,
+		Body:      strings.TrimSpace(r.FormValue("body")),
+		UserEmail: section.UserEmail,
+	}
+	if parentId, _ := strconv.Atoi(r.FormValue("parent")); parentId != 0 {
+		parent, ok := models.GetCommentById(parentId, database).(*models.Comment)
+		if !ok || parent.SectionId != section.Id {
+			return nil, "Sorry, we couldn't find the comment you were replying to."
+		}
+		if parent.ParentId != 0 {
+			parentId = parent.ParentId
+		}
+		comment.ParentId = parentId
+		return comment, ""
+	}
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	quote := r.FormValue("quote")
+	// the browser's idea of where the quote is should match ours, but ours
+	// is the one that re-anchoring will use
+	offset, found := models.FindAnchor(models.SectionText(section.Body), quote, offset)
+	if !found {
+		return nil, "Select some of the text to comment on it."
+	}
+	comment.Quote, comment.Offset = quote, offset
+	return comment, ""
+}
+
+// SectionCommentHandler is for the author and their co-authors starting or
+// replying to a thread from the section's page
+type SectionCommentHandler pathforkFrontEndHandler
+
+func (h SectionCommentHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById), manager, models.RoleCommenter)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	section := response.Obj.(*models.Section)
+	redirect := fmt.Sprintf("%v%v", URLFor("section_view"), section.Id)
+	form := forms.NewCommentForm(manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that comment couldn't be saved. Did you write something?")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	comment, msg := newCommentFromForm(r, section, h.db)
+	if comment == nil {
+		manager.AddFlash(msg)
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	comment.ByAuthor = true
+	// the author doesn't need emailing about their own comments
+	comment.Emailed = true
+	// co-authors go by their email; the owner by the name on the work
+	comment.AuthorName = manager.GetUserEmail()
+	if section.UserEmail == manager.GetUserEmail() {
+		comment.AuthorName = "Author"
+		if work, ok := models.GetWorkById(section.WorkId, h.db).(*models.Work); ok && work.Author != "" {
+			comment.AuthorName = work.Author
+		}
+	}
+	if err := insertComment(comment, h.db); err != nil {
+		glog.Errorf("Error saving comment: %v", err.Error())
+		manager.AddFlash("Sorry, something went wrong saving that comment.")
+	}
+	threadId := comment.ParentId
+	if threadId == 0 {
+		threadId = comment.Id
+	}
+	http.Redirect(w, r, fmt.Sprintf("%v#comment-%v", redirect, threadId), http.StatusFound)
+}
+
+func insertComment(comment *models.Comment, database *db.DB) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	comment.Id, err = database.Insert(comment, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h SectionCommentHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSectionCommentHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SectionCommentHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// CommentResolveHandler resolves a thread, or with resolved=false reopens
+// it. With next=feedback it goes back to the work's feedback page instead
+// of the section.
+type CommentResolveHandler pathforkFrontEndHandler
+
+func (h CommentResolveHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetCommentById), manager, models.RoleCommenter)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	comment := response.Obj.(*models.Comment)
+	threadId := comment.Id
+	if comment.ParentId != 0 {
+		threadId = comment.ParentId
+	}
+	redirect := fmt.Sprintf("%v%v#comment-%v", URLFor("section_view"), comment.SectionId, threadId)
+	if r.FormValue("next") == "feedback" {
+		redirect = fmt.Sprintf("%v%v", URLFor("work_feedback"), comment.WorkId)
+	}
+	form := forms.NewDeleteForm(comment.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	resolved := r.FormValue("resolved") != "false"
+	if err := models.SetThreadResolved(h.db, threadId, resolved); err != nil {
+		glog.Errorf("Error resolving comment thread: %v", err.Error())
+		manager.AddFlash("Sorry, something went wrong updating that thread.")
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h CommentResolveHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildCommentResolveHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return CommentResolveHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// WorkFeedbackHandler lists the open threads on all of a work's sections
+type WorkFeedbackHandler pathforkFrontEndHandler
+
+func (h WorkFeedbackHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	work := response.Obj.(*models.Work)
+	if err := h.tr.RenderPage(w, "work_feedback", pages.GetWorkFeedbackPage(manager, work)); err != nil {
+		glog.Errorf("Error with WorkFeedback page render: %v", err.Error())
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), work.Id), http.StatusFound)
+	}
+}
+
+func (h WorkFeedbackHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkFeedbackHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkFeedbackHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// ShareCommentHandler is for readers commenting through a share link. They
+// can start threads on the sections the link shares and reply to their own
+// threads.
+type ShareCommentHandler pathforkFrontEndHandler
+
+func (h ShareCommentHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	token := utils.GetQueryArg(r, "token")
+	redirect := fmt.Sprintf("%v?token=%v", URLFor("share_read"), token)
+	link := models.GetShareLinkByToken(token, h.db)
+	if link == nil || (link.HasPassword() && !manager.ShareLinkUnlocked(link.Id)) {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	form := forms.NewReaderCommentForm()
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that comment couldn't be saved. Did you write something, and sign it?")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	sectionId, _ := strconv.Atoi(r.FormValue("section"))
+	section, ok := models.GetSectionById(sectionId, h.db).(*models.Section)
+	if !ok || section.WorkId != link.WorkId || section.Snippet || len(link.Sections([]*models.Section{section})) == 0 {
+		manager.AddFlash("Sorry, you can't comment on that.")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	redirect = fmt.Sprintf("%v#section-%v", redirect, section.Id)
+	comment, msg := newCommentFromForm(r, section, h.db)
+	if comment != nil && comment.ParentId != 0 {
+		if thread, ok := models.GetCommentById(comment.ParentId, h.db).(*models.Comment); !ok || thread.ShareLinkId != link.Id {
+			comment, msg = nil, "Sorry, you can't reply to that."
+		}
+	}
+	if comment == nil {
+		manager.AddFlash(msg)
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	comment.ShareLinkId = link.Id
+	comment.AuthorName = strings.TrimSpace(r.FormValue("name"))
+	if err := insertComment(comment, h.db); err != nil {
+		glog.Errorf("Error saving reader's comment: %v", err.Error())
+		manager.AddFlash("Sorry, something went wrong saving that comment.")
+	} else {
+		manager.AddFlash("Thanks! Your comment's been saved.")
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h ShareCommentHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildShareCommentHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ShareCommentHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
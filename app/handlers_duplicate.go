@@ -0,0 +1,193 @@
+package pathfork
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// handleDuplicate runs duplicate in a transaction once the form checks out,
+// and sends the user to the copy (entity's view page) or back to the
+// original
+func handleDuplicate(w http.ResponseWriter, r *http.Request, database *db.DB, manager sessionManager.SessionManager,
+	entity string, id int, duplicate func(tx *sql.Tx) (int, error)) {
+	form := forms.NewDeleteForm(id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please try again.")
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor(entity+"_edit"), id), http.StatusFound)
+		return
+	}
+	tx, err := database.DB.Begin()
+	newId := 0
+	if err == nil {
+		if newId, err = duplicate(tx); err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error duplicating %v %v: %v", entity, id, err.Error())
+		manager.AddFlash("Looks like there was a database error making that copy.")
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor(entity+"_edit"), id), http.StatusFound)
+		return
+	}
+	manager.AddFlash("Here's your copy.")
+	http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor(entity+"_view"), newId), http.StatusFound)
+}
+
+func redirectStarterResponse(w http.ResponseWriter, r *http.Request, manager sessionManager.SessionManager, response crudStarterResponse) bool {
+	if response.RedirectCode == 0 {
+		return false
+	}
+	if response.FlashMsg != "" {
+		manager.AddFlash(response.FlashMsg)
+	}
+	http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+	return true
+}
+
+/*
+.
+.
+*/
+
+// WorkDuplicateHandler copies a work and its sections for the owner, who
+// is the only one who can use the work's characters and settings
+type WorkDuplicateHandler pathforkFrontEndHandler
+
+func (h WorkDuplicateHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleOwner)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	work := response.Obj.(*models.Work)
+	handleDuplicate(w, r, h.db, manager, "work", work.Id, func(tx *sql.Tx) (int, error) {
+		return models.DuplicateWork(h.db, tx, work)
+	})
+}
+
+func (h WorkDuplicateHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkDuplicateHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkDuplicateHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SectionDuplicateHandler pathforkFrontEndHandler
+
+func (h SectionDuplicateHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById), manager, models.RoleEditor)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	section := response.Obj.(*models.Section)
+	handleDuplicate(w, r, h.db, manager, "section", section.Id, func(tx *sql.Tx) (int, error) {
+		id, err := models.DuplicateSection(h.db, tx, section)
+		if err == nil {
+			created := models.SectionActivity(section, manager.GetUserEmail(), models.ActivityCreated)
+			created.SectionId = id
+			created.SectionTitle = models.CopyTitle(section.Title)
+			err = models.LogActivity(h.db, tx, created)
+		}
+		return id, err
+	})
+}
+
+func (h SectionDuplicateHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSectionDuplicateHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SectionDuplicateHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type CharacterDuplicateHandler pathforkFrontEndHandler
+
+func (h CharacterDuplicateHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetCharacterDetail)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	character := response.Obj.(*models.Character)
+	handleDuplicate(w, r, h.db, manager, "character", character.Id, func(tx *sql.Tx) (int, error) {
+		return models.DuplicateCharacter(h.db, tx, character)
+	})
+}
+
+func (h CharacterDuplicateHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildCharacterDuplicateHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return CharacterDuplicateHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SettingDuplicateHandler pathforkFrontEndHandler
+
+func (h SettingDuplicateHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetSettingById)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	setting := response.Obj.(*models.Setting)
+	handleDuplicate(w, r, h.db, manager, "setting", setting.Id, func(tx *sql.Tx) (int, error) {
+		return models.DuplicateSetting(h.db, tx, setting)
+	})
+}
+
+func (h SettingDuplicateHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSettingDuplicateHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SettingDuplicateHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -0,0 +1,348 @@
+package pathfork
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+type EventViewHandler pathforkFrontEndHandler
+
+func (h EventViewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	cvi := crudViewInput{
+		GetByIdFunc:     models.GetEventById,
+		GetViewPageFunc: pages.GetEventViewPage,
+		TemplateName:    "event_view",
+	}
+	HandleCrudView(r, w, h.db, h.tr, manager, cvi)
+}
+
+func (h EventViewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildEventViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return EventViewHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+func handleEventForm(event *models.Event, r *http.Request) {
+	event.Title = r.FormValue("title")
+	event.Description = r.FormValue("description")
+	event.StoryTime = r.FormValue("story_time")
+	event.StorySortKey = r.FormValue("story_sort")
+	event.StoryEndKey = r.FormValue("story_sort_end")
+}
+
+// checkOwned is an error unless owns says every one of ids is the user's
+func checkOwned(ids []int, owns func(int, sessionManager.SessionManager, *db.DB) bool,
+	manager sessionManager.SessionManager, database *db.DB) error {
+	for _, id := range ids {
+		if !owns(id, manager, database) {
+			return fmt.Errorf("%v isn't %v's to link an event to", id, manager.GetUserEmail())
+		}
+	}
+	return nil
+}
+
+// updateEventRelations works out what to link and unlink from the form's
+// current*Ids fields, which are empty for a new event. Only the user's own
+// characters, settings and sections can be linked.
+func updateEventRelations(database *db.DB, tx *sql.Tx, eventId int, r *http.Request, manager sessionManager.SessionManager) error {
+	charsToInsert, charsToDelete, _ := forms.GetRelationUpdateIds(r, "currentCharIds", "characters")
+	if err := checkOwned(charsToInsert, ownsCharacter, manager, database); err != nil {
+		return err
+	}
+	if err := models.UpdateEventsCharsRelations(database, tx, eventId, charsToInsert, charsToDelete); err != nil {
+		return err
+	}
+	settingsToInsert, settingsToDelete, _ := forms.GetRelationUpdateIds(r, "currentSettingIds", "settings")
+	if err := checkOwned(settingsToInsert, ownsSetting, manager, database); err != nil {
+		return err
+	}
+	if err := models.UpdateEventsSettingsRelations(database, tx, eventId, settingsToInsert, settingsToDelete); err != nil {
+		return err
+	}
+	sectionsToInsert, sectionsToDelete, _ := forms.GetRelationUpdateIds(r, "currentSectionIds", "sections")
+	if err := checkOwned(sectionsToInsert, ownsSection, manager, database); err != nil {
+		return err
+	}
+	return models.UpdateEventsSectionsRelations(database, tx, eventId, sectionsToInsert, sectionsToDelete)
+}
+
+type EventEditHandler pathforkFrontEndHandler
+
+func (h EventEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	params := crudEditInput{
+		GetByIdFunc:     models.GetEventById,
+		GetEditPageFunc: pages.GetEventEditPage,
+		TemplateName:    "event_edit",
+		SuccessRedirect: URLFor("event_view") + path.Base(r.URL.Path),
+		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
+			event := obj.(*models.Event)
+			handleEventForm(event, r)
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				return nil, err
+			}
+			if err := event.Save(tx); err != nil {
+				glog.Errorf("Error saving event on edit handler: %v", err.Error())
+				return nil, err
+			}
+			if err := updateEventRelations(h.db, tx, event.Id, r, manager); err != nil {
+				glog.Errorf("Problem saving event relations: %v", err.Error())
+				tx.Rollback()
+				return nil, err
+			}
+			return event, tx.Commit()
+		},
+	}
+	HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+}
+
+func (h EventEditHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildEventEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return EventEditHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type EventNewHandler pathforkFrontEndHandler
+
+func (h EventNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	characterId := utils.GetQueryArg(r, "characterId")
+	successRedirect := URLFor("timeline")
+	if characterId != "" {
+		successRedirect += "?characterId=" + characterId
+	}
+	params := crudCreateInput{
+		GetCreatePageFunc: pages.GetEventNewPage,
+		CreateFuncArgs:    []string{characterId},
+		TemplateName:      "event_edit",
+		SuccessRedirect:   successRedirect,
+		CreateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager) (db.Insertable, error) {
+			newEvent := &models.Event{UserEmail: manager.GetUserEmail()}
+			handleEventForm(newEvent, r)
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			newEvent.Id, err = h.db.Insert(newEvent, tx)
+			if err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			if err := updateEventRelations(h.db, tx, newEvent.Id, r, manager); err != nil {
+				glog.Errorf("Problem saving event relations: %v", err.Error())
+				tx.Rollback()
+				return nil, err
+			}
+			return newEvent, tx.Commit()
+		},
+	}
+	HandleCrudCreate(r, w, h.db, h.tr, manager, params)
+}
+
+func (h EventNewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildEventNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return EventNewHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type EventDeleteHandler pathforkFrontEndHandler
+
+func (h EventDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetEventById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	event := response.Obj.(*models.Event)
+	form := forms.NewDeleteForm(event.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("event_view"), event.Id), http.StatusFound)
+		return
+	}
+	if success, err := models.DeleteEvent(event.Id, h.db); err != nil || !success {
+		glog.Error(err)
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("event_view"), event.Id), http.StatusFound)
+		return
+	}
+	manager.AddFlash("OK, that never happened.")
+	http.Redirect(w, r, URLFor("timeline"), http.StatusFound)
+}
+
+func (h EventDeleteHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildEventDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return EventDeleteHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// getTimelineCharacter reads the optional characterId filter shared by the
+// timeline and its export. It's false if the character isn't the user's.
+func getTimelineCharacter(r *http.Request, manager sessionManager.SessionManager, database *db.DB) (*models.Character, bool) {
+	rawId := utils.GetQueryArg(r, "characterId")
+	if rawId == "" {
+		return nil, true
+	}
+	id, err := strconv.Atoi(rawId)
+	if err != nil {
+		return nil, false
+	}
+	character, ok := models.GetCharacterDetail(id, database).(*models.Character)
+	if !ok || !character.VerifyPermission(manager) {
+		return nil, false
+	}
+	return character, true
+}
+
+type TimelineHandler pathforkFrontEndHandler
+
+func (h TimelineHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	character, ok := getTimelineCharacter(r, manager, h.db)
+	if !ok {
+		manager.AddFlash("Sorry, that link must have been bad.")
+		http.Redirect(w, r, URLFor("timeline"), http.StatusFound)
+		return
+	}
+	characterId := 0
+	if character != nil {
+		characterId = character.Id
+	}
+	events := models.GetTimeline(manager.GetUserEmail(), characterId, h.db)
+	if err := h.tr.RenderPage(w, "timeline", pages.GetTimelinePage(manager, h.db, events, character)); err != nil {
+		glog.Errorf("Error with timeline page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h TimelineHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildTimelineHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return TimelineHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// TimelineExportHandler downloads the timeline, filtered the same way as
+// the timeline page, as ?format=json or ?format=csv
+type TimelineExportHandler pathforkFrontEndHandler
+
+func (h TimelineExportHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	character, ok := getTimelineCharacter(r, manager, h.db)
+	if !ok {
+		http.Error(w, "No such character", http.StatusNotFound)
+		return
+	}
+	characterId := 0
+	if character != nil {
+		characterId = character.Id
+	}
+	events := models.GetTimeline(manager.GetUserEmail(), characterId, h.db)
+	var err error
+	switch utils.GetQueryArg(r, "format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="timeline.json"`)
+		err = models.WriteTimelineJSON(w, events)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="timeline.csv"`)
+		err = models.WriteTimelineCSV(w, events)
+	default:
+		http.Error(w, "Unknown format, use json or csv", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Error exporting timeline: %v", err.Error())
+	}
+}
+
+func (h TimelineExportHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildTimelineExportHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return TimelineExportHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -0,0 +1,243 @@
+package pathfork
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// readCustomFields checks the custom fields on a character or setting form
+// (page.FieldDefs) and returns their values keyed by field id, ready for
+// models.SaveFieldValues. Problems are marked on the form's fields.
+func readCustomFields(r *http.Request, page pages.WebPage, userEmail string, database *db.DB) (map[int]string, error) {
+	values := map[int]string{}
+	var refNames map[string]map[int]string
+	var firstErr error
+	for _, def := range page.FieldDefs {
+		value, err := def.ParseValue(r.FormValue(def.FormName()))
+		if err == nil && def.Type == models.FieldReference && value != "" {
+			if refNames == nil {
+				refNames = models.GetFieldRefNames(userEmail, database)
+			}
+			if id, _ := strconv.Atoi(value); refNames[def.RefEntity][id] == "" {
+				err = fmt.Errorf("%v should be one of your %vs", def.Name, def.RefEntity)
+			}
+		}
+		if err != nil {
+			switch field := page.Form.Fields[def.FormName()].(type) {
+			case *forms.StringField:
+				field.Error = err
+			case *forms.SelectField:
+				field.Error = err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		values[def.Id] = value
+	}
+	return values, firstErr
+}
+
+type FieldIndexHandler pathforkFrontEndHandler
+
+func (h FieldIndexHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	if err := h.tr.RenderPage(w, "field_index", pages.GetFieldIndexPage(manager, h.db)); err != nil {
+		glog.Errorf("Error with FieldIndex page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h FieldIndexHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildFieldIndexHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return FieldIndexHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// setFieldDefFromForm fills in the parts of a field definition that can
+// change after it's made
+func setFieldDefFromForm(def *models.FieldDef, r *http.Request, page pages.WebPage, database *db.DB) error {
+	def.Name = r.FormValue("name")
+	def.Choices = models.ParseChoices(r.FormValue("choices"))
+	def.Order, _ = strconv.Atoi(r.FormValue("order"))
+	def.WorkId, _ = strconv.Atoi(r.FormValue("work"))
+	if def.WorkId != 0 {
+		work, ok := models.GetWorkById(def.WorkId, database).(*models.Work)
+		if !ok || work.UserEmail != def.UserEmail {
+			err := errors.New("Please pick one of your works.")
+			page.Form.Fields["work"].(*forms.SelectField).Error = err
+			return err
+		}
+	}
+	if err := def.Check(); err != nil {
+		err = errors.New("Sorry, " + err.Error() + ".")
+		page.Form.Fields["choices"].(*forms.StringField).Error = err
+		return err
+	}
+	return nil
+}
+
+type FieldNewHandler pathforkFrontEndHandler
+
+func (h FieldNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	params := crudCreateInput{
+		GetCreatePageFunc: pages.GetFieldDefNewPage,
+		CreateFuncArgs:    []string{utils.GetQueryArg(r, "entity")},
+		TemplateName:      "field_edit",
+		SuccessRedirect:   URLFor("field_index"),
+		CreateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager) (db.Insertable, error) {
+			def := &models.FieldDef{
+				Entity:    r.FormValue("entity"),
+				Type:      r.FormValue("type"),
+				UserEmail: manager.GetUserEmail(),
+			}
+			if def.Type == models.FieldReference {
+				def.RefEntity = r.FormValue("ref_entity")
+			}
+			if err := setFieldDefFromForm(def, r, page, h.db); err != nil {
+				return nil, err
+			}
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			if def.Id, err = h.db.Insert(def, tx); err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			return def, tx.Commit()
+		},
+	}
+	HandleCrudCreate(r, w, h.db, h.tr, manager, params)
+}
+
+func (h FieldNewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildFieldNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return FieldNewHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type FieldEditHandler pathforkFrontEndHandler
+
+func (h FieldEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	params := crudEditInput{
+		GetByIdFunc:     models.GetFieldDefById,
+		GetEditPageFunc: pages.GetFieldDefEditPage,
+		TemplateName:    "field_edit",
+		SuccessRedirect: URLFor("field_index"),
+		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
+			def := obj.(*models.FieldDef)
+			if err := setFieldDefFromForm(def, r, page, h.db); err != nil {
+				return nil, err
+			}
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				return nil, err
+			}
+			if err := def.Save(tx); err != nil {
+				glog.Errorf("Error saving field definition: %v", err.Error())
+				return nil, err
+			}
+			return def, tx.Commit()
+		},
+	}
+	HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+}
+
+func (h FieldEditHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildFieldEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return FieldEditHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type FieldDeleteHandler pathforkFrontEndHandler
+
+func (h FieldDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetFieldDefById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	def := response.Obj.(*models.FieldDef)
+	form := forms.NewDeleteForm(def.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("field_edit"), def.Id), http.StatusFound)
+		return
+	}
+	if success, err := models.DeleteFieldDef(def.Id, h.db); err != nil || !success {
+		glog.Error(err)
+		manager.AddFlash("Sorry, something went wrong :(")
+	} else {
+		manager.AddFlash(fmt.Sprintf("%v is gone, along with everything filled in for it.", def.Name))
+	}
+	http.Redirect(w, r, URLFor("field_index"), http.StatusFound)
+}
+
+func (h FieldDeleteHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildFieldDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return FieldDeleteHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
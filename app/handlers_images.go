@@ -0,0 +1,504 @@
+package pathfork
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/storage"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// imageStore is where uploaded pictures go; InitApp picks it from the
+// environment
+var imageStore storage.Store
+
+// imageOwners look up what an image can be attached to, so an upload can be
+// checked against its VerifyPermission like everything else
+var imageOwners = map[string]func(int, *db.DB) models.Verifiable{
+	"character": models.GetCharacterDetail,
+	"setting":   models.GetSettingById,
+	"work":      models.GetWorkById,
+	"section":   models.GetSectionById,
+}
+
+// imageUserEmail is whose the picture is: a co-author's uploads to a work or
+// its sections belong to the work's owner, like everything else in it
+func imageUserEmail(owner models.Verifiable, manager sessionManager.SessionManager) string {
+	switch o := owner.(type) {
+	case *models.Work:
+		return o.UserEmail
+	case *models.Section:
+		return o.UserEmail
+	}
+	return manager.GetUserEmail()
+}
+
+// imageOwnerURL is the page an image shows up on
+func imageOwnerURL(entity string, objectId int) string {
+	name := map[string]string{
+		"character": "character_view",
+		"setting":   "setting_view",
+		"work":      "work_view",
+		"section":   "section_edit",
+	}[entity]
+	if name == "" {
+		return URLFor("dashboard")
+	}
+	return fmt.Sprintf("%v%v", URLFor(name), objectId)
+}
+
+// deleteStoredImages clears images out of storage once their rows are gone.
+// A blob that won't delete is only logged; it's unreachable either way.
+func deleteStoredImages(images []*models.Image) {
+	for _, image := range images {
+		for _, key := range []string{image.Key, image.ThumbKey} {
+			if err := imageStore.Delete(key); err != nil {
+				glog.Errorf("Error deleting stored image %v: %v", key, err.Error())
+			}
+		}
+	}
+}
+
+/*
+.
+.
+*/
+
+// ImageUploadHandler takes a multipart POST with the image form's fields
+// and the file as "image". Uploads from the section editor come in over
+// XHR and get the new image back as JSON so it can go straight into the
+// text; everyone else is sent back to the page they came from.
+type ImageUploadHandler pathforkFrontEndHandler
+
+func (h ImageUploadHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	xhr := r.Header.Get("X-Requested-With") == "XMLHttpRequest"
+	entity, objectId := "", 0
+	fail := func(status int, msg string) {
+		if xhr {
+			http.Error(w, msg, status)
+			return
+		}
+		manager.AddFlash(msg)
+		http.Redirect(w, r, imageOwnerURL(entity, objectId), http.StatusFound)
+	}
+	// a little over MaxImageBytes leaves room for the other fields
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxImageBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("Sorry, pictures can't be over %vMB.", models.MaxImageBytes>>20))
+		return
+	}
+	entity = r.FormValue("entity")
+	objectId, _ = strconv.Atoi(r.FormValue("object_id"))
+	form := forms.NewImageForm(entity, objectId, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		fail(http.StatusForbidden, "Sorry, that form expired. Please reload the page.")
+		return
+	}
+	getOwner, ok := imageOwners[entity]
+	if !ok {
+		fail(http.StatusBadRequest, "Sorry, pictures can't go there.")
+		return
+	}
+	owner := getOwner(objectId, h.db)
+	if owner == nil || !models.HasRole(owner, manager, models.RoleEditor) {
+		fail(http.StatusForbidden, "Sorry, you're not allowed to access that.")
+		return
+	}
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		fail(http.StatusBadRequest, "Please pick a picture to upload.")
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		fail(http.StatusBadRequest, "Sorry, that upload didn't come through.")
+		return
+	}
+	processed, err := models.ProcessImage(data)
+	if err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("Sorry, %v.", err.Error()))
+		return
+	}
+	image, err := h.saveImage(imageUserEmail(owner, manager), entity, objectId, header.Filename, r.FormValue("caption"), data, processed)
+	if err != nil {
+		glog.Errorf("Error saving image: %v", err.Error())
+		fail(http.StatusInternalServerError, "Sorry, something went wrong saving that picture.")
+		return
+	}
+	if xhr {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      image.Id,
+			"url":     fmt.Sprintf("%v%v", URLFor("image_view"), image.Id),
+			"thumb":   fmt.Sprintf("%v%v", URLFor("image_thumb"), image.Id),
+			"caption": image.Caption,
+		})
+		return
+	}
+	http.Redirect(w, r, imageOwnerURL(entity, objectId), http.StatusFound)
+}
+
+// saveImage stores the picture and its thumbnail, then records them. If the
+// row can't be written the blobs are taken back out.
+func (h ImageUploadHandler) saveImage(userEmail, entity string, objectId int,
+	filename, caption string, data []byte, processed *models.ProcessedImage) (*models.Image, error) {
+	key, thumbKey, err := models.NewImageKeys(processed.ContentType, processed.ThumbType)
+	if err != nil {
+		return nil, err
+	}
+	image := &models.Image{
+		Entity:      entity,
+		ObjectId:    objectId,
+		Key:         key,
+		ThumbKey:    thumbKey,
+		ContentType: processed.ContentType,
+		ThumbType:   processed.ThumbType,
+		Filename:    path.Base(filename),
+		Caption:     caption,
+		Width:       processed.Width,
+		Height:      processed.Height,
+		Size:        len(data),
+		UserEmail:   userEmail,
+	}
+	if err := imageStore.Put(key, image.ContentType, data); err != nil {
+		return nil, err
+	}
+	if err := imageStore.Put(thumbKey, image.ThumbType, processed.Thumb); err != nil {
+		deleteStoredImages([]*models.Image{image})
+		return nil, err
+	}
+	tx, err := h.db.DB.Begin()
+	if err != nil {
+		deleteStoredImages([]*models.Image{image})
+		return nil, err
+	}
+	if image.Id, err = h.db.Insert(image, tx); err != nil {
+		deleteStoredImages([]*models.Image{image})
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		deleteStoredImages([]*models.Image{image})
+		return nil, err
+	}
+	return image, nil
+}
+
+func (h ImageUploadHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildImageUploadHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ImageUploadHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// serveImage sends an image, or its thumbnail, to its owner. Since it's for
+// <img> tags it answers with a bare status rather than a redirect when it
+// can't.
+func serveImage(w http.ResponseWriter, r *http.Request, database *db.DB, store sessions.Store, thumb bool) {
+	manager := sessionManager.New(r, w, store)
+	response := getCrudStarterResponse(r, w, database, manager, models.GetImageById)
+	if response.RedirectCode != 0 {
+		http.Error(w, http.StatusText(response.RedirectCode), response.RedirectCode)
+		return
+	}
+	writeImage(w, response.Obj.(*models.Image), thumb)
+}
+
+// writeImage sends the stored image, or its thumbnail, once whoever's
+// asking has been let see it
+func writeImage(w http.ResponseWriter, image *models.Image, thumb bool) {
+	key, contentType := image.Key, image.ContentType
+	if thumb {
+		key, contentType = image.ThumbKey, image.ThumbType
+	}
+	data, err := imageStore.Get(key)
+	if err != nil {
+		glog.Errorf("Error getting stored image %v: %v", key, err)
+		http.Error(w, "Sorry, that picture has gone missing.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// a key's contents never change, but they're private
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(data)
+}
+
+type ImageViewHandler pathforkFrontEndHandler
+
+func (h ImageViewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, h.db, h.sessionStore, false)
+}
+
+func (h ImageViewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildImageViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ImageViewHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type ImageThumbHandler pathforkFrontEndHandler
+
+func (h ImageThumbHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, h.db, h.sessionStore, true)
+}
+
+func (h ImageThumbHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildImageThumbHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ImageThumbHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type ImageDeleteHandler pathforkFrontEndHandler
+
+func (h ImageDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetImageById), manager, models.RoleEditor)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	image := response.Obj.(*models.Image)
+	form := forms.NewDeleteForm(image.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please reload the page.")
+		http.Redirect(w, r, imageOwnerURL(image.Entity, image.ObjectId), http.StatusFound)
+		return
+	}
+	if success, err := models.DeleteImage(image.Id, h.db); err != nil || !success {
+		glog.Error(err)
+		manager.AddFlash("Sorry, something went wrong deleting that picture.")
+		http.Redirect(w, r, imageOwnerURL(image.Entity, image.ObjectId), http.StatusFound)
+		return
+	}
+	deleteStoredImages([]*models.Image{image})
+	http.Redirect(w, r, imageOwnerURL(image.Entity, image.ObjectId), http.StatusFound)
+}
+
+func (h ImageDeleteHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildImageDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ImageDeleteHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// exportImages fetches a user's pictures from storage for an export, each
+// one at most once
+type exportImages struct {
+	byId map[int]*models.Image
+	data map[int][]byte
+}
+
+func newExportImages(userEmail string, database *db.DB) *exportImages {
+	images := &exportImages{byId: map[int]*models.Image{}, data: map[int][]byte{}}
+	for _, image := range models.GetImagesForUser(userEmail, database) {
+		images.byId[image.Id] = image
+	}
+	return images
+}
+
+func (e *exportImages) get(id int) (*models.Image, []byte, bool) {
+	image, ok := e.byId[id]
+	if !ok {
+		return nil, nil, false
+	}
+	if data, ok := e.data[id]; ok {
+		return image, data, true
+	}
+	data, err := imageStore.Get(image.Key)
+	if err != nil {
+		glog.Errorf("Error getting stored image %v for export: %v", image.Key, err)
+		return nil, nil, false
+	}
+	e.data[id] = data
+	return image, data, true
+}
+
+// first is the newest of images that can be loaded, which is the current
+// cover, portrait or map
+func (e *exportImages) first(images []*models.Image) (*models.Image, []byte, bool) {
+	for _, image := range images {
+		if image, data, ok := e.get(image.Id); ok {
+			return image, data, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (e *exportImages) dataURI(id int) (string, bool) {
+	image, data, ok := e.get(id)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("data:%v;base64,%v", image.ContentType, base64.StdEncoding.EncodeToString(data)), true
+}
+
+// embedInHTMLExport puts the pictures in an HTML export right into the
+// page, so the saved file works on its own
+func embedInHTMLExport(page *pages.WebPage, database *db.DB) {
+	images := newExportImages(page.Work.UserEmail, database)
+	prefix := URLFor("image_view")
+	page.ExportImages = map[string]template.URL{}
+	addFirst := func(key string, list []*models.Image) {
+		if image, _, ok := images.first(list); ok {
+			uri, _ := images.dataURI(image.Id)
+			page.ExportImages[key] = template.URL(uri)
+		}
+	}
+	addFirst("work", models.GetImagesFor("work", page.Work.Id, database))
+	for _, section := range append(page.SectionsList, page.SnippetsList...) {
+		section.Body = models.ReplaceImageSources(section.Body, prefix, images.dataURI)
+	}
+	for _, character := range page.CharactersList {
+		character.Body = models.ReplaceImageSources(character.Body, prefix, images.dataURI)
+		addFirst(fmt.Sprintf("character-%v", character.Id), models.GetImagesFor("character", character.Id, database))
+	}
+	for _, setting := range page.SettingsList {
+		setting.Body = models.ReplaceImageSources(setting.Body, prefix, images.dataURI)
+		addFirst(fmt.Sprintf("setting-%v", setting.Id), models.GetImagesFor("setting", setting.Id, database))
+	}
+}
+
+// buildWorkEPUB makes an e-book of the work's sections, with its newest
+// cover and the pictures in the sections packed inside. The work's
+// dedication goes before the sections, its acknowledgements and about the
+// author after.
+func buildWorkEPUB(work *models.Work, sections []*models.Section, database *db.DB) *models.EPUB {
+	images := newExportImages(work.UserEmail, database)
+	book := &models.EPUB{
+		Identifier:     fmt.Sprintf("urn:pathfork:work:%v", work.Id),
+		Title:          work.Title,
+		Subtitle:       work.Subtitle,
+		Blurb:          work.Blurb,
+		Language:       work.GetLanguage(),
+		Creator:        work.Author,
+		Rights:         work.CopyrightLine(),
+		ISBN:           work.ISBN,
+		Series:         work.Series,
+		SeriesPosition: work.SeriesNumberStr(),
+		Modified:       time.Now(),
+	}
+	if work.ISBN != "" {
+		book.Identifier = "urn:isbn:" + work.ISBN
+	}
+	if work.CopyrightYear != 0 {
+		book.Date = strconv.Itoa(work.CopyrightYear)
+	}
+	added := map[int]*models.EPUBImage{}
+	addImage := func(image *models.Image, data []byte) *models.EPUBImage {
+		if epubImage, ok := added[image.Id]; ok {
+			return epubImage
+		}
+		epubImage := &models.EPUBImage{
+			Name:        fmt.Sprintf("images/%v.%v", image.Id, image.Ext()),
+			ContentType: image.ContentType,
+			Data:        data,
+		}
+		added[image.Id] = epubImage
+		book.Images = append(book.Images, epubImage)
+		return epubImage
+	}
+	if image, data, ok := images.first(models.GetImagesFor("work", work.Id, database)); ok {
+		book.Cover = addImage(image, data)
+	}
+	if work.Dedication != "" {
+		book.Chapters = append(book.Chapters, &models.EPUBChapter{
+			Title: "Dedication",
+			Body:  work.Dedication,
+			Type:  "dedication",
+		})
+	}
+	prefix := URLFor("image_view")
+	for _, section := range sections {
+		body := models.ReplaceImageSources(section.Body, prefix, func(id int) (string, bool) {
+			image, data, ok := images.get(id)
+			if !ok {
+				return "", false
+			}
+			return addImage(image, data).Name, true
+		})
+		book.Chapters = append(book.Chapters, &models.EPUBChapter{
+			Title: section.Title,
+			Depth: section.Depth,
+			Body:  body,
+		})
+	}
+	if work.Acknowledgements != "" {
+		book.Chapters = append(book.Chapters, &models.EPUBChapter{
+			Title: "Acknowledgements",
+			Body:  work.Acknowledgements,
+			Type:  "acknowledgments",
+		})
+	}
+	if work.AboutAuthor != "" {
+		book.Chapters = append(book.Chapters, &models.EPUBChapter{
+			Title: "About the Author",
+			Body:  work.AboutAuthor,
+		})
+	}
+	return book
+}
@@ -0,0 +1,234 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/messages"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// WorkMembersHandler shows who's in a work and its activity log to anyone
+// in it. The owner invites people by POSTing to it.
+type WorkMembersHandler pathforkFrontEndHandler
+
+func (h WorkMembersHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById)
+	if r.Method == "POST" {
+		response = requireRole(response, manager, models.RoleOwner)
+	}
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	work := response.Obj.(*models.Work)
+	redirect := fmt.Sprintf("%v%v", URLFor("work_members"), work.Id)
+	if r.Method == "POST" {
+		manager.AddFlash(h.invite(r, manager, work))
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	if err := h.tr.RenderPage(w, "work_members", pages.GetWorkMembersPage(manager, work)); err != nil {
+		glog.Errorf("Error with WorkMembers page render: %v", err.Error())
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), work.Id), http.StatusFound)
+	}
+}
+
+// invite adds or re-invites a member and emails them, returning how it went
+func (h WorkMembersHandler) invite(r *http.Request, manager sessionManager.SessionManager, work *models.Work) string {
+	form := forms.NewWorkMemberForm(manager)
+	form.Populate(r)
+	email := strings.TrimSpace(r.FormValue("email"))
+	role := r.FormValue("role")
+	if !form.Validate() || !strings.Contains(email, "@") || !models.ValidMemberRole(role) {
+		return "Sorry, that invite couldn't be sent. Check the email address and role."
+	}
+	if strings.EqualFold(email, work.UserEmail) {
+		return "You're already the owner of this work."
+	}
+	member := &models.WorkMember{
+		WorkId:    work.Id,
+		UserEmail: email,
+		Role:      role,
+		InvitedBy: manager.GetUserEmail(),
+	}
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		member.Id, err = h.db.Insert(member, tx)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		glog.Errorf("Error inviting work member: %v", err.Error())
+		return "Sorry, something went wrong sending that invite."
+	}
+	if err := messages.SendWorkInviteEmail(email, manager.GetUserEmail(), work.Title, role, models.NewInviteToken(member)); err != nil {
+		glog.Errorf("Error sending invite email: %v", err.Error())
+		return "Sorry, the invite email couldn't be sent. Please try again."
+	}
+	return fmt.Sprintf("OK, we've invited %v as %v.", email, role)
+}
+
+func (h WorkMembersHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkMembersHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkMembersHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// MemberEditHandler is for the owner changing a member's role, or with
+// remove=true taking them, or their invite, out of the work
+type MemberEditHandler pathforkFrontEndHandler
+
+func (h MemberEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkMemberById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	member := response.Obj.(*models.WorkMember)
+	redirect := fmt.Sprintf("%v%v", URLFor("work_members"), member.WorkId)
+	form := forms.NewDeleteForm(member.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please reload the page.")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	if r.FormValue("remove") == "true" {
+		if success, err := models.DeleteWorkMember(member.Id, h.db); err != nil || !success {
+			glog.Error(err)
+			manager.AddFlash(fmt.Sprintf("Sorry, %v couldn't be removed.", member.UserEmail))
+		} else {
+			manager.AddFlash(fmt.Sprintf("OK, %v isn't in %v anymore.", member.UserEmail, member.WorkTitle))
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	role := r.FormValue("role")
+	if !models.ValidMemberRole(role) {
+		manager.AddFlash("Sorry, that's not a role.")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		err = models.SetWorkMemberRole(h.db, tx, member.Id, role)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		glog.Errorf("Error changing member role: %v", err.Error())
+		manager.AddFlash("Sorry, something went wrong changing that role.")
+	} else {
+		manager.AddFlash(fmt.Sprintf("OK, %v is %v now.", member.UserEmail, role))
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h MemberEditHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildMemberEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return MemberEditHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// InviteAcceptHandler is where the link in an invite email goes. The user
+// has to be logged in as whoever it was sent to.
+type InviteAcceptHandler pathforkFrontEndHandler
+
+func (h InviteAcceptHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	member := models.GetWorkMemberByInviteToken(utils.GetQueryArg(r, "token"), h.db)
+	if member == nil {
+		manager.AddFlash("Sorry, that invite has expired or been withdrawn. Ask for a new one.")
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+		return
+	}
+	if !strings.EqualFold(member.UserEmail, manager.GetUserEmail()) {
+		manager.AddFlash(fmt.Sprintf("That invite is for %v. Please log in with that address to accept it.", member.UserEmail))
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+		return
+	}
+	redirect := fmt.Sprintf("%v%v", URLFor("work_view"), member.WorkId)
+	if member.Accepted {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	if err := h.accept(member); err != nil {
+		glog.Errorf("Error accepting invite: %v", err.Error())
+		manager.AddFlash("Sorry, something went wrong accepting that invite.")
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+		return
+	}
+	manager.AddFlash(fmt.Sprintf("Welcome to %v!", member.WorkTitle))
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h InviteAcceptHandler) accept(member *models.WorkMember) error {
+	tx, err := h.db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := models.AcceptWorkInvite(h.db, tx, member.Id); err != nil {
+		return err
+	}
+	joined := &models.Activity{WorkId: member.WorkId, UserEmail: member.UserEmail, Action: models.ActivityJoined}
+	if err := models.LogActivity(h.db, tx, joined); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h InviteAcceptHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildInviteAcceptHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return InviteAcceptHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -16,7 +16,8 @@ type DashboardHandler pathforkFrontEndHandler
 func (h DashboardHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
 	works := models.GetWorksForUser(manager.GetUserEmail(), h.db)
-	page := pages.GetDashboardPage(manager, works)
+	shared := models.GetSharedWorksForUser(manager.GetUserEmail(), h.db)
+	page := pages.GetDashboardPage(manager, works, shared)
 	if err := h.tr.RenderPage(w, "dashboard", page); err != nil {
 		fmt.Printf("Error with DashboardHandler page render: %v", err.Error())
 		// flash error
@@ -28,7 +29,7 @@ func (h DashboardHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildDashboardHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildDashboardHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return DashboardHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
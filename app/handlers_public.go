@@ -1,8 +1,10 @@
 package pathfork
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/gorilla/sessions"
@@ -15,14 +17,19 @@ import (
 	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/pages"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/sessionStore"
+	"bitbucket.org/jtyburke/pathfork/app/throttle"
 	"bitbucket.org/jtyburke/pathfork/app/utils"
 )
 
+// unlockLinkValidTime is in minutes, like config.PasswordResetValidTime
+const unlockLinkValidTime = 24 * 60
+
 type pathforkFrontEndHandler struct {
 	tr           *TemplateRenderer
 	methods      []string
 	db           *db.DB
-	sessionStore *sessions.CookieStore
+	sessionStore sessions.Store
 }
 
 // HomeHandler is the handler for the homepage
@@ -99,7 +106,7 @@ func (h HomeHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildHomeHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildHomeHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return HomeHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -127,7 +134,7 @@ func (h AboutHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildAboutHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildAboutHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return AboutHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -174,7 +181,7 @@ func (h ContactHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildContactHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildContactHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return ContactHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -188,7 +195,75 @@ func BuildContactHandler(tr *TemplateRenderer, db *db.DB, store *sessions.Cookie
 .
 */
 
-type AuthHandler pathforkFrontEndHandler
+// loginHandler is for handlers that check credentials, which all share
+// the same throttle so that guesses can't be spread between them
+type loginHandler struct {
+	pathforkFrontEndHandler
+	guard throttle.Guard
+}
+
+func buildLoginHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) loginHandler {
+	return loginHandler{
+		pathforkFrontEndHandler: pathforkFrontEndHandler{
+			tr:           tr,
+			methods:      []string{"GET", "POST"},
+			db:           db,
+			sessionStore: store,
+		},
+		guard: throttle.NewGuard(throttle.NewPGLimiter(db)),
+	}
+}
+
+// throttled flashes a message and returns true if the user has to wait
+// before trying to log in again
+func (h loginHandler) throttled(manager sessionManager.SessionManager, email, ip string, now time.Time) bool {
+	wait, err := h.guard.Wait(email, ip, now)
+	if err != nil {
+		glog.Errorf("Login throttle error: %v", err.Error())
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+	glog.Warningf("Throttled login for %v from %v for %v", email, ip, wait)
+	manager.AddFlash(fmt.Sprintf("Too many failed attempts. Please wait %v and try again.", (wait + time.Second - 1).Truncate(time.Second)))
+	return true
+}
+
+func (h loginHandler) recordFailure(email, ip string, now time.Time) {
+	glog.Warningf("Failed login for %v from %v", email, ip)
+	locked, err := h.guard.Fail(email, ip, now)
+	if err != nil {
+		glog.Errorf("Login throttle error: %v", err.Error())
+		return
+	}
+	if !locked {
+		return
+	}
+	glog.Warningf("Locked %v after too many failed logins", email)
+	if user := models.GetUserByEmail(email, h.db); user != nil && user.Verified {
+		messages.SendUnlockAccountEmail(email)
+	}
+}
+
+func (h loginHandler) recordSuccess(email string) {
+	if err := h.guard.Succeed(email); err != nil {
+		glog.Errorf("Login throttle error: %v", err.Error())
+	}
+}
+
+func (h loginHandler) Methods() []string {
+	return h.methods
+}
+
+/*
+.
+.
+*/
+
+type AuthHandler struct {
+	loginHandler
+}
 
 func (h AuthHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	action := utils.GetQueryArg(r, "action")
@@ -198,14 +273,33 @@ func (h AuthHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		form.Populate(r)
 		if form.Validate() {
 			email := strings.TrimSpace(strings.ToLower(r.FormValue("email")))
+			ip := sessionStore.ClientIP(r)
+			now := authenticator.Clock()
+			if h.throttled(authenticator.Manager, email, ip, now) {
+				http.Redirect(w, r, URLFor("home"), 302)
+				return
+			}
 			user := models.GetUserByEmail(email, h.db)
 			if user != nil && user.Verified {
 				pw := r.FormValue("password")
-				if valid := authenticator.LogUserIn(user.Email, user.Password, pw); !valid {
+				remember := r.FormValue("remember") == "on"
+				if user.TOTPEnabled {
+					// the account isn't cleared until the second factor is in
+					if valid := authenticator.BeginTwoFactorLogin(user.Email, user.Password, pw, remember); valid {
+						http.Redirect(w, r, URLFor("two_factor"), 302)
+						return
+					}
+					h.recordFailure(email, ip, now)
+					authenticator.Manager.AddFlash("Sorry, your login credentials were invalid.")
+				} else if valid := authenticator.LogUserIn(user.Email, user.Password, pw, remember); !valid {
+					h.recordFailure(email, ip, now)
 					authenticator.Manager.AddFlash("Sorry, your login credentials were invalid.")
+				} else {
+					h.recordSuccess(email)
 				}
 			} else {
 				glog.Infof("Could not find user %v", email)
+				h.recordFailure(email, ip, now)
 				authenticator.Manager.AddFlash("Those credentials were incorrect.")
 			}
 		}
@@ -213,6 +307,23 @@ func (h AuthHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		authenticator.LogUserOut()
 		http.Redirect(w, r, URLFor("home"), 302)
 		return
+	} else if r.Method == "GET" && action == "unlock" {
+		email, valid := auth.VerifyTSToken("unlock-account", utils.GetQueryArg(r, "token"), unlockLinkValidTime)
+		if !valid {
+			authenticator.Manager.AddFlash("Sorry, that unlock link isn't valid.")
+		} else if err := h.guard.Unlock(email); err != nil {
+			glog.Errorf("Error unlocking %v: %v", email, err.Error())
+			authenticator.Manager.AddFlash("Looks like there was a database error unlocking your account. Ugh!")
+		} else {
+			glog.Infof("Unlocked %v", email)
+			authenticator.Manager.AddFlash("Your account is unlocked. Go ahead and log in below.")
+		}
+		http.Redirect(w, r, URLFor("home"), 302)
+		return
+	} else if r.Method == "GET" && action == "change-email" {
+		h.changeEmail(authenticator.Manager, utils.GetQueryArg(r, "token"))
+		http.Redirect(w, r, URLFor("home"), 302)
+		return
 	} else if r.Method == "GET" && action == "verify" {
 		token := utils.GetQueryArg(r, "token")
 		if token != "" {
@@ -242,17 +353,93 @@ func (h AuthHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, toForward, 302)
 }
 
-func (h AuthHandler) Methods() []string {
-	return h.methods
+// changeEmail finishes an email change once the new address is confirmed
+func (h AuthHandler) changeEmail(manager sessionManager.SessionManager, token string) {
+	from, to, valid := auth.VerifyEmailChangeToken(token)
+	if !valid {
+		manager.AddFlash("Sorry, that link isn't valid.")
+		return
+	}
+	user := models.GetUserByEmail(from, h.db)
+	if user == nil {
+		manager.AddFlash("Sorry, that link has already been used.")
+		return
+	}
+	if models.GetUserByEmail(to, h.db) != nil {
+		manager.AddFlash("Looks like that email's already in use.")
+		return
+	}
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		if err = models.ChangeUserEmail(h.db, tx, user, to); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error changing email from %v to %v: %v", from, to, err.Error())
+		manager.AddFlash("Looks like there was a database error changing your email. Ugh!")
+		return
+	}
+	glog.Infof("Changed email from %v to %v", from, to)
+	messages.SendEmailChangedEmail(from, to)
+	// every session of the old address is gone, this one included
+	manager.Restart()
+	manager.AddFlash(fmt.Sprintf("You're all set! Log in below with %v from now on.", to))
 }
 
-func BuildAuthHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
-	return AuthHandler{
-		tr:           tr,
-		methods:      []string{"GET", "POST"},
-		db:           db,
-		sessionStore: store,
+func BuildAuthHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return AuthHandler{buildLoginHandler(tr, db, store)}
+}
+
+/*
+.
+.
+*/
+
+// TwoFactorHandler is the second step of logging in for users with TOTP on
+type TwoFactorHandler struct {
+	loginHandler
+}
+
+func (h TwoFactorHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	authenticator := auth.NewAuthenticator(r, w, h.sessionStore)
+	email, ok := authenticator.PendingUser()
+	if !ok {
+		authenticator.Manager.AddFlash("Sorry, that took too long. Please log in again.")
+		http.Redirect(w, r, URLFor("home"), 302)
+		return
+	}
+	page := pages.GetTwoFactorPage(authenticator.Manager)
+	if r.Method == "POST" {
+		ip := sessionStore.ClientIP(r)
+		now := authenticator.Clock()
+		if h.throttled(authenticator.Manager, email, ip, now) {
+			http.Redirect(w, r, URLFor("two_factor"), 302)
+			return
+		}
+		page.Form.Populate(r)
+		if page.Form.Validate() {
+			user := models.GetUserByEmail(email, h.db)
+			if user != nil && models.VerifySecondFactor(h.db, user, r.FormValue("code"), now) {
+				if authenticator.FinishTwoFactorLogin() {
+					h.recordSuccess(email)
+					http.Redirect(w, r, URLFor("dashboard"), 302)
+					return
+				}
+			}
+			glog.Infof("Bad second factor for %v", email)
+			h.recordFailure(email, ip, now)
+			page.Form.AddError("Sorry, that code didn't work.")
+		}
 	}
+	if err := h.tr.RenderPage(w, "two_factor", page); err != nil {
+		glog.Error(err.Error())
+		http.Redirect(w, r, URLFor("home"), 302)
+	}
+}
+
+func BuildTwoFactorHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return TwoFactorHandler{buildLoginHandler(tr, db, store)}
 }
 
 /*
@@ -333,12 +520,22 @@ func (h ResetHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 			valid := form.Validate()
 			if passwordMatch && valid {
 				user := models.GetUserByEmail(email, h.db)
-				tx, _ := h.db.DB.Begin()
-				err := models.UpdatePassword(user, r.FormValue("newPassword"), tx)
+				tx, err := h.db.DB.Begin()
+				if err == nil {
+					err = models.UpdatePassword(user, r.FormValue("newPassword"), tx)
+					if err == nil {
+						// anyone holding an old session is logged out by the reset
+						err = models.DeleteSessionsForUser(h.db, tx, user.Email, "")
+					}
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				}
 				if err != nil {
 					manager.AddFlash("Looks like there was a database error resetting your password. Ugh!")
 				} else {
-					tx.Commit()
 					manager.AddFlash("Your password has been reset! Go ahead and log in above.")
 				}
 				http.Redirect(w, r, URLFor("home"), 302)
@@ -363,7 +560,7 @@ func (h ResetHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildResetHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildResetHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return ResetHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -0,0 +1,289 @@
+package pathfork
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+func ownsCharacter(id int, manager sessionManager.SessionManager, database *db.DB) bool {
+	character, ok := models.GetCharacterDetail(id, database).(*models.Character)
+	return ok && character.VerifyPermission(manager)
+}
+
+func ownsSetting(id int, manager sessionManager.SessionManager, database *db.DB) bool {
+	setting, ok := models.GetSettingById(id, database).(*models.Setting)
+	return ok && setting.VerifyPermission(manager)
+}
+
+func ownsSection(id int, manager sessionManager.SessionManager, database *db.DB) bool {
+	section, ok := models.GetSectionById(id, database).(*models.Section)
+	return ok && models.HasRole(section, manager, models.RoleOwner)
+}
+
+// handleRelationshipForm fills in the relationship from the form, making
+// sure everything it points at belongs to the user. Problems are marked
+// on the form's fields as well as returned.
+func handleRelationshipForm(relationship *models.CharacterRelationship, r *http.Request, page pages.WebPage,
+	manager sessionManager.SessionManager, database *db.DB) error {
+	relationship.ToId, _ = strconv.Atoi(r.FormValue("to"))
+	relationship.Kind = r.FormValue("kind")
+	relationship.Directed = r.FormValue("directed") == "on"
+	relationship.Notes = r.FormValue("notes")
+	relationship.StartSectionId, _ = strconv.Atoi(r.FormValue("start_section"))
+	relationship.EndSectionId, _ = strconv.Atoi(r.FormValue("end_section"))
+	if relationship.ToId == relationship.FromId || !ownsCharacter(relationship.ToId, manager, database) {
+		err := errors.New("Please pick one of your other characters.")
+		page.Form.Fields["to"].(*forms.SelectField).Error = err
+		return err
+	}
+	for _, name := range []string{"start_section", "end_section"} {
+		id, _ := strconv.Atoi(r.FormValue(name))
+		if id != 0 && !ownsSection(id, manager, database) {
+			err := errors.New("Please pick one of your sections.")
+			page.Form.Fields[name].(*forms.SelectField).Error = err
+			return err
+		}
+	}
+	return nil
+}
+
+type RelationshipNewHandler pathforkFrontEndHandler
+
+func (h RelationshipNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	characterId, _ := strconv.Atoi(utils.GetQueryArg(r, "characterId"))
+	if !ownsCharacter(characterId, manager, h.db) {
+		manager.AddFlash("Sorry, that link must have been bad.")
+		http.Redirect(w, r, URLFor("character_index"), http.StatusFound)
+		return
+	}
+	params := crudCreateInput{
+		GetCreatePageFunc: pages.GetRelationshipNewPage,
+		CreateFuncArgs:    []string{fmt.Sprintf("%v", characterId)},
+		TemplateName:      "relationship_edit",
+		SuccessRedirect:   fmt.Sprintf("%v%v", URLFor("character_view"), characterId),
+		CreateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager) (db.Insertable, error) {
+			relationship := &models.CharacterRelationship{FromId: characterId, UserEmail: manager.GetUserEmail()}
+			if err := handleRelationshipForm(relationship, r, page, manager, h.db); err != nil {
+				return nil, err
+			}
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			if relationship.Id, err = h.db.Insert(relationship, tx); err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			return relationship, tx.Commit()
+		},
+	}
+	HandleCrudCreate(r, w, h.db, h.tr, manager, params)
+}
+
+func (h RelationshipNewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildRelationshipNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return RelationshipNewHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type RelationshipEditHandler pathforkFrontEndHandler
+
+func (h RelationshipEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	params := crudEditInput{
+		GetByIdFunc:     models.GetRelationshipById,
+		GetEditPageFunc: pages.GetRelationshipEditPage,
+		TemplateName:    "relationship_edit",
+		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
+			relationship := obj.(*models.CharacterRelationship)
+			if err := handleRelationshipForm(relationship, r, page, manager, h.db); err != nil {
+				return nil, err
+			}
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				return nil, err
+			}
+			if err := relationship.Save(tx); err != nil {
+				glog.Errorf("Error saving relationship: %v", err.Error())
+				return nil, err
+			}
+			return relationship, tx.Commit()
+		},
+	}
+	response := HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+	if r.Method == "POST" && response.Error == nil && response.Obj != nil {
+		relationship := response.Obj.(*models.CharacterRelationship)
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("character_view"), relationship.FromId), http.StatusFound)
+	}
+}
+
+func (h RelationshipEditHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildRelationshipEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return RelationshipEditHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type RelationshipDeleteHandler pathforkFrontEndHandler
+
+func (h RelationshipDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetRelationshipById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	relationship := response.Obj.(*models.CharacterRelationship)
+	characterURL := fmt.Sprintf("%v%v", URLFor("character_view"), relationship.FromId)
+	form := forms.NewDeleteForm(relationship.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		http.Redirect(w, r, characterURL, http.StatusFound)
+		return
+	}
+	if success, err := models.DeleteRelationship(relationship.Id, h.db); err != nil || !success {
+		glog.Error(err)
+		manager.AddFlash("Sorry, something went wrong :(")
+	} else {
+		manager.AddFlash(fmt.Sprintf("%v and %v have gone their separate ways.", relationship.FromName, relationship.ToName))
+	}
+	http.Redirect(w, r, characterURL, http.StatusFound)
+}
+
+func (h RelationshipDeleteHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildRelationshipDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return RelationshipDeleteHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type WorkCastHandler pathforkFrontEndHandler
+
+func (h WorkCastHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	cvi := crudViewInput{
+		GetByIdFunc:     models.GetWorkById,
+		GetViewPageFunc: pages.GetWorkCastPage,
+		TemplateName:    "work_cast",
+	}
+	HandleCrudView(r, w, h.db, h.tr, manager, cvi)
+}
+
+func (h WorkCastHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkCastHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkCastHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// WorkCastGraphHandler serves the relationship graph of a work's cast as
+// ?format=json (the default, which the cast page draws from), dot or
+// graphml. With ?sectionId= it only has relationships that hold there.
+type WorkCastGraphHandler pathforkFrontEndHandler
+
+func (h WorkCastGraphHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById)
+	if response.RedirectCode != 0 {
+		http.Error(w, "No such work", http.StatusNotFound)
+		return
+	}
+	work := response.Obj.(*models.Work)
+	sectionId, _ := strconv.Atoi(utils.GetQueryArg(r, "sectionId"))
+	graph := models.GetCastGraphForWork(work.Id, sectionId, h.db)
+	var err error
+	switch utils.GetQueryArg(r, "format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err = json.NewEncoder(w).Encode(graph)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="cast.dot"`)
+		err = graph.WriteDOT(w, work.Title)
+	case "graphml":
+		w.Header().Set("Content-Type", "application/graphml+xml; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="cast.graphml"`)
+		err = graph.WriteGraphML(w, work.Title)
+	default:
+		http.Error(w, "Unknown format, use json, dot or graphml", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		glog.Errorf("Error writing cast graph: %v", err.Error())
+	}
+}
+
+func (h WorkCastGraphHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkCastGraphHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkCastGraphHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -0,0 +1,179 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// renameURL is the page that offers to carry a character's or setting's
+// (entity's) rename from from into its sections
+func renameURL(entity string, id int, from string) string {
+	return fmt.Sprintf("%v%v?from=%v", URLFor(entity+"_rename"), id, url.QueryEscape(from))
+}
+
+// redirectAfterEdit sends the user to the character or setting (entity)
+// they've just saved, by way of the rename page if it was called from
+// before
+func redirectAfterEdit(w http.ResponseWriter, r *http.Request, entity string, id int, from, to string) {
+	if from != "" && from != to {
+		http.Redirect(w, r, renameURL(entity, id, from), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor(entity+"_view"), id), http.StatusFound)
+}
+
+// renamePageFunc builds the rename page once there's been a preview
+type renamePageFunc func(options *models.ReplaceOptions, unlinked bool, hits []*models.ReplaceHit, fields []*models.ReplaceField) pages.WebPage
+
+// handleRename previews the character or setting (entity), now called
+// name, being renamed from ?from= through its sections, and POSTing makes
+// the replacements ticked in the preview. The old name was already
+// remembered when the new one was saved.
+func handleRename(w http.ResponseWriter, r *http.Request, database *db.DB, tr *TemplateRenderer, manager sessionManager.SessionManager,
+	entity string, id int, name string, getPage renamePageFunc) {
+	view := fmt.Sprintf("%v%v", URLFor(entity+"_view"), id)
+	from := r.FormValue("from")
+	if from == "" || from == name {
+		http.Redirect(w, r, view, http.StatusFound)
+		return
+	}
+	unlinked := r.FormValue("unlinked") != ""
+	options := &models.ReplaceOptions{Find: from, Replace: name, WholeWord: true, MatchCase: true, Rename: true}
+	fields := models.GetRenameFields(entity, id, manager.GetUserEmail(), unlinked, database)
+	if r.Method == "POST" {
+		form := forms.NewDeleteForm(id, manager)
+		form.Populate(r)
+		if !form.Validate() {
+			manager.AddFlash("Sorry, that form expired. Please try again.")
+			http.Redirect(w, r, renameURL(entity, id, from), http.StatusFound)
+			return
+		}
+		message, done := applyRename(r, database, manager, entity, id, *options, fields)
+		manager.AddFlash(message)
+		redirect := view
+		if !done {
+			redirect = renameURL(entity, id, from)
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	hits, err := models.FindReplaceHits(fields, *options)
+	if err != nil {
+		manager.AddFlash(err.Error())
+		http.Redirect(w, r, view, http.StatusFound)
+		return
+	}
+	if err := tr.RenderPage(w, "rename", getPage(options, unlinked, hits, fields)); err != nil {
+		glog.Errorf("Error with Rename page render: %v", err.Error())
+		http.Redirect(w, r, view, http.StatusFound)
+	}
+}
+
+// applyRename makes the replacements ticked in the preview, all in one
+// transaction. It says how it went, and whether it went through.
+func applyRename(r *http.Request, database *db.DB, manager sessionManager.SessionManager, entity string, id int,
+	options models.ReplaceOptions, fields []*models.ReplaceField) (string, bool) {
+	var changed []*models.ReplaceField
+	tx, err := database.DB.Begin()
+	if err == nil {
+		changed, err = models.ApplyReplace(database, tx, manager.GetUserEmail(), fields, options,
+			formValueSet(r.Form["accept"]), formValueSet(r.Form["fingerprint"]))
+		if err == nil {
+			err = logReplaceActivity(database, tx, manager.GetUserEmail(), changed)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if conflict, ok := err.(models.ReplaceConflictError); ok {
+		return conflict.Error(), false
+	}
+	if err != nil {
+		glog.Errorf("Error renaming %v %v: %v", entity, id, err.Error())
+		return "Looks like there was a database error, so nothing's been changed.", false
+	}
+	refreshCollabSections(changed)
+	if len(changed) == 0 {
+		return "Nothing was ticked, so the sections are as they were.", true
+	}
+	return fmt.Sprintf("Renamed in %v section(s). You can undo it from each work's find and replace.", len(changed)), true
+}
+
+/*
+.
+.
+*/
+
+// CharacterRenameHandler is where editing a character's name leads, to
+// carry the new name into the sections it's in
+type CharacterRenameHandler pathforkFrontEndHandler
+
+func (h CharacterRenameHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetCharacterDetail)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	character := response.Obj.(*models.Character)
+	handleRename(w, r, h.db, h.tr, manager, "character", character.Id, character.Name,
+		func(options *models.ReplaceOptions, unlinked bool, hits []*models.ReplaceHit, fields []*models.ReplaceField) pages.WebPage {
+			return pages.GetCharacterRenamePage(manager, character, options, unlinked, hits, fields)
+		})
+}
+
+func (h CharacterRenameHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildCharacterRenameHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return CharacterRenameHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SettingRenameHandler pathforkFrontEndHandler
+
+func (h SettingRenameHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetSettingById)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	setting := response.Obj.(*models.Setting)
+	handleRename(w, r, h.db, h.tr, manager, "setting", setting.Id, setting.Name,
+		func(options *models.ReplaceOptions, unlinked bool, hits []*models.ReplaceHit, fields []*models.ReplaceField) pages.WebPage {
+			return pages.GetSettingRenamePage(manager, setting, options, unlinked, hits, fields)
+		})
+}
+
+func (h SettingRenameHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSettingRenameHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SettingRenameHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -0,0 +1,193 @@
+package pathfork
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// replaceOptionsFromForm only lets the owner change their characters and
+// settings, which can be in other works too
+func replaceOptionsFromForm(r *http.Request, owner bool) *models.ReplaceOptions {
+	return &models.ReplaceOptions{
+		Find:       r.FormValue("find"),
+		Replace:    r.FormValue("replace"),
+		WholeWord:  r.FormValue("whole_word") != "",
+		MatchCase:  r.FormValue("match_case") != "",
+		Regex:      r.FormValue("regex") != "",
+		Characters: owner && r.FormValue("characters") != "",
+		Settings:   owner && r.FormValue("settings") != "",
+	}
+}
+
+func formValueSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// refreshCollabSections sends anyone editing a changed section body the
+// new one
+func refreshCollabSections(fields []*models.ReplaceField) {
+	if collabHub == nil {
+		return
+	}
+	for _, field := range fields {
+		if field.Entity == "section" && field.Field == "body" {
+			collabHub.Merge(field.Id, field.Value, false)
+		}
+	}
+}
+
+// WorkReplaceHandler is find and replace over a work. POSTing previews the
+// hits, applies the ones ticked in a preview (action=apply), or undoes an
+// earlier replace (action=undo).
+type WorkReplaceHandler pathforkFrontEndHandler
+
+func (h WorkReplaceHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleEditor)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	work := response.Obj.(*models.Work)
+	redirect := fmt.Sprintf("%v%v", URLFor("work_replace"), work.Id)
+	options := &models.ReplaceOptions{WholeWord: true, MatchCase: true}
+	var hits []*models.ReplaceHit
+	var fields []*models.ReplaceField
+	if r.Method == "POST" {
+		form := forms.NewDeleteForm(work.Id, manager)
+		form.Populate(r)
+		if !form.Validate() {
+			manager.AddFlash("Sorry, that form expired. Please try again.")
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+		options = replaceOptionsFromForm(r, work.RoleFor(manager) == models.RoleOwner)
+		switch r.FormValue("action") {
+		case "apply":
+			manager.AddFlash(h.apply(r, manager, work, *options))
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		case "undo":
+			manager.AddFlash(h.undo(r, manager, work))
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+		fields = models.GetReplaceFields(work, *options, h.db)
+		var err error
+		if hits, err = models.FindReplaceHits(fields, *options); err != nil {
+			manager.AddFlash(err.Error())
+			fields = nil
+		}
+	}
+	page := pages.GetWorkReplacePage(manager, h.db, work, options, hits, fields)
+	if err := h.tr.RenderPage(w, "work_replace", page); err != nil {
+		glog.Errorf("Error with Work Replace page render: %v", err.Error())
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), work.Id), http.StatusFound)
+	}
+}
+
+// apply makes the replacements ticked in the preview, and says how it went
+func (h WorkReplaceHandler) apply(r *http.Request, manager sessionManager.SessionManager, work *models.Work, options models.ReplaceOptions) string {
+	fields := models.GetReplaceFields(work, options, h.db)
+	var changed []*models.ReplaceField
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		changed, err = models.ApplyReplace(h.db, tx, manager.GetUserEmail(), fields, options,
+			formValueSet(r.Form["accept"]), formValueSet(r.Form["fingerprint"]))
+		if err == nil {
+			err = logReplaceActivity(h.db, tx, manager.GetUserEmail(), changed)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if conflict, ok := err.(models.ReplaceConflictError); ok {
+		return conflict.Error()
+	}
+	if err != nil {
+		glog.Errorf("Error replacing in work %v: %v", work.Id, err.Error())
+		return "Looks like there was a database error, so nothing's been replaced."
+	}
+	if len(changed) == 0 {
+		return "Nothing was ticked, so nothing's changed."
+	}
+	refreshCollabSections(changed)
+	return fmt.Sprintf("Replaced in %v field(s). You can undo it below.", len(changed))
+}
+
+// logReplaceActivity logs each section changed as edited, once, in its
+// work
+func logReplaceActivity(database *db.DB, tx *sql.Tx, email string, changed []*models.ReplaceField) error {
+	logged := map[int]bool{}
+	for _, field := range changed {
+		if field.Entity != "section" || logged[field.Id] {
+			continue
+		}
+		logged[field.Id] = true
+		activity := &models.Activity{WorkId: field.WorkId, SectionId: field.Id, SectionTitle: field.Label,
+			UserEmail: email, Action: models.ActivityEdited}
+		if err := models.LogActivity(database, tx, activity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undo puts back what an earlier replace changed, and says how it went
+func (h WorkReplaceHandler) undo(r *http.Request, manager sessionManager.SessionManager, work *models.Work) string {
+	id, _ := strconv.Atoi(r.FormValue("revision"))
+	revision := models.GetRevisionById(id, h.db)
+	if revision == nil || revision.WorkId != work.Id {
+		return "Sorry, we couldn't find that."
+	}
+	if revision.UndoneAt.Valid {
+		return "That's already been undone."
+	}
+	var restored []*models.ReplaceField
+	skipped := 0
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		if restored, skipped, err = models.UndoRevision(h.db, tx, revision, work.RoleFor(manager) == models.RoleOwner); err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error undoing revision %v: %v", revision.Id, err.Error())
+		return "Looks like there was a database error, so nothing's been undone."
+	}
+	refreshCollabSections(restored)
+	if skipped > 0 {
+		return fmt.Sprintf("Undone, except in %v field(s) that have been changed again since, are in the trash, or only the owner can change.", skipped)
+	}
+	return "Undone."
+}
+
+func (h WorkReplaceHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkReplaceHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkReplaceHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/forms"
@@ -31,7 +32,7 @@ func (h SectionViewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSectionViewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSectionViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SectionViewHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -54,6 +55,13 @@ func handleSectionForm(section *models.Section, r *http.Request, page pages.WebP
 	if r.FormValue("snippet") == "on" {
 		section.Snippet = true
 	}
+	section.StoryTime = r.FormValue("story_time")
+	section.StorySortKey = r.FormValue("story_sort")
+	// the point of view character is always one of the section's characters
+	section.POVCharacterId, _ = strconv.Atoi(r.FormValue("pov"))
+	if pov := r.FormValue("pov"); section.POVCharacterId != 0 && len(utils.StringSliceIntersection(r.Form["characters"], []string{pov})) == 0 {
+		r.Form["characters"] = append(r.Form["characters"], pov)
+	}
 	if section.UserEmail == "" { // if new section
 		section.UserEmail = manager.GetUserEmail()
 	}
@@ -69,7 +77,16 @@ func (h SectionEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request
 		TemplateName:    "section_edit",
 		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
 			section := obj.(*models.Section)
+			savedWordCount := section.WordCount
 			handleSectionForm(section, r, page, manager)
+			// the section may be open in a collaborative session too
+			if collabHub != nil {
+				body := collabHub.Merge(section.Id, section.Body, r.FormValue("collab") == "in-step")
+				if body != section.Body {
+					section.Body = body
+					section.WordCount = models.CountWords(body)
+				}
+			}
 			charsToInsert, charsToDelete, err := forms.GetRelationUpdateIds(
 				r, "currentCharIds", "characters",
 			)
@@ -82,6 +99,17 @@ func (h SectionEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request
 					glog.Errorf("Error saving section on SectionEditHandler: %v", err.Error())
 					return nil, err
 				}
+				if err := models.ReanchorComments(h.db, tx, section.Id, section.Body); err != nil {
+					glog.Errorf("Error re-anchoring comments: %v", err.Error())
+					return nil, err
+				}
+				// against what was saved, which autosaves and collaborators
+				// may have changed since the form was opened
+				if section.WordCount != savedWordCount {
+					if err := models.UpdateWorkWordCount(h.db, tx, section.WorkId, section.WordCount-savedWordCount); err != nil {
+						return nil, err
+					}
+				}
 				if action := utils.GetQueryArg(r, "action"); action == "autosave" {
 					tx.Commit()
 					return section, nil
@@ -112,13 +140,8 @@ func (h SectionEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request
 					glog.Errorf("Problem saving section relations: %v", err.Error())
 					return nil, err
 				}
-				if r.FormValue("wordCount") != r.FormValue("oldWordCount") {
-					wordCount, _ := strconv.Atoi(r.FormValue("wordCount"))
-					oldWordCount, _ := strconv.Atoi(r.FormValue("oldWordCount"))
-					diff := wordCount - oldWordCount
-					if err := models.UpdateWorkWordCount(h.db, tx, section.WorkId, diff); err != nil {
-						return nil, err
-					}
+				if err := models.LogActivity(h.db, tx, models.SectionActivity(section, manager.GetUserEmail(), models.ActivityEdited)); err != nil {
+					return nil, err
 				}
 				tx.Commit()
 				return section, nil
@@ -140,7 +163,7 @@ func (h SectionEditHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSectionEditHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSectionEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SectionEditHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -166,16 +189,24 @@ func (h SectionNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	workId := workIdQ[0]
+	workIdInt, _ := strconv.Atoi(workId)
+	work, ok := models.GetWorkById(workIdInt, h.db).(*models.Work)
+	if !ok || !models.HasRole(work, manager, models.RoleEditor) {
+		manager.AddFlash("Sorry, you're not allowed to do that.")
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+		return
+	}
 	params := crudCreateInput{
 		GetCreatePageFunc: pages.GetSectionNewPage,
 		CreateFuncArgs:    []string{workId},
 		TemplateName:      "section_edit",
 		SuccessRedirect:   URLFor("work_view") + workId,
 		CreateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager) (db.Insertable, error) {
-			newSection := &models.Section{}
+			// a section belongs to its work's owner, whoever writes it, and
+			// starts in the work's first column on the board
+			newSection := &models.Section{UserEmail: work.UserEmail, Status: work.GetStatuses()[0]}
 			handleSectionForm(newSection, r, page, manager)
-			workIdInt, _ := strconv.Atoi(workId)
-			newSection.WorkId = workIdInt
+			newSection.WorkId = work.Id
 			newSection.Order = 10000
 			tx, err := h.db.DB.Begin()
 			if err != nil {
@@ -200,6 +231,9 @@ func (h SectionNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 				diff := wordCount - oldWordCount
 				err = models.UpdateWorkWordCount(h.db, tx, newSection.WorkId, diff)
 			}
+			if err == nil {
+				err = models.LogActivity(h.db, tx, models.SectionActivity(newSection, manager.GetUserEmail(), models.ActivityCreated))
+			}
 			tx.Commit()
 			return newSection, err
 		},
@@ -211,7 +245,7 @@ func (h SectionNewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSectionNewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSectionNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SectionNewHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -229,7 +263,7 @@ type SectionDeleteHandler pathforkFrontEndHandler
 
 func (h SectionDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
-	response := getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById), manager, models.RoleEditor)
 	if response.RedirectCode != 0 {
 		if response.FlashMsg != "" {
 			manager.AddFlash(response.FlashMsg)
@@ -242,23 +276,31 @@ func (h SectionDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Reque
 	form.Populate(r)
 	if r.Method == "POST" {
 		if form.Validate() {
-			idToDelete, _ := strconv.Atoi(r.FormValue("object_id"))
-			success, err := models.DeleteSection(idToDelete, h.db)
-			tx, _ := h.db.DB.Begin()
-			err = models.UpdateWorkWordCount(h.db, tx, section.WorkId, -section.WordCount)
-			if err != nil || !success {
-				tx.Rollback()
+			tx, err := h.db.DB.Begin()
+			if err == nil {
+				err = models.TrashSection(h.db, tx, section.Id)
+				if err == nil {
+					deleted := models.SectionActivity(section, manager.GetUserEmail(), models.ActivityDeleted)
+					deleted.SectionId = 0
+					err = models.LogActivity(h.db, tx, deleted)
+				}
+				if err == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+			}
+			if err != nil && err != models.ErrAlreadyTrashed {
 				glog.Error(err)
 				http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("section_view"), section.Id), 301)
 				return
 			}
-			tx.Commit()
 		} else {
 			http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("section_view"), section.Id), 301)
 			return
 		}
 	}
-	manager.AddFlash("Alright, I got rid of that section for you.")
+	manager.AddFlash("Alright, I put that section in the trash for you.")
 	http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), section.WorkId), 301)
 }
 
@@ -266,7 +308,7 @@ func (h SectionDeleteHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSectionDeleteHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSectionDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SectionDeleteHandler{
 		tr:           tr,
 		methods:      []string{"POST"},
@@ -284,7 +326,7 @@ type SectionReorderHandler pathforkFrontEndHandler
 
 func (h SectionReorderHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
-	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleEditor)
 	if response.RedirectCode != 0 {
 		if response.FlashMsg != "" {
 			manager.AddFlash(response.FlashMsg)
@@ -322,7 +364,7 @@ func (h SectionReorderHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSectionReorderHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSectionReorderHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SectionReorderHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -330,3 +372,333 @@ func BuildSectionReorderHandler(tr *TemplateRenderer, db *db.DB, store *sessions
 		sessionStore: store,
 	}
 }
+
+/*
+.
+.
+*/
+
+// SectionSplitHandler takes the section's body with a split marker where
+// the cursor was, and makes everything after it a new section
+type SectionSplitHandler pathforkFrontEndHandler
+
+func (h SectionSplitHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById), manager, models.RoleEditor)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	section := response.Obj.(*models.Section)
+	editURL := fmt.Sprintf("%v%v", URLFor("section_edit"), section.Id)
+	form := forms.NewDeleteForm(section.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please try again.")
+		http.Redirect(w, r, editURL, http.StatusFound)
+		return
+	}
+	body := r.FormValue("body")
+	if _, _, ok := models.SplitSectionBody(body); !ok {
+		manager.AddFlash("There needs to be something on both sides of the split.")
+		http.Redirect(w, r, editURL, http.StatusFound)
+		return
+	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		title = section.Title + " (continued)"
+	}
+	tx, err := h.db.DB.Begin()
+	newId := 0
+	if err == nil {
+		newId, err = models.SplitSection(h.db, tx, section, body, title)
+		if err == nil {
+			err = models.LogActivity(h.db, tx, models.SectionActivity(section, manager.GetUserEmail(), models.ActivityEdited))
+		}
+		if err == nil {
+			created := models.SectionActivity(section, manager.GetUserEmail(), models.ActivityCreated)
+			created.SectionId = newId
+			created.SectionTitle = title
+			err = models.LogActivity(h.db, tx, created)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error splitting section %v: %v", section.Id, err.Error())
+		manager.AddFlash("Looks like there was a database error splitting that.")
+		http.Redirect(w, r, editURL, http.StatusFound)
+		return
+	}
+	// anyone still editing the section is left with the first half
+	if collabHub != nil {
+		collabHub.Merge(section.Id, section.Body, false)
+	}
+	manager.AddFlash("Split it. Here's the second half.")
+	http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("section_edit"), newId), http.StatusFound)
+}
+
+func (h SectionSplitHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSectionSplitHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SectionSplitHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// SectionMergeHandler merges the work's sections ticked on the reorder
+// page into the first of them
+type SectionMergeHandler pathforkFrontEndHandler
+
+func (h SectionMergeHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleEditor)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	work := response.Obj.(*models.Work)
+	reorderURL := fmt.Sprintf("%v%v", URLFor("section_reorder"), work.Id)
+	form := forms.NewDeleteForm(work.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please try again.")
+		http.Redirect(w, r, reorderURL, http.StatusFound)
+		return
+	}
+	ids, err := utils.StringsToInts(r.Form["sections"])
+	if err != nil {
+		manager.AddFlash("Sorry, something went wrong :(")
+		http.Redirect(w, r, reorderURL, http.StatusFound)
+		return
+	}
+	roots, snippets := models.GetSectionsForWork(work.Id, h.db)
+	ordered, err := models.MergeOrder(append(models.FlattenSectionTree(roots), snippets...), ids)
+	if err != nil {
+		manager.AddFlash(err.Error())
+		http.Redirect(w, r, reorderURL, http.StatusFound)
+		return
+	}
+	sections := make([]*models.Section, len(ordered))
+	for i := range ordered {
+		section, ok := models.GetSectionById(ordered[i].Id, h.db).(*models.Section)
+		if !ok {
+			manager.AddFlash("Sorry, something went wrong :(")
+			http.Redirect(w, r, reorderURL, http.StatusFound)
+			return
+		}
+		sections[i] = section
+	}
+	var merged *models.Section
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		merged, err = models.MergeSections(h.db, tx, sections)
+		if err == nil {
+			err = models.LogActivity(h.db, tx, models.SectionActivity(merged, manager.GetUserEmail(), models.ActivityEdited))
+		}
+		for _, section := range sections[1:] {
+			if err != nil {
+				break
+			}
+			deleted := models.SectionActivity(section, manager.GetUserEmail(), models.ActivityDeleted)
+			deleted.SectionId = 0
+			err = models.LogActivity(h.db, tx, deleted)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error merging sections of work %v: %v", work.Id, err.Error())
+		manager.AddFlash("Looks like there was a database error merging those.")
+		http.Redirect(w, r, reorderURL, http.StatusFound)
+		return
+	}
+	if collabHub != nil {
+		collabHub.Merge(merged.Id, merged.Body, false)
+	}
+	manager.AddFlash("Merged them. The others are in the trash, if you need them back.")
+	http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("section_view"), merged.Id), http.StatusFound)
+}
+
+func (h SectionMergeHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSectionMergeHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SectionMergeHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// SectionMoveHandler moves sections and snippets, with their subsections,
+// to another of the owner's works
+type SectionMoveHandler pathforkFrontEndHandler
+
+func (h SectionMoveHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleOwner)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	work := response.Obj.(*models.Work)
+	moveURL := fmt.Sprintf("%v%v", URLFor("section_move"), work.Id)
+	if r.Method == "POST" {
+		form := forms.NewDeleteForm(work.Id, manager)
+		form.Populate(r)
+		if !form.Validate() {
+			manager.AddFlash("Sorry, that form expired. Please try again.")
+			http.Redirect(w, r, moveURL, http.StatusFound)
+			return
+		}
+		targetId, _ := strconv.Atoi(r.FormValue("target"))
+		target, ok := models.GetWorkById(targetId, h.db).(*models.Work)
+		if !ok || target.Id == work.Id || target.UserEmail != manager.GetUserEmail() {
+			manager.AddFlash("Sections can only be moved to another work of yours.")
+			http.Redirect(w, r, moveURL, http.StatusFound)
+			return
+		}
+		ids, err := utils.StringsToInts(r.Form["sections"])
+		if err != nil || len(ids) == 0 {
+			manager.AddFlash("Tick the sections you want to move.")
+			http.Redirect(w, r, moveURL, http.StatusFound)
+			return
+		}
+		position, _ := strconv.Atoi(r.FormValue("position"))
+		roots, snippets := models.GetSectionsForWork(work.Id, h.db)
+		var moved []*models.Section
+		tx, err := h.db.DB.Begin()
+		if err == nil {
+			moved, err = models.MoveSections(h.db, tx, append(models.FlattenSectionTree(roots), snippets...), ids, target, position)
+			for _, section := range moved {
+				if err != nil {
+					break
+				}
+				gone := models.SectionActivity(section, manager.GetUserEmail(), models.ActivityDeleted)
+				gone.SectionId = 0
+				if err = models.LogActivity(h.db, tx, gone); err == nil {
+					arrived := models.SectionActivity(section, manager.GetUserEmail(), models.ActivityCreated)
+					arrived.WorkId = target.Id
+					err = models.LogActivity(h.db, tx, arrived)
+				}
+			}
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			glog.Errorf("Error moving sections from work %v to %v: %v", work.Id, target.Id, err.Error())
+			manager.AddFlash("Looks like there was a database error moving those.")
+			http.Redirect(w, r, moveURL, http.StatusFound)
+			return
+		}
+		manager.AddFlash(fmt.Sprintf("Moved them to %v. Drag them around here if they aren't quite where you want them.", target.Title))
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("section_reorder"), target.Id), http.StatusFound)
+		return
+	}
+	page := pages.GetSectionMovePage(manager, h.db, work)
+	if err := h.tr.RenderPage(w, "section_move", page); err != nil {
+		glog.Errorf("Error with Section Move page render: %v", err.Error())
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), work.Id), http.StatusFound)
+	}
+}
+
+func (h SectionMoveHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSectionMoveHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SectionMoveHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// SnippetPromoteHandler makes a snippet a section at the top level of the
+// table of contents, at the position POSTed
+type SnippetPromoteHandler pathforkFrontEndHandler
+
+func (h SnippetPromoteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetSectionById), manager, models.RoleEditor)
+	if redirectStarterResponse(w, r, manager, response) {
+		return
+	}
+	section := response.Obj.(*models.Section)
+	workURL := fmt.Sprintf("%v%v", URLFor("work_view"), section.WorkId)
+	form := forms.NewDeleteForm(section.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that form expired. Please try again.")
+		http.Redirect(w, r, workURL, http.StatusFound)
+		return
+	}
+	if !section.Snippet {
+		manager.AddFlash(fmt.Sprintf("%v is already a section.", section.Title))
+		http.Redirect(w, r, workURL, http.StatusFound)
+		return
+	}
+	position, _ := strconv.Atoi(r.FormValue("position"))
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		err = models.PromoteSnippet(h.db, tx, section, position)
+		if err == nil {
+			err = models.LogActivity(h.db, tx, models.SectionActivity(section, manager.GetUserEmail(), models.ActivityEdited))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error promoting snippet %v: %v", section.Id, err.Error())
+		manager.AddFlash("Looks like there was a database error with that.")
+	} else {
+		manager.AddFlash(fmt.Sprintf("%v is a section now.", section.Title))
+	}
+	http.Redirect(w, r, workURL, http.StatusFound)
+}
+
+func (h SnippetPromoteHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSnippetPromoteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SnippetPromoteHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -0,0 +1,250 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+type SeriesIndexHandler pathforkFrontEndHandler
+
+func (h SeriesIndexHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	if err := h.tr.RenderPage(w, "series_index", pages.GetSeriesIndexPage(manager, h.db)); err != nil {
+		glog.Errorf("Error with SeriesIndex page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h SeriesIndexHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSeriesIndexHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SeriesIndexHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SeriesViewHandler pathforkFrontEndHandler
+
+func (h SeriesViewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	cvi := crudViewInput{
+		GetByIdFunc:     models.GetSeriesById,
+		GetViewPageFunc: pages.GetSeriesViewPage,
+		TemplateName:    "series_view",
+	}
+	HandleCrudView(r, w, h.db, h.tr, manager, cvi)
+}
+
+func (h SeriesViewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSeriesViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SeriesViewHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SeriesEditHandler pathforkFrontEndHandler
+
+func (h SeriesEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	params := crudEditInput{
+		GetByIdFunc:     models.GetSeriesById,
+		GetEditPageFunc: pages.GetSeriesEditPage,
+		TemplateName:    "series_edit",
+		SuccessRedirect: URLFor("series_view") + path.Base(r.URL.Path),
+		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
+			series := obj.(*models.Series)
+			series.Title = r.FormValue("title")
+			series.Blurb = r.FormValue("blurb")
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				return nil, err
+			}
+			if err := series.Save(tx); err != nil {
+				glog.Errorf("Error saving series on edit handler: %v", err.Error())
+				return nil, err
+			}
+			return series, tx.Commit()
+		},
+	}
+	HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+}
+
+func (h SeriesEditHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSeriesEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SeriesEditHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SeriesNewHandler pathforkFrontEndHandler
+
+func (h SeriesNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	params := crudCreateInput{
+		GetCreatePageFunc: pages.GetSeriesNewPage,
+		TemplateName:      "series_edit",
+		CreateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager) (db.Insertable, error) {
+			newSeries := &models.Series{
+				Title:     r.FormValue("title"),
+				Blurb:     r.FormValue("blurb"),
+				UserEmail: manager.GetUserEmail(),
+			}
+			tx, err := h.db.DB.Begin()
+			if err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			newSeries.Id, err = h.db.Insert(newSeries, tx)
+			if err != nil {
+				glog.Error(err.Error())
+				return nil, err
+			}
+			return newSeries, tx.Commit()
+		},
+	}
+	response := HandleCrudCreate(r, w, h.db, h.tr, manager, params)
+	if r.Method == "POST" && response.NewObj != nil {
+		newSeries := response.NewObj.(*models.Series)
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("series_view"), newSeries.Id), http.StatusFound)
+	}
+}
+
+func (h SeriesNewHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSeriesNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SeriesNewHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type SeriesDeleteHandler pathforkFrontEndHandler
+
+func (h SeriesDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetSeriesById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	series := response.Obj.(*models.Series)
+	form := forms.NewDeleteForm(series.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("series_view"), series.Id), http.StatusFound)
+		return
+	}
+	if success, err := models.DeleteSeries(series.Id, h.db); err != nil || !success {
+		glog.Error(err)
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("series_view"), series.Id), http.StatusFound)
+		return
+	}
+	manager.AddFlash("OK, that series is gone. Its works are still here.")
+	http.Redirect(w, r, URLFor("series_index"), http.StatusFound)
+}
+
+func (h SeriesDeleteHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSeriesDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SeriesDeleteHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// SeriesExportHandler is the whole series on one page, like a work's
+// export: each work in order, then the bible and the word counts
+type SeriesExportHandler pathforkFrontEndHandler
+
+func (h SeriesExportHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetSeriesById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	series := response.Obj.(*models.Series)
+	if err := h.tr.RenderPage(w, "series_export", pages.GetSeriesExportPage(manager, series)); err != nil {
+		glog.Error(err.Error())
+		manager.AddFlash("Sorry, something went wrong exporting that.")
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("series_view"), series.Id), http.StatusFound)
+	}
+}
+
+func (h SeriesExportHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildSeriesExportHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return SeriesExportHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -1,9 +1,9 @@
 package pathfork
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"path"
 	"strconv"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
@@ -11,10 +11,26 @@ import (
 	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/pages"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
 	"github.com/golang/glog"
 	"github.com/gorilla/sessions"
 )
 
+// setSettingParent puts the setting inside the place picked on the form,
+// as long as that's one of the user's settings and doesn't make a cycle
+func setSettingParent(setting *models.Setting, r *http.Request, page pages.WebPage, database *db.DB) error {
+	parentId, _ := strconv.Atoi(r.FormValue("parent"))
+	parents := models.SettingParents(models.GetSettingsForUser(setting.UserEmail, database))
+	if err := models.CheckSettingParent(setting.Id, parentId, parents); err != nil {
+		glog.Errorf("Bad setting parent: %v", err.Error())
+		formErr := errors.New("A place can't be inside itself, or inside somewhere that's inside it.")
+		page.Form.Fields["parent"].(*forms.SelectField).Error = formErr
+		return formErr
+	}
+	setting.ParentId = parentId
+	return nil
+}
+
 type SettingViewHandler pathforkFrontEndHandler
 
 func (h SettingViewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
@@ -31,7 +47,7 @@ func (h SettingViewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSettingViewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSettingViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SettingViewHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -49,39 +65,57 @@ type SettingEditHandler pathforkFrontEndHandler
 
 func (h SettingEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
+	oldName := ""
 	params := crudEditInput{
 		GetByIdFunc:     models.GetSettingById,
 		GetEditPageFunc: pages.GetSettingEditPage,
 		TemplateName:    "setting_edit",
-		SuccessRedirect: func() string {
-			id := path.Base(r.URL.Path)
-			return URLFor("setting_view") + id
-		}(),
 		UpdateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager, obj db.Updatable) (db.Insertable, error) {
 			setting := obj.(*models.Setting)
+			oldName = setting.Name
 			setting.Name = r.FormValue("name")
 			setting.Blurb = r.FormValue("blurb")
 			setting.Body = r.FormValue("body")
+			if err := setSettingParent(setting, r, page, h.db); err != nil {
+				return nil, err
+			}
+			values, err := readCustomFields(r, page, manager.GetUserEmail(), h.db)
+			if err != nil {
+				return nil, err
+			}
 			tx, err := h.db.DB.Begin()
 			if err == nil {
 				if err := setting.Save(tx); err != nil {
 					glog.Errorf("Error saving setting on edit handler: %v", err.Error())
 					return nil, err
 				}
+				if err := models.SaveFieldValues(h.db, tx, "setting", setting.Id, values); err != nil {
+					glog.Errorf("Error saving setting fields on edit handler: %v", err.Error())
+					return nil, err
+				}
+				if oldName != setting.Name {
+					if err := models.RecordAlias(h.db, tx, "setting", setting.Id, oldName, setting.Name); err != nil {
+						glog.Errorf("Error saving setting alias on edit handler: %v", err.Error())
+						return nil, err
+					}
+				}
 				tx.Commit()
 				return setting, nil
 			}
 			return nil, err
 		},
 	}
-	HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+	output := HandleCrudEdit(r, w, h.db, h.tr, manager, params)
+	if setting, ok := output.Obj.(*models.Setting); ok {
+		redirectAfterEdit(w, r, "setting", setting.Id, oldName, setting.Name)
+	}
 }
 
 func (h SettingEditHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSettingEditHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSettingEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SettingEditHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -102,7 +136,7 @@ func (h SettingNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 	manager := sessionManager.New(r, w, h.sessionStore)
 	params := crudCreateInput{
 		GetCreatePageFunc: pages.GetSettingNewPage,
-		CreateFuncArgs:    []string{workId},
+		CreateFuncArgs:    []string{workId, utils.GetQueryArg(r, "parentId")},
 		TemplateName:      "setting_edit",
 		SuccessRedirect: func() string {
 			if workId == "0" {
@@ -117,11 +151,21 @@ func (h SettingNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 			newSetting.Blurb = r.FormValue("blurb")
 			newSetting.Body = r.FormValue("body")
 			newSetting.UserEmail = manager.GetUserEmail()
+			if err := setSettingParent(newSetting, r, page, h.db); err != nil {
+				return nil, err
+			}
+			values, err := readCustomFields(r, page, newSetting.UserEmail, h.db)
+			if err != nil {
+				return nil, err
+			}
 			workId, _ := strconv.Atoi(workId)
 			tx, err := h.db.DB.Begin()
 			if err == nil {
 				newId, err := h.db.Insert(newSetting, tx)
-				if workId != 0 {
+				if err == nil {
+					err = models.SaveFieldValues(h.db, tx, "setting", newId, values)
+				}
+				if err == nil && workId != 0 {
 					err = models.UpdateWorksSettingsRelations(h.db, tx, workId, []int{newId}, []int{})
 					if err != nil {
 						return nil, err
@@ -144,7 +188,7 @@ func (h SettingNewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSettingNewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSettingNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SettingNewHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -163,7 +207,11 @@ type SettingIndexHandler pathforkFrontEndHandler
 func (h SettingIndexHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
 	settings := models.GetSettingsForUser(manager.GetUserEmail(), h.db)
-	page := pages.GetSettingIndexPage(manager, settings)
+	if err := models.FillSettingSectionCounts(manager.GetUserEmail(), settings, h.db); err != nil {
+		glog.Errorf("Error counting sections for settings index: %v", err.Error())
+	}
+	fieldId, _ := strconv.Atoi(utils.GetQueryArg(r, "field"))
+	page := pages.GetSettingIndexPage(manager, h.db, settings, fieldId, utils.GetQueryArg(r, "value"))
 	if err := h.tr.RenderPage(w, "setting_index", page); err != nil {
 		glog.Errorf("Error with SettingsIndex page render: %v", err.Error())
 		http.Redirect(w, r, URLFor("dashboard"), 302)
@@ -174,7 +222,7 @@ func (h SettingIndexHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSettingIndexHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSettingIndexHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SettingIndexHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -205,9 +253,15 @@ func (h SettingDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Reque
 	form.Populate(r)
 	if r.Method == "POST" {
 		if form.Validate() {
-			idToDelete, _ := strconv.Atoi(r.FormValue("object_id"))
-			success, err := models.DeleteSetting(idToDelete, h.db)
-			if err != nil || !success {
+			tx, err := h.db.DB.Begin()
+			if err == nil {
+				if err = models.TrashSetting(h.db, tx, setting.Id); err == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+			}
+			if err != nil && err != models.ErrAlreadyTrashed {
 				glog.Error(err)
 				http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("setting_view"), setting.Id), 301)
 				return
@@ -217,7 +271,7 @@ func (h SettingDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Reque
 			return
 		}
 	}
-	manager.AddFlash("That setting's gone. It was a bad neighborhood anyway.")
+	manager.AddFlash("That setting's in the trash. It was a bad neighborhood anyway.")
 	http.Redirect(w, r, URLFor("setting_index"), 301)
 }
 
@@ -225,7 +279,7 @@ func (h SettingDeleteHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildSettingDeleteHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildSettingDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return SettingDeleteHandler{
 		tr:           tr,
 		methods:      []string{"POST"},
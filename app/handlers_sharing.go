@@ -0,0 +1,350 @@
+package pathfork
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/auth"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/sessionStore"
+	"bitbucket.org/jtyburke/pathfork/app/throttle"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+	"github.com/lib/pq"
+)
+
+// WorkShareHandler makes a new share link for a work, from the form on the
+// work's page
+type WorkShareHandler pathforkFrontEndHandler
+
+func (h WorkShareHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleOwner)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	work := response.Obj.(*models.Work)
+	redirect := fmt.Sprintf("%v%v", URLFor("work_view"), work.Id)
+	sections, _ := models.GetSectionsForWork(work.Id, h.db)
+	flat := models.FlattenSectionTree(sections)
+	form := forms.NewShareLinkForm(forms.SectionsToFormOptions(flat), manager)
+	form.Populate(r)
+	if !form.Validate() {
+		manager.AddFlash("Sorry, that share link couldn't be made. Give it a name, and check the date.")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	link := &models.ShareLink{
+		WorkId:    work.Id,
+		Name:      r.FormValue("name"),
+		UserEmail: manager.GetUserEmail(),
+	}
+	// only the work's own sections can be shared through it
+	inWork := map[int]bool{}
+	for _, section := range flat {
+		inWork[section.Id] = true
+	}
+	sectionIds, _ := utils.StringsToInts(r.Form["sections"])
+	for _, id := range sectionIds {
+		if inWork[id] {
+			link.SectionIds = append(link.SectionIds, id)
+		}
+	}
+	// none at all would share the whole work, which isn't what was asked for
+	if len(r.Form["sections"]) > 0 && len(link.SectionIds) == 0 {
+		manager.AddFlash("Sorry, those sections aren't in this work any more. Pick them again and try.")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	if expires := r.FormValue("expires"); expires != "" {
+		day, err := time.Parse("2006-01-02", expires)
+		if err == nil {
+			// good through the end of the day it expires on
+			link.ExpiresAt = pq.NullTime{Time: day.AddDate(0, 0, 1), Valid: true}
+		}
+	}
+	if password := r.FormValue("password"); password != "" {
+		hash, err := auth.HashPassword(password)
+		if err != nil {
+			glog.Errorf("Error hashing share link password: %v", err.Error())
+			manager.AddFlash("Sorry, something went wrong making that link.")
+			http.Redirect(w, r, redirect, http.StatusFound)
+			return
+		}
+		link.PasswordHash = hash
+	}
+	if err := h.insertShareLink(link); err != nil {
+		glog.Errorf("Error making share link: %v", err.Error())
+		manager.AddFlash("Sorry, something went wrong making that link.")
+	} else {
+		manager.AddFlash(fmt.Sprintf("OK, there's a new link for %v below.", link.Name))
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h WorkShareHandler) insertShareLink(link *models.ShareLink) error {
+	tx, err := h.db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	link.Id, err = h.db.Insert(link, tx)
+	if err != nil {
+		return err
+	}
+	if err := models.SetShareLinkToken(h.db, tx, link); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h WorkShareHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkShareHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkShareHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// ShareRevokeHandler deletes a share link, after which its token is no good
+type ShareRevokeHandler pathforkFrontEndHandler
+
+func (h ShareRevokeHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetShareLinkById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	link := response.Obj.(*models.ShareLink)
+	redirect := fmt.Sprintf("%v%v", URLFor("work_view"), link.WorkId)
+	form := forms.NewDeleteForm(link.Id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	if success, err := models.DeleteShareLink(link.Id, h.db); err != nil || !success {
+		glog.Error(err)
+		manager.AddFlash("Sorry, that link couldn't be revoked.")
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	manager.AddFlash(fmt.Sprintf("OK, the link for %v doesn't work anymore.", link.Name))
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h ShareRevokeHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildShareRevokeHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ShareRevokeHandler{
+		tr:           tr,
+		methods:      []string{"POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+// ShareReadHandler is the public, read-only view of a shared work, found by
+// the ?token= of its link. Password guesses are throttled like logins, per
+// link and per IP.
+type ShareReadHandler struct {
+	pathforkFrontEndHandler
+	guard throttle.Guard
+}
+
+func (h ShareReadHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	token := utils.GetQueryArg(r, "token")
+	link := models.GetShareLinkByToken(token, h.db)
+	var work *models.Work
+	if link != nil {
+		work, _ = models.GetWorkById(link.WorkId, h.db).(*models.Work)
+	}
+	if link == nil || work == nil {
+		h.render(w, r, pages.GetShareReadPage(manager, nil, nil, nil, false))
+		return
+	}
+	needPassword := link.HasPassword() && !manager.ShareLinkUnlocked(link.Id)
+	if needPassword && r.Method == "POST" {
+		if h.unlock(manager, link, r) {
+			manager.UnlockShareLink(link.Id)
+		}
+		http.Redirect(w, r, fmt.Sprintf("%v?token=%v", URLFor("share_read"), token), http.StatusFound)
+		return
+	}
+	if needPassword {
+		h.render(w, r, pages.GetShareReadPage(manager, link, work, nil, true))
+		return
+	}
+	sections, _ := models.GetSectionDetailForExport(work.Id, h.db)
+	page := pages.GetShareReadPage(manager, link, work, link.Sections(sections), false)
+	showShareImages(&page, token, sharedImageIds(link, page.SectionsList, h.db))
+	h.render(w, r, page)
+}
+
+// unlock checks the reader's password for link, flashing why not if it
+// won't do
+func (h ShareReadHandler) unlock(manager sessionManager.SessionManager, link *models.ShareLink, r *http.Request) bool {
+	key := fmt.Sprintf("share-link:%v", link.Id)
+	ip := sessionStore.ClientIP(r)
+	now := time.Now()
+	wait, err := h.guard.Wait(key, ip, now)
+	if err != nil {
+		glog.Errorf("Share link throttle error: %v", err.Error())
+	} else if wait > 0 {
+		manager.AddFlash(fmt.Sprintf("Too many wrong passwords. Please wait %v and try again.", (wait + time.Second - 1).Truncate(time.Second)))
+		return false
+	}
+	if link.CheckPassword(r.FormValue("password")) {
+		if err := h.guard.Succeed(key); err != nil {
+			glog.Errorf("Share link throttle error: %v", err.Error())
+		}
+		return true
+	}
+	glog.Warningf("Wrong password for share link %v from %v", link.Id, ip)
+	if _, err := h.guard.Fail(key, ip, now); err != nil {
+		glog.Errorf("Share link throttle error: %v", err.Error())
+	}
+	manager.AddFlash("Sorry, that's not the password.")
+	return false
+}
+
+func (h ShareReadHandler) render(w http.ResponseWriter, r *http.Request, page pages.WebPage) {
+	if err := h.tr.RenderPage(w, "share_read", page); err != nil {
+		glog.Errorf("Error with ShareRead page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("home"), http.StatusFound)
+	}
+}
+
+func (h ShareReadHandler) Methods() []string {
+	return h.methods
+}
+
+// sharedImageIds is the pictures a link's readers can see: the work's, and
+// those of the sections it shares
+func sharedImageIds(link *models.ShareLink, sections []*models.Section, database *db.DB) map[int]bool {
+	ids := map[int]bool{}
+	images := models.GetImagesFor("work", link.WorkId, database)
+	for _, section := range sections {
+		images = append(images, models.GetImagesFor("section", section.Id, database)...)
+	}
+	for _, image := range images {
+		ids[image.Id] = true
+	}
+	return ids
+}
+
+// shareImageURL is where a link's readers get one of its pictures
+func shareImageURL(token string, id int) string {
+	return fmt.Sprintf("%v%v?token=%v", URLFor("share_image"), id, url.QueryEscape(token))
+}
+
+// showShareImages points the pictures in the shared sections, and the
+// work's cover, at shareImageURL. Ones that aren't shared are left as they
+// are.
+func showShareImages(page *pages.WebPage, token string, shared map[int]bool) {
+	prefix := URLFor("image_view")
+	src := func(id int) (string, bool) {
+		if !shared[id] {
+			return "", false
+		}
+		return shareImageURL(token, id), true
+	}
+	for _, section := range page.SectionsList {
+		section.Body = models.ReplaceImageSources(section.Body, prefix, src)
+	}
+	page.ExportImages = map[string]template.URL{}
+	if covers := models.GetImagesFor("work", page.Work.Id, page.Work.DB); len(covers) > 0 {
+		page.ExportImages["work"] = template.URL(shareImageURL(token, covers[0].Id))
+	}
+}
+
+func BuildShareReadHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ShareReadHandler{
+		pathforkFrontEndHandler: pathforkFrontEndHandler{
+			tr:           tr,
+			methods:      []string{"GET", "POST"},
+			db:           db,
+			sessionStore: store,
+		},
+		guard: throttle.NewGuard(throttle.NewPGLimiter(db)),
+	}
+}
+
+/*
+.
+.
+*/
+
+// ShareImageHandler sends a shared work's pictures to its link's readers,
+// who aren't logged in to see them at image_view
+type ShareImageHandler pathforkFrontEndHandler
+
+func (h ShareImageHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	link := models.GetShareLinkByToken(utils.GetQueryArg(r, "token"), h.db)
+	if link == nil || (link.HasPassword() && !manager.ShareLinkUnlocked(link.Id)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(path.Base(r.URL.Path))
+	image, ok := models.GetImageById(id, h.db).(*models.Image)
+	if err != nil || !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	sections, _ := models.GetSectionDetailForExport(link.WorkId, h.db)
+	if !sharedImageIds(link, link.Sections(sections), h.db)[image.Id] {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	writeImage(w, image, false)
+}
+
+func (h ShareImageHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildShareImageHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return ShareImageHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -3,13 +3,18 @@ package pathfork
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"bitbucket.org/jtyburke/pathfork/app/auth"
 	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
 	"github.com/gorilla/sessions"
 )
 
-func getTestVars() (*httptest.ResponseRecorder, *TemplateRenderer, *db.DB, *sessions.CookieStore) {
+func getTestVars() (*httptest.ResponseRecorder, *TemplateRenderer, *db.DB, sessions.Store) {
 	rr := httptest.NewRecorder()
 	tr := NewTemplateRenderer()
 	db := db.New()
@@ -78,3 +83,70 @@ func TestAuthHandler(t *testing.T) {
 			status, http.StatusFound)
 	}
 }
+
+func TestFeedbackDigestInterval(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":    defaultFeedbackDigestInterval,
+		"12h": 12 * time.Hour,
+		"0":   0,
+	}
+	for raw, want := range tests {
+		got, err := feedbackDigestInterval(func(string) string { return raw })
+		if err != nil || got != want {
+			t.Errorf("%q: got %v, %v", raw, got, err)
+		}
+	}
+	if _, err := feedbackDigestInterval(func(string) string { return "daily" }); err == nil {
+		t.Error("Expected an error for a bad interval")
+	}
+}
+
+func TestTrashRetention(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     defaultTrashRetention,
+		"168h": 7 * 24 * time.Hour,
+		"0":    0,
+	}
+	for raw, want := range tests {
+		got, err := trashRetention(func(string) string { return raw })
+		if err != nil || got != want {
+			t.Errorf("%q: got %v, %v", raw, got, err)
+		}
+	}
+	if _, err := trashRetention(func(string) string { return "a month" }); err == nil {
+		t.Error("Expected an error for a bad retention")
+	}
+}
+
+func TestTwoFactorEnableClock(t *testing.T) {
+	_, tr, database, store := getTestVars()
+	// nothing listens here, so a code that matches stops at the database
+	database.Open("postgres://nobody@127.0.0.1:1/none?sslmode=disable&connect_timeout=1")
+	h := TwoFactorSetupHandler{tr: tr, db: database, sessionStore: store}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	code, err := auth.TOTPCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := func(now time.Time) bool {
+		req, _ := http.NewRequest("POST", URLFor("two_factor_setup"), nil)
+		manager := sessionManager.New(req, httptest.NewRecorder(), store)
+		h.enable(manager, &models.User{Email: "someone@example.com"}, secret, code, now)
+		for _, flash := range manager.Session.Flashes() {
+			if strings.Contains(flash.(string), "didn't match") {
+				return true
+			}
+		}
+		return false
+	}
+	if mismatched(at) {
+		t.Error("A code for the time enabling is checked at didn't match")
+	}
+	if !mismatched(at.Add(time.Hour)) {
+		t.Error("A code from an hour before matched")
+	}
+}
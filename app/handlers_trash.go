@@ -0,0 +1,73 @@
+package pathfork
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/pages"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// TrashHandler lists the user's trash, and restores whatever's POSTed with
+// its entity and object_id
+type TrashHandler pathforkFrontEndHandler
+
+func (h TrashHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	if r.Method == "POST" {
+		id, _ := strconv.Atoi(r.FormValue("object_id"))
+		form := forms.NewDeleteForm(id, manager)
+		form.Populate(r)
+		if !form.Validate() {
+			manager.AddFlash("Sorry, that form expired. Please try again.")
+			http.Redirect(w, r, URLFor("trash"), http.StatusFound)
+			return
+		}
+		entity := r.FormValue("entity")
+		item, ok := models.GetTrashedItem(entity, id, h.db).(*models.TrashedItem)
+		if !ok || !item.VerifyPermission(manager) {
+			manager.AddFlash("Sorry, we couldn't find that.")
+			http.Redirect(w, r, URLFor("trash"), http.StatusFound)
+			return
+		}
+		tx, err := h.db.DB.Begin()
+		if err == nil {
+			if err = models.RestoreTrashedItem(h.db, tx, item); err == nil {
+				err = tx.Commit()
+			}
+		}
+		if err != nil {
+			glog.Errorf("Error restoring %v %v: %v", entity, id, err.Error())
+			manager.AddFlash("Looks like there was a database error restoring that.")
+			http.Redirect(w, r, URLFor("trash"), http.StatusFound)
+			return
+		}
+		manager.AddFlash(fmt.Sprintf("%v is back where it was.", item.Title))
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor(entity+"_view"), id), http.StatusFound)
+		return
+	}
+	page := pages.GetTrashPage(manager, models.GetTrashForUser(manager.GetUserEmail(), h.db), trashRetentionTime)
+	if err := h.tr.RenderPage(w, "trash", page); err != nil {
+		glog.Errorf("Error with Trash page render: %v", err.Error())
+		http.Redirect(w, r, URLFor("dashboard"), http.StatusFound)
+	}
+}
+
+func (h TrashHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildTrashHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return TrashHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
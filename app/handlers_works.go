@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/forms"
@@ -20,10 +23,13 @@ type WorkViewHandler pathforkFrontEndHandler
 
 func (h WorkViewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
+	status := utils.GetQueryArg(r, "status")
 	cvi := crudViewInput{
-		GetByIdFunc:     models.GetWorkById,
-		GetViewPageFunc: pages.GetWorkViewPage,
-		TemplateName:    "work_view",
+		GetByIdFunc: models.GetWorkById,
+		GetViewPageFunc: func(sm sessionManager.SessionManager, verifiable interface{}) pages.WebPage {
+			return pages.GetWorkViewPage(sm, verifiable, status)
+		},
+		TemplateName: "work_view",
 	}
 	HandleCrudView(r, w, h.db, h.tr, manager, cvi)
 }
@@ -32,7 +38,7 @@ func (h WorkViewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildWorkViewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildWorkViewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return WorkViewHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -46,6 +52,28 @@ func BuildWorkViewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.Cooki
 .
 */
 
+// setWorkMetadata copies the publishing details from a work form that's
+// already been validated. A series that isn't the work's owner's is
+// ignored.
+func setWorkMetadata(work *models.Work, r *http.Request, database *db.DB) {
+	work.Subtitle = strings.TrimSpace(r.FormValue("subtitle"))
+	work.Author = strings.TrimSpace(r.FormValue("author"))
+	work.SeriesId, _ = strconv.Atoi(r.FormValue("series"))
+	if work.SeriesId != 0 {
+		series, ok := models.GetSeriesById(work.SeriesId, database).(*models.Series)
+		if !ok || series.UserEmail != work.UserEmail {
+			work.SeriesId = 0
+		}
+	}
+	work.SeriesNumber, _ = strconv.ParseFloat(r.FormValue("seriesNumber"), 64)
+	work.Language = strings.TrimSpace(r.FormValue("language"))
+	work.ISBN, _ = models.NormalizeISBN(r.FormValue("isbn"))
+	work.CopyrightYear, _ = strconv.Atoi(r.FormValue("copyrightYear"))
+	work.Dedication = r.FormValue("dedication")
+	work.Acknowledgements = r.FormValue("acknowledgements")
+	work.AboutAuthor = r.FormValue("aboutAuthor")
+}
+
 type WorkEditHandler pathforkFrontEndHandler
 
 func (h WorkEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
@@ -62,6 +90,8 @@ func (h WorkEditHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 			work := obj.(*models.Work)
 			work.Title = r.FormValue("title")
 			work.Blurb = r.FormValue("blurb")
+			work.Statuses = models.ParseStatuses(r.FormValue("statuses"))
+			setWorkMetadata(work, r, h.db)
 			charsToInsert, charsToDelete, err := forms.GetRelationUpdateIds(
 				r, "currentCharIds", "characters",
 			)
@@ -99,7 +129,7 @@ func (h WorkEditHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildWorkEditHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildWorkEditHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return WorkEditHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -119,13 +149,15 @@ func (h WorkNewHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
 	params := crudCreateInput{
 		GetCreatePageFunc: pages.GetWorkNewPage,
-		CreateFuncArgs:    nil,
+		CreateFuncArgs:    []string{utils.GetQueryArg(r, "seriesId")},
 		TemplateName:      "work_edit",
 		CreateObjFunc: func(r *http.Request, page pages.WebPage, sm sessionManager.SessionManager) (db.Insertable, error) {
 			newWork := &models.Work{}
 			newWork.Title = r.FormValue("title")
 			newWork.Blurb = r.FormValue("blurb")
+			newWork.Statuses = models.ParseStatuses(r.FormValue("statuses"))
 			newWork.UserEmail = manager.GetUserEmail()
+			setWorkMetadata(newWork, r, h.db)
 			tx, err := h.db.DB.Begin()
 			if err != nil {
 				glog.Error(err.Error())
@@ -152,7 +184,7 @@ func (h WorkNewHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildWorkNewHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildWorkNewHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return WorkNewHandler{
 		tr:           tr,
 		methods:      []string{"GET", "POST"},
@@ -170,7 +202,7 @@ type WorkDeleteHandler pathforkFrontEndHandler
 
 func (h WorkDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	manager := sessionManager.New(r, w, h.sessionStore)
-	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById)
+	response := requireRole(getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById), manager, models.RoleOwner)
 	if response.RedirectCode != 0 {
 		if response.FlashMsg != "" {
 			manager.AddFlash(response.FlashMsg)
@@ -183,9 +215,15 @@ func (h WorkDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 	form.Populate(r)
 	if r.Method == "POST" {
 		if form.Validate() {
-			idToDelete, _ := strconv.Atoi(r.FormValue("object_id"))
-			success, err := models.DeleteWork(idToDelete, h.db)
-			if err != nil || !success {
+			tx, err := h.db.DB.Begin()
+			if err == nil {
+				if err = models.TrashWork(h.db, tx, work.Id); err == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+			}
+			if err != nil && err != models.ErrAlreadyTrashed {
 				glog.Error(err)
 				http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), work.Id), 301)
 				return
@@ -196,7 +234,7 @@ func (h WorkDeleteHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 			return
 		}
 	}
-	manager.AddFlash("That work is no more.")
+	manager.AddFlash("That work is in the trash now, if you change your mind.")
 	http.Redirect(w, r, URLFor("dashboard"), 301)
 }
 
@@ -204,7 +242,7 @@ func (h WorkDeleteHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildWorkDeleteHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildWorkDeleteHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return WorkDeleteHandler{
 		tr:           tr,
 		methods:      []string{"POST"},
@@ -218,6 +256,23 @@ func BuildWorkDeleteHandler(tr *TemplateRenderer, db *db.DB, store *sessions.Coo
 .
 */
 
+// exportFilename makes a work's title safe to download as, keeping ASCII
+// letters and digits and turning everything else into dashes
+func exportFilename(title string) string {
+	name := strings.Trim(strings.Map(func(c rune) rune {
+		if c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_') {
+			return c
+		}
+		return '-'
+	}, title), "-")
+	if name == "" {
+		return "work"
+	}
+	return name
+}
+
+// WorkExportHandler renders the whole work as one HTML page, or with
+// ?format=epub as an e-book of its sections
 type WorkExportHandler pathforkFrontEndHandler
 
 func (h WorkExportHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
@@ -234,11 +289,18 @@ func (h WorkExportHandler) HandleRequest(w http.ResponseWriter, r *http.Request)
 	sections, snippets := models.GetSectionDetailForExport(work.Id, h.db)
 	settings := models.GetSettingsForWorkExport(work.Id, h.db)
 	characters := models.GetCharactersForWorkExport(work.Id, h.db)
-	err := h.tr.RenderPage(
-		w, "work_export", pages.GetWorkExportPage(
-			manager, work, sections, snippets, settings, characters,
-		),
-	)
+	if utils.GetQueryArg(r, "format") == "epub" {
+		w.Header().Set("Content-Type", "application/epub+zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.epub"`, exportFilename(work.Title)))
+		if err := models.WriteEPUB(w, buildWorkEPUB(work, sections, h.db)); err != nil {
+			glog.Errorf("Error writing EPUB: %v", err.Error())
+		}
+		return
+	}
+	page := pages.GetWorkExportPage(manager, work, sections, snippets, settings, characters)
+	page.CharacterTable, page.SettingTable = models.GetFieldTablesForWork(work, characters, settings, h.db)
+	embedInHTMLExport(&page, h.db)
+	err := h.tr.RenderPage(w, "work_export", page)
 	if err != nil {
 		glog.Error(err.Error())
 		manager.AddFlash("Sorry, something went wrong exporting that.")
@@ -250,7 +312,7 @@ func (h WorkExportHandler) Methods() []string {
 	return h.methods
 }
 
-func BuildWorkExportHandler(tr *TemplateRenderer, db *db.DB, store *sessions.CookieStore) FrontEndHandler {
+func BuildWorkExportHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
 	return WorkExportHandler{
 		tr:           tr,
 		methods:      []string{"GET"},
@@ -258,3 +320,120 @@ func BuildWorkExportHandler(tr *TemplateRenderer, db *db.DB, store *sessions.Coo
 		sessionStore: store,
 	}
 }
+
+/*
+.
+.
+*/
+
+// WorkBoardHandler shows a work's sections as cards in columns by status.
+// Cards are moved by POSTing the section's object_id and its new status.
+type WorkBoardHandler pathforkFrontEndHandler
+
+func (h WorkBoardHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	response := getCrudStarterResponse(r, w, h.db, manager, models.GetWorkById)
+	if response.RedirectCode != 0 {
+		if response.FlashMsg != "" {
+			manager.AddFlash(response.FlashMsg)
+		}
+		http.Redirect(w, r, URLFor("dashboard"), response.RedirectCode)
+		return
+	}
+	work := response.Obj.(*models.Work)
+	if r.Method == "POST" {
+		status, msg := http.StatusForbidden, "Sorry, you're not allowed to do that."
+		if models.HasRole(work, manager, models.RoleEditor) {
+			status, msg = h.moveSection(r, manager, work)
+		}
+		if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+			if status != http.StatusOK {
+				http.Error(w, msg, status)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if status != http.StatusOK {
+			manager.AddFlash(msg)
+		}
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_board"), work.Id), http.StatusFound)
+		return
+	}
+	if err := h.tr.RenderPage(w, "work_board", pages.GetWorkBoardPage(manager, h.db, work)); err != nil {
+		glog.Error(err.Error())
+		http.Redirect(w, r, fmt.Sprintf("%v%v", URLFor("work_view"), work.Id), http.StatusFound)
+	}
+}
+
+func (h WorkBoardHandler) moveSection(r *http.Request, manager sessionManager.SessionManager, work *models.Work) (int, string) {
+	id, _ := strconv.Atoi(r.FormValue("object_id"))
+	form := forms.NewDeleteForm(id, manager)
+	form.Populate(r)
+	if !form.Validate() {
+		return http.StatusForbidden, "Sorry, that form expired. Please reload the page."
+	}
+	sectionInt := models.GetSectionById(id, h.db)
+	if sectionInt == nil || !sectionInt.VerifyPermission(manager) {
+		return http.StatusNotFound, "Sorry, we couldn't find that section."
+	}
+	section := sectionInt.(*models.Section)
+	status := r.FormValue("status")
+	if section.WorkId != work.Id || !work.HasStatus(status) {
+		return http.StatusBadRequest, "Sorry, that section can't go there."
+	}
+	tx, err := h.db.DB.Begin()
+	if err == nil {
+		if err = models.SetSectionStatus(h.db, tx, section, status, manager.GetUserEmail(), time.Now()); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error setting section status: %v", err.Error())
+		return http.StatusInternalServerError, "Looks like there was a database error moving that section."
+	}
+	return http.StatusOK, ""
+}
+
+func (h WorkBoardHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkBoardHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkBoardHandler{
+		tr:           tr,
+		methods:      []string{"GET", "POST"},
+		db:           db,
+		sessionStore: store,
+	}
+}
+
+/*
+.
+.
+*/
+
+type WorkChronologyHandler pathforkFrontEndHandler
+
+func (h WorkChronologyHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
+	manager := sessionManager.New(r, w, h.sessionStore)
+	cvi := crudViewInput{
+		GetByIdFunc:     models.GetWorkById,
+		GetViewPageFunc: pages.GetWorkChronologyPage,
+		TemplateName:    "work_chronology",
+	}
+	HandleCrudView(r, w, h.db, h.tr, manager, cvi)
+}
+
+func (h WorkChronologyHandler) Methods() []string {
+	return h.methods
+}
+
+func BuildWorkChronologyHandler(tr *TemplateRenderer, db *db.DB, store sessions.Store) FrontEndHandler {
+	return WorkChronologyHandler{
+		tr:           tr,
+		methods:      []string{"GET"},
+		db:           db,
+		sessionStore: store,
+	}
+}
@@ -1,14 +1,30 @@
 package pathfork
 
 import (
+	"os"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/collab"
 	"bitbucket.org/jtyburke/pathfork/app/config"
 	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionStore"
+	"bitbucket.org/jtyburke/pathfork/app/storage"
+	"bitbucket.org/jtyburke/pathfork/app/throttle"
 
 	"github.com/golang/glog"
-	"github.com/gorilla/sessions"
 )
 
-func InitApp() (*TemplateRenderer, *db.DB, *sessions.CookieStore) {
+const sessionPurgeInterval = time.Hour
+
+// collabSaveInterval is how often sections being edited together are
+// written back, besides when the last editor leaves
+const collabSaveInterval = 30 * time.Second
+
+// loginAttemptMaxAge should be at least as long as any throttle.Policy's
+// ForgetAfter
+const loginAttemptMaxAge = 24 * time.Hour
+
+func InitApp() (*TemplateRenderer, *db.DB, *sessionStore.PGStore) {
 	glog.Info("Caching templates")
 	tr := NewTemplateRenderer()
 	glog.Info("Loading routes")
@@ -16,6 +32,29 @@ func InitApp() (*TemplateRenderer, *db.DB, *sessions.CookieStore) {
 	glog.Info("Opening database connection")
 	db := db.New()
 	db.Open(config.PostgresUrl)
-	store := sessions.NewCookieStore([]byte(config.SessionSecretKey))
+	store := sessionStore.New(db, sessionStore.DefaultPolicy, []byte(config.SessionSecretKey))
+	go store.PurgeEvery(sessionPurgeInterval)
+	go throttle.NewPGLimiter(db).PurgeEvery(sessionPurgeInterval, loginAttemptMaxAge)
+	glog.Info("Opening upload storage")
+	images, err := storage.FromEnv(os.Getenv)
+	if err != nil {
+		glog.Fatalf("Can't store uploads: %v", err.Error())
+	}
+	imageStore = images
+	collabHub = collab.NewHub(collabSectionStore{db: db})
+	go collabHub.SaveEvery(collabSaveInterval)
+	digestInterval, err := feedbackDigestInterval(os.Getenv)
+	if err != nil {
+		glog.Fatalf("Bad feedback digest interval: %v", err.Error())
+	}
+	if digestInterval > 0 {
+		go sendFeedbackDigestsEvery(digestInterval, db)
+	}
+	if trashRetentionTime, err = trashRetention(os.Getenv); err != nil {
+		glog.Fatalf("Bad trash retention: %v", err.Error())
+	}
+	if trashRetentionTime > 0 {
+		go purgeTrashEvery(sessionPurgeInterval, trashRetentionTime, db)
+	}
 	return tr, db, store
 }
@@ -2,6 +2,7 @@ package messages
 
 import (
 	"fmt"
+	"strings"
 
 	"bitbucket.org/jtyburke/pathfork/app/auth"
 	"bitbucket.org/jtyburke/pathfork/app/config"
@@ -10,6 +11,9 @@ import (
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
+// siteURL is where links in emails point
+const siteURL = "https://pathfork.herokuapp.com"
+
 type email struct {
 	From    []string
 	To      []string
@@ -46,7 +50,7 @@ func SendVerificationEmail(recipient string) error {
 	to := []string{"New Pathfork user", recipient}
 	subject := "Please verify your new account with Pathfork"
 	token := auth.NewToken(recipient, "verify-email")
-	link := fmt.Sprintf("https://pathfork.herokuapp.com/auth?action=verify&token=%v", token) // FIXME argh hardcode url
+	link := fmt.Sprintf(siteURL+"/auth?action=verify&token=%v", token)
 	body := fmt.Sprintf("Please follow this link to verify your email address and activate your account: %v", link)
 	verificationEmail := email{
 		From:    from,
@@ -62,7 +66,7 @@ func SendResetPasswordEmail(recipient string) error {
 	to := []string{"Pathfork user", recipient}
 	subject := "Here's the link to reset your Pathfork password"
 	token := auth.NewTSToken(recipient, "reset-password")
-	link := fmt.Sprintf("https://pathfork.herokuapp.com/reset?action=reset&token=%v", token) // FIXME argh hardcode url
+	link := fmt.Sprintf(siteURL+"/reset?action=reset&token=%v", token)
 	body := fmt.Sprintf("Please follow this link to reset your password (this link will expire in 72 hours): %v", link)
 	verificationEmail := email{
 		From:    from,
@@ -73,6 +77,52 @@ func SendResetPasswordEmail(recipient string) error {
 	return verificationEmail.Send()
 }
 
+func SendChangeEmailEmail(oldEmail, newEmail string) error {
+	from := []string{"Pathfork App", "pathforkapp@gmail.com"}
+	to := []string{"Pathfork user", newEmail}
+	subject := "Please confirm your new email address with Pathfork"
+	token := auth.NewEmailChangeToken(oldEmail, newEmail)
+	link := fmt.Sprintf(siteURL+"/auth?action=change-email&token=%v", token)
+	body := fmt.Sprintf("Please follow this link to start using this address for your Pathfork account (this link will expire in 24 hours): %v", link)
+	changeEmail := email{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	}
+	return changeEmail.Send()
+}
+
+func SendEmailChangedEmail(oldEmail, newEmail string) error {
+	from := []string{"Pathfork App", "pathforkapp@gmail.com"}
+	to := []string{"Pathfork user", oldEmail}
+	subject := "Your Pathfork email address has changed"
+	body := fmt.Sprintf("Your Pathfork account now uses %v instead of this address. If you didn't do this, please reply to this email right away.", newEmail)
+	changedEmail := email{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	}
+	return changedEmail.Send()
+}
+
+func SendUnlockAccountEmail(recipient string) error {
+	from := []string{"Pathfork App", "pathforkapp@gmail.com"}
+	to := []string{"Pathfork user", recipient}
+	subject := "Your Pathfork account has been locked"
+	token := auth.NewTSToken(recipient, "unlock-account")
+	link := fmt.Sprintf(siteURL+"/auth?action=unlock&token=%v", token)
+	body := fmt.Sprintf("There have been too many failed attempts to log in to your account, so we've locked it for now. If that was you, follow this link to unlock it (this link will expire in 24 hours): %v\n\nIf it wasn't you, someone may be guessing your password; unlocking and then resetting your password is a good idea.", link)
+	unlockEmail := email{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	}
+	return unlockEmail.Send()
+}
+
 func SendContactFormEmail(emailFrom string, message string) error {
 	from := []string{"Pathfork user", "pathforkapp@gmail.com"}
 	to := []string{"Pathfork app", "pathforkapp@gmail.com"}
@@ -86,3 +136,65 @@ func SendContactFormEmail(emailFrom string, message string) error {
 	}
 	return contactEmail.Send()
 }
+
+// FeedbackItem is one reader's comment in a feedback digest. Link is the
+// path to the section it's on.
+type FeedbackItem struct {
+	Work    string
+	Section string
+	Reader  string
+	Quote   string
+	Comment string
+	Link    string
+}
+
+func SendFeedbackDigestEmail(recipient string, items []FeedbackItem) error {
+	from := []string{"Pathfork App", "pathforkapp@gmail.com"}
+	to := []string{"Pathfork user", recipient}
+	subject := fmt.Sprintf("You have %v new comments on Pathfork", len(items))
+	if len(items) == 1 {
+		subject = "You have a new comment on Pathfork"
+	}
+	body := "Here's what your readers have said since we last wrote:\n"
+	for _, item := range items {
+		link := siteURL + item.Link
+		body += fmt.Sprintf("\n%v, in %v: %v\n", item.Work, item.Section, link)
+		if item.Quote != "" {
+			body += fmt.Sprintf("  On \"%v\"\n", item.Quote)
+		}
+		body += fmt.Sprintf("  %v wrote: %v\n", item.Reader, item.Comment)
+	}
+	digestEmail := email{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	}
+	return digestEmail.Send()
+}
+
+// SendWorkInviteEmail asks someone to join a work. The link only works once
+// they're logged in with the address it went to.
+func SendWorkInviteEmail(recipient, inviter, workTitle, role, token string) error {
+	from := []string{"Pathfork App", "pathforkapp@gmail.com"}
+	to := []string{"Pathfork user", recipient}
+	subject := fmt.Sprintf("%v has invited you to %v on Pathfork", inviter, workTitle)
+	link := fmt.Sprintf(siteURL+"/invite?token=%v", token)
+	body := fmt.Sprintf("%v would like you to join %v as %v %v. "+
+		"Log in or sign up with this email address, then follow this link to accept: %v",
+		inviter, workTitle, article(role), role, link)
+	inviteEmail := email{
+		From:    from,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	}
+	return inviteEmail.Send()
+}
+
+func article(word string) string {
+	if word != "" && strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an"
+	}
+	return "a"
+}
@@ -71,7 +71,7 @@ type characterDetailQuery struct {
 }
 
 func (q characterDetailQuery) GetQueryStr() string {
-	return characterDetailColumnStr + " WHERE character_id=$1"
+	return characterDetailColumnStr + " WHERE character_id=$1 AND deleted_at IS NULL"
 }
 
 func (q characterDetailQuery) GetQueryArgs() []interface{} {
@@ -144,6 +144,10 @@ func GetCharactersForSection(sectionId int, database *db.DB) []*Character {
 	return getCharactersForLeft("section", sectionId, database, "list")
 }
 
+func GetCharactersForEvent(eventId int, database *db.DB) []*Character {
+	return getCharactersForLeft("event", eventId, database, "list")
+}
+
 func GetCharactersForUser(userEmail string, database *db.DB) []*Character {
 	query := charactersForUserQuery{UserEmail: userEmail}
 	charactersInt, err := database.Query(query)
@@ -163,7 +167,7 @@ type charactersForUserQuery struct {
 }
 
 func (q charactersForUserQuery) GetQueryStr() string {
-	return characterListColumnStr + " WHERE user_email=$1 ORDER BY name"
+	return characterListColumnStr + " WHERE user_email=$1 AND deleted_at IS NULL ORDER BY name"
 }
 
 func (q charactersForUserQuery) GetQueryArgs() []interface{} {
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+)
+
+// storyFields holds the nullable point of view and story time columns
+// while a section row is scanned
+type storyFields struct {
+	POV     sql.NullInt64
+	Time    sql.NullString
+	SortKey sql.NullString
+}
+
+func (f storyFields) fill(s *Section) {
+	s.POVCharacterId = int(f.POV.Int64)
+	s.StoryTime = f.Time.String
+	s.StorySortKey = f.SortKey.String
+}
+
+// StoryKey is what the section sorts on in the chronology. Without a sort
+// key of its own, the story time is the best we have.
+func (s *Section) StoryKey() string {
+	if key := strings.TrimSpace(s.StorySortKey); key != "" {
+		return key
+	}
+	return strings.TrimSpace(s.StoryTime)
+}
+
+// CompareStoryKeys orders sort keys the way a person would read them: runs
+// of digits compare as numbers and everything else compares as text,
+// ignoring case, so "Year 9" comes before "Year 10" and "1203-4-2" before
+// "1203-11-1". It returns -1, 0 or 1.
+func CompareStoryKeys(a, b string) int {
+	aParts, bParts := splitStoryKey(a), splitStoryKey(b)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if c := compareStoryKeyParts(aParts[i], bParts[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aParts) < len(bParts):
+		return -1
+	case len(aParts) > len(bParts):
+		return 1
+	}
+	return 0
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+// splitStoryKey breaks a key into alternating runs of digits and non-digits
+func splitStoryKey(key string) []string {
+	key = strings.ToLower(key)
+	parts := []string{}
+	start := 0
+	for i := 1; i <= len(key); i++ {
+		if i == len(key) || isDigit(key[i]) != isDigit(key[start]) {
+			parts = append(parts, key[start:i])
+			start = i
+		}
+	}
+	return parts
+}
+
+func compareStoryKeyParts(a, b string) int {
+	aDigits, bDigits := isDigit(a[0]), isDigit(b[0])
+	if aDigits && bDigits {
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+	} else if aDigits != bDigits {
+		// numbers before words, as in a dictionary
+		if aDigits {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+type byStoryTime []*Section
+
+func (s byStoryTime) Len() int      { return len(s) }
+func (s byStoryTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byStoryTime) Less(i, j int) bool {
+	a, b := s[i].StoryKey(), s[j].StoryKey()
+	if a == "" || b == "" {
+		return a != "" && b == ""
+	}
+	return CompareStoryKeys(a, b) < 0
+}
+
+// SortSectionsByStoryTime returns the sections in story order. Sections
+// that happen at the same time, and those without a story time (which go
+// last), keep the order they were given in.
+func SortSectionsByStoryTime(sections []*Section) []*Section {
+	output := make([]*Section, len(sections))
+	copy(output, sections)
+	sort.Stable(byStoryTime(output))
+	return output
+}
+
+// StoryTimeConflict is a character who is in sections at the same story
+// time but in different places
+type StoryTimeConflict struct {
+	StoryKey      string
+	CharacterId   int
+	CharacterName string
+	Sections      []*Section
+}
+
+// FindStoryTimeConflicts looks for characters in two settings at once.
+// characters and settings map section ids to the ids linked to them, and
+// settingParents maps setting ids to the places they're in. Two sections at
+// the same story time only conflict if they share a character and none of
+// one's settings is inside (or the same as) one of the other's; a section
+// with no settings could be anywhere, so never conflicts.
+func FindStoryTimeConflicts(sections []*Section, characters, settings map[int][]int, settingParents map[int]int) []*StoryTimeConflict {
+	placed := []*Section{}
+	for _, section := range sections {
+		if section.StoryKey() != "" && len(settings[section.Id]) > 0 {
+			placed = append(placed, section)
+		}
+	}
+	placed = SortSectionsByStoryTime(placed)
+	output := []*StoryTimeConflict{}
+	for start, end := 0, 0; start < len(placed); start = end {
+		key := placed[start].StoryKey()
+		for end = start + 1; end < len(placed) && CompareStoryKeys(key, placed[end].StoryKey()) == 0; end++ {
+		}
+		if end-start < 2 {
+			continue
+		}
+		withCharacter := map[int][]*Section{}
+		characterIds := []int{}
+		for _, section := range placed[start:end] {
+			for _, id := range characters[section.Id] {
+				if _, ok := withCharacter[id]; !ok {
+					characterIds = append(characterIds, id)
+				}
+				withCharacter[id] = append(withCharacter[id], section)
+			}
+		}
+		sort.Ints(characterIds)
+		for _, id := range characterIds {
+			if inDifferentPlaces(withCharacter[id], settings, settingParents) {
+				output = append(output, &StoryTimeConflict{StoryKey: key, CharacterId: id, Sections: withCharacter[id]})
+			}
+		}
+	}
+	return output
+}
+
+func inDifferentPlaces(sections []*Section, settings map[int][]int, settingParents map[int]int) bool {
+	for i := range sections {
+		for j := i + 1; j < len(sections); j++ {
+			if !overlappingPlaces(settings[sections[i].Id], settings[sections[j].Id], settingParents) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// overlappingPlaces says whether one of a is inside one of b or the other
+// way round, so The Crooked Inn and Lowtown overlap but two inns don't
+func overlappingPlaces(a, b []int, settingParents map[int]int) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if SettingWithin(x, y, settingParents) || SettingWithin(y, x, settingParents) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetStoryTimeConflictsForWork runs FindStoryTimeConflicts over the given
+// sections of a work, with the work's links and character names filled in
+func GetStoryTimeConflictsForWork(workId int, sections []*Section, database *db.DB) []*StoryTimeConflict {
+	characters, err := getSectionLinksForWork("character", workId, database)
+	if err != nil {
+		glog.Errorf("Error on GetStoryTimeConflictsForWork: %v", err.Error())
+		return nil
+	}
+	settings, err := getSectionLinksForWork("setting", workId, database)
+	if err != nil {
+		glog.Errorf("Error on GetStoryTimeConflictsForWork: %v", err.Error())
+		return nil
+	}
+	settingParents, err := getSettingParentsForWork(workId, database)
+	if err != nil {
+		glog.Errorf("Error on GetStoryTimeConflictsForWork: %v", err.Error())
+		return nil
+	}
+	conflicts := FindStoryTimeConflicts(sections, characters, settings, settingParents)
+	if len(conflicts) == 0 {
+		return conflicts
+	}
+	names := map[int]string{}
+	for _, character := range GetCharactersForWork(workId, database) {
+		names[character.Id] = character.Name
+	}
+	for _, conflict := range conflicts {
+		conflict.CharacterName = names[conflict.CharacterId]
+	}
+	return conflicts
+}
+
+// getSectionLinksForWork maps each of the work's section ids to the ids of
+// the characters or settings (rightName) linked to it
+func getSectionLinksForWork(rightName string, workId int, database *db.DB) (map[int][]int, error) {
+	rows, err := database.DB.Query(fmt.Sprintf(`
+SELECT r.section_id, r.%[1]v_id FROM r_sections_%[1]vs r
+JOIN tbl_section ON tbl_section.section_id=r.section_id
+WHERE tbl_section.work_id=$1 AND tbl_section.deleted_at IS NULL`, rightName), workId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := map[int][]int{}
+	for rows.Next() {
+		var sectionId, rightId int
+		if err := rows.Scan(&sectionId, &rightId); err != nil {
+			return nil, err
+		}
+		links[sectionId] = append(links[sectionId], rightId)
+	}
+	return links, rows.Err()
+}
@@ -0,0 +1,414 @@
+package models
+
+import (
+	"database/sql"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+)
+
+// Comment is feedback on a section, from its author or from a reader with a
+// share link. A thread starts with a comment anchored to some text in the
+// section's body (Quote, starting at Offset); replies have a ParentId and
+// no anchor of their own.
+type Comment struct {
+	Id        int
+	SectionId int
+	ParentId  int
+	// ShareLinkId is the link a reader commented through, if it's still
+	// around
+	ShareLinkId int
+	ByAuthor    bool
+	AuthorName  string
+	Body        string
+	Quote       string
+	// Offset is where Quote starts in the section's text (see SectionText),
+	// in UTF-16 code units, since that's how the browser counts
+	Offset int
+	// Detached is set when the quote has been edited out of the section
+	Detached   bool
+	ResolvedAt pq.NullTime
+	CreatedAt  time.Time
+	// Emailed is set once the work's owner has had the comment in a digest
+	Emailed   bool
+	UserEmail string
+	// these come from the comment's section and work
+	WorkId       int
+	WorkTitle    string
+	SectionTitle string
+	Replies      []*Comment
+	DB           *db.DB
+}
+
+const commentColumnStr = `
+SELECT c.comment_id, c.section_id, c.parent_id, c.share_link_id, c.by_author, c.author_name, c.body,
+	c.quote, c.anchor_offset, c.detached, c.resolved_at, c.created_at, c.emailed, c.user_email,
+	s.work_id, w.title, s.title
+FROM tbl_comment c
+JOIN tbl_section s ON s.section_id=c.section_id AND s.deleted_at IS NULL
+JOIN tbl_work w ON w.work_id=s.work_id AND w.deleted_at IS NULL`
+
+func (c *Comment) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return c.RoleFor(sm) != ""
+}
+
+func (c *Comment) RoleFor(sm sessionManager.SessionManager) string {
+	return getWorkRole(c.WorkId, c.UserEmail, sm.GetUserEmail(), c.DB)
+}
+
+func (c *Comment) IsResolved() bool {
+	return c.ResolvedAt.Valid
+}
+
+func (c *Comment) GetInsertStr() string {
+	return `
+INSERT INTO tbl_comment(section_id, parent_id, share_link_id, by_author, author_name, body, quote, anchor_offset, emailed, user_email)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING comment_id
+`
+}
+
+func (c *Comment) GetInsertArgs() []interface{} {
+	return []interface{}{c.SectionId, db.ToNullInt(int64(c.ParentId)), db.ToNullInt(int64(c.ShareLinkId)), c.ByAuthor,
+		c.AuthorName, c.Body, c.Quote, c.Offset, c.Emailed, c.UserEmail}
+}
+
+func commentFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	c := Comment{DB: database}
+	parentId := sql.NullInt64{}
+	shareLinkId := sql.NullInt64{}
+	if err := r.Scan(&c.Id, &c.SectionId, &parentId, &shareLinkId, &c.ByAuthor, &c.AuthorName, &c.Body,
+		&c.Quote, &c.Offset, &c.Detached, &c.ResolvedAt, &c.CreatedAt, &c.Emailed, &c.UserEmail,
+		&c.WorkId, &c.WorkTitle, &c.SectionTitle); err != nil {
+		glog.Errorf("Error with commentFromRow: %v", err.Error())
+		return nil, err
+	}
+	c.ParentId = int(parentId.Int64)
+	c.ShareLinkId = int(shareLinkId.Int64)
+	return &c, nil
+}
+
+/*
+.
+.
+*/
+
+var htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// SectionText is a section body as the browser's textContent would have it:
+// the tags gone and the entities decoded, but the whitespace left alone.
+// Comment anchors are offsets into it.
+func SectionText(body string) string {
+	body = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(body)
+	body = htmlCommentPattern.ReplaceAllString(body, "")
+	return html.UnescapeString(htmlTagPattern.ReplaceAllString(body, ""))
+}
+
+// FindAnchor looks for quote in text and returns the offset of the
+// occurrence closest to offset, which is where it was last time. Both
+// offsets are in UTF-16 code units.
+func FindAnchor(text, quote string, offset int) (int, bool) {
+	if quote == "" {
+		return 0, false
+	}
+	haystack := utf16.Encode([]rune(text))
+	needle := utf16.Encode([]rune(quote))
+	best, found := 0, false
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if !utf16Equal(haystack[i:i+len(needle)], needle) {
+			continue
+		}
+		if !found || distance(i, offset) < distance(best, offset) {
+			best, found = i, true
+		}
+		if i > offset {
+			break
+		}
+	}
+	return best, found
+}
+
+func utf16Equal(a, b []uint16) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func distance(a, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Reanchor moves the comment to wherever its quote is in text now, or
+// marks it detached if the quote's gone. It returns whether anything
+// changed.
+func (c *Comment) Reanchor(text string) bool {
+	offset, found := FindAnchor(text, c.Quote, c.Offset)
+	if !found {
+		changed := !c.Detached
+		c.Detached = true
+		return changed
+	}
+	changed := c.Detached || c.Offset != offset
+	c.Offset, c.Detached = offset, false
+	return changed
+}
+
+type commentAnchorUpdate struct {
+	Id       int
+	Offset   int
+	Detached bool
+}
+
+func (u commentAnchorUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_comment SET anchor_offset=$1, detached=$2 WHERE comment_id=$3"
+}
+
+func (u commentAnchorUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Offset, u.Detached, u.Id}
+}
+
+// ReanchorComments moves a section's threads to follow their quotes after
+// the section's body has been edited
+func ReanchorComments(database *db.DB, tx *sql.Tx, sectionId int, body string) error {
+	comments := commentsFromQuery(commentsForSectionQuery{SectionId: sectionId}, database)
+	text := SectionText(body)
+	for _, comment := range comments {
+		if comment.ParentId != 0 || !comment.Reanchor(text) {
+			continue
+		}
+		update := commentAnchorUpdate{Id: comment.Id, Offset: comment.Offset, Detached: comment.Detached}
+		if err := database.Update(update, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type commentResolveUpdate struct {
+	Id       int
+	Resolved bool
+}
+
+func (u commentResolveUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_comment SET resolved_at=CASE WHEN $1 THEN now() ELSE NULL END WHERE comment_id=$2"
+}
+
+func (u commentResolveUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Resolved, u.Id}
+}
+
+// SetThreadResolved resolves or reopens the thread commentId starts
+func SetThreadResolved(database *db.DB, commentId int, resolved bool) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := database.Update(commentResolveUpdate{Id: commentId, Resolved: resolved}, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+.
+.
+*/
+
+// BuildCommentThreads puts replies under the comments they reply to, in
+// the order they came. comments should be oldest first.
+func BuildCommentThreads(comments []*Comment) []*Comment {
+	threads := []*Comment{}
+	byId := make(map[int]*Comment, len(comments))
+	for _, comment := range comments {
+		comment.Replies = nil
+		byId[comment.Id] = comment
+	}
+	for _, comment := range comments {
+		if parent, ok := byId[comment.ParentId]; ok {
+			parent.Replies = append(parent.Replies, comment)
+		} else if comment.ParentId == 0 {
+			threads = append(threads, comment)
+		}
+	}
+	return threads
+}
+
+// OpenThreads leaves out the resolved ones
+func OpenThreads(threads []*Comment) []*Comment {
+	output := []*Comment{}
+	for _, thread := range threads {
+		if !thread.IsResolved() {
+			output = append(output, thread)
+		}
+	}
+	return output
+}
+
+// ThreadsForShareLink are the threads a reader started with their link;
+// readers don't see each other's
+func ThreadsForShareLink(threads []*Comment, shareLinkId int) []*Comment {
+	output := []*Comment{}
+	for _, thread := range threads {
+		if thread.ShareLinkId == shareLinkId {
+			output = append(output, thread)
+		}
+	}
+	return output
+}
+
+func GetCommentById(id int, database *db.DB) Verifiable {
+	comments := commentsFromQuery(commentByIdQuery{Id: id}, database)
+	if len(comments) == 0 {
+		return nil
+	}
+	return comments[0]
+}
+
+// GetCommentThreadsForSection is every thread on the section, oldest first
+func GetCommentThreadsForSection(sectionId int, database *db.DB) []*Comment {
+	return BuildCommentThreads(commentsFromQuery(commentsForSectionQuery{SectionId: sectionId}, database))
+}
+
+// GetCommentThreadsForWork is every thread on the work's sections, by
+// section id; the work's open feedback is the unresolved ones
+func GetCommentThreadsForWork(workId int, database *db.DB) map[int][]*Comment {
+	threads := BuildCommentThreads(commentsFromQuery(commentsForWorkQuery{WorkId: workId}, database))
+	bySection := map[int][]*Comment{}
+	for _, thread := range threads {
+		bySection[thread.SectionId] = append(bySection[thread.SectionId], thread)
+	}
+	return bySection
+}
+
+func commentsFromQuery(query db.Queryable, database *db.DB) []*Comment {
+	commentsInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting comments: %v", err.Error())
+		return nil
+	}
+	output := make([]*Comment, len(commentsInt))
+	for i := range commentsInt {
+		output[i] = commentsInt[i].(*Comment)
+	}
+	return output
+}
+
+type commentByIdQuery struct {
+	Id int
+}
+
+func (q commentByIdQuery) GetQueryStr() string {
+	return commentColumnStr + " WHERE c.comment_id=$1"
+}
+
+func (q commentByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q commentByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return commentFromRow(database, r)
+}
+
+type commentsForSectionQuery struct {
+	SectionId int
+}
+
+func (q commentsForSectionQuery) GetQueryStr() string {
+	return commentColumnStr + " WHERE c.section_id=$1 ORDER BY c.created_at, c.comment_id"
+}
+
+func (q commentsForSectionQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.SectionId}
+}
+
+func (q commentsForSectionQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return commentFromRow(database, r)
+}
+
+type commentsForWorkQuery struct {
+	WorkId int
+}
+
+func (q commentsForWorkQuery) GetQueryStr() string {
+	return commentColumnStr + " WHERE s.work_id=$1 ORDER BY s.section_order, c.created_at, c.comment_id"
+}
+
+func (q commentsForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId}
+}
+
+func (q commentsForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return commentFromRow(database, r)
+}
+
+/*
+.
+.
+*/
+
+// GetUndigestedComments is readers' comments that haven't been emailed to
+// the works' owners yet, by owner, oldest first
+func GetUndigestedComments(database *db.DB) map[string][]*Comment {
+	byOwner := map[string][]*Comment{}
+	for _, comment := range commentsFromQuery(undigestedCommentsQuery{}, database) {
+		byOwner[comment.UserEmail] = append(byOwner[comment.UserEmail], comment)
+	}
+	return byOwner
+}
+
+type undigestedCommentsQuery struct{}
+
+func (q undigestedCommentsQuery) GetQueryStr() string {
+	return commentColumnStr + " WHERE NOT c.emailed ORDER BY c.user_email, c.created_at, c.comment_id"
+}
+
+func (q undigestedCommentsQuery) GetQueryArgs() []interface{} {
+	return []interface{}{}
+}
+
+func (q undigestedCommentsQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return commentFromRow(database, r)
+}
+
+type commentsEmailedUpdate struct {
+	Ids []int64
+}
+
+func (u commentsEmailedUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_comment SET emailed=true WHERE comment_id=ANY($1)"
+}
+
+func (u commentsEmailedUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{pq.Array(u.Ids)}
+}
+
+// MarkCommentsEmailed keeps comments out of the next digest
+func MarkCommentsEmailed(database *db.DB, comments []*Comment) error {
+	ids := make([]int64, len(comments))
+	for i, comment := range comments {
+		ids[i] = int64(comment.Id)
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := database.Update(commentsEmailedUpdate{Ids: ids}, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
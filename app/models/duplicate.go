@@ -0,0 +1,223 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+)
+
+var copySuffix = regexp.MustCompile(` \(copy(?: (\d+))?\)$`)
+
+// CopyTitle is what a duplicate is called: "Draft" becomes "Draft (copy)",
+// which becomes "Draft (copy 2)", and so on
+func CopyTitle(title string) string {
+	match := copySuffix.FindStringSubmatch(title)
+	if match == nil {
+		return title + " (copy)"
+	}
+	n := 2
+	if match[1] != "" {
+		n, _ = strconv.Atoi(match[1])
+		n++
+	}
+	return fmt.Sprintf("%v (copy %v)", title[:len(title)-len(match[0])], n)
+}
+
+// linksCopyInsert gives ToId the same rows in Table as FromId, where
+// IdColumn is the column they're in and Columns are the rest
+type linksCopyInsert struct {
+	Table    string
+	IdColumn string
+	Columns  string
+	FromId   int
+	ToId     int
+}
+
+func (i linksCopyInsert) GetInsertStr() string {
+	return fmt.Sprintf(`
+INSERT INTO %[1]v(%[2]v, %[3]v)
+SELECT $1, %[3]v FROM %[1]v WHERE %[2]v=$2
+on conflict do nothing returning 0`, i.Table, i.IdColumn, i.Columns)
+}
+
+func (i linksCopyInsert) GetInsertArgs() []interface{} {
+	return []interface{}{i.ToId, i.FromId}
+}
+
+func copyLinks(database *db.DB, tx *sql.Tx, fromId, toId int, idColumn string, tables map[string]string) error {
+	for table, columns := range tables {
+		insert := linksCopyInsert{Table: table, IdColumn: idColumn, Columns: columns, FromId: fromId, ToId: toId}
+		if _, err := database.Insert(insert, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySectionLinks gives section toId the characters and settings fromId
+// has
+func copySectionLinks(database *db.DB, tx *sql.Tx, fromId, toId int) error {
+	return copyLinks(database, tx, fromId, toId, "section_id", map[string]string{
+		"r_sections_characters": "character_id",
+		"r_sections_settings":   "setting_id",
+	})
+}
+
+// sectionsShiftUpdate makes room after position After among the sections
+// with the same work and parent (0 for the top level)
+type sectionsShiftUpdate struct {
+	WorkId   int
+	ParentId int
+	After    int64
+	By       int
+}
+
+func (u sectionsShiftUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_section SET section_order = section_order + $1
+WHERE work_id=$2 AND coalesce(parent_id, 0)=$3 AND section_order>$4`
+}
+
+func (u sectionsShiftUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.By, u.WorkId, u.ParentId, u.After}
+}
+
+// insertSectionAfter puts section into the database straight after after,
+// with the same parent, and returns its id
+func insertSectionAfter(database *db.DB, tx *sql.Tx, section, after *Section) (int, error) {
+	shift := sectionsShiftUpdate{WorkId: after.WorkId, ParentId: after.ParentId, After: after.Order, By: 1}
+	if err := database.Update(shift, tx); err != nil {
+		return 0, err
+	}
+	section.WorkId = after.WorkId
+	section.ParentId = after.ParentId
+	section.Order = after.Order + 1
+	return database.Insert(section, tx)
+}
+
+/*
+.
+.
+*/
+
+// DuplicateSection copies the section, its characters and its settings
+// into the place straight after it, and returns the copy's id. Its words
+// are added to the work's.
+func DuplicateSection(database *db.DB, tx *sql.Tx, section *Section) (int, error) {
+	duplicate := *section
+	duplicate.Title = CopyTitle(section.Title)
+	id, err := insertSectionAfter(database, tx, &duplicate, section)
+	if err != nil {
+		return 0, err
+	}
+	if err := copySectionLinks(database, tx, section.Id, id); err != nil {
+		return 0, err
+	}
+	return id, UpdateWorkWordCount(database, tx, section.WorkId, section.WordCount)
+}
+
+// DuplicateWork copies the work with all of its sections, in the same
+// order and nesting, and everything either is linked to. Members, share
+// links, comments and pictures stay with the original; so does the ISBN,
+// which is only ever for one book.
+func DuplicateWork(database *db.DB, tx *sql.Tx, work *Work) (int, error) {
+	duplicate := *work
+	duplicate.Title = CopyTitle(work.Title)
+	duplicate.ISBN = ""
+	id, err := database.Insert(&duplicate, tx)
+	if err != nil {
+		return 0, err
+	}
+	err = copyLinks(database, tx, work.Id, id, "work_id", map[string]string{
+		"r_works_characters": "character_id",
+		"r_works_settings":   "setting_id",
+	})
+	if err != nil {
+		return 0, err
+	}
+	sectionsInt, err := database.Query(sectionDetailForExportQuery{WorkId: work.Id})
+	if err != nil {
+		return 0, err
+	}
+	sections := make([]*Section, len(sectionsInt))
+	for i := range sectionsInt {
+		sections[i] = sectionsInt[i].(*Section)
+	}
+	if err := copySections(database, tx, sections, id); err != nil {
+		return 0, err
+	}
+	return id, UpdateWorkWordCount(database, tx, id, work.WordCount)
+}
+
+// copySections inserts copies of sections into work workId, parents before
+// their children so the copies can point at each other. A section whose
+// parent isn't among them goes at the top level.
+func copySections(database *db.DB, tx *sql.Tx, sections []*Section, workId int) error {
+	included := make(map[int]bool, len(sections))
+	for _, section := range sections {
+		included[section.Id] = true
+	}
+	newIds := make(map[int]int, len(sections))
+	for len(newIds) < len(sections) {
+		copied := 0
+		for _, section := range sections {
+			if _, done := newIds[section.Id]; done {
+				continue
+			}
+			parentId, parentCopied := newIds[section.ParentId]
+			if included[section.ParentId] && !parentCopied {
+				continue
+			}
+			duplicate := *section
+			duplicate.WorkId = workId
+			duplicate.ParentId = parentId
+			id, err := database.Insert(&duplicate, tx)
+			if err != nil {
+				return err
+			}
+			if err := copySectionLinks(database, tx, section.Id, id); err != nil {
+				return err
+			}
+			newIds[section.Id] = id
+			copied++
+		}
+		if copied == 0 {
+			return fmt.Errorf("sections of work %v are inside each other", sections[0].WorkId)
+		}
+	}
+	return nil
+}
+
+// DuplicateCharacter copies the character and its custom fields, and puts
+// the copy in the same works. It isn't in any of the original's sections,
+// events or relationships.
+func DuplicateCharacter(database *db.DB, tx *sql.Tx, character *Character) (int, error) {
+	duplicate := *character
+	duplicate.Name = CopyTitle(character.Name)
+	id, err := database.Insert(&duplicate, tx)
+	if err != nil {
+		return 0, err
+	}
+	return id, copyLinks(database, tx, character.Id, id, "character_id", map[string]string{
+		"r_works_characters":        "work_id",
+		"tbl_character_field_value": "field_def_id, value",
+	})
+}
+
+// DuplicateSetting is DuplicateCharacter for settings. The copy goes in the
+// same place as the original, without the places inside it.
+func DuplicateSetting(database *db.DB, tx *sql.Tx, setting *Setting) (int, error) {
+	duplicate := *setting
+	duplicate.Name = CopyTitle(setting.Name)
+	id, err := database.Insert(&duplicate, tx)
+	if err != nil {
+		return 0, err
+	}
+	return id, copyLinks(database, tx, setting.Id, id, "setting_id", map[string]string{
+		"r_works_settings":        "work_id",
+		"tbl_setting_field_value": "field_def_id, value",
+	})
+}
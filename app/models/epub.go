@@ -0,0 +1,302 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// EPUB is an EPUB 3 book: a title page, then one chapter per section
+type EPUB struct {
+	// Identifier is a URN, like urn:isbn:9780306406157
+	Identifier string
+	Title      string
+	Subtitle   string
+	// Blurb can be HTML; the description gets it as text
+	Blurb    string
+	Language string
+	Creator  string
+	// Rights is the copyright notice and Date the year it's from
+	Rights string
+	Date   string
+	ISBN   string
+	Series string
+	// SeriesPosition is the book's number in Series, like "2" or "2.5"
+	SeriesPosition string
+	Modified       time.Time
+	// Cover is also one of Images
+	Cover    *EPUBImage
+	Chapters []*EPUBChapter
+	Images   []*EPUBImage
+}
+
+// EPUBChapter's Body is HTML as it comes out of the editor; it's tidied
+// into XHTML when the book is written. Depth nests it in the contents.
+// Type is the epub:type for front and back matter, like "dedication".
+type EPUBChapter struct {
+	Title string
+	Depth int
+	Body  string
+	Type  string
+}
+
+// EPUBImage's Name is its path in the book, like "images/12.jpg", which is
+// what chapters should use as the src
+type EPUBImage struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// toXHTML turns editor HTML, which can have unclosed <p>s, <br>s and &nbsp;s,
+// into well-formed XHTML by running it through encoding/xml's forgiving HTML
+// mode and writing it back out
+func toXHTML(body string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader("<div>" + body + "</div>"))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	buf := &bytes.Buffer{}
+	e := xml.NewEncoder(buf)
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			t.Name = xml.Name{Local: strings.ToLower(t.Name.Local)}
+			// scripts and handlers aren't allowed in a book anyway
+			if t.Name.Local == "script" {
+				if err := d.Skip(); err != nil {
+					return "", err
+				}
+				continue
+			}
+			attrs := []xml.Attr{}
+			for _, attr := range t.Attr {
+				name := strings.ToLower(attr.Name.Local)
+				if attr.Name.Space != "" || strings.HasPrefix(name, "on") {
+					continue
+				}
+				attrs = append(attrs, xml.Attr{Name: xml.Name{Local: name}, Value: attr.Value})
+			}
+			t.Attr = attrs
+			token = t
+		case xml.EndElement:
+			t.Name = xml.Name{Local: strings.ToLower(t.Name.Local)}
+			token = t
+		case xml.CharData:
+		default:
+			// comments, processing instructions and doctypes
+			continue
+		}
+		if err := e.EncodeToken(token); err != nil {
+			return "", err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var (
+	htmlScriptPattern = regexp.MustCompile(`(?is)<script.*?</script>`)
+	htmlTagPattern    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// chapterXHTML is toXHTML, falling back to the text with the tags taken
+// out if the HTML is too broken to fix
+func chapterXHTML(body string) string {
+	if output, err := toXHTML(body); err == nil {
+		return output
+	}
+	return "<p>" + xmlEscape(plainText(body)) + "</p>"
+}
+
+// plainText is HTML with the tags taken out and the entities turned back
+// into characters
+func plainText(body string) string {
+	text := html.UnescapeString(htmlTagPattern.ReplaceAllString(htmlScriptPattern.ReplaceAllString(body, ""), " "))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+func xmlEscape(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// epubItemId turns an image's path into something that can be an XML id
+func epubItemId(name string) string {
+	return "image-" + strings.NewReplacer("/", "-", ".", "-").Replace(name)
+}
+
+// These are text/template, not html/template, since they're XML. Anything
+// from the user goes through x.
+var epubTemplates = template.Must(template.New("epub").Funcs(template.FuncMap{
+	"x":      xmlEscape,
+	"text":   plainText,
+	"itemId": epubItemId,
+}).Parse(`
+{{ define "content.opf" }}<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">{{ x .Identifier }}</dc:identifier>
+    <dc:title id="title">{{ x .Title }}</dc:title>
+    {{ if .Subtitle }}<meta refines="#title" property="title-type">main</meta>
+    <dc:title id="subtitle">{{ x .Subtitle }}</dc:title>
+    <meta refines="#subtitle" property="title-type">subtitle</meta>{{ end }}
+    <dc:language>{{ x .Language }}</dc:language>
+    {{ if .Creator }}<dc:creator id="creator">{{ x .Creator }}</dc:creator>
+    <meta refines="#creator" property="role" scheme="marc:relators">aut</meta>{{ end }}
+    {{ if .Blurb }}<dc:description>{{ x (text .Blurb) }}</dc:description>{{ end }}
+    {{ if .Rights }}<dc:rights>{{ x .Rights }}</dc:rights>{{ end }}
+    {{ if .Date }}<dc:date>{{ x .Date }}</dc:date>{{ end }}
+    {{ if .Series }}<meta property="belongs-to-collection" id="series">{{ x .Series }}</meta>
+    <meta refines="#series" property="collection-type">series</meta>
+    {{ if .SeriesPosition }}<meta refines="#series" property="group-position">{{ x .SeriesPosition }}</meta>{{ end }}
+    <meta name="calibre:series" content="{{ x .Series }}"/>
+    {{ if .SeriesPosition }}<meta name="calibre:series_index" content="{{ x .SeriesPosition }}"/>{{ end }}{{ end }}
+    <meta property="dcterms:modified">{{ .Modified.UTC.Format "2006-01-02T15:04:05Z" }}</meta>
+    {{ if .Cover }}<meta name="cover" content="{{ itemId .Cover.Name }}"/>{{ end }}
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="title" href="title.xhtml" media-type="application/xhtml+xml"/>
+    {{ range $i, $c := .Chapters }}<item id="chapter-{{ $i }}" href="chapter-{{ $i }}.xhtml" media-type="application/xhtml+xml"/>
+    {{ end }}{{ range .Images }}<item id="{{ itemId .Name }}" href="{{ x .Name }}" media-type="{{ x .ContentType }}"{{ if $.Cover }}{{ if eq $.Cover.Name .Name }} properties="cover-image"{{ end }}{{ end }}/>
+    {{ end }}
+  </manifest>
+  <spine>
+    <itemref idref="title"/>
+    {{ range $i, $c := .Chapters }}<itemref idref="chapter-{{ $i }}"/>
+    {{ end }}
+  </spine>
+</package>
+{{ end }}
+
+{{ define "nav.xhtml" }}<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>{{ x .Title }}</title></head>
+<body>
+<nav epub:type="toc">
+<h1>Contents</h1>
+<ol>
+{{ range $i, $c := .Chapters }}<li style="margin-left: {{ $c.Depth }}em;"><a href="chapter-{{ $i }}.xhtml">{{ x $c.Title }}</a></li>
+{{ end }}</ol>
+</nav>
+</body>
+</html>
+{{ end }}
+
+{{ define "title.xhtml" }}<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>{{ x .Title }}</title></head>
+<body>
+{{ if .Cover }}<p><img src="{{ x .Cover.Name }}" alt="Cover"/></p>{{ end }}
+<h1>{{ x .Title }}</h1>
+{{ if .Subtitle }}<h2>{{ x .Subtitle }}</h2>{{ end }}
+{{ if .Creator }}<h2>{{ x .Creator }}</h2>{{ end }}
+{{ if .Series }}<p><i>{{ if .SeriesPosition }}Book {{ x .SeriesPosition }} of {{ end }}{{ x .Series }}</i></p>{{ end }}
+{{ if .Rights }}<p><small>{{ x .Rights }}</small></p>{{ end }}
+{{ if .ISBN }}<p><small>ISBN {{ x .ISBN }}</small></p>{{ end }}
+</body>
+</html>
+{{ end }}
+
+{{ define "chapter" }}<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>{{ x .Title }}</title></head>
+<body>
+<section{{ if .Type }} epub:type="{{ x .Type }}"{{ end }}>
+<h{{ .Level }}>{{ x .Title }}</h{{ .Level }}>
+{{ .Body }}
+</section>
+</body>
+</html>
+{{ end }}
+`))
+
+type epubFile struct {
+	Name string
+	Data []byte
+}
+
+func renderEPUBFile(name, templateName string, data interface{}) (epubFile, error) {
+	buf := &bytes.Buffer{}
+	if err := epubTemplates.ExecuteTemplate(buf, templateName, data); err != nil {
+		return epubFile{}, err
+	}
+	return epubFile{Name: "OEBPS/" + name, Data: bytes.TrimSpace(buf.Bytes())}, nil
+}
+
+// WriteEPUB writes the book as a zip. The mimetype file has to come first
+// and uncompressed so readers can recognise the file.
+func WriteEPUB(w io.Writer, book *EPUB) error {
+	files := []epubFile{{Name: "META-INF/container.xml", Data: []byte(epubContainer)}}
+	for _, name := range []string{"content.opf", "nav.xhtml", "title.xhtml"} {
+		file, err := renderEPUBFile(name, name, book)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	for i, chapter := range book.Chapters {
+		level := chapter.Depth + 1
+		if level > 6 {
+			level = 6
+		}
+		file, err := renderEPUBFile(fmt.Sprintf("chapter-%v.xhtml", i), "chapter", map[string]interface{}{
+			"Title": chapter.Title,
+			"Level": level,
+			"Type":  chapter.Type,
+			"Body":  chapterXHTML(chapter.Body),
+		})
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	for _, image := range book.Images {
+		files = append(files, epubFile{Name: "OEBPS/" + image.Name, Data: image.Data})
+	}
+
+	z := zip.NewWriter(w)
+	mimetype, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mimetype, "application/epub+zip"); err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := z.Create(file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
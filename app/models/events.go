@@ -0,0 +1,309 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// Event is something that happens in the story, whether or not a section
+// shows it happening. Like a section's, its story time is free text with a
+// key to sort it on (see CompareStoryKeys); StoryEndKey is only set for an
+// event that lasts a while.
+type Event struct {
+	Id           int
+	Title        string
+	Description  string
+	StoryTime    string
+	StorySortKey string
+	StoryEndKey  string
+	UserEmail    string
+	DB           *db.DB
+	// Only filled in by GetTimeline, and then only with ids and names
+	Characters []*Character
+	Settings   []*Setting
+	Sections   []*Section
+}
+
+var eventColumnStr = "SELECT tbl_event.event_id, tbl_event.title, tbl_event.description, tbl_event.story_time, tbl_event.story_sort, tbl_event.story_sort_end, tbl_event.user_email FROM tbl_event"
+
+func (e *Event) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return e.UserEmail == sm.GetUserEmail()
+}
+
+// StoryKey is what the event sorts on, falling back to its story time
+func (e *Event) StoryKey() string {
+	if key := strings.TrimSpace(e.StorySortKey); key != "" {
+		return key
+	}
+	return strings.TrimSpace(e.StoryTime)
+}
+
+func (e *Event) GetInsertStr() string {
+	return `
+INSERT INTO tbl_event(title, description, story_time, story_sort, story_sort_end, user_email)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING event_id;
+`
+}
+
+func (e *Event) GetInsertArgs() []interface{} {
+	return []interface{}{e.Title, db.ToNullString(e.Description), db.ToNullString(e.StoryTime),
+		db.ToNullString(e.StorySortKey), db.ToNullString(e.StoryEndKey), e.UserEmail}
+}
+
+func (e *Event) GetUpdateStr() string {
+	return `
+UPDATE tbl_event
+SET title=$1, description=$2, story_time=$3, story_sort=$4, story_sort_end=$5
+WHERE event_id=$6
+`
+}
+
+func (e *Event) GetUpdateArgs() []interface{} {
+	return []interface{}{e.Title, db.ToNullString(e.Description), db.ToNullString(e.StoryTime),
+		db.ToNullString(e.StorySortKey), db.ToNullString(e.StoryEndKey), e.Id}
+}
+
+func (e *Event) Save(tx *sql.Tx) error {
+	return e.DB.Update(e, tx)
+}
+
+func eventFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	event := Event{DB: database}
+	nullDescription := sql.NullString{}
+	nullTime := sql.NullString{}
+	nullSort := sql.NullString{}
+	nullEnd := sql.NullString{}
+	if err := r.Scan(&event.Id, &event.Title, &nullDescription, &nullTime, &nullSort, &nullEnd, &event.UserEmail); err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+	event.Description = nullDescription.String
+	event.StoryTime = nullTime.String
+	event.StorySortKey = nullSort.String
+	event.StoryEndKey = nullEnd.String
+	return &event, nil
+}
+
+func GetEventById(id int, database *db.DB) Verifiable {
+	query := eventByIdQuery{Id: id}
+	eventInt, err := database.Query(query)
+	if err != nil {
+		glog.Error(err.Error())
+		return nil
+	}
+	if len(eventInt) == 0 {
+		return nil
+	}
+	return eventInt[0].(*Event)
+}
+
+type eventByIdQuery struct {
+	Id int
+}
+
+func (q eventByIdQuery) GetQueryStr() string {
+	return eventColumnStr + " WHERE event_id=$1"
+}
+
+func (q eventByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q eventByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return eventFromRow(database, r)
+}
+
+type eventsForUserQuery struct {
+	UserEmail string
+}
+
+func (q eventsForUserQuery) GetQueryStr() string {
+	return eventColumnStr + " WHERE user_email=$1"
+}
+
+func (q eventsForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.UserEmail}
+}
+
+func (q eventsForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return eventFromRow(database, r)
+}
+
+func eventsFromInsertables(eventsInt []db.Insertable) []*Event {
+	output := make([]*Event, len(eventsInt))
+	for i := range eventsInt {
+		output[i] = eventsInt[i].(*Event)
+	}
+	return output
+}
+
+func GetEventsForUser(userEmail string, database *db.DB) []*Event {
+	eventsInt, err := database.Query(eventsForUserQuery{UserEmail: userEmail})
+	if err != nil {
+		glog.Errorf("Error on GetEventsForUser: %v", err.Error())
+		return nil
+	}
+	return SortEventsByStoryTime(eventsFromInsertables(eventsInt))
+}
+
+func getEventsForRight(rightName string, rightId int, database *db.DB) []*Event {
+	query := leftForRightQuery{
+		RightName:      rightName,
+		DB:             database,
+		LeftName:       "event",
+		RightId:        rightId,
+		ColumnStr:      eventColumnStr,
+		ObjFromRowFunc: eventFromRow,
+	}
+	return SortEventsByStoryTime(eventsFromInsertables(getLeftForRight(query)))
+}
+
+// GetEventsForCharacter is the character's life history, in story order.
+// Only its owner's events are in it.
+func GetEventsForCharacter(characterId int, database *db.DB) []*Event {
+	eventsInt, err := database.Query(eventsForCharacterQuery{CharacterId: characterId})
+	if err != nil {
+		glog.Errorf("Error on GetEventsForCharacter: %v", err.Error())
+		return []*Event{}
+	}
+	return SortEventsByStoryTime(eventsFromInsertables(eventsInt))
+}
+
+type eventsForCharacterQuery struct {
+	CharacterId int
+}
+
+func (q eventsForCharacterQuery) GetQueryStr() string {
+	return eventColumnStr + `
+JOIN r_events_characters ON tbl_event.event_id = r_events_characters.event_id
+JOIN tbl_character ON r_events_characters.character_id = tbl_character.character_id
+WHERE tbl_character.character_id=$1 AND tbl_event.user_email = tbl_character.user_email
+ORDER BY tbl_event.event_id`
+}
+
+func (q eventsForCharacterQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.CharacterId}
+}
+
+func (q eventsForCharacterQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return eventFromRow(database, r)
+}
+
+func GetEventsForSetting(settingId int, database *db.DB) []*Event {
+	return getEventsForRight("setting", settingId, database)
+}
+
+func GetEventsForSection(sectionId int, database *db.DB) []*Event {
+	return getEventsForRight("section", sectionId, database)
+}
+
+type eventsByStoryTime []*Event
+
+func (s eventsByStoryTime) Len() int      { return len(s) }
+func (s eventsByStoryTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s eventsByStoryTime) Less(i, j int) bool {
+	a, b := s[i].StoryKey(), s[j].StoryKey()
+	if a == "" || b == "" {
+		return a != "" && b == ""
+	}
+	if c := CompareStoryKeys(a, b); c != 0 {
+		return c < 0
+	}
+	// of two events starting together, the shorter one ends first
+	return CompareStoryKeys(s[i].StoryEndKey, s[j].StoryEndKey) < 0
+}
+
+// SortEventsByStoryTime sorts in place and returns the events for
+// convenience. Events without a story time go last.
+func SortEventsByStoryTime(events []*Event) []*Event {
+	sort.Stable(eventsByStoryTime(events))
+	return events
+}
+
+// GetTimeline returns the user's events in story order with their
+// characters, settings and sections filled in. Given a characterId, only
+// that character's events are returned.
+func GetTimeline(userEmail string, characterId int, database *db.DB) []*Event {
+	events := []*Event{}
+	if characterId != 0 {
+		for _, event := range GetEventsForCharacter(characterId, database) {
+			if event.UserEmail == userEmail {
+				events = append(events, event)
+			}
+		}
+	} else {
+		events = GetEventsForUser(userEmail, database)
+	}
+	if err := fillEventLinks(userEmail, events, database); err != nil {
+		glog.Errorf("Error on GetTimeline: %v", err.Error())
+	}
+	return events
+}
+
+func fillEventLinks(userEmail string, events []*Event, database *db.DB) error {
+	characters, err := getEventLinksForUser("character", "name", userEmail, database)
+	if err != nil {
+		return err
+	}
+	settings, err := getEventLinksForUser("setting", "name", userEmail, database)
+	if err != nil {
+		return err
+	}
+	sections, err := getEventLinksForUser("section", "title", userEmail, database)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		for _, link := range characters[event.Id] {
+			event.Characters = append(event.Characters, &Character{Id: link.Id, Name: link.Name})
+		}
+		for _, link := range settings[event.Id] {
+			event.Settings = append(event.Settings, &Setting{Id: link.Id, Name: link.Name})
+		}
+		for _, link := range sections[event.Id] {
+			event.Sections = append(event.Sections, &Section{Id: link.Id, Title: link.Name})
+		}
+	}
+	return nil
+}
+
+type eventLink struct {
+	Id   int
+	Name string
+}
+
+// getEventLinksForUser maps each of the user's event ids to the ids and
+// names of the characters, settings or sections (rightName) linked to it
+func getEventLinksForUser(rightName, nameColumn, userEmail string, database *db.DB) (map[int][]eventLink, error) {
+	rows, err := database.DB.Query(fmt.Sprintf(`
+SELECT r.event_id, tbl_%[1]v.%[1]v_id, tbl_%[1]v.%[2]v FROM r_events_%[1]vs r
+JOIN tbl_%[1]v ON tbl_%[1]v.%[1]v_id=r.%[1]v_id AND tbl_%[1]v.deleted_at IS NULL
+JOIN tbl_event ON tbl_event.event_id=r.event_id
+WHERE tbl_event.user_email=$1 AND tbl_%[1]v.user_email=$1
+ORDER BY tbl_%[1]v.%[2]v`, rightName, nameColumn), userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := map[int][]eventLink{}
+	for rows.Next() {
+		var eventId int
+		link := eventLink{}
+		if err := rows.Scan(&eventId, &link.Id, &link.Name); err != nil {
+			return nil, err
+		}
+		links[eventId] = append(links[eventId], link)
+	}
+	return links, rows.Err()
+}
+
+func DeleteEvent(eventId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(eventId, "event", database)
+}
@@ -2,7 +2,12 @@ package models
 
 import (
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"github.com/bradfitz/slice"
@@ -13,7 +18,7 @@ type sectionDetailForExportQuery struct {
 }
 
 func (q sectionDetailForExportQuery) GetQueryStr() string {
-	return sectionDetailColumnStr + " where tbl_section.work_id=$1"
+	return sectionDetailColumnStr + " where tbl_section.work_id=$1 and tbl_section.deleted_at is null"
 }
 
 func (q sectionDetailForExportQuery) GetQueryArgs() []interface{} {
@@ -50,10 +55,7 @@ func GetSectionDetailForExport(workId int, database *db.DB) ([]*Section, []*Sect
 			sections = append(sections, allSections[i])
 		}
 	}
-	slice.Sort(sections, func(i, j int) bool {
-		return sections[i].Order < sections[j].Order
-	})
-	return sections, snippets
+	return FlattenSectionTree(BuildSectionTree(sections)), snippets
 }
 
 func GetCharactersForWorkExport(workId int, database *db.DB) []*Character {
@@ -63,3 +65,78 @@ func GetCharactersForWorkExport(workId int, database *db.DB) []*Character {
 func GetSettingsForWorkExport(workId int, database *db.DB) []*Setting {
 	return getSettingsForLeft("work", workId, database, "detail")
 }
+
+// timelineEntry is how an event looks in a timeline export
+type timelineEntry struct {
+	Id          int      `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	StoryTime   string   `json:"story_time"`
+	Start       string   `json:"start"`
+	End         string   `json:"end"`
+	Characters  []string `json:"characters"`
+	Settings    []string `json:"settings"`
+	Sections    []string `json:"sections"`
+}
+
+func newTimelineEntry(event *Event) timelineEntry {
+	entry := timelineEntry{
+		Id:          event.Id,
+		Title:       event.Title,
+		Description: event.Description,
+		StoryTime:   event.StoryTime,
+		Start:       event.StoryKey(),
+		End:         event.StoryEndKey,
+		Characters:  []string{},
+		Settings:    []string{},
+		Sections:    []string{},
+	}
+	for _, character := range event.Characters {
+		entry.Characters = append(entry.Characters, character.Name)
+	}
+	for _, setting := range event.Settings {
+		entry.Settings = append(entry.Settings, setting.Name)
+	}
+	for _, section := range event.Sections {
+		entry.Sections = append(entry.Sections, section.Title)
+	}
+	return entry
+}
+
+// WriteTimelineJSON writes events, as returned by GetTimeline, as a JSON array
+func WriteTimelineJSON(w io.Writer, events []*Event) error {
+	entries := make([]timelineEntry, len(events))
+	for i := range events {
+		entries[i] = newTimelineEntry(events[i])
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// timelineListSeparator joins names in a single CSV cell
+const timelineListSeparator = "; "
+
+// WriteTimelineCSV writes events, as returned by GetTimeline, one per row
+// with a header row first
+func WriteTimelineCSV(w io.Writer, events []*Event) error {
+	writer := csv.NewWriter(w)
+	header := []string{"id", "title", "description", "story_time", "start", "end", "characters", "settings", "sections"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, event := range events {
+		entry := newTimelineEntry(event)
+		row := []string{
+			strconv.Itoa(entry.Id), entry.Title, entry.Description, entry.StoryTime, entry.Start, entry.End,
+			strings.Join(entry.Characters, timelineListSeparator),
+			strings.Join(entry.Settings, timelineListSeparator),
+			strings.Join(entry.Sections, timelineListSeparator),
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
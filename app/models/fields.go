@@ -0,0 +1,550 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// The kinds of value a custom field can hold
+const (
+	FieldText      = "text"
+	FieldNumber    = "number"
+	FieldDate      = "date"
+	FieldSelect    = "select"
+	FieldReference = "reference"
+)
+
+var FieldTypes = []string{FieldText, FieldNumber, FieldDate, FieldSelect, FieldReference}
+
+// FieldEntities are the things that can have custom fields, and the
+// things a reference field can point at
+var FieldEntities = []string{"character", "setting"}
+
+// FieldDateLayout is how dates are stored, so that they sort as text
+const FieldDateLayout = "2006-01-02"
+
+// FieldDef is one field in a user's schema for characters or settings, like
+// Age or Faction. A field with a WorkId only applies to the characters or
+// settings in that work; the rest apply everywhere.
+type FieldDef struct {
+	Id     int
+	Entity string
+	Name   string
+	Type   string
+	// Choices are a select field's options
+	Choices []string
+	// RefEntity is what a reference field points at
+	RefEntity string
+	WorkId    int
+	WorkTitle string
+	Order     int
+	UserEmail string
+	DB        *db.DB
+}
+
+const fieldDefColumnStr = `
+SELECT d.field_def_id, d.entity, d.name, d.field_type, d.choices, d.ref_entity, d.work_id, w.title,
+d.field_order, d.user_email
+FROM tbl_field_def d
+LEFT JOIN tbl_work w ON w.work_id=d.work_id`
+
+func validFieldEntity(entity string) bool {
+	for _, e := range FieldEntities {
+		if e == entity {
+			return true
+		}
+	}
+	return false
+}
+
+func validFieldType(fieldType string) bool {
+	for _, t := range FieldTypes {
+		if t == fieldType {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *FieldDef) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return d.UserEmail == sm.GetUserEmail()
+}
+
+// FormName is the name of the field's input on character and setting forms
+func (d *FieldDef) FormName() string {
+	return fmt.Sprintf("field_%v", d.Id)
+}
+
+// Check makes sure the definition makes sense before it's saved
+func (d *FieldDef) Check() error {
+	if !validFieldEntity(d.Entity) {
+		return fmt.Errorf("custom fields can't go on %q", d.Entity)
+	}
+	if !validFieldType(d.Type) {
+		return fmt.Errorf("there's no %q kind of field", d.Type)
+	}
+	if d.Type == FieldSelect && len(d.Choices) == 0 {
+		return errors.New("a select field needs some choices")
+	}
+	if d.Type == FieldReference && !validFieldEntity(d.RefEntity) {
+		return errors.New("a reference field has to point at characters or settings")
+	}
+	return nil
+}
+
+// ParseChoices splits a select field's choices, one per line
+func ParseChoices(raw string) []string {
+	choices := []string{}
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			choices = append(choices, line)
+		}
+	}
+	return choices
+}
+
+// ParseValue checks a value typed into the field and returns it the way it
+// is stored. An empty value is always fine and means the field isn't set.
+// A reference is only checked to be an id here; whether the user owns it is
+// up to the caller.
+func (d *FieldDef) ParseValue(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	switch d.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return "", fmt.Errorf("%v should be a number", d.Name)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case FieldDate:
+		if _, err := time.Parse(FieldDateLayout, raw); err != nil {
+			return "", fmt.Errorf("%v should be a date like 2016-04-23", d.Name)
+		}
+	case FieldSelect:
+		for _, choice := range d.Choices {
+			if strings.EqualFold(choice, raw) {
+				return choice, nil
+			}
+		}
+		return "", fmt.Errorf("%v should be one of its choices", d.Name)
+	case FieldReference:
+		if id, err := strconv.Atoi(raw); err != nil || id <= 0 {
+			return "", fmt.Errorf("%v should be one of your %vs", d.Name, d.RefEntity)
+		}
+	}
+	return raw, nil
+}
+
+// Display is how a stored value reads, with references turned into names
+func (d *FieldDef) Display(value string, refNames map[string]map[int]string) string {
+	if d.Type != FieldReference || value == "" {
+		return value
+	}
+	id, _ := strconv.Atoi(value)
+	return refNames[d.RefEntity][id]
+}
+
+// Matches says whether a stored value passes an index page filter. Numbers
+// and dates take an optional <, <=, > or >= in front of the query; text,
+// choices and references match if they contain the query, ignoring case.
+func (d *FieldDef) Matches(value, query string, refNames map[string]map[int]string) bool {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return true
+	}
+	if value == "" {
+		return false
+	}
+	if d.Type != FieldNumber && d.Type != FieldDate {
+		return strings.Contains(strings.ToLower(d.Display(value, refNames)), strings.ToLower(query))
+	}
+	op := ""
+	for _, prefix := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(query, prefix) {
+			op, query = prefix, strings.TrimSpace(query[len(prefix):])
+			break
+		}
+	}
+	c := 0
+	if d.Type == FieldNumber {
+		a, errA := strconv.ParseFloat(value, 64)
+		b, errB := strconv.ParseFloat(query, 64)
+		if errA != nil || errB != nil {
+			return false
+		}
+		if a < b {
+			c = -1
+		} else if a > b {
+			c = 1
+		}
+	} else {
+		// stored dates sort as text; a partial query like "1203" matches
+		// the whole year
+		if op == "" || op == "=" {
+			return strings.HasPrefix(value, query)
+		}
+		c = strings.Compare(value, query)
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return c == 0
+}
+
+func (d *FieldDef) GetInsertStr() string {
+	return `
+INSERT INTO tbl_field_def(entity, name, field_type, choices, ref_entity, work_id, field_order, user_email)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING field_def_id;
+`
+}
+
+func (d *FieldDef) GetInsertArgs() []interface{} {
+	return []interface{}{d.Entity, d.Name, d.Type, db.ToNullString(strings.Join(d.Choices, "\n")),
+		db.ToNullString(d.RefEntity), db.ToNullInt(int64(d.WorkId)), d.Order, d.UserEmail}
+}
+
+// GetUpdateStr leaves the entity and type alone, since changing either
+// would strand the values already saved
+func (d *FieldDef) GetUpdateStr() string {
+	return `
+UPDATE tbl_field_def
+SET name=$1, choices=$2, work_id=$3, field_order=$4
+WHERE field_def_id=$5
+`
+}
+
+func (d *FieldDef) GetUpdateArgs() []interface{} {
+	return []interface{}{d.Name, db.ToNullString(strings.Join(d.Choices, "\n")), db.ToNullInt(int64(d.WorkId)),
+		d.Order, d.Id}
+}
+
+func (d *FieldDef) Save(tx *sql.Tx) error {
+	return d.DB.Update(d, tx)
+}
+
+func fieldDefFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	d := FieldDef{DB: database}
+	nullChoices := sql.NullString{}
+	nullRef := sql.NullString{}
+	nullWork := sql.NullInt64{}
+	nullWorkTitle := sql.NullString{}
+	if err := r.Scan(&d.Id, &d.Entity, &d.Name, &d.Type, &nullChoices, &nullRef, &nullWork, &nullWorkTitle,
+		&d.Order, &d.UserEmail); err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+	d.Choices = ParseChoices(nullChoices.String)
+	d.RefEntity = nullRef.String
+	d.WorkId = int(nullWork.Int64)
+	d.WorkTitle = nullWorkTitle.String
+	return &d, nil
+}
+
+func fieldDefsFromQuery(query db.Queryable, database *db.DB) []*FieldDef {
+	defsInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting field definitions: %v", err.Error())
+		return nil
+	}
+	output := make([]*FieldDef, len(defsInt))
+	for i := range defsInt {
+		output[i] = defsInt[i].(*FieldDef)
+	}
+	return output
+}
+
+func GetFieldDefById(id int, database *db.DB) Verifiable {
+	defs := fieldDefsFromQuery(fieldDefByIdQuery{Id: id}, database)
+	if len(defs) == 0 {
+		return nil
+	}
+	return defs[0]
+}
+
+type fieldDefByIdQuery struct {
+	Id int
+}
+
+func (q fieldDefByIdQuery) GetQueryStr() string {
+	return fieldDefColumnStr + " WHERE d.field_def_id=$1"
+}
+
+func (q fieldDefByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q fieldDefByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return fieldDefFromRow(database, r)
+}
+
+// GetFieldDefsForUser returns the user's whole schema, characters first
+func GetFieldDefsForUser(userEmail string, database *db.DB) []*FieldDef {
+	return fieldDefsFromQuery(fieldDefsForUserQuery{UserEmail: userEmail}, database)
+}
+
+type fieldDefsForUserQuery struct {
+	UserEmail string
+}
+
+func (q fieldDefsForUserQuery) GetQueryStr() string {
+	return fieldDefColumnStr + `
+WHERE d.user_email=$1
+ORDER BY d.entity, d.field_order, d.name`
+}
+
+func (q fieldDefsForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.UserEmail}
+}
+
+func (q fieldDefsForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return fieldDefFromRow(database, r)
+}
+
+// GetFieldDefsFor returns the fields a character or setting (entity) has:
+// the global ones, plus those for any work it's in. objectId is 0 for one
+// that's being made, and workId is the work it's being made for, if any.
+func GetFieldDefsFor(entity, userEmail string, objectId, workId int, database *db.DB) []*FieldDef {
+	if !validFieldEntity(entity) {
+		return nil
+	}
+	return fieldDefsFromQuery(fieldDefsForObjectQuery{
+		Entity: entity, UserEmail: userEmail, ObjectId: objectId, WorkId: workId,
+	}, database)
+}
+
+type fieldDefsForObjectQuery struct {
+	Entity    string
+	UserEmail string
+	ObjectId  int
+	WorkId    int
+}
+
+func (q fieldDefsForObjectQuery) GetQueryStr() string {
+	return fieldDefColumnStr + fmt.Sprintf(`
+WHERE d.user_email=$1 AND d.entity=$2 AND (
+	d.work_id IS NULL OR d.work_id=$3 OR
+	d.work_id IN (SELECT work_id FROM r_works_%[1]vs WHERE %[1]v_id=$4)
+)
+ORDER BY d.work_id NULLS FIRST, d.field_order, d.name`, q.Entity)
+}
+
+func (q fieldDefsForObjectQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.UserEmail, q.Entity, q.WorkId, q.ObjectId}
+}
+
+func (q fieldDefsForObjectQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return fieldDefFromRow(database, r)
+}
+
+// GetFieldDefsForWork returns the fields the work's characters or settings
+// can have, for exporting the work
+func GetFieldDefsForWork(entity, userEmail string, workId int, database *db.DB) []*FieldDef {
+	output := []*FieldDef{}
+	for _, d := range GetFieldDefsForUser(userEmail, database) {
+		if d.Entity == entity && (d.WorkId == 0 || d.WorkId == workId) {
+			output = append(output, d)
+		}
+	}
+	return output
+}
+
+// FieldValue is a field and what one character or setting has in it
+type FieldValue struct {
+	Def     *FieldDef
+	Value   string
+	Display string
+}
+
+// GetFieldValues maps the ids of the user's characters or settings (entity)
+// to their values, keyed by field id
+func GetFieldValues(entity, userEmail string, database *db.DB) (map[int]map[int]string, error) {
+	if !validFieldEntity(entity) {
+		return nil, fmt.Errorf("custom fields can't go on %q", entity)
+	}
+	rows, err := database.DB.Query(fmt.Sprintf(`
+SELECT v.%[1]v_id, v.field_def_id, v.value FROM tbl_%[1]v_field_value v
+JOIN tbl_field_def d ON d.field_def_id=v.field_def_id
+WHERE d.user_email=$1`, entity), userEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[int]map[int]string{}
+	for rows.Next() {
+		var objectId, defId int
+		var value string
+		if err := rows.Scan(&objectId, &defId, &value); err != nil {
+			return nil, err
+		}
+		if values[objectId] == nil {
+			values[objectId] = map[int]string{}
+		}
+		values[objectId][defId] = value
+	}
+	return values, rows.Err()
+}
+
+// GetFieldValuesFor lists a character's or setting's fields with their
+// values, in schema order, including the ones that aren't set
+func GetFieldValuesFor(entity, userEmail string, objectId int, database *db.DB) []*FieldValue {
+	defs := GetFieldDefsFor(entity, userEmail, objectId, 0, database)
+	if len(defs) == 0 {
+		return []*FieldValue{}
+	}
+	values, err := GetFieldValues(entity, userEmail, database)
+	if err != nil {
+		glog.Errorf("Error on GetFieldValuesFor: %v", err.Error())
+	}
+	refNames := GetFieldRefNames(userEmail, database)
+	output := make([]*FieldValue, len(defs))
+	for i, d := range defs {
+		value := values[objectId][d.Id]
+		output[i] = &FieldValue{Def: d, Value: value, Display: d.Display(value, refNames)}
+	}
+	return output
+}
+
+// GetFieldRefNames maps "character" and "setting" to the names of the
+// user's characters and settings by id, which is what a reference field can
+// point at
+func GetFieldRefNames(userEmail string, database *db.DB) map[string]map[int]string {
+	names := map[string]map[int]string{"character": {}, "setting": {}}
+	for _, c := range GetCharactersForUser(userEmail, database) {
+		names["character"][c.Id] = c.Name
+	}
+	for _, s := range GetSettingsForUser(userEmail, database) {
+		names["setting"][s.Id] = s.Name
+	}
+	return names
+}
+
+type fieldValueInsert struct {
+	Entity   string
+	DefId    int
+	ObjectId int
+	Value    string
+}
+
+func (i fieldValueInsert) GetInsertStr() string {
+	return fmt.Sprintf(`
+INSERT INTO tbl_%[1]v_field_value(field_def_id, %[1]v_id, value)
+VALUES ($1, $2, $3)`, i.Entity)
+}
+
+func (i fieldValueInsert) GetInsertArgs() []interface{} {
+	return []interface{}{i.DefId, i.ObjectId, i.Value}
+}
+
+type fieldValuesDelete struct {
+	Entity   string
+	ObjectId int
+}
+
+func (d fieldValuesDelete) GetDeleteStr() string {
+	return fmt.Sprintf("DELETE FROM tbl_%[1]v_field_value WHERE %[1]v_id=$1", d.Entity)
+}
+
+func (d fieldValuesDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.ObjectId}
+}
+
+// SaveFieldValues replaces a character's or setting's values with values,
+// which is keyed by field id and should already have been through
+// ParseValue. Empty values are left out.
+func SaveFieldValues(database *db.DB, tx *sql.Tx, entity string, objectId int, values map[int]string) error {
+	if !validFieldEntity(entity) {
+		return fmt.Errorf("custom fields can't go on %q", entity)
+	}
+	if err := database.Delete(fieldValuesDelete{Entity: entity, ObjectId: objectId}, tx); err != nil {
+		return err
+	}
+	for defId, value := range values {
+		if value == "" {
+			continue
+		}
+		insert := fieldValueInsert{Entity: entity, DefId: defId, ObjectId: objectId, Value: value}
+		if _, err := database.Insert(insert, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FieldTable is the custom fields of a work's characters or settings laid
+// out for an export, one row each and one column per field
+type FieldTable struct {
+	Fields []*FieldDef
+	Rows   []*FieldTableRow
+}
+
+type FieldTableRow struct {
+	Id     int
+	Name   string
+	Values []string
+}
+
+// BuildFieldTable lays out the values of the objects named in names (by
+// id, in the order of ids) for the given fields
+func BuildFieldTable(defs []*FieldDef, ids []int, names map[int]string, values map[int]map[int]string,
+	refNames map[string]map[int]string) *FieldTable {
+	table := &FieldTable{Fields: defs, Rows: []*FieldTableRow{}}
+	for _, id := range ids {
+		row := &FieldTableRow{Id: id, Name: names[id], Values: make([]string, len(defs))}
+		for i, d := range defs {
+			row.Values[i] = d.Display(values[id][d.Id], refNames)
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+// GetFieldTablesForWork builds the export tables for the work's characters
+// and settings. A table with no fields is nil.
+func GetFieldTablesForWork(work *Work, characters []*Character, settings []*Setting, database *db.DB) (*FieldTable, *FieldTable) {
+	refNames := GetFieldRefNames(work.UserEmail, database)
+	build := func(entity string, ids []int, names map[int]string) *FieldTable {
+		defs := GetFieldDefsForWork(entity, work.UserEmail, work.Id, database)
+		if len(defs) == 0 {
+			return nil
+		}
+		values, err := GetFieldValues(entity, work.UserEmail, database)
+		if err != nil {
+			glog.Errorf("Error on GetFieldTablesForWork: %v", err.Error())
+		}
+		return BuildFieldTable(defs, ids, names, values, refNames)
+	}
+	characterIds, characterNames := []int{}, map[int]string{}
+	for _, c := range characters {
+		characterIds = append(characterIds, c.Id)
+		characterNames[c.Id] = c.Name
+	}
+	settingIds, settingNames := []int{}, map[int]string{}
+	for _, s := range settings {
+		settingIds = append(settingIds, s.Id)
+		settingNames[s.Id] = s.Name
+	}
+	return build("character", characterIds, characterNames), build("setting", settingIds, settingNames)
+}
+
+func DeleteFieldDef(defId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(defId, "field_def", database)
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+)
+
+// CastGraph is a work's characters and the relationships between them, in
+// a shape that graph libraries and the export formats can all use
+type CastGraph struct {
+	Nodes []CastNode `json:"nodes"`
+	Edges []CastEdge `json:"edges"`
+}
+
+type CastNode struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type CastEdge struct {
+	Id       int    `json:"id"`
+	Source   int    `json:"source"`
+	Target   int    `json:"target"`
+	Kind     string `json:"kind"`
+	Directed bool   `json:"directed"`
+	Notes    string `json:"notes"`
+}
+
+// BuildCastGraph leaves out relationships with a character outside the
+// cast. Given a sectionId, it also leaves out relationships that don't
+// hold at that section (see CharacterRelationship.ActiveAt).
+func BuildCastGraph(characters []*Character, relationships []*CharacterRelationship, sectionId int, positions map[int]int) *CastGraph {
+	graph := &CastGraph{Nodes: []CastNode{}, Edges: []CastEdge{}}
+	inCast := map[int]bool{}
+	for _, character := range characters {
+		inCast[character.Id] = true
+		graph.Nodes = append(graph.Nodes, CastNode{Id: character.Id, Name: character.Name})
+	}
+	for _, r := range relationships {
+		if !inCast[r.FromId] || !inCast[r.ToId] {
+			continue
+		}
+		if sectionId != 0 && !r.ActiveAt(sectionId, positions) {
+			continue
+		}
+		graph.Edges = append(graph.Edges, CastEdge{
+			Id: r.Id, Source: r.FromId, Target: r.ToId, Kind: r.Kind, Directed: r.Directed, Notes: r.Notes,
+		})
+	}
+	return graph
+}
+
+// GetCastGraphForWork builds the graph of a work's cast, as it stands at
+// sectionId if that's not 0
+func GetCastGraphForWork(workId, sectionId int, database *db.DB) *CastGraph {
+	sections, _ := GetSectionsForWork(workId, database)
+	positions := map[int]int{}
+	for i, section := range FlattenSectionTree(sections) {
+		positions[section.Id] = i
+	}
+	return BuildCastGraph(
+		GetCharactersForWork(workId, database), GetRelationshipsForWork(workId, database), sectionId, positions,
+	)
+}
+
+// WriteDOT writes the graph for Graphviz. Everything goes in one digraph,
+// with undirected relationships drawn without arrowheads.
+func (g *CastGraph) WriteDOT(w io.Writer, name string) error {
+	lines := []string{fmt.Sprintf("digraph %v {", strconv.Quote(name))}
+	for _, node := range g.Nodes {
+		lines = append(lines, fmt.Sprintf("  c%v [label=%v];", node.Id, strconv.Quote(node.Name)))
+	}
+	for _, edge := range g.Edges {
+		attrs := fmt.Sprintf("label=%v", strconv.Quote(edge.Kind))
+		if !edge.Directed {
+			attrs += ", dir=none"
+		}
+		lines = append(lines, fmt.Sprintf("  c%v -> c%v [%v];", edge.Source, edge.Target, attrs))
+	}
+	lines = append(lines, "}")
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	Id       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	Id          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	Id   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Id       string        `xml:"id,attr"`
+	Source   string        `xml:"source,attr"`
+	Target   string        `xml:"target,attr"`
+	Directed bool          `xml:"directed,attr"`
+	Data     []graphMLData `xml:"data"`
+}
+
+// WriteGraphML writes the graph as GraphML, which Gephi, yEd and most
+// network tools can open. Directedness is set edge by edge.
+func (g *CastGraph) WriteGraphML(w io.Writer, name string) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{Id: "name", For: "node", AttrName: "name", AttrType: "string"},
+			{Id: "kind", For: "edge", AttrName: "kind", AttrType: "string"},
+			{Id: "notes", For: "edge", AttrName: "notes", AttrType: "string"},
+		},
+		Graph: graphMLGraph{Id: name, EdgeDefault: "undirected"},
+	}
+	for _, node := range g.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			Id:   fmt.Sprintf("c%v", node.Id),
+			Data: []graphMLData{{Key: "name", Value: node.Name}},
+		})
+	}
+	for _, edge := range g.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Id:       fmt.Sprintf("r%v", edge.Id),
+			Source:   fmt.Sprintf("c%v", edge.Source),
+			Target:   fmt.Sprintf("c%v", edge.Target),
+			Directed: edge.Directed,
+			Data:     []graphMLData{{Key: "kind", Value: edge.Kind}, {Key: "notes", Value: edge.Notes}},
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,389 @@
+package models
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"regexp"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// ImageEntities are what an image can be attached to: a character's
+// portrait, a setting's map, a work's cover or a picture in a section
+var ImageEntities = []string{"character", "setting", "work", "section"}
+
+const (
+	// MaxImageBytes is the biggest upload we'll take
+	MaxImageBytes = 10 << 20
+	// maxImagePixels keeps a small file that decodes to something enormous
+	// from eating all the memory
+	maxImagePixels = 40 * 1000 * 1000
+	// ThumbnailSize is the longest side of a thumbnail, in pixels
+	ThumbnailSize = 240
+)
+
+func validImageEntity(entity string) bool {
+	for _, e := range ImageEntities {
+		if e == entity {
+			return true
+		}
+	}
+	return false
+}
+
+// Image is an uploaded picture. The picture itself and its thumbnail live in
+// a storage.Store under Key and ThumbKey; only the details are kept here.
+type Image struct {
+	Id          int
+	Entity      string
+	ObjectId    int
+	Key         string
+	ThumbKey    string
+	ContentType string
+	ThumbType   string
+	Filename    string
+	Caption     string
+	Width       int
+	Height      int
+	Size        int
+	UserEmail   string
+	DB          *db.DB
+}
+
+const imageColumnStr = `
+SELECT i.image_id,
+CASE WHEN i.character_id IS NOT NULL THEN 'character'
+	WHEN i.setting_id IS NOT NULL THEN 'setting'
+	WHEN i.work_id IS NOT NULL THEN 'work'
+	ELSE 'section' END,
+coalesce(i.character_id, i.setting_id, i.work_id, i.section_id),
+i.storage_key, i.thumb_key, i.content_type, i.thumb_type, i.filename, i.caption,
+i.width, i.height, i.size_bytes, i.user_email
+FROM tbl_image i`
+
+// VerifyPermission lets a work's members see its cover and the pictures in
+// its sections, as well as the owner
+func (i *Image) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return i.RoleFor(sm) != ""
+}
+
+func (i *Image) RoleFor(sm sessionManager.SessionManager) string {
+	if i.UserEmail == sm.GetUserEmail() {
+		return RoleOwner
+	}
+	var in Verifiable
+	switch i.Entity {
+	case "work":
+		in = GetWorkById(i.ObjectId, i.DB)
+	case "section":
+		in = GetSectionById(i.ObjectId, i.DB)
+	}
+	if m, ok := in.(Membered); ok {
+		return m.RoleFor(sm)
+	}
+	return ""
+}
+
+// Ext is the file extension that goes with the image's content type
+func (i *Image) Ext() string {
+	return imageExt(i.ContentType)
+}
+
+func imageExt(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return "jpg"
+	case "image/gif":
+		return "gif"
+	}
+	return "png"
+}
+
+// objectIds is the image's object id in whichever of the character,
+// setting, work and section columns matches its entity, NULL in the rest
+func (i *Image) objectIds() []interface{} {
+	ids := make([]interface{}, len(ImageEntities))
+	for n, entity := range ImageEntities {
+		id := 0
+		if entity == i.Entity {
+			id = i.ObjectId
+		}
+		ids[n] = db.ToNullInt(int64(id))
+	}
+	return ids
+}
+
+func (i *Image) GetInsertStr() string {
+	return `
+INSERT INTO tbl_image(character_id, setting_id, work_id, section_id, storage_key, thumb_key,
+content_type, thumb_type, filename, caption, width, height, size_bytes, user_email)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+RETURNING image_id;
+`
+}
+
+func (i *Image) GetInsertArgs() []interface{} {
+	return append(i.objectIds(), i.Key, i.ThumbKey, i.ContentType, i.ThumbType, i.Filename,
+		db.ToNullString(i.Caption), i.Width, i.Height, i.Size, i.UserEmail)
+}
+
+func imageFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	i := Image{DB: database}
+	nullCaption := sql.NullString{}
+	if err := r.Scan(&i.Id, &i.Entity, &i.ObjectId, &i.Key, &i.ThumbKey, &i.ContentType, &i.ThumbType,
+		&i.Filename, &nullCaption, &i.Width, &i.Height, &i.Size, &i.UserEmail); err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+	i.Caption = nullCaption.String
+	return &i, nil
+}
+
+func imagesFromQuery(query db.Queryable, database *db.DB) []*Image {
+	imagesInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting images: %v", err.Error())
+		return nil
+	}
+	output := make([]*Image, len(imagesInt))
+	for i := range imagesInt {
+		output[i] = imagesInt[i].(*Image)
+	}
+	return output
+}
+
+func GetImageById(id int, database *db.DB) Verifiable {
+	images := imagesFromQuery(imageByIdQuery{Id: id}, database)
+	if len(images) == 0 {
+		return nil
+	}
+	return images[0]
+}
+
+type imageByIdQuery struct {
+	Id int
+}
+
+func (q imageByIdQuery) GetQueryStr() string {
+	return imageColumnStr + " WHERE i.image_id=$1"
+}
+
+func (q imageByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q imageByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return imageFromRow(database, r)
+}
+
+// GetImagesFor returns the images attached to a character, setting, work
+// or section, newest first, so the first is the current portrait, map or
+// cover
+func GetImagesFor(entity string, objectId int, database *db.DB) []*Image {
+	if !validImageEntity(entity) {
+		return []*Image{}
+	}
+	return imagesFromQuery(imagesForObjectQuery{Entity: entity, ObjectId: objectId}, database)
+}
+
+type imagesForObjectQuery struct {
+	Entity   string
+	ObjectId int
+}
+
+func (q imagesForObjectQuery) GetQueryStr() string {
+	return fmt.Sprintf(imageColumnStr+`
+WHERE i.%v_id=$1
+ORDER BY i.image_id DESC`, q.Entity)
+}
+
+func (q imagesForObjectQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.ObjectId}
+}
+
+func (q imagesForObjectQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return imageFromRow(database, r)
+}
+
+// GetImagesForWork returns the work's covers and the images in its
+// sections. Deleting the work deletes these rows too, so the caller uses
+// this to clear them out of storage.
+func GetImagesForWork(workId int, database *db.DB) []*Image {
+	return imagesFromQuery(imagesForWorkQuery{WorkId: workId}, database)
+}
+
+type imagesForWorkQuery struct {
+	WorkId int
+}
+
+func (q imagesForWorkQuery) GetQueryStr() string {
+	return imageColumnStr + `
+WHERE i.work_id=$1 OR i.section_id IN (SELECT section_id FROM tbl_section WHERE work_id=$2)
+ORDER BY i.image_id DESC`
+}
+
+func (q imagesForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId, q.WorkId}
+}
+
+func (q imagesForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return imageFromRow(database, r)
+}
+
+// GetImagesForUser is every image the user has uploaded, for exports, which
+// can show a picture from anywhere that's been put in a section body
+func GetImagesForUser(userEmail string, database *db.DB) []*Image {
+	return imagesFromQuery(imagesForUserQuery{UserEmail: userEmail}, database)
+}
+
+type imagesForUserQuery struct {
+	UserEmail string
+}
+
+func (q imagesForUserQuery) GetQueryStr() string {
+	return imageColumnStr + `
+WHERE i.user_email=$1
+ORDER BY i.image_id DESC`
+}
+
+func (q imagesForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.UserEmail}
+}
+
+func (q imagesForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return imageFromRow(database, r)
+}
+
+func DeleteImage(imageId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(imageId, "image", database)
+}
+
+/*
+.
+.
+*/
+
+// ProcessedImage is an upload that's been checked, along with its
+// thumbnail
+type ProcessedImage struct {
+	ContentType string
+	Width       int
+	Height      int
+	Thumb       []byte
+	ThumbType   string
+}
+
+// ProcessImage makes sure data is a JPEG, PNG or GIF of a sane size and
+// makes its thumbnail. JPEGs get JPEG thumbnails; the rest get PNGs so
+// transparency survives. An animated GIF's thumbnail is its first frame.
+func ProcessImage(data []byte) (*ProcessedImage, error) {
+	if len(data) > MaxImageBytes {
+		return nil, fmt.Errorf("that image is over %vMB", MaxImageBytes>>20)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("that doesn't look like a JPEG, PNG or GIF")
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("that image is too big, at %vx%v", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("that image seems to be damaged")
+	}
+	output := &ProcessedImage{
+		ContentType: "image/" + format,
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+	thumb := Thumbnail(img, ThumbnailSize)
+	buf := &bytes.Buffer{}
+	if format == "jpeg" {
+		output.ThumbType = "image/jpeg"
+		err = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		output.ThumbType = "image/png"
+		err = png.Encode(buf, thumb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	output.Thumb = buf.Bytes()
+	return output, nil
+}
+
+// Thumbnail shrinks img so its longer side is at most size, averaging the
+// pixels that go into each pixel of the thumbnail. Smaller images come back
+// as they are.
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	thumb := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := bounds.Min.Y+ty*h/th, bounds.Min.Y+(ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := bounds.Min.X+tx*w/tw, bounds.Min.X+(tx+1)*w/tw
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			thumb.SetRGBA64(tx, ty, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return thumb
+}
+
+// NewImageKeys picks random storage keys for an image and its thumbnail
+func NewImageKeys(contentType, thumbType string) (string, string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	name := hex.EncodeToString(raw)
+	return fmt.Sprintf("images/%v.%v", name, imageExt(contentType)),
+		fmt.Sprintf("thumbs/%v.%v", name, imageExt(thumbType)), nil
+}
+
+// ReplaceImageSources swaps the src of each <img> in body that points at
+// one of our images, prefix followed by its id ("/image/12"), for whatever
+// replace returns. Images replace doesn't know about are left alone.
+func ReplaceImageSources(body, prefix string, replace func(id int) (string, bool)) string {
+	pattern := regexp.MustCompile(`(<img\b[^>]*?\ssrc=["'])[^"']*?` + regexp.QuoteMeta(prefix) + `(\d+)(["'])`)
+	return pattern.ReplaceAllStringFunc(body, func(match string) string {
+		parts := pattern.FindStringSubmatch(match)
+		id, _ := strconv.Atoi(parts[2])
+		src, ok := replace(id)
+		if !ok {
+			return match
+		}
+		return parts[1] + src + parts[3]
+	})
+}
@@ -0,0 +1,393 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/auth"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// The roles someone can have in a work, from most to least they can do.
+// The owner is whoever's user_email is on the work; everyone else is a
+// member, in tbl_work_member.
+const (
+	RoleOwner     = "owner"
+	RoleEditor    = "editor"
+	RoleCommenter = "commenter"
+	RoleViewer    = "viewer"
+)
+
+// MemberRoles are the roles an owner can give other people
+var MemberRoles = []string{RoleEditor, RoleCommenter, RoleViewer}
+
+var roleRanks = map[string]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+// RoleAllows is whether someone with role can do something that takes at
+// least needed. No role allows nothing.
+func RoleAllows(role, needed string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[needed]
+}
+
+func ValidMemberRole(role string) bool {
+	return role != RoleOwner && roleRanks[role] > 0
+}
+
+// Membered is something in a work, which the work's members can do more or
+// less with depending on their role. Its VerifyPermission is whether the
+// user has any role at all.
+type Membered interface {
+	Verifiable
+	RoleFor(sm sessionManager.SessionManager) string
+}
+
+// HasRole is whether the user can do what takes role with v. Anything that
+// isn't in a work has only its owner, who can do everything.
+func HasRole(v Verifiable, sm sessionManager.SessionManager, role string) bool {
+	if m, ok := v.(Membered); ok {
+		return RoleAllows(m.RoleFor(sm), role)
+	}
+	return v.VerifyPermission(sm)
+}
+
+// getWorkRole is email's role in the work ownerEmail owns, or "" if they
+// have none. Invites only count once they're accepted.
+func getWorkRole(workId int, ownerEmail, email string, database *db.DB) string {
+	if email == "" {
+		return ""
+	}
+	if email == ownerEmail {
+		return RoleOwner
+	}
+	var role string
+	err := database.DB.QueryRow(
+		"SELECT role FROM tbl_work_member WHERE work_id=$1 AND user_email=$2 AND accepted", workId, email,
+	).Scan(&role)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			glog.Errorf("Error getting work role: %v", err.Error())
+		}
+		return ""
+	}
+	return role
+}
+
+/*
+.
+.
+*/
+
+// InviteTokenKind is what invite tokens are signed as
+const InviteTokenKind = "work-invite"
+
+// inviteValidTime is how long an invite link works for, in minutes
+const inviteValidTime = 7 * 24 * 60
+
+// WorkMember is someone other than the owner with a role in a work. Until
+// they follow the link in their invite email it's just an invite.
+type WorkMember struct {
+	Id        int
+	WorkId    int
+	UserEmail string
+	Role      string
+	Accepted  bool
+	InvitedBy string
+	CreatedAt time.Time
+	// these come from the work
+	WorkTitle  string
+	OwnerEmail string
+	DB         *db.DB
+}
+
+const workMemberColumnStr = `
+SELECT m.work_member_id, m.work_id, m.user_email, m.role, m.accepted, m.invited_by, m.created_at, w.title, w.user_email
+FROM tbl_work_member m
+JOIN tbl_work w ON w.work_id=m.work_id AND w.deleted_at IS NULL`
+
+// VerifyPermission is for managing members, which only the owner does
+func (m *WorkMember) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return m.OwnerEmail == sm.GetUserEmail()
+}
+
+// GetInsertStr re-invites someone who's already a member or invited with
+// the new role, rather than failing
+func (m *WorkMember) GetInsertStr() string {
+	return `
+INSERT INTO tbl_work_member(work_id, user_email, role, invited_by)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (work_id, user_email) DO UPDATE SET role=excluded.role
+RETURNING work_member_id
+`
+}
+
+func (m *WorkMember) GetInsertArgs() []interface{} {
+	return []interface{}{m.WorkId, strings.ToLower(m.UserEmail), m.Role, m.InvitedBy}
+}
+
+func workMemberFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	m := WorkMember{DB: database}
+	if err := r.Scan(&m.Id, &m.WorkId, &m.UserEmail, &m.Role, &m.Accepted, &m.InvitedBy, &m.CreatedAt,
+		&m.WorkTitle, &m.OwnerEmail); err != nil {
+		glog.Errorf("Error with workMemberFromRow: %v", err.Error())
+		return nil, err
+	}
+	return &m, nil
+}
+
+type workMemberRoleUpdate struct {
+	Id   int
+	Role string
+}
+
+func (u workMemberRoleUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_work_member SET role=$1 WHERE work_member_id=$2"
+}
+
+func (u workMemberRoleUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Role, u.Id}
+}
+
+func SetWorkMemberRole(database *db.DB, tx *sql.Tx, memberId int, role string) error {
+	return database.Update(workMemberRoleUpdate{Id: memberId, Role: role}, tx)
+}
+
+type workMemberAcceptUpdate struct {
+	Id int
+}
+
+func (u workMemberAcceptUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_work_member SET accepted=true WHERE work_member_id=$1"
+}
+
+func (u workMemberAcceptUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+func AcceptWorkInvite(database *db.DB, tx *sql.Tx, memberId int) error {
+	return database.Update(workMemberAcceptUpdate{Id: memberId}, tx)
+}
+
+// NewInviteToken is for the link in the member's invite email
+func NewInviteToken(m *WorkMember) string {
+	return auth.NewTSToken(strconv.Itoa(m.Id), InviteTokenKind)
+}
+
+// GetWorkMemberByInviteToken returns who the invite was for, or nil if the
+// token's forged, too old or the invite's been withdrawn
+func GetWorkMemberByInviteToken(token string, database *db.DB) *WorkMember {
+	rawId, valid := auth.VerifyTSToken(InviteTokenKind, token, inviteValidTime)
+	if !valid {
+		return nil
+	}
+	id, err := strconv.Atoi(rawId)
+	if err != nil {
+		return nil
+	}
+	member, _ := GetWorkMemberById(id, database).(*WorkMember)
+	return member
+}
+
+func GetWorkMemberById(id int, database *db.DB) Verifiable {
+	members := workMembersFromQuery(workMemberByIdQuery{Id: id}, database)
+	if len(members) == 0 {
+		return nil
+	}
+	return members[0]
+}
+
+// GetMembersForWork is the work's members and open invites, by email
+func GetMembersForWork(workId int, database *db.DB) []*WorkMember {
+	return workMembersFromQuery(workMembersForWorkQuery{WorkId: workId}, database)
+}
+
+func workMembersFromQuery(query db.Queryable, database *db.DB) []*WorkMember {
+	membersInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting work members: %v", err.Error())
+		return nil
+	}
+	output := make([]*WorkMember, len(membersInt))
+	for i := range membersInt {
+		output[i] = membersInt[i].(*WorkMember)
+	}
+	return output
+}
+
+type workMemberByIdQuery struct {
+	Id int
+}
+
+func (q workMemberByIdQuery) GetQueryStr() string {
+	return workMemberColumnStr + " WHERE m.work_member_id=$1"
+}
+
+func (q workMemberByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q workMemberByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return workMemberFromRow(database, r)
+}
+
+type workMembersForWorkQuery struct {
+	WorkId int
+}
+
+func (q workMembersForWorkQuery) GetQueryStr() string {
+	return workMemberColumnStr + " WHERE m.work_id=$1 ORDER BY m.user_email"
+}
+
+func (q workMembersForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId}
+}
+
+func (q workMembersForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return workMemberFromRow(database, r)
+}
+
+func DeleteWorkMember(memberId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(memberId, "work_member", database)
+}
+
+// GetSharedWorksForUser is the works someone's a member of but doesn't own
+func GetSharedWorksForUser(email string, database *db.DB) []*Work {
+	return parseMultiworkQuery(database.Query(sharedWorksForUserQuery{Email: email}))
+}
+
+type sharedWorksForUserQuery struct {
+	Email string
+}
+
+func (q sharedWorksForUserQuery) GetQueryStr() string {
+	return workListColumnStr + `
+where tbl_work.work_id in (select work_id from tbl_work_member where user_email=$1 and accepted)
+and tbl_work.deleted_at is null
+order by tbl_work.title`
+}
+
+func (q sharedWorksForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Email}
+}
+
+func (q sharedWorksForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return workFromRow(database, r)
+}
+
+/*
+.
+.
+*/
+
+// What an Activity can be
+const (
+	ActivityCreated = "created"
+	ActivityEdited  = "edited"
+	ActivityDeleted = "deleted"
+	ActivityJoined  = "joined"
+)
+
+// Activity is something someone did in a work, mostly to its sections.
+// SectionTitle is kept as it was, so the log still reads right after the
+// section's renamed or gone.
+type Activity struct {
+	Id           int
+	WorkId       int
+	SectionId    int
+	SectionTitle string
+	UserEmail    string
+	Action       string
+	CreatedAt    time.Time
+}
+
+const activityColumnStr = `
+SELECT activity_id, work_id, section_id, section_title, user_email, action, created_at
+FROM tbl_activity`
+
+// SectionActivity is what the section editors log
+func SectionActivity(section *Section, email, action string) *Activity {
+	return &Activity{
+		WorkId:       section.WorkId,
+		SectionId:    section.Id,
+		SectionTitle: section.Title,
+		UserEmail:    email,
+		Action:       action,
+	}
+}
+
+// Describe is the activity for the log, without who did it or when
+func (a *Activity) Describe() string {
+	if a.Action == ActivityJoined {
+		return "joined the work"
+	}
+	return fmt.Sprintf("%v %v", a.Action, a.SectionTitle)
+}
+
+func (a *Activity) GetInsertStr() string {
+	return `
+INSERT INTO tbl_activity(work_id, section_id, section_title, user_email, action)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING activity_id
+`
+}
+
+func (a *Activity) GetInsertArgs() []interface{} {
+	return []interface{}{a.WorkId, db.ToNullInt(int64(a.SectionId)), a.SectionTitle, a.UserEmail, a.Action}
+}
+
+func activityFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	a := Activity{}
+	sectionId := sql.NullInt64{}
+	if err := r.Scan(&a.Id, &a.WorkId, &sectionId, &a.SectionTitle, &a.UserEmail, &a.Action, &a.CreatedAt); err != nil {
+		glog.Errorf("Error with activityFromRow: %v", err.Error())
+		return nil, err
+	}
+	a.SectionId = int(sectionId.Int64)
+	return &a, nil
+}
+
+// LogActivity goes in the same transaction as the change it's about
+func LogActivity(database *db.DB, tx *sql.Tx, a *Activity) error {
+	_, err := database.Insert(a, tx)
+	return err
+}
+
+// GetActivityForWork is the work's latest activity, newest first
+func GetActivityForWork(workId, limit int, database *db.DB) []*Activity {
+	activityInt, err := database.Query(activityForWorkQuery{WorkId: workId, Limit: limit})
+	if err != nil {
+		glog.Errorf("Error getting activity: %v", err.Error())
+		return nil
+	}
+	output := make([]*Activity, len(activityInt))
+	for i := range activityInt {
+		output[i] = activityInt[i].(*Activity)
+	}
+	return output
+}
+
+type activityForWorkQuery struct {
+	WorkId int
+	Limit  int
+}
+
+func (q activityForWorkQuery) GetQueryStr() string {
+	return activityColumnStr + " WHERE work_id=$1 ORDER BY created_at DESC, activity_id DESC LIMIT $2"
+}
+
+func (q activityForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId, q.Limit}
+}
+
+func (q activityForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return activityFromRow(database, r)
+}
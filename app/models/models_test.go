@@ -1,14 +1,25 @@
 package models
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/lib/pq"
 )
 
 func TestInserts(t *testing.T) {
-	objects := []db.Insertable{&Section{}, &Work{}, &Character{}}
+	objects := []db.Insertable{&Section{}, &Work{}, &Character{}, &APIToken{}, userCopyInsert{}, linksCopyInsert{}, &StatusChange{}, &Event{}, &CharacterRelationship{}, &Setting{}, &FieldDef{}, fieldValueInsert{Entity: "character"}, &Image{Entity: "work"}, &Series{}, &ShareLink{}, &Comment{}, &WorkMember{}, &Activity{}, &Revision{}, revisionChangeInsert{Field: &ReplaceField{}}, aliasInsert{Entity: "character"}}
 	for _, obj := range objects {
 		queryStr := obj.GetInsertStr()
 		queryArgs := obj.GetInsertArgs()
@@ -20,7 +31,12 @@ func TestInserts(t *testing.T) {
 }
 
 func TestUpdates(t *testing.T) {
-	objects := []db.Updatable{&Section{}, &Work{}, &Character{}}
+	objects := []db.Updatable{&Section{}, &Work{}, &Character{}, totpUpdate{}, userEmailUpdate{Table: "tbl_work"}, invitedByUpdate{}, loginAttemptsUpdate{}, sectionStatusUpdate{}, &Event{}, &CharacterRelationship{}, &Setting{}, &FieldDef{}, &Series{}, shareLinkTokenUpdate{},
+		commentAnchorUpdate{}, commentResolveUpdate{}, commentsEmailedUpdate{}, workMemberRoleUpdate{}, workMemberAcceptUpdate{},
+		trashUpdate{Entity: "work"}, workSectionsTrashUpdate{}, workSectionsRestoreUpdate{}, sectionWordsUpdate{}, settingParentClear{},
+		sectionsShiftUpdate{}, commentsMoveUpdate{}, sectionChildrenMoveUpdate{},
+		sectionWorkUpdate{}, snippetPromoteUpdate{}, fieldValueUpdate{Entity: "section", Field: "body"}, sectionWordCountUpdate{},
+		sectionWordCountSet{}, revisionUndoneUpdate{}}
 	for _, obj := range objects {
 		queryStr := obj.GetUpdateStr()
 		queryArgs := obj.GetUpdateArgs()
@@ -38,6 +54,49 @@ func TestQueries(t *testing.T) {
 		&worksForUserQuery{},
 		&characterDetailQuery{},
 		&charactersForUserQuery{},
+		&apiTokenByHashQuery{},
+		&apiTokensForUserQuery{},
+		&sessionsForUserQuery{},
+		&userByEmailQuery{},
+		&statusHistoryForWorkQuery{},
+		&eventByIdQuery{},
+		&eventsForUserQuery{},
+		&sectionsForUserQuery{},
+		&relationshipByIdQuery{},
+		&relationshipsForCharacterQuery{},
+		&relationshipsForWorkQuery{},
+		&sectionsWithinSettingQuery{},
+		&settingByIdQuery{},
+		&settingsForUserQuery{},
+		&fieldDefByIdQuery{},
+		&fieldDefsForUserQuery{},
+		&fieldDefsForObjectQuery{Entity: "character"},
+		&imageByIdQuery{},
+		&imagesForObjectQuery{Entity: "section"},
+		&imagesForWorkQuery{},
+		&imagesForUserQuery{},
+		&seriesByIdQuery{},
+		&seriesForUserQuery{},
+		&worksForSeriesQuery{},
+		&seriesBibleQuery{Entity: "character"},
+		&seriesBibleQuery{Entity: "setting"},
+		&shareLinkByIdQuery{},
+		&shareLinksForWorkQuery{},
+		&commentByIdQuery{},
+		&commentsForSectionQuery{},
+		&commentsForWorkQuery{},
+		&undigestedCommentsQuery{},
+		&workMemberByIdQuery{},
+		&workMembersForWorkQuery{},
+		&sharedWorksForUserQuery{},
+		&activityForWorkQuery{},
+		&trashForUserQuery{},
+		&expiredTrashQuery{},
+		&trashedItemQuery{Entity: "section"},
+		&revisionsForWorkQuery{},
+		&renameSectionsQuery{Entity: "setting"},
+		&eventsForCharacterQuery{},
+		&revisionByIdQuery{},
 	}
 	for _, obj := range objects {
 		queryStr := obj.GetQueryStr()
@@ -48,3 +107,953 @@ func TestQueries(t *testing.T) {
 		}
 	}
 }
+
+func TestRecoveryCodesInsert(t *testing.T) {
+	insert := recoveryCodesInsert{Email: "a@b.c", Hashes: []string{"x", "y", "z"}}
+	// $1 is reused for every row, so check the highest placeholder instead
+	queryStr := insert.GetInsertStr()
+	if !strings.Contains(queryStr, "$4") || strings.Contains(queryStr, "$5") || len(insert.GetInsertArgs()) != 4 {
+		t.Errorf("Mismatch in number of arguments on %v", queryStr)
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	_, token, err := NewAPIToken("script", "admin", "a@b.c", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Scope != TokenScopeRead {
+		t.Errorf("Unknown scope should fall back to read, got %v", token.Scope)
+	}
+	if token.Allows("POST") || !token.Allows("GET") {
+		t.Error("Read tokens should only allow GET")
+	}
+	if token.IsExpired(time.Now()) {
+		t.Error("Token without an expiry date expired")
+	}
+	token.ExpiresAt.Time, token.ExpiresAt.Valid = time.Now().Add(-time.Minute), true
+	if !token.IsExpired(time.Now()) {
+		t.Error("Expired token still valid")
+	}
+}
+
+func TestBuildSectionTree(t *testing.T) {
+	sections := []*Section{
+		{Id: 1, Order: 2, WordCount: 100},
+		{Id: 2, Order: 1, WordCount: 10},
+		{Id: 3, Order: 2, ParentId: 1, WordCount: 20},
+		{Id: 4, Order: 1, ParentId: 1, WordCount: 30},
+		{Id: 5, Order: 1, ParentId: 4, WordCount: 40},
+		{Id: 6, Order: 3, ParentId: 99, WordCount: 1},
+	}
+	roots := BuildSectionTree(sections)
+	if len(roots) != 3 || roots[0].Id != 2 || roots[1].Id != 1 || roots[2].Id != 6 {
+		t.Fatalf("Wrong roots: %v", roots)
+	}
+	flat := FlattenSectionTree(roots)
+	expected := []struct {
+		id     int
+		number string
+		depth  int
+		total  int
+	}{
+		{2, "1", 0, 10}, {1, "2", 0, 190}, {4, "2.1", 1, 70}, {5, "2.1.1", 2, 40}, {3, "2.2", 1, 20}, {6, "3", 0, 1},
+	}
+	for i, want := range expected {
+		got := flat[i]
+		if got.Id != want.id || got.Number != want.number || got.Depth != want.depth || got.TotalWordCount != want.total {
+			t.Errorf("Position %v: got id %v %v depth %v total %v, want %+v", i, got.Id, got.Number, got.Depth, got.TotalWordCount, want)
+		}
+	}
+	cycle := BuildSectionTree([]*Section{{Id: 1, ParentId: 2}, {Id: 2, ParentId: 1}})
+	if len(FlattenSectionTree(cycle)) != 2 {
+		t.Error("Sections in a parent cycle went missing")
+	}
+}
+
+func TestSectionPlacements(t *testing.T) {
+	placements, err := parseSectionOrder("1-1-0,2-1-1,3-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !placements[1].MoveParent || placements[1].ParentId != 1 || placements[2].MoveParent {
+		t.Errorf("Bad parse: %+v", placements)
+	}
+	if _, err := parseSectionOrder("1-x-0"); err == nil {
+		t.Error("Bad entry parsed")
+	}
+	parents := map[int]int{1: 0, 2: 0, 3: 2}
+	if err := checkSectionPlacements(placements, parents); err != nil {
+		t.Error(err)
+	}
+	if err := checkSectionPlacements([]sectionPlacement{{Id: 2, ParentId: 3, MoveParent: true}}, parents); err == nil {
+		t.Error("Section moved inside its own subsection")
+	}
+	if err := checkSectionPlacements([]sectionPlacement{{Id: 2, ParentId: 42, MoveParent: true}}, parents); err == nil {
+		t.Error("Section moved under another work's section")
+	}
+	if err := checkSectionPlacements([]sectionPlacement{{Id: 42, Order: 1}}, parents); err == nil {
+		t.Error("Another work's section reordered")
+	}
+}
+
+func TestParseStatuses(t *testing.T) {
+	got := ParseStatuses(" outline, draft,,draft , done ")
+	if strings.Join(got, "|") != "outline|draft|done" {
+		t.Errorf("Got %v", got)
+	}
+	if len(ParseStatuses(" , ")) != len(DefaultSectionStatuses) {
+		t.Error("Empty statuses didn't fall back to the defaults")
+	}
+}
+
+func TestGroupSectionsByStatus(t *testing.T) {
+	work := &Work{Statuses: []string{"idea", "done"}}
+	sections := []*Section{
+		{Id: 1, WordCount: 10}, {Id: 2, Status: "done", WordCount: 20},
+		{Id: 3, Status: "cut", WordCount: 5}, {Id: 4, Status: "idea", WordCount: 1},
+	}
+	columns := GroupSectionsByStatus(work, sections)
+	if len(columns) != 3 {
+		t.Fatalf("Expected 3 columns, got %v", len(columns))
+	}
+	expected := []struct {
+		status    string
+		count     int
+		wordCount int
+	}{{"idea", 2, 11}, {"done", 1, 20}, {"cut", 1, 5}}
+	for i, want := range expected {
+		got := columns[i]
+		if got.Status != want.status || len(got.Sections) != want.count || got.WordCount != want.wordCount {
+			t.Errorf("Column %v: got %v with %v sections and %v words, want %+v", i, got.Status, len(got.Sections), got.WordCount, want)
+		}
+	}
+	if filtered := filterSectionsByStatus(sections, []string{"done", "cut"}); len(filtered) != 2 {
+		t.Errorf("Expected 2 filtered sections, got %v", len(filtered))
+	}
+}
+
+func TestCompareStoryKeys(t *testing.T) {
+	ordered := []string{"", "1203-2-14", "1203-02-15", "1203-11-3 21:00", "Year 9", "year 10", "Year 10 spring"}
+	for i := 1; i < len(ordered); i++ {
+		if CompareStoryKeys(ordered[i-1], ordered[i]) != -1 || CompareStoryKeys(ordered[i], ordered[i-1]) != 1 {
+			t.Errorf("Expected %q before %q", ordered[i-1], ordered[i])
+		}
+	}
+	if CompareStoryKeys("1203-4-2", "1203-04-02") != 0 {
+		t.Error("Leading zeros changed the order")
+	}
+	sections := SortSectionsByStoryTime([]*Section{
+		{Id: 1}, {Id: 2, StorySortKey: "10"}, {Id: 3, StoryTime: "9"}, {Id: 4, StorySortKey: "2", StoryTime: "11"},
+	})
+	for i, id := range []int{4, 3, 2, 1} {
+		if sections[i].Id != id {
+			t.Errorf("Position %v: got section %v, want %v", i, sections[i].Id, id)
+		}
+	}
+}
+
+func TestFindStoryTimeConflicts(t *testing.T) {
+	sections := []*Section{
+		{Id: 1, StorySortKey: "1203-4-2"}, {Id: 2, StorySortKey: "1203-04-02"},
+		{Id: 3, StorySortKey: "1203-4-2"}, {Id: 4, StorySortKey: "1203-4-3"}, {Id: 5},
+	}
+	characters := map[int][]int{1: {10, 11}, 2: {10}, 3: {11}, 4: {10}, 5: {10}}
+	settings := map[int][]int{1: {20}, 2: {21}, 3: {20, 21}, 4: {22}, 5: {23}}
+	conflicts := FindStoryTimeConflicts(sections, characters, settings, nil)
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected 1 conflict, got %v", len(conflicts))
+	}
+	if conflicts[0].CharacterId != 10 || len(conflicts[0].Sections) != 2 {
+		t.Errorf("Wrong conflict: %+v", conflicts[0])
+	}
+	settings[2] = nil
+	if conflicts := FindStoryTimeConflicts(sections, characters, settings, nil); len(conflicts) != 0 {
+		t.Errorf("A section without a setting conflicted: %+v", conflicts[0])
+	}
+	// 21 and 22 are both inside 20: being in 20 and 21 at once is fine,
+	// being in 21 and 22 isn't
+	parents := map[int]int{20: 0, 21: 20, 22: 20}
+	settings[2] = []int{21}
+	if conflicts := FindStoryTimeConflicts(sections, characters, settings, parents); len(conflicts) != 0 {
+		t.Errorf("A section inside another's setting conflicted: %+v", conflicts[0])
+	}
+	settings[1] = []int{22}
+	if conflicts := FindStoryTimeConflicts(sections, characters, settings, parents); len(conflicts) != 1 {
+		t.Errorf("Expected sibling places to conflict, got %v", len(conflicts))
+	}
+}
+
+func TestSortEventsByStoryTime(t *testing.T) {
+	events := SortEventsByStoryTime([]*Event{
+		{Id: 1}, {Id: 2, StorySortKey: "Year 10", StoryEndKey: "Year 12"},
+		{Id: 3, StorySortKey: "Year 10", StoryEndKey: "Year 11"}, {Id: 4, StoryTime: "Year 9"},
+	})
+	for i, id := range []int{4, 3, 2, 1} {
+		if events[i].Id != id {
+			t.Errorf("Position %v: got event %v, want %v", i, events[i].Id, id)
+		}
+	}
+}
+
+func TestTimelineExport(t *testing.T) {
+	events := []*Event{{
+		Id: 7, Title: "The duel", Description: "Swords, \"mostly\"", StoryTime: "Midsummer", StorySortKey: "1203-6-21",
+		Characters: []*Character{{Id: 1, Name: "Ada"}, {Id: 2, Name: "Bo"}},
+		Settings:   []*Setting{{Id: 3, Name: "The green"}},
+	}}
+	buf := &bytes.Buffer{}
+	if err := WriteTimelineCSV(buf, events); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id,title,description,story_time,start,end,characters,settings,sections\n" +
+		"7,The duel,\"Swords, \"\"mostly\"\"\",Midsummer,1203-6-21,,Ada; Bo,The green,\n"
+	if buf.String() != expected {
+		t.Errorf("Got CSV %q", buf.String())
+	}
+	buf.Reset()
+	if err := WriteTimelineJSON(buf, events); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"start": "1203-6-21"`, `"characters": [`, `"sections": []`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("JSON missing %v: %v", want, buf.String())
+		}
+	}
+}
+
+func TestBuildCastGraph(t *testing.T) {
+	characters := []*Character{{Id: 1, Name: "Ada"}, {Id: 2, Name: "Bo"}, {Id: 3, Name: "Cy"}}
+	relationships := []*CharacterRelationship{
+		{Id: 1, FromId: 1, ToId: 2, Kind: "sibling"},
+		{Id: 2, FromId: 2, ToId: 3, Kind: "mentor", Directed: true, StartSectionId: 20},
+		{Id: 3, FromId: 1, ToId: 3, Kind: "rival", EndSectionId: 10},
+		{Id: 4, FromId: 1, ToId: 9, Kind: "loves"},
+	}
+	positions := map[int]int{10: 0, 20: 1, 30: 2}
+	tests := []struct {
+		SectionId int
+		Edges     []int
+	}{
+		{0, []int{1, 2, 3}},
+		{10, []int{1, 3}},
+		{30, []int{1, 2}},
+	}
+	for _, test := range tests {
+		graph := BuildCastGraph(characters, relationships, test.SectionId, positions)
+		if len(graph.Nodes) != 3 || len(graph.Edges) != len(test.Edges) {
+			t.Errorf("At section %v: got %v nodes and edges %v", test.SectionId, len(graph.Nodes), graph.Edges)
+			continue
+		}
+		for i, id := range test.Edges {
+			if graph.Edges[i].Id != id {
+				t.Errorf("At section %v: got edge %v, want %v", test.SectionId, graph.Edges[i].Id, id)
+			}
+		}
+	}
+}
+
+func TestCastGraphExport(t *testing.T) {
+	graph := &CastGraph{
+		Nodes: []CastNode{{Id: 1, Name: "Ada \"the Red\""}, {Id: 2, Name: "Bo"}},
+		Edges: []CastEdge{{Id: 5, Source: 1, Target: 2, Kind: "sibling"}, {Id: 6, Source: 2, Target: 1, Kind: "mentor", Directed: true}},
+	}
+	buf := &bytes.Buffer{}
+	if err := graph.WriteDOT(buf, "Novel"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`c1 [label="Ada \"the Red\""];`, `c1 -> c2 [label="sibling", dir=none];`, `c2 -> c1 [label="mentor"];`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("DOT missing %v: %v", want, buf.String())
+		}
+	}
+	buf.Reset()
+	if err := graph.WriteGraphML(buf, "Novel"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<node id="c1">`, `<edge id="r6" source="c2" target="c1" directed="true">`, `<data key="kind">mentor</data>`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("GraphML missing %v: %v", want, buf.String())
+		}
+	}
+}
+
+func TestBuildSettingTree(t *testing.T) {
+	settings := []*Setting{
+		{Id: 1, Name: "The Southern Reaches"}, {Id: 2, Name: "Caldera", ParentId: 1},
+		{Id: 3, Name: "Lowtown", ParentId: 2}, {Id: 4, Name: "Crooked Inn", ParentId: 3},
+		{Id: 5, Name: "Anvil Street", ParentId: 3}, {Id: 6, Name: "Elsewhere"},
+	}
+	flat := FlattenSettingTree(BuildSettingTree(settings))
+	for i, id := range []int{6, 1, 2, 3, 5, 4} {
+		if flat[i].Id != id {
+			t.Errorf("Position %v: got setting %v, want %v", i, flat[i].Id, id)
+		}
+	}
+	if settings[3].Depth != 3 {
+		t.Errorf("Crooked Inn has depth %v", settings[3].Depth)
+	}
+	cycle := BuildSettingTree([]*Setting{{Id: 1, ParentId: 2}, {Id: 2, ParentId: 1}})
+	if len(FlattenSettingTree(cycle)) != 2 {
+		t.Error("Settings in a parent cycle went missing")
+	}
+}
+
+func TestCheckSettingParent(t *testing.T) {
+	parents := map[int]int{1: 0, 2: 1, 3: 2, 4: 0}
+	tests := []struct {
+		Id, ParentId int
+		OK           bool
+	}{
+		{3, 4, true},
+		{4, 3, true},
+		{2, 0, true},
+		{1, 1, false},
+		{1, 3, false},
+		{2, 9, false},
+	}
+	for _, test := range tests {
+		if err := CheckSettingParent(test.Id, test.ParentId, parents); (err == nil) != test.OK {
+			t.Errorf("Putting %v in %v: got error %v", test.Id, test.ParentId, err)
+		}
+	}
+	if ancestors := SettingAncestors(3, parents); len(ancestors) != 2 || ancestors[0] != 2 || ancestors[1] != 1 {
+		t.Errorf("Wrong ancestors: %v", ancestors)
+	}
+	if ancestors := SettingAncestors(1, map[int]int{1: 2, 2: 1}); len(ancestors) != 1 {
+		t.Errorf("Ancestors looped on a cycle: %v", ancestors)
+	}
+}
+
+func TestFieldParseValue(t *testing.T) {
+	tests := []struct {
+		Def       FieldDef
+		Raw, Want string
+		OK        bool
+	}{
+		{FieldDef{Type: FieldText}, " Grey ", "Grey", true},
+		{FieldDef{Type: FieldNumber}, "30.50", "30.5", true},
+		{FieldDef{Type: FieldNumber}, "thirty", "", false},
+		{FieldDef{Type: FieldDate}, "1203-04-23", "1203-04-23", true},
+		{FieldDef{Type: FieldDate}, "April 1203", "", false},
+		{FieldDef{Type: FieldSelect, Choices: []string{"Red", "Blue"}}, "blue", "Blue", true},
+		{FieldDef{Type: FieldSelect, Choices: []string{"Red", "Blue"}}, "Green", "", false},
+		{FieldDef{Type: FieldReference, RefEntity: "character"}, "7", "7", true},
+		{FieldDef{Type: FieldReference, RefEntity: "character"}, "-7", "", false},
+		{FieldDef{Type: FieldNumber}, "", "", true},
+	}
+	for _, test := range tests {
+		got, err := test.Def.ParseValue(test.Raw)
+		if (err == nil) != test.OK || got != test.Want {
+			t.Errorf("%v field with %q: got %q, %v", test.Def.Type, test.Raw, got, err)
+		}
+	}
+}
+
+func TestFieldMatches(t *testing.T) {
+	refNames := map[string]map[int]string{"setting": {3: "Lowtown"}}
+	tests := []struct {
+		Def          FieldDef
+		Value, Query string
+		Want         bool
+	}{
+		{FieldDef{Type: FieldNumber}, "30", ">25", true},
+		{FieldDef{Type: FieldNumber}, "30", "<= 29.5", false},
+		{FieldDef{Type: FieldNumber}, "30", "30", true},
+		{FieldDef{Type: FieldDate}, "1203-04-23", "1203", true},
+		{FieldDef{Type: FieldDate}, "1203-04-23", "<1203-05", true},
+		{FieldDef{Type: FieldDate}, "1203-04-23", ">=1204", false},
+		{FieldDef{Type: FieldText}, "Dark grey", "GREY", true},
+		{FieldDef{Type: FieldReference, RefEntity: "setting"}, "3", "low", true},
+		{FieldDef{Type: FieldText}, "", "grey", false},
+		{FieldDef{Type: FieldText}, "", " ", true},
+	}
+	for _, test := range tests {
+		if got := test.Def.Matches(test.Value, test.Query, refNames); got != test.Want {
+			t.Errorf("%v field %q against %q: got %v", test.Def.Type, test.Value, test.Query, got)
+		}
+	}
+}
+
+func TestBuildFieldTable(t *testing.T) {
+	defs := []*FieldDef{
+		{Id: 1, Type: FieldNumber},
+		{Id: 2, Type: FieldReference, RefEntity: "character"},
+	}
+	names := map[int]string{10: "Ada", 11: "Bram"}
+	values := map[int]map[int]string{10: {1: "34", 2: "11"}}
+	refNames := map[string]map[int]string{"character": names}
+	table := BuildFieldTable(defs, []int{11, 10}, names, values, refNames)
+	if len(table.Rows) != 2 || table.Rows[0].Name != "Bram" {
+		t.Fatalf("Rows in the wrong order: %v", table.Rows)
+	}
+	if table.Rows[0].Values[0] != "" || table.Rows[1].Values[0] != "34" || table.Rows[1].Values[1] != "Bram" {
+		t.Errorf("Wrong values: %v, %v", table.Rows[0].Values, table.Rows[1].Values)
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 600, 300))
+	for x := 0; x < 600; x++ {
+		for y := 0; y < 300; y++ {
+			img.Set(x, y, color.NRGBA{uint8(x % 2 * 255), 0, 0, 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	png.Encode(buf, img)
+	processed, err := ProcessImage(buf.Bytes())
+	if err != nil {
+		t.Fatalf("PNG: %v", err)
+	}
+	if processed.ContentType != "image/png" || processed.ThumbType != "image/png" ||
+		processed.Width != 600 || processed.Height != 300 {
+		t.Errorf("PNG came out as %+v", processed)
+	}
+	thumb, err := png.Decode(bytes.NewReader(processed.Thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := thumb.Bounds().Size(); size.X != ThumbnailSize || size.Y != ThumbnailSize/2 {
+		t.Errorf("Thumbnail is %v", size)
+	}
+	// alternating red and black columns should average out to dark red
+	if r, _, _, _ := thumb.At(10, 10).RGBA(); r>>8 < 100 || r>>8 > 155 {
+		t.Errorf("Thumbnail wasn't averaged: red is %v", r>>8)
+	}
+
+	buf.Reset()
+	jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 10, 20)), nil)
+	if processed, err := ProcessImage(buf.Bytes()); err != nil || processed.ThumbType != "image/jpeg" {
+		t.Errorf("JPEG: %+v, %v", processed, err)
+	}
+	if _, err := ProcessImage([]byte("<svg></svg>")); err == nil {
+		t.Error("Took something that isn't an image")
+	}
+}
+
+func TestReplaceImageSources(t *testing.T) {
+	body := `<p>Map: <img src="/image/12" alt="map"> and <img alt="x" src='https://pathfork.example/image/7'>` +
+		` and <img src="/image/99"> but not <a href="/image/12">this</a> or <img src="/image/thumb/12"></p>`
+	got := ReplaceImageSources(body, "/image/", func(id int) (string, bool) {
+		if id == 99 {
+			return "", false
+		}
+		return "images/" + strconv.Itoa(id) + ".png", true
+	})
+	want := `<p>Map: <img src="images/12.png" alt="map"> and <img alt="x" src='images/7.png'>` +
+		` and <img src="/image/99"> but not <a href="/image/12">this</a> or <img src="/image/thumb/12"></p>`
+	if got != want {
+		t.Errorf("Got %v", got)
+	}
+}
+
+func TestWriteEPUB(t *testing.T) {
+	cover := &EPUBImage{Name: "images/1.png", ContentType: "image/png", Data: []byte("png")}
+	book := &EPUB{
+		Identifier:     "urn:pathfork:work:1",
+		Title:          "Salt & Iron",
+		Subtitle:       "A Novel",
+		Blurb:          "<p>Two &amp; a <b>half</b></p>",
+		Language:       "en",
+		Creator:        "A. N. Author",
+		Rights:         "Copyright © 2017 A. N. Author",
+		Series:         "The Long Road",
+		SeriesPosition: "2",
+		Modified:       time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC),
+		Cover:          cover,
+		Images:         []*EPUBImage{cover},
+		Chapters: []*EPUBChapter{
+			{Title: "Dedication", Body: "<p>For Sam</p>", Type: "dedication"},
+			{Title: "One", Body: `<p>It was&nbsp;dark<br>and <img src="images/1.png"><p>unclosed`},
+			{Title: "One <and> a half", Depth: 1, Body: `a < b, <script>alert(1)</script>`},
+		},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteEPUB(buf, book); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.File[0].Name != "mimetype" || z.File[0].Method != zip.Store {
+		t.Errorf("mimetype isn't first and stored")
+	}
+	files := map[string]string{}
+	for _, f := range z.File {
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(data)
+		if strings.HasSuffix(f.Name, ".xhtml") || strings.HasSuffix(f.Name, ".opf") || strings.HasSuffix(f.Name, ".xml") {
+			d := xml.NewDecoder(bytes.NewReader(data))
+			for {
+				if _, err := d.Token(); err != nil {
+					if err.Error() != "EOF" {
+						t.Errorf("%v isn't well-formed: %v\n%s", f.Name, err, data)
+					}
+					break
+				}
+			}
+		}
+	}
+	if files["OEBPS/images/1.png"] != "png" {
+		t.Error("Image missing")
+	}
+	if !strings.Contains(files["OEBPS/content.opf"], `properties="cover-image"`) ||
+		!strings.Contains(files["OEBPS/content.opf"], `<dc:title id="title">Salt &amp; Iron</dc:title>`) {
+		t.Errorf("Bad package: %v", files["OEBPS/content.opf"])
+	}
+	for _, want := range []string{
+		`<dc:title id="subtitle">A Novel</dc:title>`,
+		`<dc:creator id="creator">A. N. Author</dc:creator>`,
+		`<dc:description>Two &amp; a half</dc:description>`,
+		`<dc:rights>Copyright © 2017 A. N. Author</dc:rights>`,
+		`<meta property="belongs-to-collection" id="series">The Long Road</meta>`,
+		`<meta refines="#series" property="group-position">2</meta>`,
+	} {
+		if !strings.Contains(files["OEBPS/content.opf"], want) {
+			t.Errorf("Package is missing %v", want)
+		}
+	}
+	if !strings.Contains(files["OEBPS/title.xhtml"], "Book 2 of The Long Road") {
+		t.Errorf("Bad title page: %v", files["OEBPS/title.xhtml"])
+	}
+	if !strings.Contains(files["OEBPS/chapter-0.xhtml"], `epub:type="dedication"`) {
+		t.Errorf("Dedication isn't marked: %v", files["OEBPS/chapter-0.xhtml"])
+	}
+	if strings.Contains(files["OEBPS/chapter-2.xhtml"], "alert") {
+		t.Errorf("Script survived: %v", files["OEBPS/chapter-2.xhtml"])
+	}
+	if !strings.Contains(files["OEBPS/chapter-1.xhtml"], `<img src="images/1.png">`) {
+		t.Errorf("Chapter lost its image: %v", files["OEBPS/chapter-1.xhtml"])
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		ISBN string
+		Want string
+	}{
+		{"978-0-306-40615-7", "9780306406157"},
+		{"0-306-40615-2", "0306406152"},
+		{"0 8044 2957 x", "080442957X"},
+		{"978-0-306-40615-8", ""},
+		{"0-306-40615-3", ""},
+		{"X-306-40615-2", ""},
+		{"12345", ""},
+	}
+	for _, test := range tests {
+		got, err := NormalizeISBN(test.ISBN)
+		if got != test.Want || (err == nil) != (test.Want != "") {
+			t.Errorf("%v: got %q, %v", test.ISBN, got, err)
+		}
+	}
+}
+
+func TestWorkMetadata(t *testing.T) {
+	work := &Work{}
+	if work.GetLanguage() != "en" || work.SeriesLine() != "" || work.CopyrightLine() != "" {
+		t.Errorf("Bare work has metadata: %q %q %q", work.GetLanguage(), work.SeriesLine(), work.CopyrightLine())
+	}
+	work = &Work{Series: "The Long Road", SeriesNumber: 2.5, Author: "Ann", CopyrightYear: 2017}
+	if work.SeriesLine() != "Book 2.5 of The Long Road" {
+		t.Errorf("Got %v", work.SeriesLine())
+	}
+	if work.CopyrightLine() != "Copyright © 2017 Ann" {
+		t.Errorf("Got %v", work.CopyrightLine())
+	}
+}
+
+func TestNewSeriesStats(t *testing.T) {
+	works := []*Work{{Id: 1, WordCount: 300}, {Id: 2, WordCount: 100}, {Id: 3}}
+	stats := NewSeriesStats(works, map[int]int{1: 4, 2: 2})
+	if stats.Words != 400 || stats.Average != 133 {
+		t.Errorf("Got %v words, %v average", stats.Words, stats.Average)
+	}
+	want := []SeriesWorkStats{
+		{Words: 300, Sections: 4, Share: 75, Running: 300},
+		{Words: 100, Sections: 2, Share: 25, Running: 400},
+		{Words: 0, Sections: 0, Share: 0, Running: 400},
+	}
+	for i, w := range want {
+		got := *stats.Works[i]
+		got.Work = nil
+		if got != w {
+			t.Errorf("Work %v: got %+v, want %+v", i, got, w)
+		}
+	}
+	if empty := NewSeriesStats(nil, nil); empty.Words != 0 || empty.Average != 0 {
+		t.Errorf("Empty series: %+v", empty)
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	sections := []*Section{{Id: 1}, {Id: 2}, {Id: 3}}
+	whole := &ShareLink{}
+	if got := whole.Sections(sections); len(got) != 3 {
+		t.Errorf("Whole work link shared %v sections", len(got))
+	}
+	some := &ShareLink{SectionIds: []int{3, 1, 9}}
+	got := some.Sections(sections)
+	if len(got) != 2 || got[0].Id != 1 || got[1].Id != 3 {
+		t.Errorf("Got sections %+v", got)
+	}
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	if whole.IsExpired(now) {
+		t.Error("Link without an expiry expired")
+	}
+	expiring := &ShareLink{ExpiresAt: pq.NullTime{Time: now.Add(time.Hour), Valid: true}}
+	if expiring.IsExpired(now) || !expiring.IsExpired(now.Add(2*time.Hour)) {
+		t.Error("Expiry is off")
+	}
+	if whole.HasPassword() || !whole.CheckPassword("anything") {
+		t.Error("Link without a password wanted one")
+	}
+}
+
+func TestSectionText(t *testing.T) {
+	body := "<p>Tom &amp; Jerry</p>\r\n<!-- note --><p>ran <em>away</em>.</p>"
+	if got := SectionText(body); got != "Tom & Jerry\nran away." {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	body := "<p>Call me <em>Ishmael</em>.</p>\n<p>Some years&nbsp;ago&mdash;never mind</p>"
+	if got := CountWords(body); got != 7 {
+		t.Errorf("Got %v", got)
+	}
+	if got := CountWords(""); got != 0 {
+		t.Errorf("Got %v for nothing", got)
+	}
+}
+
+func TestFindAnchor(t *testing.T) {
+	text := "the cat sat on the mat by the door"
+	tests := []struct {
+		quote  string
+		offset int
+		want   int
+		found  bool
+	}{
+		{"the", 0, 0, true},
+		{"the", 14, 15, true},
+		{"the", 30, 26, true},
+		{"mat", 0, 19, true},
+		{"dog", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		got, found := FindAnchor(text, test.quote, test.offset)
+		if got != test.want || found != test.found {
+			t.Errorf("FindAnchor(%q, %v): got %v, %v", test.quote, test.offset, got, found)
+		}
+	}
+	// offsets count UTF-16 code units, like the browser
+	if got, _ := FindAnchor("\U0001F600 hello", "hello", 0); got != 3 {
+		t.Errorf("Got %v after an emoji", got)
+	}
+}
+
+func TestCommentReanchor(t *testing.T) {
+	comment := &Comment{Quote: "sat", Offset: 8}
+	if comment.Reanchor("the cat sat") {
+		t.Error("Reanchor changed a comment that hadn't moved")
+	}
+	if !comment.Reanchor("once, the cat sat") || comment.Offset != 14 || comment.Detached {
+		t.Errorf("Got %+v", comment)
+	}
+	if !comment.Reanchor("the cat stood") || !comment.Detached {
+		t.Errorf("Got %+v", comment)
+	}
+	if !comment.Reanchor("the cat sat down") || comment.Detached || comment.Offset != 8 {
+		t.Errorf("Got %+v", comment)
+	}
+}
+
+func TestBuildCommentThreads(t *testing.T) {
+	comments := []*Comment{
+		{Id: 1, ShareLinkId: 7},
+		{Id: 2, ParentId: 1},
+		{Id: 3, ResolvedAt: pq.NullTime{Valid: true}},
+		{Id: 4, ParentId: 1},
+	}
+	threads := BuildCommentThreads(comments)
+	if len(threads) != 2 || len(threads[0].Replies) != 2 || threads[0].Replies[1].Id != 4 {
+		t.Errorf("Got threads %+v", threads)
+	}
+	if open := OpenThreads(threads); len(open) != 1 || open[0].Id != 1 {
+		t.Errorf("Got open threads %+v", open)
+	}
+	if mine := ThreadsForShareLink(threads, 7); len(mine) != 1 || mine[0].Id != 1 {
+		t.Errorf("Got link's threads %+v", mine)
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	cases := []struct {
+		role, needed string
+		expected     bool
+	}{
+		{RoleOwner, RoleOwner, true},
+		{RoleOwner, RoleViewer, true},
+		{RoleEditor, RoleOwner, false},
+		{RoleEditor, RoleCommenter, true},
+		{RoleCommenter, RoleEditor, false},
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleCommenter, false},
+		{"", RoleViewer, false},
+		{"admin", RoleViewer, false},
+	}
+	for _, c := range cases {
+		if RoleAllows(c.role, c.needed) != c.expected {
+			t.Errorf("RoleAllows(%q, %q) should be %v", c.role, c.needed, c.expected)
+		}
+	}
+	if ValidMemberRole(RoleOwner) || ValidMemberRole("") || !ValidMemberRole(RoleCommenter) {
+		t.Error("Only editor, commenter and viewer can be given to members")
+	}
+}
+
+func TestActivityDescribe(t *testing.T) {
+	section := &Section{Id: 4, WorkId: 2, Title: "The Storm"}
+	edited := SectionActivity(section, "co@example.com", ActivityEdited)
+	if edited.WorkId != 2 || edited.SectionId != 4 || edited.Describe() != "edited The Storm" {
+		t.Errorf("Got %+v", edited)
+	}
+	joined := &Activity{Action: ActivityJoined}
+	if joined.Describe() != "joined the work" {
+		t.Errorf("Got %v", joined.Describe())
+	}
+}
+
+func TestTrashFiltering(t *testing.T) {
+	queries := []db.Queryable{
+		rightForLeftQuery{LeftName: "work", RightName: "character"},
+		leftForRightQuery{LeftName: "section", RightName: "setting"},
+	}
+	for _, q := range queries {
+		if !strings.Contains(q.GetQueryStr(), "deleted_at IS NULL") {
+			t.Errorf("Trash isn't left out of %v", q.GetQueryStr())
+		}
+	}
+	events := rightForLeftQuery{LeftName: "section", RightName: "event"}
+	if strings.Contains(events.GetQueryStr(), "deleted_at") {
+		t.Errorf("Events don't have a trash: %v", events.GetQueryStr())
+	}
+	for _, entity := range TrashEntities {
+		q := trashedItemQuery{Entity: entity}
+		if !strings.Contains(q.GetQueryStr(), "t."+entity+"_id=$1") {
+			t.Errorf("Bad trashed %v query: %v", entity, q.GetQueryStr())
+		}
+	}
+}
+
+func TestCopyTitle(t *testing.T) {
+	tests := map[string]string{
+		"Draft":              "Draft (copy)",
+		"Draft (copy)":       "Draft (copy 2)",
+		"Draft (copy 2)":     "Draft (copy 3)",
+		"Draft (copy 9) two": "Draft (copy 9) two (copy)",
+		"(copy)":             "(copy) (copy)",
+	}
+	for title, want := range tests {
+		if got := CopyTitle(title); got != want {
+			t.Errorf("CopyTitle(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestSplitSectionBody(t *testing.T) {
+	tests := []struct {
+		body, first, second string
+		ok                  bool
+	}{
+		{`<p>one</p><hr class="pathfork-split"><p>two</p>`, `<p>one</p>`, `<p>two</p>`, true},
+		{`<p>one <em>two<hr class="pathfork-split">three</em> four</p>`, `<p>one <em>two</em></p>`, `<p><em>three</em> four</p>`, true},
+		{`<p>one</p><p><hr class="pathfork-split">two</p>`, `<p>one</p>`, `<p>two</p>`, true},
+		{`<p>one</p>` + "\n" + `<p class="x"><em><hr class="pathfork-split">two</em></p>`, "<p>one</p>\n", `<p class="x"><em>two</em></p>`, true},
+		{`<p>one<hr class="pathfork-split"></p>` + "\n" + `<p>two</p>`, `<p>one</p>`, "\n<p>two</p>", true},
+		{`<p>a<br>b<!-- <i> --><hr class="pathfork-split">c</p>`, `<p>a<br>b<!-- <i> --></p>`, `<p>c</p>`, true},
+		{`<p>one</p><p>two</p>`, "", "", false},
+		{`<p>one</p><hr class="pathfork-split">`, "", "", false},
+		{`<p><hr class="pathfork-split">one</p>`, "", "", false},
+	}
+	for _, test := range tests {
+		first, second, ok := SplitSectionBody(test.body)
+		if ok != test.ok || first != test.first || second != test.second {
+			t.Errorf("SplitSectionBody(%q) = %q, %q, %v, want %q, %q, %v", test.body, first, second, ok, test.first, test.second, test.ok)
+		}
+	}
+}
+
+func TestMergeOrder(t *testing.T) {
+	sections := []*Section{
+		{Id: 1, Order: 1},
+		{Id: 2, Order: 3},
+		{Id: 3, Order: 2},
+		{Id: 4, Order: 1, ParentId: 1},
+		{Id: 5, Order: 2, ParentId: 1},
+		{Id: 6, Order: 4, Snippet: true},
+		{Id: 7, Order: 4, ParentId: 99},
+	}
+	tests := []struct {
+		ids  []int
+		want []int
+	}{
+		{[]int{2, 3}, []int{3, 2}},
+		{[]int{1, 2, 3}, []int{1, 3, 2}},
+		{[]int{2, 7}, []int{2, 7}},
+		{[]int{5, 4}, []int{4, 5}},
+		{[]int{1, 2}, nil},
+		{[]int{1, 4}, nil},
+		{[]int{2, 6}, nil},
+		{[]int{1, 8}, nil},
+		{[]int{1}, nil},
+	}
+	for _, test := range tests {
+		got, err := MergeOrder(sections, test.ids)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("MergeOrder(%v) should have failed", test.ids)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(test.want) {
+			t.Errorf("MergeOrder(%v) = %v, %v", test.ids, got, err)
+			continue
+		}
+		for i := range got {
+			if got[i].Id != test.want[i] {
+				t.Errorf("MergeOrder(%v)[%v] = %v, want %v", test.ids, i, got[i].Id, test.want[i])
+			}
+		}
+	}
+}
+
+func TestTopLevelOrder(t *testing.T) {
+	top := []*Section{{Id: 3}, {Id: 1}, {Id: 2}}
+	tests := []struct {
+		ids      []int
+		position int
+		want     string
+	}{
+		{[]int{9}, 1, "9-1,3-2,1-3,2-4"},
+		{[]int{9, 8}, 2, "3-1,9-2,8-3,1-4,2-5"},
+		{[]int{9}, 0, "3-1,1-2,2-3,9-4"},
+		{[]int{9}, 4, "3-1,1-2,2-3,9-4"},
+		{[]int{9}, 40, "3-1,1-2,2-3,9-4"},
+		{[]int{1}, 1, "1-1,3-2,2-3"},
+	}
+	for _, test := range tests {
+		if got := topLevelOrder(top, test.ids, test.position); got != test.want {
+			t.Errorf("topLevelOrder(%v, %v) = %q, want %q", test.ids, test.position, got, test.want)
+		}
+	}
+}
+
+func TestSectionsToMove(t *testing.T) {
+	sections := []*Section{
+		{Id: 1},
+		{Id: 2, ParentId: 1},
+		{Id: 3, ParentId: 2},
+		{Id: 4},
+		{Id: 5, ParentId: 4},
+		{Id: 6, Snippet: true},
+	}
+	moved, roots, err := sectionsToMove(sections, []int{1, 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, section := range moved {
+		ids = append(ids, section.Id)
+	}
+	if len(ids) != 5 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 || ids[3] != 5 || ids[4] != 6 {
+		t.Errorf("Moving the wrong sections: %v", ids)
+	}
+	if !roots[1] || roots[2] || roots[3] || !roots[5] || !roots[6] {
+		t.Errorf("Wrong sections going without their parents: %v", roots)
+	}
+	if _, _, err := sectionsToMove(sections, []int{1, 7}); err == nil {
+		t.Error("Moving a section from another work should fail")
+	}
+}
+
+func TestFindReplaceHits(t *testing.T) {
+	tests := []struct {
+		value   string
+		field   string
+		options ReplaceOptions
+		matches []string
+		want    string
+	}{
+		{`<p class="Jon">Jon met Jonathan. Jon's horse</p>`, "body",
+			ReplaceOptions{Find: "Jon", Replace: "Jakob", WholeWord: true, MatchCase: true},
+			[]string{"Jon", "Jon"}, `<p class="Jon">Jakob met Jonathan. Jakob's horse</p>`},
+		{`<p>jon and JON</p>`, "body",
+			ReplaceOptions{Find: "Jon", Replace: "Jakob"},
+			[]string{"jon", "JON"}, `<p>Jakob and Jakob</p>`},
+		{`<p>jon and JON</p>`, "body",
+			ReplaceOptions{Find: "Jon", Replace: "Jakob", MatchCase: true},
+			nil, `<p>jon and JON</p>`},
+		{`<p>Tom &amp; Jerry &lt;3</p>`, "body",
+			ReplaceOptions{Find: "& Jerry <", Replace: "and <Spike>"},
+			[]string{"& Jerry <"}, `<p>Tom and &lt;Spike&gt;3</p>`},
+		{`<p>caf&eacute; Zo&euml;</p>`, "body",
+			ReplaceOptions{Find: "Zoë", Replace: "Zoe", WholeWord: true},
+			[]string{"Zoë"}, `<p>caf&eacute; Zoe</p>`},
+		{`<p>Chapter 12, Chapter 3</p><!-- Chapter 9 -->`, "body",
+			ReplaceOptions{Find: `Chapter (\d+)`, Replace: "Part $1", Regex: true},
+			[]string{"Chapter 12", "Chapter 3"}, `<p>Part 12, Part 3</p><!-- Chapter 9 -->`},
+		{`Tom & <Jerry>`, "title",
+			ReplaceOptions{Find: "<Jerry>", Replace: "Spike & Co"},
+			[]string{"<Jerry>"}, `Tom & Spike & Co`},
+		{`<p>Jon&#39;s horse, Jon’s sword, Jonathan and jon. Jon.</p>`, "body",
+			ReplaceOptions{Find: "Jon", Replace: "Jakob", WholeWord: true, MatchCase: true, Rename: true},
+			[]string{"Jon's", "Jon’s", "Jon"}, `<p>Jakob's horse, Jakob’s sword, Jonathan and jon. Jakob.</p>`},
+		{`<p>James' horse and James's sword</p>`, "body",
+			ReplaceOptions{Find: "James", Replace: "Jakob", WholeWord: true, MatchCase: true, Rename: true},
+			[]string{"James'", "James's"}, `<p>Jakob's horse and Jakob's sword</p>`},
+		{`<p>Jon.* and Jon's</p>`, "body",
+			ReplaceOptions{Find: "Jon.*", Replace: "Hob", WholeWord: true, MatchCase: true, Rename: true},
+			[]string{"Jon.*"}, `<p>Hob and Jon's</p>`},
+	}
+	for _, test := range tests {
+		field := &ReplaceField{Entity: "section", Id: 1, Field: test.field, Value: test.value}
+		hits, err := FindReplaceHits([]*ReplaceField{field}, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := map[string]bool{}
+		if len(hits) != len(test.matches) {
+			t.Errorf("Found %v hits in %q, want %v", len(hits), test.value, len(test.matches))
+			continue
+		}
+		for i, hit := range hits {
+			if hit.Match != test.matches[i] {
+				t.Errorf("Hit %v in %q is %q, want %q", i, test.value, hit.Match, test.matches[i])
+			}
+			accepted[hit.Key] = true
+		}
+		pattern, _ := test.options.Pattern()
+		if got := replaceAccepted(field.Value, findInField(field, pattern, test.options), accepted); got != test.want {
+			t.Errorf("Replacing in %q gave %q, want %q", test.value, got, test.want)
+		}
+	}
+	if _, err := FindReplaceHits(nil, ReplaceOptions{Find: "(", Regex: true}); err == nil {
+		t.Error("A bad regular expression should be an error")
+	}
+}
+
+func TestReplaceAccepted(t *testing.T) {
+	field := &ReplaceField{Entity: "section", Id: 2, Field: "body", Value: "<p>a b a b a</p>"}
+	options := ReplaceOptions{Find: "a", Replace: "c", WholeWord: true}
+	pattern, _ := options.Pattern()
+	matches := findInField(field, pattern, options)
+	accepted := map[string]bool{"section-2-body-0": true, "section-2-body-2": true}
+	if got := replaceAccepted(field.Value, matches, accepted); got != "<p>c b a b c</p>" {
+		t.Errorf("Replacing some hits gave %q", got)
+	}
+}
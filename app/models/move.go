@@ -0,0 +1,168 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+)
+
+// topLevelOrder is the reorder form value ("id-order" entries) that puts
+// ids in among top, a work's top-level sections in order, at position: 1
+// for the start, and 0 or anything past the end for the end
+func topLevelOrder(top []*Section, ids []int, position int) string {
+	moving := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		moving[id] = true
+	}
+	order := []int{}
+	for _, section := range top {
+		if !moving[section.Id] {
+			order = append(order, section.Id)
+		}
+	}
+	if position < 1 || position > len(order)+1 {
+		position = len(order) + 1
+	}
+	order = append(order[:position-1], append(append([]int{}, ids...), order[position-1:]...)...)
+	entries := make([]string, len(order))
+	for i, id := range order {
+		entries[i] = fmt.Sprintf("%v-%v", id, i+1)
+	}
+	return strings.Join(entries, ",")
+}
+
+// placeAtTopLevel puts ids in among workId's top-level sections at
+// position, as topLevelOrder does. A section whose parent is in the trash
+// is left where it is.
+func placeAtTopLevel(database *db.DB, tx *sql.Tx, workId int, ids []int, position int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	roots, _ := GetSectionsForWork(workId, database)
+	top := []*Section{}
+	for _, section := range roots {
+		if section.ParentId == 0 {
+			top = append(top, section)
+		}
+	}
+	return ReorderSectionsFromFormValue(topLevelOrder(top, ids, position), workId, tx)
+}
+
+type sectionWorkUpdate struct {
+	Id         int
+	WorkId     int
+	KeepParent bool
+}
+
+func (u sectionWorkUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_section SET work_id=$1, parent_id=CASE WHEN $2 THEN parent_id END
+WHERE section_id=$3`
+}
+
+func (u sectionWorkUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.WorkId, u.KeepParent, u.Id}
+}
+
+// sectionsToMove is ids and everything inside them, from sections, which
+// are all of a work's in reading order, along with which of them are going
+// without their parents
+func sectionsToMove(sections []*Section, ids []int) ([]*Section, map[int]bool, error) {
+	moving := make(map[int]bool, len(sections))
+	inWork := make(map[int]bool, len(sections))
+	for _, section := range sections {
+		inWork[section.Id] = true
+	}
+	for _, id := range ids {
+		if !inWork[id] {
+			return nil, nil, errors.New("Those sections aren't all in this work.")
+		}
+		moving[id] = true
+	}
+	for added := true; added; {
+		added = false
+		for _, section := range sections {
+			if !moving[section.Id] && moving[section.ParentId] {
+				moving[section.Id], added = true, true
+			}
+		}
+	}
+	moved := []*Section{}
+	roots := make(map[int]bool)
+	for _, section := range sections {
+		if moving[section.Id] {
+			moved = append(moved, section)
+			roots[section.Id] = !moving[section.ParentId]
+		}
+	}
+	return moved, roots, nil
+}
+
+// MoveSections moves the sections ids, from sections, which are all of
+// their work's in reading order, to target with the subsections inside
+// them. Those that were inside one that isn't moving go in at the top level
+// at position, as with topLevelOrder. target gets their characters and
+// settings and their words, and it returns everything that moved.
+func MoveSections(database *db.DB, tx *sql.Tx, sections []*Section, ids []int, target *Work, position int) ([]*Section, error) {
+	moved, roots, err := sectionsToMove(sections, ids)
+	if err != nil || len(moved) == 0 {
+		return nil, err
+	}
+	words := 0
+	placed := []int{}
+	characterIds := []int{}
+	settingIds := []int{}
+	for _, section := range moved {
+		update := sectionWorkUpdate{Id: section.Id, WorkId: target.Id, KeepParent: !roots[section.Id]}
+		if err := database.Update(update, tx); err != nil {
+			return nil, err
+		}
+		if roots[section.Id] && !section.Snippet {
+			placed = append(placed, section.Id)
+		}
+		for _, character := range GetCharactersForSection(section.Id, database) {
+			characterIds = append(characterIds, character.Id)
+		}
+		for _, setting := range GetSettingsForSection(section.Id, database) {
+			settingIds = append(settingIds, setting.Id)
+		}
+		words += section.WordCount
+	}
+	if err := UpdateWorksCharsNoConflict(database, tx, target.Id, characterIds); err != nil {
+		return nil, err
+	}
+	if err := UpdateWorksSettingsNoConflict(database, tx, target.Id, settingIds); err != nil {
+		return nil, err
+	}
+	if err := UpdateWorkWordCount(database, tx, moved[0].WorkId, -words); err != nil {
+		return nil, err
+	}
+	if err := UpdateWorkWordCount(database, tx, target.Id, words); err != nil {
+		return nil, err
+	}
+	return moved, placeAtTopLevel(database, tx, target.Id, placed, position)
+}
+
+type snippetPromoteUpdate struct {
+	Id int
+}
+
+func (u snippetPromoteUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_section SET is_snippet=false, parent_id=NULL WHERE section_id=$1"
+}
+
+func (u snippetPromoteUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+// PromoteSnippet makes the snippet a top-level section at position in the
+// table of contents
+func PromoteSnippet(database *db.DB, tx *sql.Tx, snippet *Section, position int) error {
+	if err := database.Update(snippetPromoteUpdate{Id: snippet.Id}, tx); err != nil {
+		return err
+	}
+	return placeAtTopLevel(database, tx, snippet.WorkId, []int{snippet.Id}, position)
+}
@@ -0,0 +1,245 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/bradfitz/slice"
+	"github.com/golang/glog"
+)
+
+// BuildSettingTree nests settings under the places they're in, sorts each
+// level by name and fills in each setting's Depth. Like BuildSectionTree,
+// a setting whose parent isn't in the list, or that is somehow part of a
+// cycle, is treated as top-level.
+func BuildSettingTree(settings []*Setting) []*Setting {
+	byId := make(map[int]*Setting, len(settings))
+	for _, setting := range settings {
+		setting.Children = nil
+		byId[setting.Id] = setting
+	}
+	roots := []*Setting{}
+	for _, setting := range settings {
+		parent, ok := byId[setting.ParentId]
+		if !ok || setting.ParentId == setting.Id {
+			roots = append(roots, setting)
+			continue
+		}
+		parent.Children = append(parent.Children, setting)
+	}
+	visited := make(map[int]bool, len(settings))
+	placeSettings(roots, 0, visited)
+	for _, setting := range settings {
+		if !visited[setting.Id] {
+			glog.Errorf("Setting %v is in a parent cycle, showing it at the top", setting.Id)
+			setting.Children = nil
+			roots = append(roots, setting)
+			placeSettings([]*Setting{setting}, 0, visited)
+		}
+	}
+	return roots
+}
+
+func placeSettings(settings []*Setting, depth int, visited map[int]bool) {
+	slice.Sort(settings, func(i, j int) bool {
+		return settings[i].Name < settings[j].Name
+	})
+	for _, setting := range settings {
+		if visited[setting.Id] {
+			continue
+		}
+		visited[setting.Id] = true
+		setting.Depth = depth
+		placeSettings(setting.Children, depth+1, visited)
+	}
+}
+
+// FlattenSettingTree lists a tree from BuildSettingTree depth first
+func FlattenSettingTree(roots []*Setting) []*Setting {
+	output := []*Setting{}
+	for _, setting := range roots {
+		output = append(output, setting)
+		output = append(output, FlattenSettingTree(setting.Children)...)
+	}
+	return output
+}
+
+// SettingParents maps each setting's id to its parent's id
+func SettingParents(settings []*Setting) map[int]int {
+	parents := make(map[int]int, len(settings))
+	for _, setting := range settings {
+		parents[setting.Id] = setting.ParentId
+	}
+	return parents
+}
+
+// SettingAncestors returns the ids of the places settingId is in, nearest
+// first. It stops rather than loop if the parents have a cycle.
+func SettingAncestors(settingId int, parents map[int]int) []int {
+	output := []int{}
+	seen := map[int]bool{settingId: true}
+	for parent := parents[settingId]; parent != 0 && !seen[parent]; parent = parents[parent] {
+		seen[parent] = true
+		output = append(output, parent)
+	}
+	return output
+}
+
+// SettingWithin says whether settingId is placeId or somewhere inside it
+func SettingWithin(settingId, placeId int, parents map[int]int) bool {
+	if settingId == placeId {
+		return true
+	}
+	for _, ancestor := range SettingAncestors(settingId, parents) {
+		if ancestor == placeId {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSettingParent makes sure settingId can go inside parentId: the
+// parent has to be one of parents' settings (the user's), and can't be the
+// setting itself or anywhere inside it. A parentId of 0 is always fine.
+func CheckSettingParent(settingId, parentId int, parents map[int]int) error {
+	if parentId == 0 {
+		return nil
+	}
+	if _, ok := parents[parentId]; !ok {
+		return fmt.Errorf("setting %v isn't one of yours", parentId)
+	}
+	if SettingWithin(parentId, settingId, parents) {
+		return fmt.Errorf("setting %v would be inside itself", settingId)
+	}
+	return nil
+}
+
+// GetSettingBreadcrumbs returns the places the setting is in, outermost
+// first, for showing "The Southern Reaches > Caldera > Lowtown"
+func GetSettingBreadcrumbs(setting *Setting) []*Setting {
+	if setting.ParentId == 0 {
+		return []*Setting{}
+	}
+	settings := GetSettingsForUser(setting.UserEmail, setting.DB)
+	byId := make(map[int]*Setting, len(settings))
+	for _, s := range settings {
+		byId[s.Id] = s
+	}
+	ancestors := SettingAncestors(setting.Id, SettingParents(settings))
+	output := []*Setting{}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		// a place in the trash isn't in the list, and ends the trail
+		if byId[ancestors[i]] == nil {
+			output = output[:0]
+			continue
+		}
+		output = append(output, byId[ancestors[i]])
+	}
+	return output
+}
+
+// withinSettingCTE lists setting $1 and every place inside it. UNION
+// rather than UNION ALL keeps it from looping on a cycle.
+const withinSettingCTE = `
+WITH RECURSIVE within_setting(setting_id) AS (
+	SELECT $1::integer
+	UNION
+	SELECT tbl_setting.setting_id FROM tbl_setting
+	JOIN within_setting ON tbl_setting.parent_id=within_setting.setting_id
+	WHERE tbl_setting.deleted_at IS NULL
+)
+`
+
+// GetSectionsWithinSetting returns the sections linked to the setting or
+// to any place inside it, so a scene at The Crooked Inn counts as being in
+// Lowtown too
+func GetSectionsWithinSetting(settingId int, database *db.DB) []*Section {
+	sectionsInt, err := database.Query(sectionsWithinSettingQuery{SettingId: settingId})
+	if err != nil {
+		glog.Errorf("Error on GetSectionsWithinSetting: %v", err.Error())
+		return nil
+	}
+	output := make([]*Section, len(sectionsInt))
+	for i := range sectionsInt {
+		output[i] = sectionsInt[i].(*Section)
+	}
+	return output
+}
+
+type sectionsWithinSettingQuery struct {
+	SettingId int
+}
+
+func (q sectionsWithinSettingQuery) GetQueryStr() string {
+	return withinSettingCTE + sectionListColumnStr + `
+WHERE tbl_section.section_id IN (
+	SELECT section_id FROM r_sections_settings
+	WHERE setting_id IN (SELECT setting_id FROM within_setting)
+) AND tbl_section.deleted_at IS NULL
+ORDER BY tbl_section.work_id, tbl_section.section_order`
+}
+
+func (q sectionsWithinSettingQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.SettingId}
+}
+
+func (q sectionsWithinSettingQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return sectionListFromRow(database, r)
+}
+
+// FillSettingSectionCounts sets each setting's SectionCount to the number
+// of sections in it or anywhere inside it. A section linked to both
+// The Crooked Inn and Lowtown only counts once for Lowtown.
+func FillSettingSectionCounts(userEmail string, settings []*Setting, database *db.DB) error {
+	rows, err := database.DB.Query(`
+WITH RECURSIVE setting_tree(ancestor_id, setting_id) AS (
+	SELECT setting_id, setting_id FROM tbl_setting WHERE user_email=$1 AND deleted_at IS NULL
+	UNION
+	SELECT setting_tree.ancestor_id, tbl_setting.setting_id FROM tbl_setting
+	JOIN setting_tree ON tbl_setting.parent_id=setting_tree.setting_id
+	WHERE tbl_setting.deleted_at IS NULL
+)
+SELECT setting_tree.ancestor_id, count(DISTINCT r.section_id) FROM setting_tree
+JOIN r_sections_settings r ON r.setting_id=setting_tree.setting_id
+JOIN tbl_section ON tbl_section.section_id=r.section_id AND tbl_section.deleted_at IS NULL
+GROUP BY setting_tree.ancestor_id`, userEmail)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := map[int]int{}
+	for rows.Next() {
+		var id, count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return err
+		}
+		counts[id] = count
+	}
+	for _, setting := range settings {
+		setting.SectionCount = counts[setting.Id]
+	}
+	return rows.Err()
+}
+
+// getSettingParentsForWork is SettingParents for all the settings of the
+// work's owner, since a work's sections can be in places the work itself
+// isn't linked to
+func getSettingParentsForWork(workId int, database *db.DB) (map[int]int, error) {
+	rows, err := database.DB.Query(`
+SELECT setting_id, coalesce(parent_id, 0) FROM tbl_setting
+WHERE user_email=(SELECT user_email FROM tbl_work WHERE work_id=$1)`, workId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	parents := map[int]int{}
+	for rows.Next() {
+		var id, parent int
+		if err := rows.Scan(&id, &parent); err != nil {
+			return nil, err
+		}
+		parents[id] = parent
+	}
+	return parents, rows.Err()
+}
@@ -88,6 +88,45 @@ func UpdateSectionsSettingsRelations(database *db.DB, tx *sql.Tx, sectionId int,
 	return updateRelations(database, updater)
 }
 
+func UpdateEventsCharsRelations(database *db.DB, tx *sql.Tx, eventId int, charsToInsert, charsToDelete []int) error {
+	updater := relationshipUpdater{
+		TableName: "r_events_characters",
+		InsertIds: charsToInsert,
+		DeleteIds: charsToDelete,
+		LeftName:  "event_id",
+		LeftId:    eventId,
+		RightName: "character_id",
+		Tx:        tx,
+	}
+	return updateRelations(database, updater)
+}
+
+func UpdateEventsSettingsRelations(database *db.DB, tx *sql.Tx, eventId int, settingsToInsert, settingsToDelete []int) error {
+	updater := relationshipUpdater{
+		TableName: "r_events_settings",
+		InsertIds: settingsToInsert,
+		DeleteIds: settingsToDelete,
+		LeftName:  "event_id",
+		LeftId:    eventId,
+		RightName: "setting_id",
+		Tx:        tx,
+	}
+	return updateRelations(database, updater)
+}
+
+func UpdateEventsSectionsRelations(database *db.DB, tx *sql.Tx, eventId int, sectionsToInsert, sectionsToDelete []int) error {
+	updater := relationshipUpdater{
+		TableName: "r_events_sections",
+		InsertIds: sectionsToInsert,
+		DeleteIds: sectionsToDelete,
+		LeftName:  "event_id",
+		LeftId:    eventId,
+		RightName: "section_id",
+		Tx:        tx,
+	}
+	return updateRelations(database, updater)
+}
+
 type relationshipUpdater struct {
 	TableName           string
 	InsertIds           []int
@@ -181,10 +220,10 @@ func (q rightForLeftQuery) GetQueryStr() string {
 	return q.ColumnStr + fmt.Sprintf(`
 JOIN r_%vs_%vs
 ON tbl_%v.%v_id = r_%vs_%vs.%v_id
-WHERE r_%vs_%vs.%v_id=$1`,
+WHERE r_%vs_%vs.%v_id=$1%v`,
 		q.LeftName, q.RightName,
 		q.RightName, q.RightName, q.LeftName, q.RightName, q.RightName,
-		q.LeftName, q.RightName, q.LeftName)
+		q.LeftName, q.RightName, q.LeftName, notTrashed(q.RightName))
 }
 
 func (q rightForLeftQuery) GetQueryArgs() []interface{} {
@@ -219,13 +258,13 @@ JOIN r_%vs_%vs
 ON tbl_%v.%v_id = r_%vs_%vs.%v_id
 JOIN tbl_%v
 ON r_%vs_%vs.%v_id = tbl_%v.%v_id
-WHERE tbl_%v.%v_id=$1
+WHERE tbl_%v.%v_id=$1%v
 ORDER BY tbl_%v.%v_id`,
 		q.LeftName, q.RightName,
 		q.LeftName, q.LeftName, q.LeftName, q.RightName, q.LeftName,
 		q.RightName,
 		q.LeftName, q.RightName, q.RightName, q.RightName, q.RightName,
-		q.RightName, q.RightName,
+		q.RightName, q.RightName, notTrashed(q.LeftName),
 		q.LeftName, q.LeftName)
 }
 
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"database/sql"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// CharacterRelationship links two characters. An undirected relationship
+// reads the same both ways (siblings); a directed one goes from one to the
+// other (mentor, loves). It holds from StartSectionId up to and including
+// EndSectionId, either of which can be 0 for "always".
+type CharacterRelationship struct {
+	Id             int
+	FromId         int
+	FromName       string
+	ToId           int
+	ToName         string
+	Kind           string
+	Directed       bool
+	Notes          string
+	StartSectionId int
+	StartSection   string
+	EndSectionId   int
+	EndSection     string
+	UserEmail      string
+	DB             *db.DB
+}
+
+const relationshipColumnStr = `
+SELECT r.character_relationship_id, r.from_character_id, f.name, r.to_character_id, t.name,
+r.kind, r.directed, r.notes, r.start_section_id, ss.title, r.end_section_id, es.title, r.user_email
+FROM tbl_character_relationship r
+JOIN tbl_character f ON f.character_id=r.from_character_id AND f.deleted_at IS NULL
+JOIN tbl_character t ON t.character_id=r.to_character_id AND t.deleted_at IS NULL
+LEFT JOIN tbl_section ss ON ss.section_id=r.start_section_id AND ss.deleted_at IS NULL
+LEFT JOIN tbl_section es ON es.section_id=r.end_section_id AND es.deleted_at IS NULL`
+
+func (c *CharacterRelationship) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return c.UserEmail == sm.GetUserEmail()
+}
+
+// Other is the id and name of whichever end of the relationship isn't
+// characterId, for listing a character's relationships
+func (c *CharacterRelationship) Other(characterId int) (int, string) {
+	if c.FromId == characterId {
+		return c.ToId, c.ToName
+	}
+	return c.FromId, c.FromName
+}
+
+// ActiveAt says whether the relationship holds at a section, given each
+// section's position in reading order. Bounds in sections that aren't in
+// positions (another work's, say) are ignored.
+func (c *CharacterRelationship) ActiveAt(sectionId int, positions map[int]int) bool {
+	at, ok := positions[sectionId]
+	if !ok {
+		return true
+	}
+	if start, ok := positions[c.StartSectionId]; ok && at < start {
+		return false
+	}
+	if end, ok := positions[c.EndSectionId]; ok && at > end {
+		return false
+	}
+	return true
+}
+
+func (c *CharacterRelationship) GetInsertStr() string {
+	return `
+INSERT INTO tbl_character_relationship(from_character_id, to_character_id, kind, directed, notes,
+start_section_id, end_section_id, user_email)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING character_relationship_id;
+`
+}
+
+func (c *CharacterRelationship) GetInsertArgs() []interface{} {
+	return []interface{}{c.FromId, c.ToId, c.Kind, c.Directed, db.ToNullString(c.Notes),
+		db.ToNullInt(int64(c.StartSectionId)), db.ToNullInt(int64(c.EndSectionId)), c.UserEmail}
+}
+
+func (c *CharacterRelationship) GetUpdateStr() string {
+	return `
+UPDATE tbl_character_relationship
+SET to_character_id=$1, kind=$2, directed=$3, notes=$4, start_section_id=$5, end_section_id=$6
+WHERE character_relationship_id=$7
+`
+}
+
+func (c *CharacterRelationship) GetUpdateArgs() []interface{} {
+	return []interface{}{c.ToId, c.Kind, c.Directed, db.ToNullString(c.Notes),
+		db.ToNullInt(int64(c.StartSectionId)), db.ToNullInt(int64(c.EndSectionId)), c.Id}
+}
+
+func (c *CharacterRelationship) Save(tx *sql.Tx) error {
+	return c.DB.Update(c, tx)
+}
+
+func relationshipFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	c := CharacterRelationship{DB: database}
+	nullNotes := sql.NullString{}
+	nullStart := sql.NullInt64{}
+	nullStartTitle := sql.NullString{}
+	nullEnd := sql.NullInt64{}
+	nullEndTitle := sql.NullString{}
+	if err := r.Scan(&c.Id, &c.FromId, &c.FromName, &c.ToId, &c.ToName, &c.Kind, &c.Directed, &nullNotes,
+		&nullStart, &nullStartTitle, &nullEnd, &nullEndTitle, &c.UserEmail); err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+	c.Notes = nullNotes.String
+	c.StartSectionId = int(nullStart.Int64)
+	c.StartSection = nullStartTitle.String
+	c.EndSectionId = int(nullEnd.Int64)
+	c.EndSection = nullEndTitle.String
+	return &c, nil
+}
+
+func relationshipsFromQuery(query db.Queryable, database *db.DB) []*CharacterRelationship {
+	relationshipsInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting relationships: %v", err.Error())
+		return nil
+	}
+	output := make([]*CharacterRelationship, len(relationshipsInt))
+	for i := range relationshipsInt {
+		output[i] = relationshipsInt[i].(*CharacterRelationship)
+	}
+	return output
+}
+
+func GetRelationshipById(id int, database *db.DB) Verifiable {
+	relationships := relationshipsFromQuery(relationshipByIdQuery{Id: id}, database)
+	if len(relationships) == 0 {
+		return nil
+	}
+	return relationships[0]
+}
+
+type relationshipByIdQuery struct {
+	Id int
+}
+
+func (q relationshipByIdQuery) GetQueryStr() string {
+	return relationshipColumnStr + " WHERE r.character_relationship_id=$1"
+}
+
+func (q relationshipByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q relationshipByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return relationshipFromRow(database, r)
+}
+
+// GetRelationshipsForCharacter returns relationships in either direction
+func GetRelationshipsForCharacter(characterId int, database *db.DB) []*CharacterRelationship {
+	return relationshipsFromQuery(relationshipsForCharacterQuery{CharacterId: characterId}, database)
+}
+
+type relationshipsForCharacterQuery struct {
+	CharacterId int
+}
+
+func (q relationshipsForCharacterQuery) GetQueryStr() string {
+	return relationshipColumnStr + `
+WHERE $1 IN (r.from_character_id, r.to_character_id)
+ORDER BY r.kind, r.character_relationship_id`
+}
+
+func (q relationshipsForCharacterQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.CharacterId}
+}
+
+func (q relationshipsForCharacterQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return relationshipFromRow(database, r)
+}
+
+// GetRelationshipsForWork returns relationships where both characters are
+// in the work's cast
+func GetRelationshipsForWork(workId int, database *db.DB) []*CharacterRelationship {
+	return relationshipsFromQuery(relationshipsForWorkQuery{WorkId: workId}, database)
+}
+
+type relationshipsForWorkQuery struct {
+	WorkId int
+}
+
+func (q relationshipsForWorkQuery) GetQueryStr() string {
+	return relationshipColumnStr + `
+JOIN r_works_characters wf ON wf.character_id=r.from_character_id
+JOIN r_works_characters wt ON wt.character_id=r.to_character_id AND wt.work_id=wf.work_id
+WHERE wf.work_id=$1
+ORDER BY r.character_relationship_id`
+}
+
+func (q relationshipsForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId}
+}
+
+func (q relationshipsForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return relationshipFromRow(database, r)
+}
+
+func DeleteRelationship(relationshipId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(relationshipId, "character_relationship", database)
+}
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+)
+
+// renameable is whether entity is something that can be renamed through its
+// sections and remember what it used to be called
+func renameable(entity string) bool {
+	return entity == "character" || entity == "setting"
+}
+
+// renameSectionsQuery is the sections a character or setting (Entity) is
+// in, and with Unlinked, the rest of the sections in its works, in reading
+// order as near as it can be. Only UserEmail's sections are included, as
+// links can be left over from someone else's work, and nothing in the
+// trash is.
+type renameSectionsQuery struct {
+	Entity    string
+	ObjectId  int
+	Unlinked  bool
+	UserEmail string
+}
+
+func (q renameSectionsQuery) GetQueryStr() string {
+	return sectionDetailColumnStr + fmt.Sprintf(`
+WHERE deleted_at IS NULL AND tbl_section.user_email=$4
+AND NOT EXISTS (SELECT 1 FROM tbl_work w WHERE w.work_id=tbl_section.work_id AND w.deleted_at IS NOT NULL)
+AND (section_id IN (SELECT section_id FROM r_sections_%[1]vs WHERE %[1]v_id=$1)
+	OR ($2 AND work_id IN (SELECT work_id FROM r_works_%[1]vs WHERE %[1]v_id=$3)))
+ORDER BY work_id, is_snippet, section_order`, q.Entity)
+}
+
+func (q renameSectionsQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.ObjectId, q.Unlinked, q.ObjectId, q.UserEmail}
+}
+
+func (q renameSectionsQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return sectionDetailFromRow(database, r)
+}
+
+// GetRenameFields is the section bodies a rename of userEmail's character
+// or setting (entity) looks through: their sections it's in, and with
+// unlinked, the rest of its works' sections too
+func GetRenameFields(entity string, objectId int, userEmail string, unlinked bool, database *db.DB) []*ReplaceField {
+	fields := []*ReplaceField{}
+	if !renameable(entity) {
+		return fields
+	}
+	sectionsInt, err := database.Query(renameSectionsQuery{Entity: entity, ObjectId: objectId, Unlinked: unlinked, UserEmail: userEmail})
+	if err != nil {
+		glog.Errorf("Error getting sections to rename %v %v in: %v", entity, objectId, err.Error())
+		return fields
+	}
+	for i := range sectionsInt {
+		section := sectionsInt[i].(*Section)
+		fields = append(fields, &ReplaceField{Entity: "section", Id: section.Id, WorkId: section.WorkId,
+			Field: "body", Label: section.Title, Value: section.Body})
+	}
+	return fields
+}
+
+/*
+.
+.
+*/
+
+// GetAliases is what a character or setting (entity) used to be called,
+// in the order it was renamed
+func GetAliases(entity string, objectId int, database *db.DB) []string {
+	aliases := []string{}
+	if !renameable(entity) {
+		return aliases
+	}
+	rows, err := database.DB.Query(fmt.Sprintf(`
+SELECT name FROM tbl_%[1]v_alias WHERE %[1]v_id=$1
+ORDER BY created_at, name`, entity), objectId)
+	if err != nil {
+		glog.Errorf("Error getting aliases for %v %v: %v", entity, objectId, err.Error())
+		return aliases
+	}
+	defer rows.Close()
+	for rows.Next() {
+		name := ""
+		if err := rows.Scan(&name); err != nil {
+			glog.Errorf("Error getting aliases for %v %v: %v", entity, objectId, err.Error())
+			return aliases
+		}
+		aliases = append(aliases, name)
+	}
+	return aliases
+}
+
+type aliasInsert struct {
+	Entity   string
+	ObjectId int
+	Name     string
+}
+
+func (i aliasInsert) GetInsertStr() string {
+	return fmt.Sprintf(`
+INSERT INTO tbl_%[1]v_alias(%[1]v_id, name)
+VALUES ($1, $2)
+on conflict do nothing returning 0`, i.Entity)
+}
+
+func (i aliasInsert) GetInsertArgs() []interface{} {
+	return []interface{}{i.ObjectId, i.Name}
+}
+
+type aliasDelete struct {
+	Entity   string
+	ObjectId int
+	Name     string
+}
+
+func (d aliasDelete) GetDeleteStr() string {
+	return fmt.Sprintf("DELETE FROM tbl_%[1]v_alias WHERE %[1]v_id=$1 AND name=$2", d.Entity)
+}
+
+func (d aliasDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.ObjectId, d.Name}
+}
+
+// RecordAlias remembers that the character or setting (entity) was called
+// from before it was called to. Going back to an old name takes it off the
+// list.
+func RecordAlias(database *db.DB, tx *sql.Tx, entity string, objectId int, from, to string) error {
+	if !renameable(entity) {
+		return fmt.Errorf("%q can't have aliases", entity)
+	}
+	if err := database.Delete(aliasDelete{Entity: entity, ObjectId: objectId, Name: to}, tx); err != nil {
+		return err
+	}
+	if from == "" || from == to {
+		return nil
+	}
+	_, err := database.Insert(aliasInsert{Entity: entity, ObjectId: objectId, Name: from}, tx)
+	return err
+}
@@ -0,0 +1,644 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+)
+
+// replaceContext is how many characters of text either side of a hit the
+// preview shows
+const replaceContext = 40
+
+var (
+	// replaceableFields are the columns find and replace looks through,
+	// for each entity. Titles are plain text; the rest are HTML.
+	replaceableFields = map[string][]string{
+		"section":   {"title", "blurb", "body"},
+		"character": {"body"},
+		"setting":   {"body"},
+	}
+	markupPattern = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+	entityPattern = regexp.MustCompile(`&(?:#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+	textEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// ReplaceOptions is a find and replace over a work. Characters and
+// Settings take in the bodies of the work's characters and settings too.
+// Rename is a character or setting being renamed from Find to Replace,
+// which keeps whatever possessive comes after the old name.
+type ReplaceOptions struct {
+	Find       string
+	Replace    string
+	WholeWord  bool
+	MatchCase  bool
+	Regex      bool
+	Characters bool
+	Settings   bool
+	Rename     bool
+}
+
+// Pattern is Find compiled with the options. With Regex, Replace can use
+// $1 and so on for the groups.
+func (o ReplaceOptions) Pattern() (*regexp.Regexp, error) {
+	if o.Find == "" {
+		return nil, errors.New("There's nothing to find.")
+	}
+	expr := o.Find
+	switch {
+	case o.Rename:
+		// the apostrophe or 's after a possessive is the first group
+		expr = regexp.QuoteMeta(expr) + `(['’]s?)?`
+	case !o.Regex:
+		expr = regexp.QuoteMeta(expr)
+	}
+	if !o.MatchCase {
+		expr = "(?i)" + expr
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("That isn't a regular expression we understand: %v", err.Error())
+	}
+	return pattern, nil
+}
+
+// Describe is the options as the revision list shows them
+func (o ReplaceOptions) Describe() string {
+	if o.Rename {
+		return fmt.Sprintf("Renamed %q to %q", o.Find, o.Replace)
+	}
+	return fmt.Sprintf("Replaced %q with %q", o.Find, o.Replace)
+}
+
+// ReplaceField is one field find and replace looks through. WorkId is the
+// work whose revisions a change to it goes in.
+type ReplaceField struct {
+	Entity string
+	Id     int
+	WorkId int
+	Field  string
+	// Label is the title or name of what the field belongs to
+	Label string
+	Value string
+}
+
+func (f *ReplaceField) Key() string {
+	return fmt.Sprintf("%v-%v-%v", f.Entity, f.Id, f.Field)
+}
+
+// Fingerprint tells whether the field's changed since a preview
+func (f *ReplaceField) Fingerprint() string {
+	return fmt.Sprintf("%v-%08x", f.Key(), crc32.ChecksumIEEE([]byte(f.Value)))
+}
+
+func (f *ReplaceField) plain() bool {
+	return f.Field == "title"
+}
+
+// ReplaceHit is one match in a field, for the preview. Before and After are
+// the text around it.
+type ReplaceHit struct {
+	Key         string
+	Field       *ReplaceField
+	Before      string
+	Match       string
+	After       string
+	Replacement string
+}
+
+// textMatch is a match's place in a field's value, and what it's replaced
+// with there
+type textMatch struct {
+	Start       int
+	End         int
+	Replacement string
+	Hit         *ReplaceHit
+}
+
+// renamed is what the name renamed from becomes with possessive after it:
+// with Jon renamed Jakob, "Jon's" is "Jakob's", and with James renamed
+// Jakob, "James'" is "Jakob's" too
+func renamed(from, to, possessive string) string {
+	if possessive != "" && !strings.HasSuffix(possessive, "s") && strings.HasSuffix(from, "s") && !strings.HasSuffix(to, "s") {
+		return to + possessive + "s"
+	}
+	return to + possessive
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wholeWord is whether text[start:end] isn't part of a longer word
+func wholeWord(text string, start, end int) bool {
+	if before, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWordRune(before) {
+		return false
+	}
+	if after, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isWordRune(after) {
+		return false
+	}
+	return true
+}
+
+// decodeText unescapes raw, a run of text between tags, and returns where
+// each byte of the result (and its end) came from in raw
+func decodeText(raw string) (string, []int) {
+	decoded := []byte{}
+	offsets := []int{}
+	at := 0
+	for _, loc := range append(entityPattern.FindAllStringIndex(raw, -1), []int{len(raw), len(raw)}) {
+		for i := at; i < loc[0]; i++ {
+			decoded = append(decoded, raw[i])
+			offsets = append(offsets, i)
+		}
+		entity := html.UnescapeString(raw[loc[0]:loc[1]])
+		for i := 0; i < len(entity); i++ {
+			decoded = append(decoded, entity[i])
+			offsets = append(offsets, loc[0])
+		}
+		at = loc[1]
+	}
+	return string(decoded), append(offsets, len(raw))
+}
+
+func lastRunes(s string, n int) string {
+	for i := len(s); i > 0; {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+		if n--; n == 0 {
+			return s[i:]
+		}
+	}
+	return s
+}
+
+func firstRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// findInField is every match of pattern in the field's text, never inside
+// a tag or half an entity
+func findInField(field *ReplaceField, pattern *regexp.Regexp, options ReplaceOptions) []textMatch {
+	segments := [][]int{{0, len(field.Value)}}
+	if !field.plain() {
+		segments = [][]int{}
+		at := 0
+		for _, loc := range append(markupPattern.FindAllStringIndex(field.Value, -1), []int{len(field.Value), len(field.Value)}) {
+			if loc[0] > at {
+				segments = append(segments, []int{at, loc[0]})
+			}
+			at = loc[1]
+		}
+	}
+	matches := []textMatch{}
+	for _, segment := range segments {
+		raw := field.Value[segment[0]:segment[1]]
+		text, offsets := raw, []int(nil)
+		if !field.plain() {
+			text, offsets = decodeText(raw)
+		}
+		rawOffset := func(i int) int {
+			if offsets == nil {
+				return segment[0] + i
+			}
+			return segment[0] + offsets[i]
+		}
+		for _, loc := range pattern.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if start == end || (options.WholeWord && !wholeWord(text, start, end)) {
+				continue
+			}
+			// a match has to start and end on the edges of entities
+			if offsets != nil && ((start > 0 && offsets[start] == offsets[start-1]) || offsets[end] == offsets[end-1]) {
+				continue
+			}
+			replacement := options.Replace
+			switch {
+			case options.Rename:
+				possessive := ""
+				if loc[2] >= 0 {
+					possessive = text[loc[2]:loc[3]]
+				}
+				replacement = renamed(options.Find, options.Replace, possessive)
+			case options.Regex:
+				replacement = string(pattern.ExpandString(nil, options.Replace, text, loc))
+			}
+			match := textMatch{Start: rawOffset(start), End: rawOffset(end), Replacement: replacement}
+			if !field.plain() {
+				match.Replacement = textEscaper.Replace(replacement)
+			}
+			match.Hit = &ReplaceHit{
+				Key:         fmt.Sprintf("%v-%v", field.Key(), len(matches)),
+				Field:       field,
+				Before:      lastRunes(text[:start], replaceContext),
+				Match:       text[start:end],
+				After:       firstRunes(text[end:], replaceContext),
+				Replacement: replacement,
+			}
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+// FindReplaceHits is every hit of options in fields, for the preview
+func FindReplaceHits(fields []*ReplaceField, options ReplaceOptions) ([]*ReplaceHit, error) {
+	pattern, err := options.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	hits := []*ReplaceHit{}
+	for _, field := range fields {
+		for _, match := range findInField(field, pattern, options) {
+			hits = append(hits, match.Hit)
+		}
+	}
+	return hits, nil
+}
+
+// replaceAccepted is value with the matches whose hits are accepted
+// replaced
+func replaceAccepted(value string, matches []textMatch, accepted map[string]bool) string {
+	output := ""
+	at := 0
+	for _, match := range matches {
+		if !accepted[match.Hit.Key] {
+			continue
+		}
+		output += value[at:match.Start] + match.Replacement
+		at = match.End
+	}
+	return output + value[at:]
+}
+
+// GetReplaceFields is everything in the work find and replace looks
+// through, in reading order
+func GetReplaceFields(work *Work, options ReplaceOptions, database *db.DB) []*ReplaceField {
+	fields := []*ReplaceField{}
+	sections, snippets := GetSectionDetailForExport(work.Id, database)
+	for _, section := range append(sections, snippets...) {
+		fields = append(fields,
+			&ReplaceField{Entity: "section", Id: section.Id, WorkId: work.Id, Field: "title", Label: section.Title, Value: section.Title},
+			&ReplaceField{Entity: "section", Id: section.Id, WorkId: work.Id, Field: "blurb", Label: section.Title, Value: section.Blurb},
+			&ReplaceField{Entity: "section", Id: section.Id, WorkId: work.Id, Field: "body", Label: section.Title, Value: section.Body},
+		)
+	}
+	if options.Characters {
+		for _, character := range GetCharactersForWorkExport(work.Id, database) {
+			fields = append(fields, &ReplaceField{Entity: "character", Id: character.Id, WorkId: work.Id, Field: "body", Label: character.Name, Value: character.Body})
+		}
+	}
+	if options.Settings {
+		for _, setting := range GetSettingsForWorkExport(work.Id, database) {
+			fields = append(fields, &ReplaceField{Entity: "setting", Id: setting.Id, WorkId: work.Id, Field: "body", Label: setting.Name, Value: setting.Body})
+		}
+	}
+	return fields
+}
+
+/*
+.
+.
+*/
+
+func replaceable(entity, field string) bool {
+	for _, f := range replaceableFields[entity] {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+type fieldValueUpdate struct {
+	Entity string
+	Field  string
+	Id     int
+	Value  string
+}
+
+func (u fieldValueUpdate) GetUpdateStr() string {
+	return fmt.Sprintf("UPDATE tbl_%[1]v SET %[2]v=$1 WHERE %[1]v_id=$2", u.Entity, u.Field)
+}
+
+func (u fieldValueUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Value, u.Id}
+}
+
+// sectionWordCountUpdate sets the section's word count, and moves its
+// work's by the difference
+type sectionWordCountUpdate struct {
+	Id        int
+	WordCount int
+}
+
+func (u sectionWordCountUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_work SET word_count = tbl_work.word_count + $1 - s.word_count
+FROM tbl_section s WHERE s.section_id=$2 AND tbl_work.work_id=s.work_id`
+}
+
+func (u sectionWordCountUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.WordCount, u.Id}
+}
+
+type sectionWordCountSet struct {
+	Id        int
+	WordCount int
+}
+
+func (u sectionWordCountSet) GetUpdateStr() string {
+	return "UPDATE tbl_section SET word_count=$1 WHERE section_id=$2"
+}
+
+func (u sectionWordCountSet) GetUpdateArgs() []interface{} {
+	return []interface{}{u.WordCount, u.Id}
+}
+
+// setFieldValue saves a field find and replace has changed. A section body
+// gets its words counted and its comments anchored again.
+func setFieldValue(database *db.DB, tx *sql.Tx, entity, field string, id int, value string) error {
+	if !replaceable(entity, field) {
+		return fmt.Errorf("find and replace can't change %v %v", entity, field)
+	}
+	if err := database.Update(fieldValueUpdate{Entity: entity, Field: field, Id: id, Value: value}, tx); err != nil {
+		return err
+	}
+	if entity != "section" || field != "body" {
+		return nil
+	}
+	wordCount := CountWords(value)
+	if err := database.Update(sectionWordCountUpdate{Id: id, WordCount: wordCount}, tx); err != nil {
+		return err
+	}
+	if err := database.Update(sectionWordCountSet{Id: id, WordCount: wordCount}, tx); err != nil {
+		return err
+	}
+	return ReanchorComments(database, tx, id, value)
+}
+
+// Revision is what a find and replace changed, so that it can be undone
+type Revision struct {
+	Id          int
+	WorkId      int
+	UserEmail   string
+	Description string
+	CreatedAt   time.Time
+	UndoneAt    pq.NullTime
+	// Changes is how many fields it changed
+	Changes int
+}
+
+func (r *Revision) GetInsertStr() string {
+	return `
+INSERT INTO tbl_revision(work_id, user_email, description)
+VALUES ($1, $2, $3)
+RETURNING revision_id
+`
+}
+
+func (r *Revision) GetInsertArgs() []interface{} {
+	return []interface{}{r.WorkId, r.UserEmail, r.Description}
+}
+
+type revisionChangeInsert struct {
+	RevisionId int
+	Field      *ReplaceField
+	NewValue   string
+}
+
+func (i revisionChangeInsert) GetInsertStr() string {
+	return `
+INSERT INTO tbl_revision_change(revision_id, entity, object_id, field, old_value, new_value)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING 0
+`
+}
+
+func (i revisionChangeInsert) GetInsertArgs() []interface{} {
+	return []interface{}{i.RevisionId, i.Field.Entity, i.Field.Id, i.Field.Field, i.Field.Value, i.NewValue}
+}
+
+// ReplaceConflictError is ApplyReplace's when a field has changed since the
+// preview
+type ReplaceConflictError struct {
+	Label string
+}
+
+func (e ReplaceConflictError) Error() string {
+	return fmt.Sprintf("%v has changed since the preview, so nothing's been replaced. Please preview it again.", e.Label)
+}
+
+// ApplyReplace makes the accepted replacements, by hit key, and records a
+// revision of them in each work they're in. Any field with a hit accepted
+// has to have the fingerprint it had in the preview, or nothing's changed.
+// It returns the fields it changed with their new values.
+func ApplyReplace(database *db.DB, tx *sql.Tx, email string, fields []*ReplaceField,
+	options ReplaceOptions, accepted, fingerprints map[string]bool) ([]*ReplaceField, error) {
+	pattern, err := options.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	revisions := map[int]*Revision{}
+	changed := []*ReplaceField{}
+	for _, field := range fields {
+		matches := findInField(field, pattern, options)
+		value := replaceAccepted(field.Value, matches, accepted)
+		if value == field.Value {
+			continue
+		}
+		if !fingerprints[field.Fingerprint()] {
+			return nil, ReplaceConflictError{Label: field.Label}
+		}
+		revision, ok := revisions[field.WorkId]
+		if !ok {
+			revision = &Revision{WorkId: field.WorkId, UserEmail: email, Description: options.Describe()}
+			if revision.Id, err = database.Insert(revision, tx); err != nil {
+				return nil, err
+			}
+			revisions[field.WorkId] = revision
+		}
+		if _, err := database.Insert(revisionChangeInsert{RevisionId: revision.Id, Field: field, NewValue: value}, tx); err != nil {
+			return nil, err
+		}
+		if err := setFieldValue(database, tx, field.Entity, field.Field, field.Id, value); err != nil {
+			return nil, err
+		}
+		changed = append(changed, &ReplaceField{Entity: field.Entity, Id: field.Id, WorkId: field.WorkId,
+			Field: field.Field, Label: field.Label, Value: value})
+	}
+	return changed, nil
+}
+
+/*
+.
+.
+*/
+
+const revisionColumnStr = `
+SELECT r.revision_id, r.work_id, r.user_email, r.description, r.created_at, r.undone_at,
+(SELECT count(*) FROM tbl_revision_change c WHERE c.revision_id=r.revision_id)
+FROM tbl_revision r`
+
+func revisionFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	revision := Revision{}
+	if err := r.Scan(&revision.Id, &revision.WorkId, &revision.UserEmail, &revision.Description,
+		&revision.CreatedAt, &revision.UndoneAt, &revision.Changes); err != nil {
+		glog.Errorf("Error with revisionFromRow: %v", err.Error())
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// GetRevisionsForWork is the work's latest find and replaces, newest first
+func GetRevisionsForWork(workId, limit int, database *db.DB) []*Revision {
+	revisionsInt, err := database.Query(revisionsForWorkQuery{WorkId: workId, Limit: limit})
+	if err != nil {
+		glog.Errorf("Error getting revisions: %v", err.Error())
+		return nil
+	}
+	output := make([]*Revision, len(revisionsInt))
+	for i := range revisionsInt {
+		output[i] = revisionsInt[i].(*Revision)
+	}
+	return output
+}
+
+type revisionsForWorkQuery struct {
+	WorkId int
+	Limit  int
+}
+
+func (q revisionsForWorkQuery) GetQueryStr() string {
+	return revisionColumnStr + " WHERE r.work_id=$1 ORDER BY r.created_at DESC, r.revision_id DESC LIMIT $2"
+}
+
+func (q revisionsForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId, q.Limit}
+}
+
+func (q revisionsForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return revisionFromRow(database, r)
+}
+
+// GetRevisionById is nil if there's no such revision
+func GetRevisionById(id int, database *db.DB) *Revision {
+	revisionsInt, err := database.Query(revisionByIdQuery{Id: id})
+	if err != nil || len(revisionsInt) == 0 {
+		return nil
+	}
+	return revisionsInt[0].(*Revision)
+}
+
+type revisionByIdQuery struct {
+	Id int
+}
+
+func (q revisionByIdQuery) GetQueryStr() string {
+	return revisionColumnStr + " WHERE r.revision_id=$1"
+}
+
+func (q revisionByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q revisionByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return revisionFromRow(database, r)
+}
+
+type revisionUndoneUpdate struct {
+	Id int
+}
+
+func (u revisionUndoneUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_revision SET undone_at=now() WHERE revision_id=$1 AND undone_at IS NULL"
+}
+
+func (u revisionUndoneUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+// revisionChange is one row of tbl_revision_change, with what the field is
+// now unless it's Gone, which includes being in the trash
+type revisionChange struct {
+	Field    ReplaceField
+	OldValue string
+	NewValue string
+	Gone     bool
+}
+
+func getRevisionChanges(revisionId int, tx *sql.Tx) ([]*revisionChange, error) {
+	rows, err := tx.Query(`
+SELECT entity, object_id, field, old_value, new_value
+FROM tbl_revision_change WHERE revision_id=$1`, revisionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []*revisionChange{}
+	for rows.Next() {
+		c := revisionChange{}
+		if err := rows.Scan(&c.Field.Entity, &c.Field.Id, &c.Field.Field, &c.OldValue, &c.NewValue); err != nil {
+			return nil, err
+		}
+		changes = append(changes, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		if !replaceable(c.Field.Entity, c.Field.Field) {
+			return nil, fmt.Errorf("revision %v changed %v %v", revisionId, c.Field.Entity, c.Field.Field)
+		}
+		query := fmt.Sprintf("SELECT coalesce(%[2]v, '') FROM tbl_%[1]v WHERE %[1]v_id=$1 AND deleted_at IS NULL", c.Field.Entity, c.Field.Field)
+		if err := tx.QueryRow(query, c.Field.Id).Scan(&c.Field.Value); err == sql.ErrNoRows {
+			c.Gone = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// UndoRevision puts back what the revision changed, except in fields
+// that have changed again since or are in the trash. Only the owner can
+// put back characters and settings, as with replacing in them. It returns
+// the fields it put back and how many it left alone.
+func UndoRevision(database *db.DB, tx *sql.Tx, revision *Revision, owner bool) ([]*ReplaceField, int, error) {
+	changes, err := getRevisionChanges(revision.Id, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	restored := []*ReplaceField{}
+	skipped := 0
+	for _, c := range changes {
+		if c.Gone || c.Field.Value != c.NewValue || (c.Field.Entity != "section" && !owner) {
+			skipped++
+			continue
+		}
+		if err := setFieldValue(database, tx, c.Field.Entity, c.Field.Field, c.Field.Id, c.OldValue); err != nil {
+			return nil, 0, err
+		}
+		field := c.Field
+		field.Value = c.OldValue
+		restored = append(restored, &field)
+	}
+	return restored, skipped, database.Update(revisionUndoneUpdate{Id: revision.Id}, tx)
+}
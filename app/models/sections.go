@@ -8,12 +8,13 @@ import (
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"bitbucket.org/jtyburke/pathfork/app/utils"
 	"github.com/bradfitz/slice"
 	"github.com/golang/glog"
 )
 
-const sectionListColumnStr = "select tbl_section.section_id, tbl_section.title, tbl_section.blurb, tbl_section.user_email, tbl_section.work_id, tbl_section.section_order, tbl_section.is_snippet, tbl_section.word_count from tbl_section"
-const sectionDetailColumnStr = "select tbl_section.section_id, tbl_section.title, tbl_section.blurb, tbl_section.body, user_email, tbl_section.work_id, tbl_section.section_order, tbl_section.is_snippet, tbl_section.word_count from tbl_section"
+const sectionListColumnStr = "select tbl_section.section_id, tbl_section.title, tbl_section.blurb, tbl_section.user_email, tbl_section.work_id, tbl_section.section_order, tbl_section.is_snippet, tbl_section.word_count, tbl_section.parent_id, tbl_section.status, tbl_section.pov_character_id, tbl_section.story_time, tbl_section.story_sort from tbl_section"
+const sectionDetailColumnStr = "select tbl_section.section_id, tbl_section.title, tbl_section.blurb, tbl_section.body, user_email, tbl_section.work_id, tbl_section.section_order, tbl_section.is_snippet, tbl_section.word_count, tbl_section.parent_id, tbl_section.status, tbl_section.pov_character_id, tbl_section.story_time, tbl_section.story_sort from tbl_section"
 
 type Section struct {
 	Title     string
@@ -26,6 +27,23 @@ type Section struct {
 	Order     int64
 	Snippet   bool
 	WordCount int
+	// ParentId is 0 for a top-level section
+	ParentId int
+	// Status only changes through SetSectionStatus, so that it's recorded
+	Status string
+	// POVCharacterId is 0 when no point of view is set; otherwise it's one
+	// of the section's linked characters
+	POVCharacterId int
+	// StoryTime is when the section happens in the story, in whatever
+	// calendar the story uses. StorySortKey is what the chronology sorts on;
+	// see CompareStoryKeys.
+	StoryTime    string
+	StorySortKey string
+	// The rest are only filled in by BuildSectionTree
+	Children       []*Section
+	Depth          int
+	Number         string
+	TotalWordCount int
 }
 
 func NewSection(title, blurb, body, workId, email string) *Section {
@@ -40,36 +58,59 @@ func NewSection(title, blurb, body, workId, email string) *Section {
 	}
 }
 
+func (s *Section) GetStatus() string {
+	if s.Status == "" {
+		return DefaultSectionStatuses[0]
+	}
+	return s.Status
+}
+
+// VerifyPermission is the same as for the section's work. A section's
+// UserEmail is always its work's owner, whoever wrote it.
 func (s *Section) VerifyPermission(sm sessionManager.SessionManager) bool {
-	return s.UserEmail == sm.GetUserEmail()
+	return s.RoleFor(sm) != ""
+}
+
+func (s *Section) RoleFor(sm sessionManager.SessionManager) string {
+	return getWorkRole(s.WorkId, s.UserEmail, sm.GetUserEmail(), s.DB)
 }
 
 func (s *Section) GetInsertStr() string {
 	return `
-INSERT INTO tbl_section(title, blurb, body, work_id, section_order, user_email, is_snippet, word_count)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8) returning section_id;`
+INSERT INTO tbl_section(title, blurb, body, work_id, section_order, user_email, is_snippet, word_count, parent_id, status,
+pov_character_id, story_time, story_sort)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) returning section_id;`
 }
 
 func (s *Section) GetInsertArgs() []interface{} {
-	return []interface{}{s.Title, db.ToNullString(s.Blurb), db.ToNullString(s.Body), s.WorkId, db.ToNullInt(s.Order), s.UserEmail, s.Snippet, s.WordCount}
+	return []interface{}{s.Title, db.ToNullString(s.Blurb), db.ToNullString(s.Body), s.WorkId, db.ToNullInt(s.Order), s.UserEmail, s.Snippet, s.WordCount, db.ToNullInt(int64(s.ParentId)), s.GetStatus(),
+		db.ToNullInt(int64(s.POVCharacterId)), db.ToNullString(s.StoryTime), db.ToNullString(s.StorySortKey)}
 }
 
 func (s *Section) GetUpdateStr() string {
 	return `
 UPDATE tbl_section
-SET title=$1, blurb=$2, body=$3, section_order=$4, is_snippet=$5, word_count=$6
-WHERE section_id=$7
+SET title=$1, blurb=$2, body=$3, section_order=$4, is_snippet=$5, word_count=$6,
+pov_character_id=$7, story_time=$8, story_sort=$9
+WHERE section_id=$10
 `
 }
 
 func (s *Section) GetUpdateArgs() []interface{} {
-	return []interface{}{s.Title, s.Blurb, s.Body, s.Order, s.Snippet, s.WordCount, s.Id}
+	return []interface{}{s.Title, s.Blurb, s.Body, s.Order, s.Snippet, s.WordCount,
+		db.ToNullInt(int64(s.POVCharacterId)), db.ToNullString(s.StoryTime), db.ToNullString(s.StorySortKey), s.Id}
 }
 
 func (s *Section) Save(tx *sql.Tx) error {
 	return s.DB.Update(s, tx)
 }
 
+// CountWords is for bodies saved without the edit form, which counts them
+// in the browser
+func CountWords(body string) int {
+	return len(strings.Fields(SectionText(body)))
+}
+
 func GetSectionById(id int, database *db.DB) Verifiable {
 	query := sectionByIdQuery{Id: id}
 	sectionInt, err := database.Query(query)
@@ -88,7 +129,7 @@ type sectionByIdQuery struct {
 }
 
 func (q sectionByIdQuery) GetQueryStr() string {
-	return sectionDetailColumnStr + " where section_id=$1"
+	return sectionDetailColumnStr + " where section_id=$1 and deleted_at is null"
 }
 
 func (q sectionByIdQuery) GetQueryArgs() []interface{} {
@@ -103,12 +144,16 @@ func sectionListFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
 	section := Section{DB: db}
 	nullBlurb := sql.NullString{}
 	nullOrder := sql.NullInt64{}
-	if err := r.Scan(&section.Id, &section.Title, &nullBlurb, &section.UserEmail, &section.WorkId, &nullOrder, &section.Snippet, &section.WordCount); err != nil {
+	nullParent := sql.NullInt64{}
+	story := storyFields{}
+	if err := r.Scan(&section.Id, &section.Title, &nullBlurb, &section.UserEmail, &section.WorkId, &nullOrder, &section.Snippet, &section.WordCount, &nullParent, &section.Status, &story.POV, &story.Time, &story.SortKey); err != nil {
 		glog.Error(err.Error())
 		return nil, err
 	}
 	section.Blurb = nullBlurb.String
 	section.Order = nullOrder.Int64
+	section.ParentId = int(nullParent.Int64)
+	story.fill(&section)
 	return &section, nil
 }
 
@@ -117,17 +162,26 @@ func sectionDetailFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
 	nullBlurb := sql.NullString{}
 	nullBody := sql.NullString{}
 	nullOrder := sql.NullInt64{}
-	if err := r.Scan(&section.Id, &section.Title, &nullBlurb, &nullBody, &section.UserEmail, &section.WorkId, &nullOrder, &section.Snippet, &section.WordCount); err != nil {
+	nullParent := sql.NullInt64{}
+	story := storyFields{}
+	if err := r.Scan(&section.Id, &section.Title, &nullBlurb, &nullBody, &section.UserEmail, &section.WorkId, &nullOrder, &section.Snippet, &section.WordCount, &nullParent, &section.Status, &story.POV, &story.Time, &story.SortKey); err != nil {
 		glog.Error(err.Error())
 		return nil, err
 	}
 	section.Blurb = nullBlurb.String
 	section.Body = nullBody.String
 	section.Order = nullOrder.Int64
+	section.ParentId = int(nullParent.Int64)
+	story.fill(&section)
 	return &section, nil
 }
 
-func GetSectionsForWork(workId int, db *db.DB) ([]*Section, []*Section) {
+// GetSectionsForWork returns the top-level sections of the work, with their
+// subsections filled in under Children (see BuildSectionTree), and the
+// work's snippets as a flat list. Given any statuses, only sections with one
+// of them are returned; a section whose parent was filtered out is shown at
+// the top level.
+func GetSectionsForWork(workId int, db *db.DB, statuses ...string) ([]*Section, []*Section) {
 	query := sectionsForWorkQuery{Id: workId}
 	sectionInt, err := db.Query(query)
 	if err != nil {
@@ -138,6 +192,9 @@ func GetSectionsForWork(workId int, db *db.DB) ([]*Section, []*Section) {
 	for i := range sectionInt {
 		allSections[i] = sectionInt[i].(*Section)
 	}
+	if len(statuses) > 0 {
+		allSections = filterSectionsByStatus(allSections, statuses)
+	}
 	sections := []*Section{}
 	snippets := []*Section{}
 	for i := range allSections {
@@ -147,10 +204,68 @@ func GetSectionsForWork(workId int, db *db.DB) ([]*Section, []*Section) {
 			sections = append(sections, allSections[i])
 		}
 	}
+	return BuildSectionTree(sections), snippets
+}
+
+// BuildSectionTree nests sections under their parents, sorts each level by
+// Order, and fills in each section's Depth, hierarchical Number ("2.1.3")
+// and TotalWordCount, which includes all of its subsections. A section
+// whose parent isn't in the list is treated as top-level.
+func BuildSectionTree(sections []*Section) []*Section {
+	byId := make(map[int]*Section, len(sections))
+	for _, section := range sections {
+		section.Children = nil
+		byId[section.Id] = section
+	}
+	roots := []*Section{}
+	for _, section := range sections {
+		parent, ok := byId[section.ParentId]
+		if !ok || section.ParentId == section.Id {
+			roots = append(roots, section)
+			continue
+		}
+		parent.Children = append(parent.Children, section)
+	}
+	// anything left unvisited below is part of a cycle, so has no root
+	visited := make(map[int]bool, len(sections))
+	numberSections(roots, "", 0, visited)
+	for _, section := range sections {
+		if !visited[section.Id] {
+			glog.Errorf("Section %v is in a parent cycle, showing it at the top", section.Id)
+			section.Children = nil
+			roots = append(roots, section)
+			numberSections([]*Section{section}, "", 0, visited)
+		}
+	}
+	return roots
+}
+
+func numberSections(sections []*Section, prefix string, depth int, visited map[int]bool) int {
 	slice.Sort(sections, func(i, j int) bool {
 		return sections[i].Order < sections[j].Order
 	})
-	return sections, snippets
+	total := 0
+	for i, section := range sections {
+		if visited[section.Id] {
+			continue
+		}
+		visited[section.Id] = true
+		section.Depth = depth
+		section.Number = fmt.Sprintf("%v%v", prefix, i+1)
+		section.TotalWordCount = section.WordCount + numberSections(section.Children, section.Number+".", depth+1, visited)
+		total += section.TotalWordCount
+	}
+	return total
+}
+
+// FlattenSectionTree lists a tree from BuildSectionTree in reading order
+func FlattenSectionTree(roots []*Section) []*Section {
+	output := []*Section{}
+	for _, section := range roots {
+		output = append(output, section)
+		output = append(output, FlattenSectionTree(section.Children)...)
+	}
+	return output
 }
 
 type sectionsForWorkQuery struct {
@@ -159,7 +274,8 @@ type sectionsForWorkQuery struct {
 
 func (q sectionsForWorkQuery) GetQueryStr() string {
 	return `
-select section_id, title, blurb, section_order, is_snippet, word_count from tbl_section where work_id=$1`
+select section_id, title, blurb, section_order, is_snippet, word_count, parent_id, status,
+pov_character_id, story_time, story_sort from tbl_section where work_id=$1 and deleted_at is null`
 }
 
 func (q sectionsForWorkQuery) GetQueryArgs() []interface{} {
@@ -170,12 +286,16 @@ func (q sectionsForWorkQuery) ObjFromRow(db *db.DB, r *sql.Rows) (db.Insertable,
 	section := Section{DB: db}
 	nullBlurb := sql.NullString{}
 	nullOrder := sql.NullInt64{}
-	if err := r.Scan(&section.Id, &section.Title, &nullBlurb, &nullOrder, &section.Snippet, &section.WordCount); err != nil {
+	nullParent := sql.NullInt64{}
+	story := storyFields{}
+	if err := r.Scan(&section.Id, &section.Title, &nullBlurb, &nullOrder, &section.Snippet, &section.WordCount, &nullParent, &section.Status, &story.POV, &story.Time, &story.SortKey); err != nil {
 		glog.Error(err.Error())
 		return nil, err
 	}
 	section.Blurb = nullBlurb.String
 	section.Order = nullOrder.Int64
+	section.ParentId = int(nullParent.Int64)
+	story.fill(&section)
 	return &section, nil
 }
 
@@ -213,29 +333,213 @@ func GetSectionsForSetting(settingId int, database *db.DB) []*Section {
 	return output
 }
 
+func GetSectionsForEvent(eventId int, database *db.DB) []*Section {
+	query := rightForLeftQuery{
+		LeftName:       "event",
+		LeftId:         eventId,
+		RightName:      "section",
+		ColumnStr:      sectionListColumnStr,
+		ObjFromRowFunc: sectionListFromRow,
+		DB:             database,
+	}
+	sectionsInt := getRightForLeft(query)
+	output := make([]*Section, len(sectionsInt))
+	for i := range sectionsInt {
+		output[i] = sectionsInt[i].(*Section)
+	}
+	return output
+}
+
+func GetSectionsForUser(userEmail string, database *db.DB) []*Section {
+	sectionInt, err := database.Query(sectionsForUserQuery{UserEmail: userEmail})
+	if err != nil {
+		glog.Errorf("Error on GetSectionsForUser: %v", err.Error())
+		return nil
+	}
+	output := make([]*Section, len(sectionInt))
+	for i := range sectionInt {
+		output[i] = sectionInt[i].(*Section)
+	}
+	return output
+}
+
+type sectionsForUserQuery struct {
+	UserEmail string
+}
+
+func (q sectionsForUserQuery) GetQueryStr() string {
+	return sectionListColumnStr + " WHERE tbl_section.user_email=$1 AND tbl_section.deleted_at IS NULL ORDER BY tbl_section.work_id, tbl_section.section_order"
+}
+
+func (q sectionsForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.UserEmail}
+}
+
+func (q sectionsForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return sectionListFromRow(database, r)
+}
+
+type sectionChildrenUpdate struct {
+	Id int
+}
+
+func (u sectionChildrenUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_section
+SET parent_id=(SELECT parent_id FROM tbl_section WHERE section_id=$1)
+WHERE parent_id=$1`
+}
+
+func (u sectionChildrenUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+// DeleteSection moves the section's subsections up a level before deleting
+// it, so that deleting a part doesn't take its chapters with it.
 func DeleteSection(sectionId int, database *db.DB) (bool, error) {
-	return db.DoBasicDelete(sectionId, "section", database)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		glog.Errorf("section delete database error: %v", err.Error())
+		return false, err
+	}
+	err = database.Update(sectionChildrenUpdate{Id: sectionId}, tx)
+	if err == nil {
+		err = database.Delete(sectionDelete{Id: sectionId}, tx)
+	}
+	if err != nil {
+		glog.Errorf("section delete database error: %v", err.Error())
+		tx.Rollback()
+		return false, err
+	}
+	err = tx.Commit()
+	return err == nil, err
 }
 
-func ReorderSectionsFromFormValue(rawOrder string, workId int, tx *sql.Tx) error {
+type sectionDelete struct {
+	Id int
+}
+
+func (d sectionDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_section WHERE section_id=$1"
+}
+
+func (d sectionDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Id}
+}
+
+// sectionPlacement is one entry from the reorder form: where a section goes
+// among its siblings, and under which parent (0 for the top level).
+// Entries in the old "id-order" form leave the parent alone.
+type sectionPlacement struct {
+	Id         int
+	Order      int
+	ParentId   int
+	MoveParent bool
+}
+
+func parseSectionOrder(rawOrder string) ([]sectionPlacement, error) {
 	splitOrder := strings.Split(rawOrder, ",")
-	updateStr := `UPDATE tbl_section SET section_order = mt.section_order
-	FROM (values `
-	updateArgs := make([]interface{}, len(splitOrder)*2)
+	output := make([]sectionPlacement, len(splitOrder))
 	for i := range splitOrder {
-		nForSql := i*2 + 1
-		updateStr += fmt.Sprintf("($%v::integer, $%v::integer)", nForSql, nForSql+1)
-		if i < len(splitOrder)-1 {
+		parts := strings.Split(splitOrder[i], "-")
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, fmt.Errorf("bad section order entry %q", splitOrder[i])
+		}
+		ints, err := utils.StringsToInts(parts)
+		if err != nil {
+			return nil, err
+		}
+		output[i] = sectionPlacement{Id: ints[0], Order: ints[1]}
+		if len(ints) == 3 {
+			output[i].ParentId, output[i].MoveParent = ints[2], true
+		}
+	}
+	return output, nil
+}
+
+// checkSectionPlacements makes sure the new parents all belong to the work
+// and that nothing ends up as its own ancestor. parents maps each of the
+// work's section ids to its current parent id.
+func checkSectionPlacements(placements []sectionPlacement, parents map[int]int) error {
+	newParents := make(map[int]int, len(parents))
+	for id, parent := range parents {
+		newParents[id] = parent
+	}
+	for _, p := range placements {
+		if _, ok := parents[p.Id]; !ok {
+			return fmt.Errorf("section %v isn't in this work", p.Id)
+		}
+		if !p.MoveParent {
+			continue
+		}
+		if _, ok := parents[p.ParentId]; p.ParentId != 0 && !ok {
+			return fmt.Errorf("section %v can't go under section %v from another work", p.Id, p.ParentId)
+		}
+		newParents[p.Id] = p.ParentId
+	}
+	for id := range newParents {
+		seen := map[int]bool{id: true}
+		for parent := newParents[id]; parent != 0; parent = newParents[parent] {
+			if seen[parent] {
+				return fmt.Errorf("section %v would be inside itself", id)
+			}
+			seen[parent] = true
+		}
+	}
+	return nil
+}
+
+func getSectionParentsForWork(workId int, tx *sql.Tx) (map[int]int, error) {
+	rows, err := tx.Query("SELECT section_id, coalesce(parent_id, 0) FROM tbl_section WHERE work_id=$1", workId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	parents := make(map[int]int)
+	for rows.Next() {
+		var id, parent int
+		if err := rows.Scan(&id, &parent); err != nil {
+			return nil, err
+		}
+		parents[id] = parent
+	}
+	return parents, rows.Err()
+}
+
+// ReorderSectionsFromFormValue takes "id-order-parentId" entries, comma
+// separated, and moves the work's sections to match.
+func ReorderSectionsFromFormValue(rawOrder string, workId int, tx *sql.Tx) error {
+	placements, err := parseSectionOrder(rawOrder)
+	if err == nil {
+		var parents map[int]int
+		if parents, err = getSectionParentsForWork(workId, tx); err == nil {
+			err = checkSectionPlacements(placements, parents)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Reorder error: %v", err.Error())
+		tx.Rollback()
+		return err
+	}
+	updateStr := `UPDATE tbl_section SET section_order = mt.section_order,
+	parent_id = CASE WHEN mt.move_parent THEN nullif(mt.parent_id, 0) ELSE tbl_section.parent_id END
+	FROM (values `
+	updateArgs := make([]interface{}, len(placements)*4)
+	for i, p := range placements {
+		nForSql := i*4 + 1
+		updateStr += fmt.Sprintf("($%v::integer, $%v::integer, $%v::integer, $%v::boolean)", nForSql, nForSql+1, nForSql+2, nForSql+3)
+		if i < len(placements)-1 {
 			updateStr += ", "
 		}
-		idAndOrder := strings.Split(splitOrder[i], "-")
-		updateArgs[i*2] = idAndOrder[0]
-		updateArgs[i*2+1] = idAndOrder[1]
+		updateArgs[i*4] = p.Id
+		updateArgs[i*4+1] = p.Order
+		updateArgs[i*4+2] = p.ParentId
+		updateArgs[i*4+3] = p.MoveParent
 	}
 	updateStr += `
-	) AS mt(section_id, section_order)
+	) AS mt(section_id, section_order, parent_id, move_parent)
 	WHERE mt.section_id::integer=tbl_section.section_id::integer `
-	updateStr += fmt.Sprintf("AND tbl_section.work_id::integer=$%v", len(splitOrder)*2+1)
+	updateStr += fmt.Sprintf("AND tbl_section.work_id::integer=$%v", len(placements)*4+1)
 	updateArgs = append(updateArgs, workId)
 	stmt, err := tx.Prepare(updateStr)
 	if err != nil {
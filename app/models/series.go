@@ -0,0 +1,327 @@
+package models
+
+import (
+	"database/sql"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// Series groups works, in the order of their SeriesNumber. Its bible is
+// every character and setting linked to any of them.
+type Series struct {
+	Id        int
+	Title     string
+	Blurb     string
+	UserEmail string
+	DB        *db.DB
+}
+
+const seriesColumnStr = "SELECT tbl_series.series_id, tbl_series.title, tbl_series.blurb, tbl_series.user_email FROM tbl_series"
+
+func (s *Series) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return s.UserEmail == sm.GetUserEmail()
+}
+
+func (s *Series) GetInsertStr() string {
+	return `
+INSERT INTO tbl_series(title, blurb, user_email)
+VALUES ($1, $2, $3)
+RETURNING series_id
+`
+}
+
+func (s *Series) GetInsertArgs() []interface{} {
+	return []interface{}{s.Title, db.ToNullString(s.Blurb), s.UserEmail}
+}
+
+func (s *Series) GetUpdateStr() string {
+	return `
+UPDATE tbl_series
+SET title=$1, blurb=$2
+WHERE series_id=$3
+`
+}
+
+func (s *Series) GetUpdateArgs() []interface{} {
+	return []interface{}{s.Title, db.ToNullString(s.Blurb), s.Id}
+}
+
+func (s *Series) Save(tx *sql.Tx) error {
+	return s.DB.Update(s, tx)
+}
+
+func seriesFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	s := Series{DB: database}
+	nullBlurb := sql.NullString{}
+	if err := r.Scan(&s.Id, &s.Title, &nullBlurb, &s.UserEmail); err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+	s.Blurb = nullBlurb.String
+	return &s, nil
+}
+
+func GetSeriesById(id int, database *db.DB) Verifiable {
+	seriesInt, err := database.Query(seriesByIdQuery{Id: id})
+	if err != nil {
+		glog.Errorf("Error with GetSeriesById: %v", err.Error())
+		return nil
+	}
+	if len(seriesInt) == 0 {
+		return nil
+	}
+	return seriesInt[0].(*Series)
+}
+
+type seriesByIdQuery struct {
+	Id int
+}
+
+func (q seriesByIdQuery) GetQueryStr() string {
+	return seriesColumnStr + " WHERE series_id=$1"
+}
+
+func (q seriesByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q seriesByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return seriesFromRow(database, r)
+}
+
+func GetSeriesForUser(userEmail string, database *db.DB) []*Series {
+	seriesInt, err := database.Query(seriesForUserQuery{UserEmail: userEmail})
+	if err != nil {
+		glog.Errorf("Error with GetSeriesForUser: %v", err.Error())
+		return nil
+	}
+	output := make([]*Series, len(seriesInt))
+	for i := range seriesInt {
+		output[i] = seriesInt[i].(*Series)
+	}
+	return output
+}
+
+type seriesForUserQuery struct {
+	UserEmail string
+}
+
+func (q seriesForUserQuery) GetQueryStr() string {
+	return seriesColumnStr + " WHERE user_email=$1 ORDER BY title"
+}
+
+func (q seriesForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.UserEmail}
+}
+
+func (q seriesForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return seriesFromRow(database, r)
+}
+
+// DeleteSeries leaves its works alone; they just stop being in a series
+func DeleteSeries(seriesId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(seriesId, "series", database)
+}
+
+// GetWorksForSeries returns the series' works in order. Works without a
+// number go at the end.
+func GetWorksForSeries(seriesId int, database *db.DB) []*Work {
+	return parseMultiworkQuery(database.Query(worksForSeriesQuery{SeriesId: seriesId}))
+}
+
+type worksForSeriesQuery struct {
+	SeriesId int
+}
+
+func (q worksForSeriesQuery) GetQueryStr() string {
+	return workListColumnStr + " where tbl_work.series_id=$1 and tbl_work.deleted_at is null order by tbl_work.series_number nulls last, tbl_work.title"
+}
+
+func (q worksForSeriesQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.SeriesId}
+}
+
+func (q worksForSeriesQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return workFromRow(database, r)
+}
+
+/*
+.
+.
+*/
+
+// SeriesBible is the characters and settings of every work in a series
+type SeriesBible struct {
+	Characters []*Character
+	Settings   []*Setting
+	// CharacterWorks and SettingWorks are the works each character and
+	// setting is in, by id, in series order
+	CharacterWorks map[int][]*Work
+	SettingWorks   map[int][]*Work
+}
+
+// GetSeriesBible collects the characters and settings linked to any of
+// works, which should be the series' works in order
+func GetSeriesBible(seriesId int, works []*Work, database *db.DB) (*SeriesBible, error) {
+	bible := &SeriesBible{
+		CharacterWorks: map[int][]*Work{},
+		SettingWorks:   map[int][]*Work{},
+	}
+	charactersInt, err := database.Query(seriesBibleQuery{SeriesId: seriesId, Entity: "character"})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range charactersInt {
+		bible.Characters = append(bible.Characters, c.(*Character))
+	}
+	settingsInt, err := database.Query(seriesBibleQuery{SeriesId: seriesId, Entity: "setting"})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settingsInt {
+		bible.Settings = append(bible.Settings, s.(*Setting))
+	}
+	for entity, byId := range map[string]map[int][]*Work{"character": bible.CharacterWorks, "setting": bible.SettingWorks} {
+		links, err := getSeriesLinks(seriesId, entity, database)
+		if err != nil {
+			return nil, err
+		}
+		for _, work := range works {
+			for _, id := range links[work.Id] {
+				byId[id] = append(byId[id], work)
+			}
+		}
+	}
+	return bible, nil
+}
+
+// seriesBibleQuery is the characters or settings (Entity) linked to the
+// series' works, in full since the bible shows their bodies
+type seriesBibleQuery struct {
+	SeriesId int
+	Entity   string
+}
+
+func (q seriesBibleQuery) GetQueryStr() string {
+	columnStr := characterDetailColumnStr
+	if q.Entity == "setting" {
+		columnStr = settingDetailColumnStr
+	}
+	return columnStr + `
+WHERE ` + q.Entity + `_id IN (
+	SELECT r.` + q.Entity + `_id FROM r_works_` + q.Entity + `s r
+	JOIN tbl_work w ON w.work_id=r.work_id
+	WHERE w.series_id=$1 AND w.deleted_at IS NULL)
+AND deleted_at IS NULL
+ORDER BY name`
+}
+
+func (q seriesBibleQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.SeriesId}
+}
+
+func (q seriesBibleQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	if q.Entity == "setting" {
+		return settingDetailFromRow(database, r)
+	}
+	return characterDetailFromRow(database, r)
+}
+
+// getSeriesLinks returns the ids of the characters or settings linked to
+// each of the series' works, by work id
+func getSeriesLinks(seriesId int, entity string, database *db.DB) (map[int][]int, error) {
+	rows, err := database.DB.Query(`
+SELECT r.work_id, r.`+entity+`_id FROM r_works_`+entity+`s r
+JOIN tbl_work w ON w.work_id=r.work_id
+WHERE w.series_id=$1 AND w.deleted_at IS NULL`, seriesId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := map[int][]int{}
+	for rows.Next() {
+		var workId, id int
+		if err := rows.Scan(&workId, &id); err != nil {
+			return nil, err
+		}
+		links[workId] = append(links[workId], id)
+	}
+	return links, rows.Err()
+}
+
+/*
+.
+.
+*/
+
+// SeriesStats are word counts across a series
+type SeriesStats struct {
+	Words int
+	// Average is words per work, rounded down
+	Average int
+	Works   []*SeriesWorkStats
+}
+
+type SeriesWorkStats struct {
+	Work  *Work
+	Words int
+	// Sections leaves out snippets
+	Sections int
+	// Share is the work's percentage of the series' words
+	Share int
+	// Running is the series' word count up to the end of this work
+	Running int
+}
+
+// NewSeriesStats works out the stats for works, in series order, given how
+// many sections each has by work id
+func NewSeriesStats(works []*Work, sectionCounts map[int]int) *SeriesStats {
+	stats := &SeriesStats{}
+	for _, work := range works {
+		stats.Words += work.WordCount
+		stats.Works = append(stats.Works, &SeriesWorkStats{
+			Work:     work,
+			Words:    work.WordCount,
+			Sections: sectionCounts[work.Id],
+			Running:  stats.Words,
+		})
+	}
+	if len(works) > 0 {
+		stats.Average = stats.Words / len(works)
+	}
+	if stats.Words > 0 {
+		for _, work := range stats.Works {
+			work.Share = work.Words * 100 / stats.Words
+		}
+	}
+	return stats
+}
+
+// GetSeriesStats is NewSeriesStats with the section counts from the
+// database
+func GetSeriesStats(seriesId int, works []*Work, database *db.DB) (*SeriesStats, error) {
+	rows, err := database.DB.Query(`
+SELECT s.work_id, count(*) FROM tbl_section s
+JOIN tbl_work w ON w.work_id=s.work_id
+WHERE w.series_id=$1 AND NOT coalesce(s.is_snippet, false)
+AND s.deleted_at IS NULL AND w.deleted_at IS NULL
+GROUP BY s.work_id`, seriesId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sectionCounts := map[int]int{}
+	for rows.Next() {
+		var workId, count int
+		if err := rows.Scan(&workId, &count); err != nil {
+			return nil, err
+		}
+		sectionCounts[workId] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return NewSeriesStats(works, sectionCounts), nil
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+)
+
+// UserSession is a logged-in session as shown on the account sessions page;
+// the session data itself is only ever touched by the session store.
+type UserSession struct {
+	Id         int
+	TokenHash  string
+	UserEmail  string
+	UserAgent  string
+	IP         string
+	Remember   bool
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Current    bool
+}
+
+// Device gives a rough, human-readable description of the user agent
+func (s *UserSession) Device() string {
+	ua := s.UserAgent
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edge/", "Edge"}, {"OPR/", "Opera"}, {"Chrome/", "Chrome"},
+		{"Firefox/", "Firefox"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	platform := ""
+	for _, p := range []struct{ token, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	if platform == "" {
+		return browser
+	}
+	return browser + " on " + platform
+}
+
+func GetSessionsForUser(email, currentHash string, database *db.DB) []*UserSession {
+	query := sessionsForUserQuery{Email: email}
+	sessionInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error on GetSessionsForUser: %v", err.Error())
+		return nil
+	}
+	output := make([]*UserSession, len(sessionInt))
+	for i := range sessionInt {
+		output[i] = sessionInt[i].(*UserSession)
+		output[i].Current = output[i].TokenHash == currentHash
+	}
+	return output
+}
+
+type sessionsForUserQuery struct {
+	Email string
+}
+
+func (q sessionsForUserQuery) GetQueryStr() string {
+	return `
+SELECT session_id, token_hash, user_email, user_agent, ip, remember, created_at, last_seen_at
+FROM tbl_session WHERE user_email=$1 ORDER BY last_seen_at DESC`
+}
+
+func (q sessionsForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Email}
+}
+
+func (q sessionsForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	s := UserSession{}
+	if err := r.Scan(&s.Id, &s.TokenHash, &s.UserEmail, &s.UserAgent, &s.IP, &s.Remember, &s.CreatedAt, &s.LastSeenAt); err != nil {
+		glog.Errorf("Error with sessionsForUserQuery: %v", err.Error())
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UserSessions are only ever inserted by the session store
+func (s *UserSession) GetInsertStr() string {
+	return ""
+}
+
+func (s *UserSession) GetInsertArgs() []interface{} {
+	return nil
+}
+
+type userSessionsDelete struct {
+	Email      string
+	ExceptHash string
+}
+
+func (d userSessionsDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_session WHERE user_email=$1 AND token_hash<>$2"
+}
+
+func (d userSessionsDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Email, d.ExceptHash}
+}
+
+type userSessionDelete struct {
+	Email     string
+	SessionId int
+}
+
+func (d userSessionDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_session WHERE user_email=$1 AND session_id=$2"
+}
+
+func (d userSessionDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Email, d.SessionId}
+}
+
+// DeleteSessionsForUser logs a user out everywhere, except for the session
+// whose hash is exceptHash (pass "" to log them out of every session).
+func DeleteSessionsForUser(database *db.DB, tx *sql.Tx, email, exceptHash string) error {
+	return database.Delete(userSessionsDelete{Email: email, ExceptHash: exceptHash}, tx)
+}
+
+// DeleteSessionForUser logs a user out of the one session. It's an error
+// without one.
+func DeleteSessionForUser(database *db.DB, tx *sql.Tx, email string, sessionId int) error {
+	if sessionId == 0 {
+		return errors.New("no session to log out of")
+	}
+	return database.Delete(userSessionDelete{Email: email, SessionId: sessionId}, tx)
+}
@@ -16,10 +16,17 @@ type Setting struct {
 	UserEmail string
 	DB        *db.DB
 	Body      string
+	// ParentId is the place this one is in, or 0. It only changes after
+	// CheckSettingParent.
+	ParentId int
+	// The rest are only filled in by BuildSettingTree
+	Children     []*Setting
+	Depth        int
+	SectionCount int
 }
 
-var settingListColumnStr = "SELECT tbl_setting.setting_id, name, tbl_setting.blurb, tbl_setting.user_email FROM tbl_setting"
-var settingDetailColumnStr = "SELECT tbl_setting.setting_id, name, tbl_setting.blurb, tbl_setting.body, tbl_setting.user_email FROM tbl_setting"
+var settingListColumnStr = "SELECT tbl_setting.setting_id, name, tbl_setting.blurb, tbl_setting.parent_id, tbl_setting.user_email FROM tbl_setting"
+var settingDetailColumnStr = "SELECT tbl_setting.setting_id, name, tbl_setting.blurb, tbl_setting.body, tbl_setting.parent_id, tbl_setting.user_email FROM tbl_setting"
 
 func (s *Setting) VerifyPermission(sm sessionManager.SessionManager) bool {
 	return s.UserEmail == sm.GetUserEmail()
@@ -27,26 +34,26 @@ func (s *Setting) VerifyPermission(sm sessionManager.SessionManager) bool {
 
 func (s *Setting) GetInsertStr() string {
 	return `
-INSERT INTO tbl_setting(name, blurb, body, user_email)
-VALUES ($1, $2, $3, $4)
+INSERT INTO tbl_setting(name, blurb, body, parent_id, user_email)
+VALUES ($1, $2, $3, $4, $5)
 RETURNING setting_id;
 `
 }
 
 func (s *Setting) GetInsertArgs() []interface{} {
-	return []interface{}{s.Name, db.ToNullString(s.Blurb), db.ToNullString(s.Body), s.UserEmail}
+	return []interface{}{s.Name, db.ToNullString(s.Blurb), db.ToNullString(s.Body), db.ToNullInt(int64(s.ParentId)), s.UserEmail}
 }
 
 func (s *Setting) GetUpdateStr() string {
 	return `
 UPDATE tbl_setting
-SET name=$1, blurb=$2, body=$3
-WHERE setting_id=$4
+SET name=$1, blurb=$2, body=$3, parent_id=$4
+WHERE setting_id=$5
 `
 }
 
 func (s *Setting) GetUpdateArgs() []interface{} {
-	return []interface{}{s.Name, s.Blurb, s.Body, s.Id}
+	return []interface{}{s.Name, s.Blurb, s.Body, db.ToNullInt(int64(s.ParentId)), s.Id}
 }
 
 func (s *Setting) Save(tx *sql.Tx) error {
@@ -71,7 +78,7 @@ type settingByIdQuery struct {
 }
 
 func (q settingByIdQuery) GetQueryStr() string {
-	return settingDetailColumnStr + " where setting_id=$1"
+	return settingDetailColumnStr + " where setting_id=$1 and deleted_at is null"
 }
 
 func (q settingByIdQuery) GetQueryArgs() []interface{} {
@@ -85,11 +92,13 @@ func (q settingByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertabl
 func settingListFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
 	setting := Setting{DB: database}
 	nullBlurb := sql.NullString{}
-	if err := r.Scan(&setting.Id, &setting.Name, &nullBlurb, &setting.UserEmail); err != nil {
+	nullParent := sql.NullInt64{}
+	if err := r.Scan(&setting.Id, &setting.Name, &nullBlurb, &nullParent, &setting.UserEmail); err != nil {
 		glog.Error(err.Error())
 		return nil, err
 	}
 	setting.Blurb = nullBlurb.String
+	setting.ParentId = int(nullParent.Int64)
 	return &setting, nil
 }
 
@@ -97,12 +106,14 @@ func settingDetailFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
 	setting := Setting{DB: database}
 	nullBlurb := sql.NullString{}
 	nullBody := sql.NullString{}
-	if err := r.Scan(&setting.Id, &setting.Name, &nullBlurb, &nullBody, &setting.UserEmail); err != nil {
+	nullParent := sql.NullInt64{}
+	if err := r.Scan(&setting.Id, &setting.Name, &nullBlurb, &nullBody, &nullParent, &setting.UserEmail); err != nil {
 		glog.Error(err.Error())
 		return nil, err
 	}
 	setting.Blurb = nullBlurb.String
 	setting.Body = nullBody.String
+	setting.ParentId = int(nullParent.Int64)
 	return &setting, nil
 }
 
@@ -144,6 +155,10 @@ func GetSettingsForSection(sectionId int, database *db.DB) []*Setting {
 	return getSettingsForLeft("section", sectionId, database, "list")
 }
 
+func GetSettingsForEvent(eventId int, database *db.DB) []*Setting {
+	return getSettingsForLeft("event", eventId, database, "list")
+}
+
 func GetSettingsForUser(userEmail string, database *db.DB) []*Setting {
 	query := settingsForUserQuery{UserEmail: userEmail}
 	settingsInt, err := database.Query(query)
@@ -163,7 +178,7 @@ type settingsForUserQuery struct {
 }
 
 func (q settingsForUserQuery) GetQueryStr() string {
-	return settingListColumnStr + " WHERE user_email=$1"
+	return settingListColumnStr + " WHERE user_email=$1 AND deleted_at IS NULL"
 }
 
 func (q settingsForUserQuery) GetQueryArgs() []interface{} {
@@ -174,6 +189,49 @@ func (q settingsForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Inser
 	return settingListFromRow(database, r)
 }
 
+type settingChildrenUpdate struct {
+	Id int
+}
+
+func (u settingChildrenUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_setting
+SET parent_id=(SELECT parent_id FROM tbl_setting WHERE setting_id=$1)
+WHERE parent_id=$1`
+}
+
+func (u settingChildrenUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+// DeleteSetting moves the places inside the setting up a level before
+// deleting it, the same way DeleteSection does.
 func DeleteSetting(settingId int, database *db.DB) (bool, error) {
-	return db.DoBasicDelete(settingId, "setting", database)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		glog.Errorf("setting delete database error: %v", err.Error())
+		return false, err
+	}
+	if err := database.Update(settingChildrenUpdate{Id: settingId}, tx); err != nil {
+		glog.Errorf("setting delete database error: %v", err.Error())
+		return false, err
+	}
+	if err := database.Delete(settingDelete{Id: settingId}, tx); err != nil {
+		glog.Errorf("setting delete database error: %v", err.Error())
+		return false, err
+	}
+	err = tx.Commit()
+	return err == nil, err
+}
+
+type settingDelete struct {
+	Id int
+}
+
+func (d settingDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_setting WHERE setting_id=$1"
+}
+
+func (d settingDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Id}
 }
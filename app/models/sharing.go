@@ -0,0 +1,208 @@
+package models
+
+import (
+	"database/sql"
+	"math"
+	"strconv"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/auth"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+)
+
+// ShareTokenKind is what share link tokens are signed as
+const ShareTokenKind = "share-link"
+
+// ShareLink lets anyone with its token read a work, or just some of its
+// sections, without logging in. Revoking it deletes it, which is the end of
+// the token too.
+type ShareLink struct {
+	Id     int
+	WorkId int
+	// Name is for the author, to tell links apart: "Beta readers", "Mum"
+	Name  string
+	Token string
+	// SectionIds are the sections shared; none means the whole work
+	SectionIds   []int
+	PasswordHash string
+	ExpiresAt    pq.NullTime
+	CreatedAt    time.Time
+	UserEmail    string
+	DB           *db.DB
+}
+
+const shareLinkColumnStr = `
+SELECT share_link_id, work_id, name, token, section_ids, password_hash, expires_at, created_at, user_email
+FROM tbl_share_link`
+
+func (l *ShareLink) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return l.UserEmail == sm.GetUserEmail()
+}
+
+func (l *ShareLink) IsExpired(now time.Time) bool {
+	return l.ExpiresAt.Valid && now.After(l.ExpiresAt.Time)
+}
+
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+func (l *ShareLink) CheckPassword(raw string) bool {
+	return !l.HasPassword() || auth.CheckPassword(raw, l.PasswordHash)
+}
+
+// Sections picks the shared sections out of the work's, keeping their order
+func (l *ShareLink) Sections(sections []*Section) []*Section {
+	if len(l.SectionIds) == 0 {
+		return sections
+	}
+	shared := make(map[int]bool, len(l.SectionIds))
+	for _, id := range l.SectionIds {
+		shared[id] = true
+	}
+	output := []*Section{}
+	for _, section := range sections {
+		if shared[section.Id] {
+			output = append(output, section)
+		}
+	}
+	return output
+}
+
+// GetInsertStr leaves the token out; it's signed over the id, so it's set
+// with SetShareLinkToken once the link has one
+func (l *ShareLink) GetInsertStr() string {
+	return `
+INSERT INTO tbl_share_link(work_id, name, section_ids, password_hash, expires_at, user_email)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING share_link_id
+`
+}
+
+func (l *ShareLink) GetInsertArgs() []interface{} {
+	sectionIds := make([]int64, len(l.SectionIds))
+	for i, id := range l.SectionIds {
+		sectionIds[i] = int64(id)
+	}
+	return []interface{}{l.WorkId, l.Name, pq.Array(sectionIds), db.ToNullString(l.PasswordHash),
+		l.ExpiresAt, l.UserEmail}
+}
+
+func shareLinkFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	l := ShareLink{DB: database}
+	var sectionIds []int64
+	passwordHash := sql.NullString{}
+	if err := r.Scan(&l.Id, &l.WorkId, &l.Name, &l.Token, pq.Array(&sectionIds), &passwordHash,
+		&l.ExpiresAt, &l.CreatedAt, &l.UserEmail); err != nil {
+		glog.Errorf("Error with shareLinkFromRow: %v", err.Error())
+		return nil, err
+	}
+	for _, id := range sectionIds {
+		l.SectionIds = append(l.SectionIds, int(id))
+	}
+	l.PasswordHash = passwordHash.String
+	return &l, nil
+}
+
+type shareLinkTokenUpdate struct {
+	Id    int
+	Token string
+}
+
+func (u shareLinkTokenUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_share_link SET token=$1 WHERE share_link_id=$2"
+}
+
+func (u shareLinkTokenUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Token, u.Id}
+}
+
+// SetShareLinkToken signs a token for a newly inserted link
+func SetShareLinkToken(database *db.DB, tx *sql.Tx, link *ShareLink) error {
+	link.Token = auth.NewTSToken(strconv.Itoa(link.Id), ShareTokenKind)
+	return database.Update(shareLinkTokenUpdate{Id: link.Id, Token: link.Token}, tx)
+}
+
+func GetShareLinkById(id int, database *db.DB) Verifiable {
+	links := shareLinksFromQuery(shareLinkByIdQuery{Id: id}, database)
+	if len(links) == 0 {
+		return nil
+	}
+	return links[0]
+}
+
+// GetShareLinkByToken returns the link a token is for, or nil if the token
+// is forged, revoked or expired. The token's own timestamp doesn't expire
+// it; the link's ExpiresAt does.
+func GetShareLinkByToken(token string, database *db.DB) *ShareLink {
+	rawId, valid := auth.VerifyTSToken(ShareTokenKind, token, math.MaxFloat64)
+	if !valid {
+		return nil
+	}
+	id, err := strconv.Atoi(rawId)
+	if err != nil {
+		return nil
+	}
+	link, ok := GetShareLinkById(id, database).(*ShareLink)
+	if !ok || link.Token != token || link.IsExpired(time.Now()) {
+		return nil
+	}
+	return link
+}
+
+func shareLinksFromQuery(query db.Queryable, database *db.DB) []*ShareLink {
+	linksInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting share links: %v", err.Error())
+		return nil
+	}
+	output := make([]*ShareLink, len(linksInt))
+	for i := range linksInt {
+		output[i] = linksInt[i].(*ShareLink)
+	}
+	return output
+}
+
+type shareLinkByIdQuery struct {
+	Id int
+}
+
+func (q shareLinkByIdQuery) GetQueryStr() string {
+	return shareLinkColumnStr + " WHERE share_link_id=$1"
+}
+
+func (q shareLinkByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q shareLinkByIdQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return shareLinkFromRow(database, r)
+}
+
+// GetShareLinksForWork is newest first
+func GetShareLinksForWork(workId int, database *db.DB) []*ShareLink {
+	return shareLinksFromQuery(shareLinksForWorkQuery{WorkId: workId}, database)
+}
+
+type shareLinksForWorkQuery struct {
+	WorkId int
+}
+
+func (q shareLinksForWorkQuery) GetQueryStr() string {
+	return shareLinkColumnStr + " WHERE work_id=$1 ORDER BY created_at DESC"
+}
+
+func (q shareLinksForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId}
+}
+
+func (q shareLinksForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return shareLinkFromRow(database, r)
+}
+
+func DeleteShareLink(linkId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(linkId, "share_link", database)
+}
@@ -0,0 +1,253 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/bradfitz/slice"
+)
+
+var (
+	// the editor marks where the cursor was with <hr class="pathfork-split">
+	splitMarkerPattern = regexp.MustCompile(`<hr\b[^>]*\bpathfork-split\b[^>]*>`)
+	splitTagPattern    = regexp.MustCompile(`(?s)<!--.*?-->|<(/?)([a-zA-Z][a-zA-Z0-9-]*)[^>]*>`)
+	voidElements       = map[string]bool{
+		"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+		"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+	}
+)
+
+type openTag struct {
+	Name string
+	Tag  string
+}
+
+// openTagsIn is what's still open at the end of body, outermost first
+func openTagsIn(body string) []openTag {
+	open := []openTag{}
+	for _, match := range splitTagPattern.FindAllStringSubmatch(body, -1) {
+		name := strings.ToLower(match[2])
+		if name == "" || voidElements[name] || strings.HasSuffix(match[0], "/>") {
+			continue
+		}
+		if match[1] == "" {
+			open = append(open, openTag{Name: name, Tag: match[0]})
+			continue
+		}
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i].Name == name {
+				open = open[:i]
+				break
+			}
+		}
+	}
+	return open
+}
+
+// SplitSectionBody cuts body at the first split marker. Whatever the marker
+// was inside is closed at the end of the first half and opened again at the
+// start of the second, unless that would leave it empty. It isn't ok if
+// there's no marker, or no words on one side of it.
+func SplitSectionBody(body string) (string, string, bool) {
+	loc := splitMarkerPattern.FindStringIndex(body)
+	if loc == nil {
+		return "", "", false
+	}
+	before := body[:loc[0]]
+	after := splitMarkerPattern.ReplaceAllString(body[loc[1]:], "")
+	open := openTagsIn(before)
+
+	// innermost first, so "<p><em>" right before the marker goes entirely
+	closing := ""
+	for i := len(open) - 1; i >= 0; i-- {
+		trimmed := strings.TrimRight(before, " \t\r\n")
+		if closing == "" && strings.HasSuffix(trimmed, open[i].Tag) {
+			before = strings.TrimSuffix(trimmed, open[i].Tag)
+			continue
+		}
+		closing += "</" + open[i].Name + ">"
+	}
+	first := before + closing
+
+	reopened := len(open)
+	for reopened > 0 {
+		trimmed := strings.TrimLeft(after, " \t\r\n")
+		end := "</" + open[reopened-1].Name + ">"
+		if len(trimmed) < len(end) || !strings.EqualFold(trimmed[:len(end)], end) {
+			break
+		}
+		after = trimmed[len(end):]
+		reopened--
+	}
+	opening := ""
+	for _, tag := range open[:reopened] {
+		opening += tag.Tag
+	}
+	second := opening + after
+
+	if strings.TrimSpace(SectionText(first)) == "" || strings.TrimSpace(SectionText(second)) == "" {
+		return "", "", false
+	}
+	return first, second, true
+}
+
+// SplitSection makes the part of section after the marker in body a new
+// section called title, straight after it and with the same characters
+// and settings, and returns the new section's id. section.Body is set to
+// the part before.
+func SplitSection(database *db.DB, tx *sql.Tx, section *Section, body, title string) (int, error) {
+	first, second, ok := SplitSectionBody(body)
+	if !ok {
+		return 0, errors.New("There needs to be something on both sides of the split.")
+	}
+	savedWordCount := section.WordCount
+	section.Body = first
+	section.WordCount = CountWords(first)
+	if err := section.Save(tx); err != nil {
+		return 0, err
+	}
+	if err := ReanchorComments(database, tx, section.Id, section.Body); err != nil {
+		return 0, err
+	}
+	rest := &Section{
+		Title:     title,
+		Body:      second,
+		UserEmail: section.UserEmail,
+		Snippet:   section.Snippet,
+		WordCount: CountWords(second),
+		Status:    section.Status,
+	}
+	id, err := insertSectionAfter(database, tx, rest, section)
+	if err != nil {
+		return 0, err
+	}
+	if err := copySectionLinks(database, tx, section.Id, id); err != nil {
+		return 0, err
+	}
+	return id, UpdateWorkWordCount(database, tx, section.WorkId, section.WordCount+rest.WordCount-savedWordCount)
+}
+
+/*
+.
+.
+*/
+
+// MergeOrder checks that ids are adjacent sections of the same kind under
+// the same parent in sections, which are all of a work's, and returns them
+// in order. Like in BuildSectionTree, a section whose parent isn't there is
+// at the top level.
+func MergeOrder(sections []*Section, ids []int) ([]*Section, error) {
+	if len(ids) < 2 {
+		return nil, errors.New("Pick at least two sections to merge.")
+	}
+	byId := make(map[int]*Section, len(sections))
+	for _, section := range sections {
+		byId[section.Id] = section
+	}
+	selected := make([]*Section, 0, len(ids))
+	for _, id := range ids {
+		section, ok := byId[id]
+		if !ok {
+			return nil, errors.New("Those sections aren't all in this work.")
+		}
+		selected = append(selected, section)
+	}
+	parentOf := func(section *Section) int {
+		if _, ok := byId[section.ParentId]; ok {
+			return section.ParentId
+		}
+		return 0
+	}
+	first := selected[0]
+	siblings := []*Section{}
+	for _, section := range sections {
+		if parentOf(section) == parentOf(first) && section.Snippet == first.Snippet {
+			siblings = append(siblings, section)
+		}
+	}
+	slice.Sort(siblings, func(i, j int) bool { return siblings[i].Order < siblings[j].Order })
+	position := make(map[int]int, len(siblings))
+	for i, section := range siblings {
+		position[section.Id] = i
+	}
+	for _, section := range selected {
+		if _, ok := position[section.Id]; !ok {
+			return nil, errors.New("Only sections in the same place, like chapters of the same part, can be merged.")
+		}
+	}
+	slice.Sort(selected, func(i, j int) bool { return position[selected[i].Id] < position[selected[j].Id] })
+	for i, section := range selected {
+		if position[section.Id] != position[selected[0].Id]+i {
+			return nil, errors.New("Only sections next to each other can be merged.")
+		}
+	}
+	return selected, nil
+}
+
+type commentsMoveUpdate struct {
+	FromId int
+	ToId   int
+}
+
+func (u commentsMoveUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_comment SET section_id=$1 WHERE section_id=$2"
+}
+
+func (u commentsMoveUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.ToId, u.FromId}
+}
+
+// sectionChildrenMoveUpdate puts FromId's subsections after ToId's
+type sectionChildrenMoveUpdate struct {
+	FromId int
+	ToId   int
+}
+
+func (u sectionChildrenMoveUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_section
+SET parent_id=$1, section_order = section_order + coalesce((SELECT max(section_order) FROM tbl_section WHERE parent_id=$2), 0)
+WHERE parent_id=$3`
+}
+
+func (u sectionChildrenMoveUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.ToId, u.ToId, u.FromId}
+}
+
+// MergeSections adds the bodies of the rest of sections, which MergeOrder
+// has checked, to the first one's, and puts them in the trash. The first
+// one gets their characters, settings, comments and subsections too.
+func MergeSections(database *db.DB, tx *sql.Tx, sections []*Section) (*Section, error) {
+	merged := sections[0]
+	savedWordCount := merged.WordCount
+	bodies := make([]string, len(sections))
+	for i, section := range sections {
+		bodies[i] = section.Body
+	}
+	for _, section := range sections[1:] {
+		if err := copySectionLinks(database, tx, section.Id, merged.Id); err != nil {
+			return nil, err
+		}
+		if err := database.Update(commentsMoveUpdate{FromId: section.Id, ToId: merged.Id}, tx); err != nil {
+			return nil, err
+		}
+		if err := database.Update(sectionChildrenMoveUpdate{FromId: section.Id, ToId: merged.Id}, tx); err != nil {
+			return nil, err
+		}
+		if err := TrashSection(database, tx, section.Id); err != nil {
+			return nil, err
+		}
+	}
+	merged.Body = strings.Join(bodies, "\n")
+	merged.WordCount = CountWords(merged.Body)
+	if err := merged.Save(tx); err != nil {
+		return nil, err
+	}
+	if err := ReanchorComments(database, tx, merged.Id, merged.Body); err != nil {
+		return nil, err
+	}
+	return merged, UpdateWorkWordCount(database, tx, merged.WorkId, merged.WordCount-savedWordCount)
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+)
+
+// DefaultSectionStatuses are what a work starts with; each work can set its own
+var DefaultSectionStatuses = []string{"idea", "drafted", "revised", "final"}
+
+// ParseStatuses reads a comma-separated list of statuses as typed into the
+// work form, dropping blanks and repeats
+func ParseStatuses(raw string) []string {
+	output := []string{}
+	seen := map[string]bool{}
+	for _, status := range strings.Split(raw, ",") {
+		status = strings.TrimSpace(status)
+		if status == "" || seen[status] {
+			continue
+		}
+		seen[status] = true
+		output = append(output, status)
+	}
+	if len(output) == 0 {
+		return DefaultSectionStatuses
+	}
+	return output
+}
+
+func filterSectionsByStatus(sections []*Section, statuses []string) []*Section {
+	output := []*Section{}
+	for _, section := range sections {
+		for _, status := range statuses {
+			if section.GetStatus() == status {
+				output = append(output, section)
+				break
+			}
+		}
+	}
+	return output
+}
+
+// StatusColumn is one column of a work's board
+type StatusColumn struct {
+	Status    string
+	Sections  []*Section
+	WordCount int
+}
+
+// GroupSectionsByStatus lays sections out in the work's status order. Any
+// section whose status has since been dropped from the work gets a column
+// of its own at the end, so that it can still be moved.
+func GroupSectionsByStatus(work *Work, sections []*Section) []*StatusColumn {
+	columns := []*StatusColumn{}
+	byStatus := map[string]*StatusColumn{}
+	for _, status := range work.GetStatuses() {
+		column := &StatusColumn{Status: status}
+		columns = append(columns, column)
+		byStatus[status] = column
+	}
+	for _, section := range sections {
+		column, ok := byStatus[section.GetStatus()]
+		if !ok {
+			column = &StatusColumn{Status: section.GetStatus()}
+			columns = append(columns, column)
+			byStatus[column.Status] = column
+		}
+		column.Sections = append(column.Sections, section)
+		column.WordCount += section.WordCount
+	}
+	return columns
+}
+
+/*
+.
+.
+*/
+
+// StatusChange is one entry in a section's status history
+type StatusChange struct {
+	Id           int
+	SectionId    int
+	SectionTitle string
+	Status       string
+	ChangedAt    time.Time
+	UserEmail    string
+}
+
+func (c *StatusChange) GetInsertStr() string {
+	return `
+INSERT INTO tbl_section_status(section_id, status, changed_at, user_email)
+VALUES ($1, $2, $3, $4) returning section_status_id`
+}
+
+func (c *StatusChange) GetInsertArgs() []interface{} {
+	return []interface{}{c.SectionId, c.Status, c.ChangedAt, c.UserEmail}
+}
+
+type sectionStatusUpdate struct {
+	Id     int
+	Status string
+}
+
+func (u sectionStatusUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_section SET status=$1 WHERE section_id=$2"
+}
+
+func (u sectionStatusUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Status, u.Id}
+}
+
+// SetSectionStatus moves a section to a new status and records the move.
+// Setting the status it already has does nothing.
+func SetSectionStatus(database *db.DB, tx *sql.Tx, section *Section, status, email string, now time.Time) error {
+	if section.GetStatus() == status {
+		return nil
+	}
+	if err := database.Update(sectionStatusUpdate{Id: section.Id, Status: status}, tx); err != nil {
+		return err
+	}
+	change := &StatusChange{SectionId: section.Id, Status: status, ChangedAt: now, UserEmail: email}
+	if _, err := database.Insert(change, tx); err != nil {
+		return err
+	}
+	section.Status = status
+	return nil
+}
+
+// GetStatusHistoryForWork returns the most recent status changes across a
+// work's sections, newest first
+func GetStatusHistoryForWork(workId, limit int, database *db.DB) []*StatusChange {
+	changesInt, err := database.Query(statusHistoryForWorkQuery{WorkId: workId, Limit: limit})
+	if err != nil {
+		glog.Errorf("Error on GetStatusHistoryForWork: %v", err.Error())
+		return nil
+	}
+	output := make([]*StatusChange, len(changesInt))
+	for i := range changesInt {
+		output[i] = changesInt[i].(*StatusChange)
+	}
+	return output
+}
+
+type statusHistoryForWorkQuery struct {
+	WorkId int
+	Limit  int
+}
+
+func (q statusHistoryForWorkQuery) GetQueryStr() string {
+	return `
+SELECT tbl_section_status.section_status_id, tbl_section_status.section_id, tbl_section.title,
+tbl_section_status.status, tbl_section_status.changed_at, tbl_section_status.user_email
+FROM tbl_section_status JOIN tbl_section ON tbl_section.section_id=tbl_section_status.section_id
+WHERE tbl_section.work_id=$1 AND tbl_section.deleted_at IS NULL
+ORDER BY tbl_section_status.changed_at DESC LIMIT $2`
+}
+
+func (q statusHistoryForWorkQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.WorkId, q.Limit}
+}
+
+func (q statusHistoryForWorkQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	c := StatusChange{}
+	if err := r.Scan(&c.Id, &c.SectionId, &c.SectionTitle, &c.Status, &c.ChangedAt, &c.UserEmail); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
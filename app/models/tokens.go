@@ -0,0 +1,202 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/auth"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+)
+
+const (
+	TokenScopeRead  = "read"
+	TokenScopeWrite = "write"
+)
+
+var apiTokenColumnStr = "SELECT tbl_api_token.api_token_id, tbl_api_token.name, tbl_api_token.token_prefix, tbl_api_token.token_hash, tbl_api_token.scope, tbl_api_token.user_email, tbl_api_token.created_at, tbl_api_token.expires_at, tbl_api_token.last_used_at FROM tbl_api_token"
+
+// APIToken is a named, revocable personal access token. Only the hash of the
+// token is stored; TokenPrefix is kept so users can tell their tokens apart.
+type APIToken struct {
+	Id          int
+	Name        string
+	TokenPrefix string
+	TokenHash   string
+	Scope       string
+	UserEmail   string
+	CreatedAt   time.Time
+	ExpiresAt   pq.NullTime
+	LastUsedAt  pq.NullTime
+	DB          *db.DB
+}
+
+// NewAPIToken returns the raw token, which must be shown to the user right
+// away, and the unsaved APIToken that stores its hash.
+func NewAPIToken(name, scope, email string, expiresAt time.Time) (string, *APIToken, error) {
+	raw, hashed, err := auth.NewAPIToken()
+	if err != nil {
+		return "", nil, err
+	}
+	if scope != TokenScopeWrite {
+		scope = TokenScopeRead
+	}
+	token := &APIToken{
+		Name:        name,
+		TokenPrefix: raw[:8],
+		TokenHash:   hashed,
+		Scope:       scope,
+		UserEmail:   email,
+		ExpiresAt:   pq.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()},
+	}
+	return raw, token, nil
+}
+
+func (t *APIToken) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return t.UserEmail == sm.GetUserEmail()
+}
+
+func (t *APIToken) IsExpired(now time.Time) bool {
+	return t.ExpiresAt.Valid && now.After(t.ExpiresAt.Time)
+}
+
+// Allows reports whether the token's scope covers the given request method.
+func (t *APIToken) Allows(method string) bool {
+	if t.Scope == TokenScopeWrite {
+		return true
+	}
+	return method == "GET" || method == "HEAD"
+}
+
+func (t *APIToken) GetInsertStr() string {
+	return `
+INSERT INTO tbl_api_token(name, token_prefix, token_hash, scope, user_email, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING api_token_id
+`
+}
+
+func (t *APIToken) GetInsertArgs() []interface{} {
+	return []interface{}{t.Name, t.TokenPrefix, t.TokenHash, t.Scope, t.UserEmail, t.ExpiresAt}
+}
+
+func apiTokenFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
+	token := APIToken{DB: db}
+	if err := r.Scan(&token.Id, &token.Name, &token.TokenPrefix, &token.TokenHash, &token.Scope,
+		&token.UserEmail, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt); err != nil {
+		glog.Errorf("Error with apiTokenFromRow: %v", err.Error())
+		return nil, err
+	}
+	return &token, nil
+}
+
+func GetAPITokenById(id int, database *db.DB) Verifiable {
+	query := apiTokenByIdQuery{Id: id}
+	tokenInt, err := database.Query(query)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	if len(tokenInt) == 0 {
+		return nil
+	}
+	return tokenInt[0].(*APIToken)
+}
+
+type apiTokenByIdQuery struct {
+	Id int
+}
+
+func (q apiTokenByIdQuery) GetQueryStr() string {
+	return apiTokenColumnStr + " WHERE api_token_id=$1"
+}
+
+func (q apiTokenByIdQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q apiTokenByIdQuery) ObjFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return apiTokenFromRow(db, r)
+}
+
+// GetAPITokenByRaw looks a token up by the hash of the raw bearer value
+func GetAPITokenByRaw(raw string, database *db.DB) *APIToken {
+	query := apiTokenByHashQuery{Hash: auth.HashAPIToken(raw)}
+	tokenInt, err := database.Query(query)
+	if err != nil {
+		glog.Error(err)
+		return nil
+	}
+	if len(tokenInt) == 0 {
+		return nil
+	}
+	return tokenInt[0].(*APIToken)
+}
+
+type apiTokenByHashQuery struct {
+	Hash string
+}
+
+func (q apiTokenByHashQuery) GetQueryStr() string {
+	return apiTokenColumnStr + " WHERE token_hash=$1"
+}
+
+func (q apiTokenByHashQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Hash}
+}
+
+func (q apiTokenByHashQuery) ObjFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return apiTokenFromRow(db, r)
+}
+
+func GetAPITokensForUser(email string, database *db.DB) []*APIToken {
+	query := apiTokensForUserQuery{Email: email}
+	tokenInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error on GetAPITokensForUser: %v", err.Error())
+		return nil
+	}
+	output := make([]*APIToken, len(tokenInt))
+	for i := range tokenInt {
+		output[i] = tokenInt[i].(*APIToken)
+	}
+	return output
+}
+
+type apiTokensForUserQuery struct {
+	Email string
+}
+
+func (q apiTokensForUserQuery) GetQueryStr() string {
+	return apiTokenColumnStr + " WHERE user_email=$1 ORDER BY created_at DESC"
+}
+
+func (q apiTokensForUserQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Email}
+}
+
+func (q apiTokensForUserQuery) ObjFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return apiTokenFromRow(db, r)
+}
+
+type apiTokenLastUsedUpdate struct {
+	Id int
+}
+
+func (u apiTokenLastUsedUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_api_token SET last_used_at=now() WHERE api_token_id=$1"
+}
+
+func (u apiTokenLastUsedUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+func TouchAPIToken(database *db.DB, tx *sql.Tx, id int) error {
+	return database.Update(apiTokenLastUsedUpdate{Id: id}, tx)
+}
+
+func DeleteAPIToken(tokenId int, database *db.DB) (bool, error) {
+	return db.DoBasicDelete(tokenId, "api_token", database)
+}
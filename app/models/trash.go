@@ -0,0 +1,384 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+	"github.com/lib/pq"
+)
+
+// TrashedItem is a work, section, character or setting in the trash. Its
+// relations are left alone while it's there, so restoring it brings them
+// back too.
+type TrashedItem struct {
+	Entity string
+	Id     int
+	Title  string
+	// WorkTitle is the work a section was in
+	WorkTitle string
+	DeletedAt time.Time
+	UserEmail string
+}
+
+// TrashEntities are the things with a deleted_at, in the order the Trash
+// page lists them
+var TrashEntities = []string{"work", "section", "character", "setting"}
+
+// trashedSelects list each table's trash as TrashedItems, with the table as
+// t. Sections of a work in the trash go with the work rather than on their
+// own.
+var trashedSelects = map[string]string{
+	"work": `
+SELECT 'work', t.work_id, t.title, '', t.deleted_at, t.user_email FROM tbl_work t
+WHERE t.deleted_at IS NOT NULL`,
+	"section": `
+SELECT 'section', t.section_id, t.title, w.title, t.deleted_at, t.user_email FROM tbl_section t
+JOIN tbl_work w ON w.work_id=t.work_id
+WHERE t.deleted_at IS NOT NULL AND w.deleted_at IS NULL`,
+	"character": `
+SELECT 'character', t.character_id, t.name, '', t.deleted_at, t.user_email FROM tbl_character t
+WHERE t.deleted_at IS NOT NULL`,
+	"setting": `
+SELECT 'setting', t.setting_id, t.name, '', t.deleted_at, t.user_email FROM tbl_setting t
+WHERE t.deleted_at IS NOT NULL`,
+}
+
+// notTrashed is the condition that leaves tbl_<entity>'s trash out of a
+// query, or nothing for a table without one
+func notTrashed(entity string) string {
+	if _, ok := trashedSelects[entity]; !ok {
+		return ""
+	}
+	return fmt.Sprintf(" AND tbl_%v.deleted_at IS NULL", entity)
+}
+
+// trashedQueryStr is all of the trash with cond added to each table's
+// part. cond's $1 becomes the part's own placeholder, so the query takes
+// its one argument once per table.
+func trashedQueryStr(cond string) string {
+	parts := make([]string, len(TrashEntities))
+	for i, entity := range TrashEntities {
+		parts[i] = trashedSelects[entity] + " AND " + strings.Replace(cond, "$1", fmt.Sprintf("$%v", i+1), -1)
+	}
+	return strings.Join(parts, "\nUNION ALL") + "\nORDER BY 5 DESC"
+}
+
+func repeatArg(arg interface{}) []interface{} {
+	output := make([]interface{}, len(TrashEntities))
+	for i := range output {
+		output[i] = arg
+	}
+	return output
+}
+
+func (i *TrashedItem) VerifyPermission(sm sessionManager.SessionManager) bool {
+	return i.UserEmail == sm.GetUserEmail()
+}
+
+// TrashedItems are only ever put in the trash by the Trash functions
+func (i *TrashedItem) GetInsertStr() string {
+	return ""
+}
+
+func (i *TrashedItem) GetInsertArgs() []interface{} {
+	return nil
+}
+
+func trashedItemFromRow(r *sql.Rows) (db.Insertable, error) {
+	item := TrashedItem{}
+	if err := r.Scan(&item.Entity, &item.Id, &item.Title, &item.WorkTitle, &item.DeletedAt, &item.UserEmail); err != nil {
+		glog.Errorf("Error with trashedItemFromRow: %v", err.Error())
+		return nil, err
+	}
+	return &item, nil
+}
+
+func trashedItemsFromQuery(query db.Queryable, database *db.DB) []*TrashedItem {
+	itemsInt, err := database.Query(query)
+	if err != nil {
+		glog.Errorf("Error getting trash: %v", err.Error())
+		return nil
+	}
+	output := make([]*TrashedItem, len(itemsInt))
+	for i := range itemsInt {
+		output[i] = itemsInt[i].(*TrashedItem)
+	}
+	return output
+}
+
+// GetTrashForUser is everything the user has put in the trash, most
+// recent first. Sections belong to the work's owner, so a section an
+// editor threw out shows up in the owner's trash.
+func GetTrashForUser(email string, database *db.DB) []*TrashedItem {
+	return trashedItemsFromQuery(trashForUserQuery{Email: email}, database)
+}
+
+type trashForUserQuery struct {
+	Email string
+}
+
+func (q trashForUserQuery) GetQueryStr() string {
+	return trashedQueryStr("t.user_email=$1")
+}
+
+func (q trashForUserQuery) GetQueryArgs() []interface{} {
+	return repeatArg(q.Email)
+}
+
+func (q trashForUserQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return trashedItemFromRow(r)
+}
+
+// GetExpiredTrash is everyone's trash from before the cutoff
+func GetExpiredTrash(before time.Time, database *db.DB) []*TrashedItem {
+	return trashedItemsFromQuery(expiredTrashQuery{Before: before}, database)
+}
+
+type expiredTrashQuery struct {
+	Before time.Time
+}
+
+func (q expiredTrashQuery) GetQueryStr() string {
+	return trashedQueryStr("t.deleted_at<$1")
+}
+
+func (q expiredTrashQuery) GetQueryArgs() []interface{} {
+	return repeatArg(q.Before)
+}
+
+func (q expiredTrashQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return trashedItemFromRow(r)
+}
+
+// GetTrashedItem returns the entity if it's in the trash, and nil if it
+// isn't or doesn't exist
+func GetTrashedItem(entity string, id int, database *db.DB) Verifiable {
+	if _, ok := trashedSelects[entity]; !ok {
+		return nil
+	}
+	items := trashedItemsFromQuery(trashedItemQuery{Entity: entity, Id: id}, database)
+	if len(items) == 0 {
+		return nil
+	}
+	return items[0]
+}
+
+type trashedItemQuery struct {
+	Entity string
+	Id     int
+}
+
+func (q trashedItemQuery) GetQueryStr() string {
+	return trashedSelects[q.Entity] + fmt.Sprintf(" AND t.%v_id=$1", q.Entity)
+}
+
+func (q trashedItemQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Id}
+}
+
+func (q trashedItemQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	return trashedItemFromRow(r)
+}
+
+/*
+.
+.
+*/
+
+// trashUpdate puts tbl_<Entity> Id in the trash, or takes it out when
+// DeletedAt isn't valid. Either way it leaves it alone if it's already
+// where it's going.
+type trashUpdate struct {
+	Entity    string
+	Id        int
+	DeletedAt pq.NullTime
+}
+
+func (u trashUpdate) GetUpdateStr() string {
+	guard := "deleted_at IS NULL"
+	if !u.DeletedAt.Valid {
+		guard = "deleted_at IS NOT NULL"
+	}
+	return fmt.Sprintf("UPDATE tbl_%[1]v SET deleted_at=$1 WHERE %[1]v_id=$2 AND %[2]v", u.Entity, guard)
+}
+
+func (u trashUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.DeletedAt, u.Id}
+}
+
+// workSectionsTrashUpdate stamps the work's sections with the work's own
+// deleted_at. Ones already in the trash keep theirs.
+type workSectionsTrashUpdate struct {
+	WorkId    int
+	DeletedAt time.Time
+}
+
+func (u workSectionsTrashUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_section SET deleted_at=$1 WHERE work_id=$2 AND deleted_at IS NULL"
+}
+
+func (u workSectionsTrashUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.DeletedAt, u.WorkId}
+}
+
+// workSectionsRestoreUpdate brings back the sections that went in the
+// trash with the work, and not the ones thrown out before it
+type workSectionsRestoreUpdate struct {
+	WorkId int
+}
+
+func (u workSectionsRestoreUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_section SET deleted_at=NULL
+WHERE work_id=$1 AND deleted_at=(SELECT deleted_at FROM tbl_work WHERE work_id=$2)`
+}
+
+func (u workSectionsRestoreUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.WorkId, u.WorkId}
+}
+
+// sectionWordsUpdate adds a trashed section's words back to its work's
+// count, or takes them off when Sign is -1 and it isn't trashed yet
+type sectionWordsUpdate struct {
+	Id   int
+	Sign int
+}
+
+func (u sectionWordsUpdate) GetUpdateStr() string {
+	guard := "s.deleted_at IS NOT NULL"
+	if u.Sign < 0 {
+		guard = "s.deleted_at IS NULL"
+	}
+	return fmt.Sprintf(`
+UPDATE tbl_work SET word_count = word_count + $1 * s.word_count
+FROM tbl_section s WHERE s.section_id=$2 AND tbl_work.work_id=s.work_id AND %v`, guard)
+}
+
+func (u sectionWordsUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Sign, u.Id}
+}
+
+type settingParentClear struct {
+	Id int
+}
+
+func (u settingParentClear) GetUpdateStr() string {
+	return "UPDATE tbl_setting SET parent_id=NULL WHERE setting_id=$1"
+}
+
+func (u settingParentClear) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Id}
+}
+
+// ErrAlreadyTrashed is what the Trash functions return when there was
+// nothing to put in the trash, like when a delete form is sent twice
+var ErrAlreadyTrashed = errors.New("already in the trash")
+
+// trash runs u, which is putting something in the trash, and says
+// ErrAlreadyTrashed if it was there already
+func trash(tx *sql.Tx, u trashUpdate) error {
+	result, err := tx.Exec(u.GetUpdateStr(), u.GetUpdateArgs()...)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err == nil && rows == 0 {
+		err = ErrAlreadyTrashed
+	}
+	return err
+}
+
+func trashNow() pq.NullTime {
+	return pq.NullTime{Time: time.Now(), Valid: true}
+}
+
+// TrashWork puts the work in the trash along with its sections
+func TrashWork(database *db.DB, tx *sql.Tx, workId int) error {
+	now := trashNow()
+	if err := database.Update(workSectionsTrashUpdate{WorkId: workId, DeletedAt: now.Time}, tx); err != nil {
+		return err
+	}
+	return trash(tx, trashUpdate{Entity: "work", Id: workId, DeletedAt: now})
+}
+
+// TrashSection takes the section's words off its work. Its subsections
+// stay put, and show at the top level until it's restored.
+func TrashSection(database *db.DB, tx *sql.Tx, sectionId int) error {
+	if err := database.Update(sectionWordsUpdate{Id: sectionId, Sign: -1}, tx); err != nil {
+		return err
+	}
+	return trash(tx, trashUpdate{Entity: "section", Id: sectionId, DeletedAt: trashNow()})
+}
+
+func TrashCharacter(database *db.DB, tx *sql.Tx, characterId int) error {
+	return trash(tx, trashUpdate{Entity: "character", Id: characterId, DeletedAt: trashNow()})
+}
+
+// TrashSetting leaves the places inside it where they are, the same way
+// TrashSection does
+func TrashSetting(database *db.DB, tx *sql.Tx, settingId int) error {
+	return trash(tx, trashUpdate{Entity: "setting", Id: settingId, DeletedAt: trashNow()})
+}
+
+// RestoreTrashedItem undoes whichever Trash function put item in the trash
+func RestoreTrashedItem(database *db.DB, tx *sql.Tx, item *TrashedItem) error {
+	var err error
+	switch item.Entity {
+	case "work":
+		err = database.Update(workSectionsRestoreUpdate{WorkId: item.Id}, tx)
+	case "section":
+		err = database.Update(sectionWordsUpdate{Id: item.Id, Sign: 1}, tx)
+	case "setting":
+		err = uncycleRestoredSetting(database, tx, item)
+	}
+	if err != nil {
+		return err
+	}
+	return database.Update(trashUpdate{Entity: item.Entity, Id: item.Id}, tx)
+}
+
+// uncycleRestoredSetting moves a setting to the top level if, while it was
+// in the trash, its parent was put somewhere inside it
+func uncycleRestoredSetting(database *db.DB, tx *sql.Tx, item *TrashedItem) error {
+	rows, err := tx.Query("SELECT setting_id, coalesce(parent_id, 0) FROM tbl_setting WHERE user_email=$1", item.UserEmail)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	parents := map[int]int{}
+	for rows.Next() {
+		var id, parent int
+		if err := rows.Scan(&id, &parent); err != nil {
+			return err
+		}
+		parents[id] = parent
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if parent := parents[item.Id]; parent != 0 && SettingWithin(parent, item.Id, parents) {
+		return database.Update(settingParentClear{Id: item.Id}, tx)
+	}
+	return nil
+}
+
+// PurgeTrashedItem deletes item for good, the way deleting used to
+func PurgeTrashedItem(item *TrashedItem, database *db.DB) (bool, error) {
+	switch item.Entity {
+	case "work":
+		return DeleteWork(item.Id, database)
+	case "section":
+		return DeleteSection(item.Id, database)
+	case "character":
+		return DeleteCharacter(item.Id, database)
+	case "setting":
+		return DeleteSetting(item.Id, database)
+	}
+	return false, fmt.Errorf("can't purge a %v", item.Entity)
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/auth"
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+)
+
+const RecoveryCodeCount = 10
+
+type totpUpdate struct {
+	Email    string
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func (u totpUpdate) GetUpdateStr() string {
+	return `
+UPDATE tbl_user
+SET totp_secret=$1, totp_enabled=$2, totp_last_step=$3
+WHERE email=$4
+`
+}
+
+func (u totpUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{db.ToNullString(u.Secret), u.Enabled, u.LastStep, u.Email}
+}
+
+// EnableTOTP turns on two-factor auth and swaps in a fresh set of recovery
+// codes; the raw codes are returned to be shown to the user exactly once.
+func EnableTOTP(database *db.DB, tx *sql.Tx, u *User, secret string, step int64) ([]string, error) {
+	update := totpUpdate{Email: u.Email, Secret: secret, Enabled: true, LastStep: step}
+	if err := database.Update(update, tx); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := auth.NewRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := replaceRecoveryCodes(database, tx, u.Email, hashes); err != nil {
+		return nil, err
+	}
+	u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep = secret, true, step
+	return codes, nil
+}
+
+func DisableTOTP(database *db.DB, tx *sql.Tx, u *User) error {
+	if err := database.Update(totpUpdate{Email: u.Email}, tx); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(database, tx, u.Email, nil); err != nil {
+		return err
+	}
+	u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep = "", false, 0
+	return nil
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Either way the code is burned so it can't be replayed.
+func VerifySecondFactor(database *db.DB, u *User, code string, now time.Time) bool {
+	if !u.TOTPEnabled {
+		return false
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		glog.Error(err.Error())
+		return false
+	}
+	if step, ok := auth.VerifyTOTP(u.TOTPSecret, code, now, u.TOTPLastStep); ok {
+		update := totpUpdate{Email: u.Email, Secret: u.TOTPSecret, Enabled: true, LastStep: step}
+		if err := database.Update(update, tx); err != nil {
+			glog.Error(err.Error())
+			tx.Rollback()
+			return false
+		}
+		u.TOTPLastStep = step
+		return tx.Commit() == nil
+	}
+	var id int
+	err = tx.QueryRow(`
+UPDATE tbl_recovery_code SET used_at=now()
+WHERE user_email=$1 AND code_hash=$2 AND used_at IS NULL
+RETURNING recovery_code_id`, u.Email, auth.HashRecoveryCode(code)).Scan(&id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			glog.Error(err.Error())
+		}
+		tx.Rollback()
+		return false
+	}
+	glog.Infof("Recovery code %v used by %v", id, u.Email)
+	return tx.Commit() == nil
+}
+
+func CountRecoveryCodesLeft(email string, database *db.DB) int {
+	count := 0
+	err := database.DB.QueryRow(
+		"SELECT count(*) FROM tbl_recovery_code WHERE user_email=$1 AND used_at IS NULL", email,
+	).Scan(&count)
+	if err != nil {
+		glog.Error(err.Error())
+	}
+	return count
+}
+
+type recoveryCodesInsert struct {
+	Email  string
+	Hashes []string
+}
+
+func (i recoveryCodesInsert) GetInsertStr() string {
+	output := "INSERT INTO tbl_recovery_code (user_email, code_hash) VALUES"
+	for j := range i.Hashes {
+		output += fmt.Sprintf(" ($1, $%v)", j+2)
+		if j != len(i.Hashes)-1 {
+			output += ","
+		}
+	}
+	return output + " returning 0"
+}
+
+func (i recoveryCodesInsert) GetInsertArgs() []interface{} {
+	output := []interface{}{i.Email}
+	for j := range i.Hashes {
+		output = append(output, i.Hashes[j])
+	}
+	return output
+}
+
+type recoveryCodesDelete struct {
+	Email string
+}
+
+func (d recoveryCodesDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_recovery_code WHERE user_email=$1"
+}
+
+func (d recoveryCodesDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Email}
+}
+
+func replaceRecoveryCodes(database *db.DB, tx *sql.Tx, email string, hashes []string) error {
+	if err := database.Delete(recoveryCodesDelete{Email: email}, tx); err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	_, err := database.Insert(recoveryCodesInsert{Email: email, Hashes: hashes}, tx)
+	return err
+}
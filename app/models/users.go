@@ -2,18 +2,23 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
 
 	"bitbucket.org/jtyburke/pathfork/app/auth"
 	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/throttle"
 	"github.com/golang/glog"
 )
 
 type User struct {
-	Email     string
-	Password  string
-	DB        *db.DB
-	Confirmed bool
-	Verified  bool
+	Email        string
+	Password     string
+	DB           *db.DB
+	Confirmed    bool
+	Verified     bool
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
 }
 
 func NewUser(email, pw string) (*User, error) {
@@ -55,7 +60,7 @@ type userByEmailQuery struct {
 }
 
 func (q userByEmailQuery) GetQueryStr() string {
-	return "select * from tbl_user where email=$1"
+	return "select email, pw, verified, totp_secret, totp_enabled, totp_last_step from tbl_user where email=$1"
 }
 
 func (q userByEmailQuery) GetQueryArgs() []interface{} {
@@ -64,9 +69,11 @@ func (q userByEmailQuery) GetQueryArgs() []interface{} {
 
 func (q userByEmailQuery) ObjFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
 	user := User{DB: db}
-	if err := r.Scan(&user.Email, &user.Password, &user.Verified); err != nil {
+	nullSecret := sql.NullString{}
+	if err := r.Scan(&user.Email, &user.Password, &user.Verified, &nullSecret, &user.TOTPEnabled, &user.TOTPLastStep); err != nil {
 		return nil, err
 	}
+	user.TOTPSecret = nullSecret.String
 	return &user, nil
 }
 
@@ -101,3 +108,145 @@ func UpdatePassword(u *User, password string, tx *sql.Tx) error {
 	}
 	return nil
 }
+
+// userEmailTables is every table with a user_email column, all of which have
+// to follow the user when their email changes. tbl_session isn't here since
+// changing email logs the user out everywhere.
+var userEmailTables = []string{
+	"tbl_work",
+	"tbl_section",
+	"tbl_character",
+	"tbl_setting",
+	"tbl_api_token",
+	"tbl_section_status",
+	"tbl_recovery_code",
+	"tbl_event",
+	"tbl_character_relationship",
+	"tbl_field_def",
+	"tbl_image",
+	"tbl_series",
+	"tbl_share_link",
+	"tbl_comment",
+	"tbl_work_member",
+	"tbl_activity",
+	"tbl_revision",
+}
+
+type userCopyInsert struct {
+	From string
+	To   string
+}
+
+func (i userCopyInsert) GetInsertStr() string {
+	return `
+INSERT INTO tbl_user(email, pw, verified, totp_secret, totp_enabled, totp_last_step)
+SELECT $1, pw, true, totp_secret, totp_enabled, totp_last_step FROM tbl_user WHERE email=$2
+returning 0`
+}
+
+func (i userCopyInsert) GetInsertArgs() []interface{} {
+	return []interface{}{i.To, i.From}
+}
+
+type userEmailUpdate struct {
+	Table string
+	From  string
+	To    string
+}
+
+func (u userEmailUpdate) GetUpdateStr() string {
+	return fmt.Sprintf("UPDATE %v SET user_email=$1 WHERE user_email=$2", u.Table)
+}
+
+func (u userEmailUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.To, u.From}
+}
+
+// invitedByUpdate keeps the user's name on the invitations they sent
+type invitedByUpdate struct {
+	From string
+	To   string
+}
+
+func (u invitedByUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_work_member SET invited_by=$1 WHERE invited_by=$2"
+}
+
+func (u invitedByUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.To, u.From}
+}
+
+// loginAttemptsUpdate carries the user's failed logins over to their new
+// email, so changing it doesn't let anyone start guessing afresh
+type loginAttemptsUpdate struct {
+	From string
+	To   string
+}
+
+func (u loginAttemptsUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_login_attempt SET attempt_key=$1 WHERE attempt_key=$2"
+}
+
+func (u loginAttemptsUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{throttle.AccountKey(u.To), throttle.AccountKey(u.From)}
+}
+
+// loginAttemptsDelete clears failed logins to an email nobody had yet, so
+// the user's own can take their place
+type loginAttemptsDelete struct {
+	Email string
+}
+
+func (d loginAttemptsDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_login_attempt WHERE attempt_key=$1"
+}
+
+func (d loginAttemptsDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{throttle.AccountKey(d.Email)}
+}
+
+type userDelete struct {
+	Email string
+}
+
+func (d userDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_user WHERE email=$1"
+}
+
+func (d userDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Email}
+}
+
+// ChangeUserEmail moves the user and everything they own over to newEmail.
+// Since email is tbl_user's primary key, this copies the user to the new
+// email, repoints every user_email, the invitations they sent and their
+// failed logins at the copy and then drops the original, all inside tx.
+// Every session the user had is logged out.
+func ChangeUserEmail(database *db.DB, tx *sql.Tx, u *User, newEmail string) error {
+	if err := DeleteSessionsForUser(database, tx, u.Email, ""); err != nil {
+		return err
+	}
+	if _, err := database.Insert(userCopyInsert{From: u.Email, To: newEmail}, tx); err != nil {
+		return err
+	}
+	for _, table := range userEmailTables {
+		if err := database.Update(userEmailUpdate{Table: table, From: u.Email, To: newEmail}, tx); err != nil {
+			return err
+		}
+	}
+	if err := database.Update(invitedByUpdate{From: u.Email, To: newEmail}, tx); err != nil {
+		return err
+	}
+	if err := database.Delete(loginAttemptsDelete{Email: newEmail}, tx); err != nil {
+		return err
+	}
+	if err := database.Update(loginAttemptsUpdate{From: u.Email, To: newEmail}, tx); err != nil {
+		return err
+	}
+	if err := database.Delete(userDelete{Email: u.Email}, tx); err != nil {
+		return err
+	}
+	u.Email = newEmail
+	u.Verified = true
+	return nil
+}
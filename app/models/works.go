@@ -2,14 +2,25 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
 	"github.com/golang/glog"
+	"github.com/lib/pq"
 )
 
-var workListColumnStr = "select tbl_work.work_id, tbl_work.title, tbl_work.blurb, tbl_work.user_email, tbl_work.word_count from tbl_work"
+var workListColumnStr = `select tbl_work.work_id, tbl_work.title, tbl_work.blurb, tbl_work.user_email, tbl_work.word_count, tbl_work.statuses,
+tbl_work.subtitle, tbl_work.author, tbl_work.series_id,
+(select tbl_series.title from tbl_series where tbl_series.series_id=tbl_work.series_id), tbl_work.series_number, tbl_work.language, tbl_work.isbn,
+tbl_work.copyright_year, tbl_work.dedication, tbl_work.acknowledgements, tbl_work.about_author from tbl_work`
+
+// DefaultLanguage is what a work's written in if it doesn't say
+const DefaultLanguage = "en"
 
 type Work struct {
 	Title     string
@@ -18,6 +29,24 @@ type Work struct {
 	UserEmail string
 	WordCount int
 	Id        int
+	// Statuses are the steps a section goes through in this work, in order
+	Statuses []string
+
+	// The rest is for publishing: title pages and e-book metadata
+	Subtitle string
+	// Author is the name on the cover, which may be a pen name
+	Author   string
+	SeriesId int
+	// Series is the title of the series, which is read along with the work
+	Series       string
+	SeriesNumber float64
+	// Language is a language tag like "en" or "pt-BR"
+	Language         string
+	ISBN             string
+	CopyrightYear    int
+	Dedication       string
+	Acknowledgements string
+	AboutAuthor      string
 }
 
 func NewWork(title string, blurb string, email string) *Work {
@@ -25,37 +54,121 @@ func NewWork(title string, blurb string, email string) *Work {
 		Title:     title,
 		Blurb:     blurb,
 		UserEmail: email,
+		Statuses:  DefaultSectionStatuses,
 	}
 }
 
+// VerifyPermission lets in the owner and all the work's members; see
+// RoleFor for what each can do
 func (w *Work) VerifyPermission(sm sessionManager.SessionManager) bool {
-	return w.UserEmail == sm.GetUserEmail()
+	return w.RoleFor(sm) != ""
+}
+
+func (w *Work) RoleFor(sm sessionManager.SessionManager) string {
+	return getWorkRole(w.Id, w.UserEmail, sm.GetUserEmail(), w.DB)
 }
 
 func (w *Work) GetInsertStr() string {
 	return `
-INSERT INTO tbl_work(title, blurb, user_email)
-VALUES ($1, $2, $3) returning work_id`
+INSERT INTO tbl_work(title, blurb, user_email, statuses, subtitle, author, series_id, series_number,
+language, isbn, copyright_year, dedication, acknowledgements, about_author)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning work_id`
 }
 
 func (w *Work) GetInsertArgs() []interface{} {
-	return []interface{}{
+	return append([]interface{}{
 		w.Title,
 		db.ToNullString(w.Blurb),
 		w.UserEmail,
-	}
+		pq.Array(w.GetStatuses()),
+	}, w.metadataArgs()...)
 }
 
 func (w *Work) GetUpdateStr() string {
 	return `
 UPDATE tbl_work
-SET title=$1, blurb=$2
-WHERE work_id=$3
+SET title=$1, blurb=$2, statuses=$3, subtitle=$4, author=$5, series_id=$6, series_number=$7,
+language=$8, isbn=$9, copyright_year=$10, dedication=$11, acknowledgements=$12, about_author=$13
+WHERE work_id=$14
 `
 }
 
 func (w *Work) GetUpdateArgs() []interface{} {
-	return []interface{}{w.Title, w.Blurb, w.Id}
+	args := append([]interface{}{w.Title, w.Blurb, pq.Array(w.GetStatuses())}, w.metadataArgs()...)
+	return append(args, w.Id)
+}
+
+// metadataArgs are the publishing fields, in the order both the insert and
+// the update list them
+func (w *Work) metadataArgs() []interface{} {
+	return []interface{}{
+		db.ToNullString(w.Subtitle),
+		db.ToNullString(w.Author),
+		db.ToNullInt(int64(w.SeriesId)),
+		sql.NullFloat64{Float64: w.SeriesNumber, Valid: w.SeriesNumber != 0},
+		w.GetLanguage(),
+		db.ToNullString(w.ISBN),
+		db.ToNullInt(int64(w.CopyrightYear)),
+		db.ToNullString(w.Dedication),
+		db.ToNullString(w.Acknowledgements),
+		db.ToNullString(w.AboutAuthor),
+	}
+}
+
+func (w *Work) GetLanguage() string {
+	if w.Language == "" {
+		return DefaultLanguage
+	}
+	return w.Language
+}
+
+// SeriesNumberStr is the work's place in its series without a trailing
+// ".0", so novellas can sit at 2.5
+func (w *Work) SeriesNumberStr() string {
+	if w.SeriesNumber == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(w.SeriesNumber, 'f', -1, 64)
+}
+
+// SeriesLine is something like "Book 2 of The Long Road", or "" if the
+// work isn't in a series
+func (w *Work) SeriesLine() string {
+	if w.Series == "" {
+		return ""
+	}
+	if w.SeriesNumber == 0 {
+		return w.Series
+	}
+	return fmt.Sprintf("Book %v of %v", w.SeriesNumberStr(), w.Series)
+}
+
+// CopyrightLine is the notice for the title page, or "" without a year
+func (w *Work) CopyrightLine() string {
+	if w.CopyrightYear == 0 {
+		return ""
+	}
+	if w.Author == "" {
+		return fmt.Sprintf("Copyright © %v", w.CopyrightYear)
+	}
+	return fmt.Sprintf("Copyright © %v %v", w.CopyrightYear, w.Author)
+}
+
+// GetStatuses falls back to the defaults for works that never set any
+func (w *Work) GetStatuses() []string {
+	if len(w.Statuses) == 0 {
+		return DefaultSectionStatuses
+	}
+	return w.Statuses
+}
+
+func (w *Work) HasStatus(status string) bool {
+	for _, s := range w.GetStatuses() {
+		if s == status {
+			return true
+		}
+	}
+	return false
 }
 
 func (w *Work) Save(tx *sql.Tx) error {
@@ -80,7 +193,7 @@ type workByIdQuery struct {
 }
 
 func (q workByIdQuery) GetQueryStr() string {
-	return workListColumnStr + " where work_id=$1"
+	return workListColumnStr + " where work_id=$1 and deleted_at is null"
 }
 
 func (q workByIdQuery) GetQueryArgs() []interface{} {
@@ -93,11 +206,25 @@ func (q workByIdQuery) ObjFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error)
 
 func workFromRow(db *db.DB, r *sql.Rows) (db.Insertable, error) {
 	work := Work{DB: db}
-	nullBlurb := sql.NullString{}
-	if err := r.Scan(&work.Id, &work.Title, &nullBlurb, &work.UserEmail, &work.WordCount); err != nil {
+	var nullBlurb, subtitle, author, series, isbn, dedication, acknowledgements, aboutAuthor sql.NullString
+	seriesNumber := sql.NullFloat64{}
+	var seriesId, copyrightYear sql.NullInt64
+	if err := r.Scan(&work.Id, &work.Title, &nullBlurb, &work.UserEmail, &work.WordCount, pq.Array(&work.Statuses),
+		&subtitle, &author, &seriesId, &series, &seriesNumber, &work.Language, &isbn,
+		&copyrightYear, &dedication, &acknowledgements, &aboutAuthor); err != nil {
 		return nil, err
 	}
 	work.Blurb = nullBlurb.String
+	work.Subtitle = subtitle.String
+	work.Author = author.String
+	work.SeriesId = int(seriesId.Int64)
+	work.Series = series.String
+	work.SeriesNumber = seriesNumber.Float64
+	work.ISBN = isbn.String
+	work.CopyrightYear = int(copyrightYear.Int64)
+	work.Dedication = dedication.String
+	work.Acknowledgements = acknowledgements.String
+	work.AboutAuthor = aboutAuthor.String
 	return &work, nil
 }
 
@@ -123,7 +250,7 @@ type worksForUserQuery struct {
 }
 
 func (q worksForUserQuery) GetQueryStr() string {
-	return workListColumnStr + " where user_email=$1"
+	return workListColumnStr + " where user_email=$1 and deleted_at is null"
 }
 
 func (q worksForUserQuery) GetQueryArgs() []interface{} {
@@ -196,3 +323,52 @@ func UpdateWorkWordCount(database *db.DB, tx *sql.Tx, id, wordCount int) error {
 	}
 	return database.Update(update, tx)
 }
+
+// NormalizeISBN checks an ISBN-10 or ISBN-13's check digit and returns it
+// without hyphens or spaces
+func NormalizeISBN(isbn string) (string, error) {
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	invalid := errors.New("That isn't a valid ISBN-10 or ISBN-13.")
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, c := range digits {
+			value := int(c - '0')
+			if c == 'X' && i == 9 {
+				value = 10
+			} else if c < '0' || c > '9' {
+				return "", invalid
+			}
+			sum += (10 - i) * value
+		}
+		if sum%11 != 0 {
+			return "", invalid
+		}
+	case 13:
+		sum := 0
+		for i, c := range digits {
+			if c < '0' || c > '9' {
+				return "", invalid
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(c-'0')
+		}
+		if sum%10 != 0 {
+			return "", invalid
+		}
+	default:
+		return "", invalid
+	}
+	return digits, nil
+}
+
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// ValidLanguageTag is a loose check that tag looks like "en", "fr" or
+// "pt-BR", which is all e-readers need
+func ValidLanguageTag(tag string) bool {
+	return languageTagPattern.MatchString(tag)
+}
@@ -0,0 +1,59 @@
+package pages
+
+import (
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+)
+
+func GetAPITokensPage(sm sessionManager.SessionManager, tokens []*models.APIToken) WebPage {
+	return WebPage{
+		Title:         "API tokens",
+		Headline:      "Personal access tokens",
+		Name:          "api_tokens",
+		Form:          forms.NewAPITokenForm(sm),
+		APITokensList: tokens,
+		Universals:    getUniversals(sm),
+		DeleteForm:    forms.NewDeleteForm(0, sm),
+	}
+}
+
+func GetSessionsPage(sm sessionManager.SessionManager, userSessions []*models.UserSession) WebPage {
+	return WebPage{
+		Title:        "Sessions",
+		Headline:     "Where you're logged in",
+		Name:         "sessions",
+		SessionsList: userSessions,
+		Universals:   getUniversals(sm),
+		DeleteForm:   forms.NewDeleteForm(0, sm),
+	}
+}
+
+func GetTwoFactorSetupPage(sm sessionManager.SessionManager, user *models.User, secret, uri string, recoveryLeft int) WebPage {
+	form := forms.NewTOTPEnableForm(sm)
+	if user.TOTPEnabled {
+		form = forms.NewTOTPDisableForm(sm)
+	}
+	return WebPage{
+		Title:        "Two-factor authentication",
+		Headline:     "Two-factor authentication",
+		Name:         "two_factor_setup",
+		Form:         form,
+		User:         user,
+		TOTPSecret:   secret,
+		TOTPURI:      uri,
+		RecoveryLeft: recoveryLeft,
+		Universals:   getUniversals(sm),
+	}
+}
+
+func GetChangeEmailPage(sm sessionManager.SessionManager, user *models.User) WebPage {
+	return WebPage{
+		Title:      "Email address",
+		Headline:   "Change your email address",
+		Name:       "change_email",
+		Form:       forms.NewChangeEmailForm(sm),
+		User:       user,
+		Universals: getUniversals(sm),
+	}
+}
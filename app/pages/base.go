@@ -1,6 +1,8 @@
 package pages
 
 import (
+	"html/template"
+
 	"bitbucket.org/jtyburke/pathfork/app/forms"
 	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
@@ -36,6 +38,81 @@ type WebPage struct {
 	DeleteForm     *forms.Form
 	Token          string
 	SnippetsList   []*models.Section
+	APITokensList  []*models.APIToken
+	SessionsList   []*models.UserSession
+	User           *models.User
+	TOTPSecret     string
+	TOTPURI        string
+	RecoveryCodes  []string
+	RecoveryLeft   int
+	StatusFilter   string
+	StatusColumns  []*models.StatusColumn
+	StatusHistory  []*models.StatusChange
+	StoryConflicts []*models.StoryTimeConflict
+	CharacterNames map[int]string
+	EventsList     []*models.Event
+	Event          *models.Event
+	Relationships  []*models.CharacterRelationship
+	Relationship   *models.CharacterRelationship
+	Breadcrumbs    []*models.Setting
+	FieldDefs      []*models.FieldDef
+	FieldDef       *models.FieldDef
+	FieldValues    []*models.FieldValue
+	FieldFilter    *FieldFilter
+	CharacterTable *models.FieldTable
+	SettingTable   *models.FieldTable
+	Images         []*models.Image
+	ImageForm      *forms.Form
+	Series         *models.Series
+	SeriesList     []*models.Series
+	WorksBySeries  map[int][]*models.Work
+	SeriesBible    *models.SeriesBible
+	SeriesStats    *models.SeriesStats
+	SeriesExport   []*SeriesExportWork
+	ShareLinks     []*models.ShareLink
+	ShareLink      *models.ShareLink
+	ShareForm      *forms.Form
+	// CommentThreads are by section id
+	CommentThreads map[int][]*models.Comment
+	CommentForm    *forms.Form
+	Feedback       []*SectionFeedback
+	// Role is the user's in the page's work; see CanEdit and friends
+	Role        string
+	Members     []*models.WorkMember
+	Activity    []*models.Activity
+	SharedWorks []*models.Work
+	// ExportImages are data: URIs for the HTML export, or share link URLs
+	// for its readers, keyed "work" for the cover and "character-12" or
+	// "setting-3" for portraits and maps
+	ExportImages map[string]template.URL
+	Trash        []*models.TrashedItem
+	// TrashDays is how long the trash is kept, or 0 for forever
+	TrashDays int
+	Replace   *models.ReplaceOptions
+	// ReplaceHits is nil until there's been a preview
+	ReplaceHits []*models.ReplaceHit
+	// Fingerprints are of the fields the preview looked through
+	Fingerprints []string
+	Revisions    []*models.Revision
+	// Aliases are what the page's character or setting used to be called
+	Aliases []string
+	// RenameEntity and RenameId are the character or setting being renamed
+	// through its sections; Unlinked takes in the rest of its works' too
+	RenameEntity string
+	RenameId     int
+	Unlinked     bool
+}
+
+func (w WebPage) CanEdit() bool {
+	return models.RoleAllows(w.Role, models.RoleEditor)
+}
+
+func (w WebPage) CanComment() bool {
+	return models.RoleAllows(w.Role, models.RoleCommenter)
+}
+
+func (w WebPage) IsOwner() bool {
+	return w.Role == models.RoleOwner
 }
 
 func (w WebPage) RefreshUniversals(sm sessionManager.SessionManager) {
@@ -1,6 +1,9 @@
 package pages
 
 import (
+	"fmt"
+	"strconv"
+
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/forms"
 	"bitbucket.org/jtyburke/pathfork/app/models"
@@ -32,6 +35,42 @@ func GetCharacterViewPage(sm sessionManager.SessionManager, verifiable interface
 		Character:      character,
 		Universals:     getUniversals(sm),
 		SectionsByWork: sectionsByWork,
+		EventsList:     models.GetEventsForCharacter(character.Id, character.DB),
+		Relationships:  models.GetRelationshipsForCharacter(character.Id, character.DB),
+		FieldValues:    models.GetFieldValuesFor("character", character.UserEmail, character.Id, character.DB),
+		Images:         models.GetImagesFor("character", character.Id, character.DB),
+		ImageForm:      forms.NewImageForm("character", character.Id, sm),
+		Aliases:        models.GetAliases("character", character.Id, character.DB),
+	}
+}
+
+// GetCharacterRenamePage offers to carry the character's new name into its
+// sections, with the preview's hits in fields
+func GetCharacterRenamePage(sm sessionManager.SessionManager, character *models.Character, options *models.ReplaceOptions,
+	unlinked bool, hits []*models.ReplaceHit, fields []*models.ReplaceField) WebPage {
+	page := getRenamePage(sm, "character", character.Id, options, unlinked, hits, fields)
+	page.Character = character
+	return page
+}
+
+// getRenamePage is the rename page for a character or setting (entity)
+func getRenamePage(sm sessionManager.SessionManager, entity string, id int, options *models.ReplaceOptions,
+	unlinked bool, hits []*models.ReplaceHit, fields []*models.ReplaceField) WebPage {
+	fingerprints := make([]string, len(fields))
+	for i, field := range fields {
+		fingerprints[i] = field.Fingerprint()
+	}
+	return WebPage{
+		Title:        fmt.Sprintf("Rename %v to %v", options.Find, options.Replace),
+		Name:         entity + "_rename",
+		Universals:   getUniversals(sm),
+		DeleteForm:   forms.NewDeleteForm(id, sm),
+		Replace:      options,
+		ReplaceHits:  hits,
+		Fingerprints: fingerprints,
+		RenameEntity: entity,
+		RenameId:     id,
+		Unlinked:     unlinked,
 	}
 }
 
@@ -41,11 +80,13 @@ func GetCharacterEditPage(sm sessionManager.SessionManager, database *db.DB, ver
 	form.Fields["name"].SetData(character.Name)
 	form.Fields["blurb"].SetData(character.Blurb)
 	form.Fields["body"].SetData(character.Body)
+	defs := addCustomFields(form, "character", sm, database, character.Id, 0)
 	return WebPage{
 		Title:      character.Name,
 		Headline:   character.Name,
 		Name:       "character_edit",
 		Form:       form,
+		FieldDefs:  defs,
 		Character:  character,
 		Universals: getUniversals(sm),
 		DeleteForm: forms.NewDeleteForm(character.Id, sm),
@@ -55,27 +96,46 @@ func GetCharacterEditPage(sm sessionManager.SessionManager, database *db.DB, ver
 func GetCharacterNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
 	form := forms.NewCharacterForm(sm)
 	workId := args[0]
+	workIdInt, _ := strconv.Atoi(workId)
+	defs := addCustomFields(form, "character", sm, database, 0, workIdInt)
 	return WebPage{
 		Headline:   "You must be the new guy.",
 		Title:      "Add a character",
 		Name:       "character_new",
 		Character:  &models.Character{},
 		Form:       form,
+		FieldDefs:  defs,
 		NewObj:     true,
 		Universals: getUniversals(sm),
 		ParentId:   workId,
 	}
 }
 
-func GetCharacterIndexPage(sm sessionManager.SessionManager, characters []*models.Character) WebPage {
+// GetCharacterIndexPage lists the characters, only those whose custom
+// field fieldId matches query if fieldId isn't 0
+func GetCharacterIndexPage(sm sessionManager.SessionManager, database *db.DB, characters []*models.Character,
+	fieldId int, query string) WebPage {
 	slice.Sort(characters, func(i, j int) bool {
 		return characters[i].Name < characters[j].Name
 	})
+	ids := make([]int, len(characters))
+	for i := range characters {
+		ids[i] = characters[i].Id
+	}
+	keep, filter := filterByField("character", sm, database, ids, fieldId, query)
+	filtered := []*models.Character{}
+	for _, character := range characters {
+		if keep[character.Id] {
+			filtered = append(filtered, character)
+		}
+	}
 	return WebPage{
 		Headline:       "Here are some folks you wrote",
 		Title:          "Characters index",
 		Name:           "character_index",
-		CharactersList: characters,
+		CharactersList: filtered,
+		FieldDefs:      entityFieldDefs("character", sm, database),
+		FieldFilter:    filter,
 		Universals:     getUniversals(sm),
 	}
 }
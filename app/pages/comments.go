@@ -0,0 +1,38 @@
+package pages
+
+import (
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+)
+
+// SectionFeedback is a section's open threads, for a work's feedback page
+type SectionFeedback struct {
+	Section *models.Section
+	Threads []*models.Comment
+}
+
+// GetWorkFeedbackPage lists the work's unresolved threads in reading
+// order, leaving out the sections that have none
+func GetWorkFeedbackPage(sm sessionManager.SessionManager, work *models.Work) WebPage {
+	threads := models.GetCommentThreadsForWork(work.Id, work.DB)
+	sections, snippets := models.GetSectionsForWork(work.Id, work.DB)
+	feedback := []*SectionFeedback{}
+	for _, section := range append(models.FlattenSectionTree(sections), snippets...) {
+		if open := models.OpenThreads(threads[section.Id]); len(open) > 0 {
+			feedback = append(feedback, &SectionFeedback{Section: section, Threads: open})
+		}
+	}
+	return WebPage{
+		Title:      fmt.Sprintf("Feedback on %v", work.Title),
+		Headline:   work.Title,
+		Name:       "work_feedback",
+		Work:       work,
+		Feedback:   feedback,
+		Universals: getUniversals(sm),
+		DeleteForm: forms.NewDeleteForm(0, sm),
+		Role:       work.RoleFor(sm),
+	}
+}
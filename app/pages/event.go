@@ -0,0 +1,103 @@
+package pages
+
+import (
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+)
+
+func GetEventViewPage(sm sessionManager.SessionManager, verifiable interface{}) WebPage {
+	event := verifiable.(*models.Event)
+	return WebPage{
+		Title:          event.Title,
+		Headline:       event.Title,
+		Name:           "event_view",
+		Event:          event,
+		CharactersList: models.GetCharactersForEvent(event.Id, event.DB),
+		SettingsList:   models.GetSettingsForEvent(event.Id, event.DB),
+		SectionsList:   models.GetSectionsForEvent(event.Id, event.DB),
+		Universals:     getUniversals(sm),
+	}
+}
+
+func GetEventEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
+	event := verifiable.(*models.Event)
+	form := forms.NewEventForm(
+		forms.CharsToFormOptions(
+			models.GetCharactersForUser(sm.GetUserEmail(), database),
+			models.GetCharactersForEvent(event.Id, database)...,
+		),
+		forms.SettingsToFormOptions(
+			models.GetSettingsForUser(sm.GetUserEmail(), database),
+			models.GetSettingsForEvent(event.Id, database)...,
+		),
+		forms.SectionsToFormOptions(
+			models.GetSectionsForUser(sm.GetUserEmail(), database),
+			models.GetSectionsForEvent(event.Id, database)...,
+		),
+		sm,
+	)
+	form.Fields["title"].SetData(event.Title)
+	form.Fields["description"].SetData(event.Description)
+	form.Fields["story_time"].SetData(event.StoryTime)
+	form.Fields["story_sort"].SetData(event.StorySortKey)
+	form.Fields["story_sort_end"].SetData(event.StoryEndKey)
+	return WebPage{
+		Title:      event.Title,
+		Headline:   event.Title,
+		Name:       "event_edit",
+		Event:      event,
+		Form:       form,
+		Universals: getUniversals(sm),
+		DeleteForm: forms.NewDeleteForm(event.Id, sm),
+	}
+}
+
+// GetEventNewPage takes the id of a character to start the event with, so
+// that events can be added straight from a character's history
+func GetEventNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
+	characters := models.GetCharactersForUser(sm.GetUserEmail(), database)
+	selected := []*models.Character{}
+	for _, character := range characters {
+		if args[0] == fmt.Sprintf("%v", character.Id) {
+			selected = append(selected, character)
+		}
+	}
+	form := forms.NewEventForm(
+		forms.CharsToFormOptions(characters, selected...),
+		forms.SettingsToFormOptions(models.GetSettingsForUser(sm.GetUserEmail(), database)),
+		forms.SectionsToFormOptions(models.GetSectionsForUser(sm.GetUserEmail(), database)),
+		sm,
+	)
+	return WebPage{
+		Headline:   "What happens?",
+		Title:      "Add an event",
+		Name:       "event_new",
+		Event:      &models.Event{},
+		Form:       form,
+		NewObj:     true,
+		ParentId:   args[0],
+		Universals: getUniversals(sm),
+	}
+}
+
+// GetTimelinePage shows events in story order; given a character, it's
+// that character's life history
+func GetTimelinePage(sm sessionManager.SessionManager, database *db.DB, events []*models.Event, character *models.Character) WebPage {
+	title := "Timeline"
+	if character != nil {
+		title = "Timeline for " + character.Name
+	}
+	return WebPage{
+		Title:          title,
+		Headline:       title,
+		Name:           "timeline",
+		EventsList:     events,
+		Character:      character,
+		CharactersList: models.GetCharactersForUser(sm.GetUserEmail(), database),
+		Universals:     getUniversals(sm),
+	}
+}
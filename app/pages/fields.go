@@ -0,0 +1,154 @@
+package pages
+
+import (
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+)
+
+// FieldFilter is a custom field filter on the character or setting index
+type FieldFilter struct {
+	Def   *models.FieldDef
+	Query string
+	// Values are how the field reads for each character or setting, by id
+	Values map[int]string
+}
+
+// addCustomFields puts the custom fields a character or setting (entity)
+// has on its form and returns their definitions. objectId is 0 for a new
+// one, which gets the global fields and those of the work it's for.
+func addCustomFields(form *forms.Form, entity string, sm sessionManager.SessionManager, database *db.DB, objectId, workId int) []*models.FieldDef {
+	defs := models.GetFieldDefsFor(entity, sm.GetUserEmail(), objectId, workId, database)
+	if len(defs) == 0 {
+		return defs
+	}
+	values := map[int]string{}
+	if objectId != 0 {
+		allValues, err := models.GetFieldValues(entity, sm.GetUserEmail(), database)
+		if err == nil && allValues[objectId] != nil {
+			values = allValues[objectId]
+		}
+	}
+	refOptions := map[string][]map[string]string{}
+	for _, def := range defs {
+		if def.Type == models.FieldReference && len(refOptions) == 0 {
+			refOptions["character"] = forms.CharsToFormOptions(models.GetCharactersForUser(sm.GetUserEmail(), database))
+			refOptions["setting"] = forms.SettingsToFormOptions(models.GetSettingsForUser(sm.GetUserEmail(), database))
+		}
+	}
+	forms.AddCustomFields(form, defs, values, refOptions)
+	return defs
+}
+
+// filterByField keeps the ids whose value for field fieldId matches query
+// (see FieldDef.Matches). With no such field it keeps everything and
+// returns a nil filter.
+func filterByField(entity string, sm sessionManager.SessionManager, database *db.DB, ids []int, fieldId int, query string) (map[int]bool, *FieldFilter) {
+	keep := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+	if fieldId == 0 {
+		return keep, nil
+	}
+	var def *models.FieldDef
+	for _, d := range models.GetFieldDefsForUser(sm.GetUserEmail(), database) {
+		if d.Id == fieldId && d.Entity == entity {
+			def = d
+		}
+	}
+	if def == nil {
+		return keep, nil
+	}
+	values, err := models.GetFieldValues(entity, sm.GetUserEmail(), database)
+	if err != nil {
+		return keep, nil
+	}
+	refNames := map[string]map[int]string{}
+	if def.Type == models.FieldReference {
+		refNames = models.GetFieldRefNames(sm.GetUserEmail(), database)
+	}
+	filter := &FieldFilter{Def: def, Query: query, Values: map[int]string{}}
+	for _, id := range ids {
+		value := values[id][def.Id]
+		filter.Values[id] = def.Display(value, refNames)
+		keep[id] = def.Matches(value, query, refNames)
+	}
+	return keep, filter
+}
+
+func entityFieldDefs(entity string, sm sessionManager.SessionManager, database *db.DB) []*models.FieldDef {
+	output := []*models.FieldDef{}
+	for _, def := range models.GetFieldDefsForUser(sm.GetUserEmail(), database) {
+		if def.Entity == entity {
+			output = append(output, def)
+		}
+	}
+	return output
+}
+
+func fieldDefWorkOptions(sm sessionManager.SessionManager, database *db.DB, workId int) []map[string]string {
+	options := []map[string]string{}
+	for _, work := range models.GetWorksForUser(sm.GetUserEmail(), database) {
+		option := map[string]string{"value": fmt.Sprintf("%v", work.Id), "text": work.Title}
+		if work.Id == workId {
+			option["selected"] = "true"
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// GetFieldIndexPage lists the user's custom fields, characters' then
+// settings'
+func GetFieldIndexPage(sm sessionManager.SessionManager, database *db.DB) WebPage {
+	return WebPage{
+		Title:      "Custom fields",
+		Headline:   "Custom fields",
+		Name:       "field_index",
+		FieldDefs:  models.GetFieldDefsForUser(sm.GetUserEmail(), database),
+		Universals: getUniversals(sm),
+	}
+}
+
+func GetFieldDefEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
+	def := verifiable.(*models.FieldDef)
+	form := forms.NewFieldDefForm(fieldDefWorkOptions(sm, database, def.WorkId), false, sm)
+	form.Fields["name"].SetData(def.Name)
+	form.Fields["order"].SetData(fmt.Sprintf("%v", def.Order))
+	choices := ""
+	for _, choice := range def.Choices {
+		choices += choice + "\n"
+	}
+	form.Fields["choices"].SetData(choices)
+	return WebPage{
+		Title:      def.Name,
+		Headline:   def.Name,
+		Name:       "field_edit",
+		FieldDef:   def,
+		Form:       form,
+		Universals: getUniversals(sm),
+		DeleteForm: forms.NewDeleteForm(def.Id, sm),
+	}
+}
+
+// GetFieldDefNewPage takes the entity the field is for, which is picked
+// to start with on the form
+func GetFieldDefNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
+	form := forms.NewFieldDefForm(fieldDefWorkOptions(sm, database, 0), true, sm)
+	if len(args) > 0 && args[0] != "" {
+		form.Fields["entity"].SetData(args[0])
+	}
+	return WebPage{
+		Title:      "Add a custom field",
+		Headline:   "What else should we know?",
+		Name:       "field_new",
+		FieldDef:   &models.FieldDef{},
+		Form:       form,
+		NewObj:     true,
+		Universals: getUniversals(sm),
+	}
+}
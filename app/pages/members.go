@@ -0,0 +1,32 @@
+package pages
+
+import (
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+)
+
+// activityShown is how much of a work's activity log its members page shows
+const activityShown = 50
+
+// GetWorkMembersPage lists who's in the work and what they've been doing.
+// Only the owner gets the invite form.
+func GetWorkMembersPage(sm sessionManager.SessionManager, work *models.Work) WebPage {
+	page := WebPage{
+		Title:      fmt.Sprintf("People in %v", work.Title),
+		Headline:   work.Title,
+		Name:       "work_members",
+		Work:       work,
+		Role:       work.RoleFor(sm),
+		Members:    models.GetMembersForWork(work.Id, work.DB),
+		Activity:   models.GetActivityForWork(work.Id, activityShown, work.DB),
+		Universals: getUniversals(sm),
+		DeleteForm: forms.NewDeleteForm(0, sm),
+	}
+	if page.IsOwner() {
+		page.Form = forms.NewWorkMemberForm(sm)
+	}
+	return page
+}
@@ -1,15 +1,33 @@
 package pages
 
 import (
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/forms"
 	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
 )
 
-func GetDashboardPage(sm sessionManager.SessionManager, works []*models.Work) WebPage {
+// GetDashboardPage takes the user's own works, then those they're a member of
+func GetDashboardPage(sm sessionManager.SessionManager, works, shared []*models.Work) WebPage {
+	return WebPage{
+		Title:       "Dashboard",
+		Name:        "dashboard",
+		WorksList:   works,
+		SharedWorks: shared,
+		Universals:  getUniversals(sm),
+	}
+}
+
+// GetTrashPage takes how long the trash is kept, with 0 for forever
+func GetTrashPage(sm sessionManager.SessionManager, items []*models.TrashedItem, retention time.Duration) WebPage {
 	return WebPage{
-		Title:      "Dashboard",
-		Name:       "dashboard",
-		WorksList:  works,
+		Title:      "Trash",
+		Headline:   "Trash",
+		Name:       "trash",
+		Trash:      items,
+		TrashDays:  int((retention + 24*time.Hour - 1) / (24 * time.Hour)),
 		Universals: getUniversals(sm),
+		DeleteForm: forms.NewDeleteForm(0, sm),
 	}
 }
@@ -49,3 +49,12 @@ func GetResetPasswordPage(sm sessionManager.SessionManager, token string) WebPag
 		Token:      token,
 	}
 }
+
+func GetTwoFactorPage(sm sessionManager.SessionManager) WebPage {
+	return WebPage{
+		Title:      "Two-factor authentication",
+		Name:       "two_factor",
+		Form:       forms.NewTwoFactorForm(),
+		Universals: getUniversals(sm),
+	}
+}
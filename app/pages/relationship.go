@@ -0,0 +1,88 @@
+package pages
+
+import (
+	"fmt"
+	"strconv"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+)
+
+// newRelationshipForm offers every character but the one the relationship
+// is from
+func newRelationshipForm(sm sessionManager.SessionManager, database *db.DB, fromId int) *forms.Form {
+	others := []*models.Character{}
+	for _, character := range models.GetCharactersForUser(sm.GetUserEmail(), database) {
+		if character.Id != fromId {
+			others = append(others, character)
+		}
+	}
+	return forms.NewRelationshipForm(
+		forms.CharsToFormOptions(others),
+		forms.SectionsToFormOptions(models.GetSectionsForUser(sm.GetUserEmail(), database)),
+		sm,
+	)
+}
+
+func GetRelationshipEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
+	relationship := verifiable.(*models.CharacterRelationship)
+	form := newRelationshipForm(sm, database, relationship.FromId)
+	form.Fields["to"].SetData(fmt.Sprintf("%v", relationship.ToId))
+	form.Fields["kind"].SetData(relationship.Kind)
+	if relationship.Directed {
+		form.Fields["directed"].SetData("on")
+	}
+	form.Fields["notes"].SetData(relationship.Notes)
+	if relationship.StartSectionId != 0 {
+		form.Fields["start_section"].SetData(fmt.Sprintf("%v", relationship.StartSectionId))
+	}
+	if relationship.EndSectionId != 0 {
+		form.Fields["end_section"].SetData(fmt.Sprintf("%v", relationship.EndSectionId))
+	}
+	return WebPage{
+		Title:        fmt.Sprintf("%v and %v", relationship.FromName, relationship.ToName),
+		Headline:     fmt.Sprintf("%v and %v", relationship.FromName, relationship.ToName),
+		Name:         "relationship_edit",
+		Relationship: relationship,
+		Form:         form,
+		Universals:   getUniversals(sm),
+		DeleteForm:   forms.NewDeleteForm(relationship.Id, sm),
+	}
+}
+
+// GetRelationshipNewPage takes the id of the character the relationship
+// is from
+func GetRelationshipNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
+	id, _ := strconv.Atoi(args[0])
+	character, _ := models.GetCharacterDetail(id, database).(*models.Character)
+	fromId, name := 0, ""
+	if character != nil {
+		fromId, name = character.Id, character.Name
+	}
+	return WebPage{
+		Title:        "Add a relationship",
+		Headline:     fmt.Sprintf("Who is %v to whom?", name),
+		Name:         "relationship_new",
+		Relationship: &models.CharacterRelationship{FromId: fromId, FromName: name},
+		Form:         newRelationshipForm(sm, database, fromId),
+		NewObj:       true,
+		ParentId:     args[0],
+		Universals:   getUniversals(sm),
+	}
+}
+
+// GetWorkCastPage draws the relationship graph for a work's characters
+func GetWorkCastPage(sm sessionManager.SessionManager, verifiable interface{}) WebPage {
+	work := verifiable.(*models.Work)
+	sections, _ := models.GetSectionsForWork(work.Id, work.DB)
+	return WebPage{
+		Title:          fmt.Sprintf("Cast of %v", work.Title),
+		Name:           "work_cast",
+		Work:           work,
+		SectionsList:   models.FlattenSectionTree(sections),
+		CharactersList: models.GetCharactersForWork(work.Id, work.DB),
+		Universals:     getUniversals(sm),
+	}
+}
@@ -2,6 +2,7 @@ package pages
 
 import (
 	"fmt"
+	"strconv"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/forms"
@@ -13,24 +14,39 @@ func GetSectionViewPage(sm sessionManager.SessionManager, verifiable interface{}
 	section := verifiable.(*models.Section)
 	characters := models.GetCharactersForSection(section.Id, section.DB)
 	settings := models.GetSettingsForSection(section.Id, section.DB)
+	var pov *models.Character
+	for _, character := range characters {
+		if character.Id == section.POVCharacterId {
+			pov = character
+		}
+	}
 	return WebPage{
 		Title:          fmt.Sprintf("View section: %v", section.Title),
 		Name:           "section_view",
 		Section:        section,
 		Universals:     getUniversals(sm),
 		CharactersList: characters,
+		Character:      pov,
 		SettingsList:   settings,
+		StoryConflicts: getStoryConflictsForSection(section),
+		CommentThreads: map[int][]*models.Comment{
+			section.Id: models.GetCommentThreadsForSection(section.Id, section.DB),
+		},
+		CommentForm: forms.NewCommentForm(sm),
+		Role:        section.RoleFor(sm),
 	}
 }
 
 func GetSectionEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
 	section := verifiable.(*models.Section)
+	// the section's UserEmail is its work's owner, whose characters and
+	// settings co-authors pick from too
 	charsMap := forms.CharsToFormOptions(
-		models.GetCharactersForUser(sm.GetUserEmail(), database),
+		models.GetCharactersForUser(section.UserEmail, database),
 		models.GetCharactersForSection(section.Id, database)...,
 	)
 	settingsMap := forms.SettingsToFormOptions(
-		models.GetSettingsForUser(sm.GetUserEmail(), database),
+		models.GetSettingsForUser(section.UserEmail, database),
 		models.GetSettingsForSection(section.Id, database)...,
 	)
 	form := forms.NewSectionForm(charsMap, settingsMap, sm)
@@ -40,6 +56,11 @@ func GetSectionEditPage(sm sessionManager.SessionManager, database *db.DB, verif
 	if section.Snippet == true {
 		form.Fields["snippet"].SetData("on")
 	}
+	if section.POVCharacterId != 0 {
+		form.Fields["pov"].SetData(fmt.Sprintf("%v", section.POVCharacterId))
+	}
+	form.Fields["story_time"].SetData(section.StoryTime)
+	form.Fields["story_sort"].SetData(section.StorySortKey)
 	return WebPage{
 		Title:      fmt.Sprintf("Edit section: %v", section.Title),
 		Name:       "section_edit",
@@ -47,6 +68,8 @@ func GetSectionEditPage(sm sessionManager.SessionManager, database *db.DB, verif
 		Form:       form,
 		Universals: getUniversals(sm),
 		DeleteForm: forms.NewDeleteForm(section.Id, sm),
+		Images:     models.GetImagesFor("section", section.Id, database),
+		ImageForm:  forms.NewImageForm("section", section.Id, sm),
 	}
 }
 
@@ -58,18 +81,49 @@ func GetSectionReorderPage(sm sessionManager.SessionManager, database *db.DB, wo
 		SectionsList: sections,
 		Work:         work,
 		Universals:   getUniversals(sm),
+		// for merging
+		DeleteForm: forms.NewDeleteForm(work.Id, sm),
+	}
+}
+
+// GetSectionMovePage lists the work's sections and snippets, and the
+// owner's other works they can go to
+func GetSectionMovePage(sm sessionManager.SessionManager, database *db.DB, work *models.Work) WebPage {
+	sections, snippets := models.GetSectionsForWork(work.Id, database)
+	targets := []*models.Work{}
+	for _, other := range models.GetWorksForUser(work.UserEmail, database) {
+		if other.Id != work.Id {
+			targets = append(targets, other)
+		}
+	}
+	return WebPage{
+		Title:        fmt.Sprintf("Move sections from %v", work.Title),
+		Name:         "section_move",
+		SectionsList: models.FlattenSectionTree(sections),
+		SnippetsList: snippets,
+		WorksList:    targets,
+		Work:         work,
+		Universals:   getUniversals(sm),
+		DeleteForm:   forms.NewDeleteForm(work.Id, sm),
 	}
 }
 
 func GetSectionNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
+	workId := args[0]
+	// co-authors pick from the owner's characters and settings
+	ownerEmail := sm.GetUserEmail()
+	if id, err := strconv.Atoi(workId); err == nil {
+		if work, ok := models.GetWorkById(id, database).(*models.Work); ok {
+			ownerEmail = work.UserEmail
+		}
+	}
 	charsMap := forms.CharsToFormOptions(
-		models.GetCharactersForUser(sm.GetUserEmail(), database),
+		models.GetCharactersForUser(ownerEmail, database),
 	)
 	settingsMap := forms.SettingsToFormOptions(
-		models.GetSettingsForUser(sm.GetUserEmail(), database),
+		models.GetSettingsForUser(ownerEmail, database),
 	)
 	form := forms.NewSectionForm(charsMap, settingsMap, sm)
-	workId := args[0]
 	return WebPage{
 		Title:      "New section",
 		Name:       "section_edit",
@@ -80,3 +134,23 @@ func GetSectionNewPage(sm sessionManager.SessionManager, database *db.DB, args .
 		Universals: getUniversals(sm),
 	}
 }
+
+// getStoryConflictsForSection only looks further than the section itself
+// when it has a story time to clash over
+func getStoryConflictsForSection(section *models.Section) []*models.StoryTimeConflict {
+	output := []*models.StoryTimeConflict{}
+	if section.StoryKey() == "" {
+		return output
+	}
+	sections, _ := models.GetSectionsForWork(section.WorkId, section.DB)
+	conflicts := models.GetStoryTimeConflictsForWork(section.WorkId, models.FlattenSectionTree(sections), section.DB)
+	for _, conflict := range conflicts {
+		for _, s := range conflict.Sections {
+			if s.Id == section.Id {
+				output = append(output, conflict)
+				break
+			}
+		}
+	}
+	return output
+}
@@ -0,0 +1,114 @@
+package pages
+
+import (
+	"fmt"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/forms"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
+	"github.com/golang/glog"
+)
+
+// SeriesExportWork is one of the works in a series export, with its
+// sections in reading order
+type SeriesExportWork struct {
+	Work     *models.Work
+	Sections []*models.Section
+}
+
+func GetSeriesIndexPage(sm sessionManager.SessionManager, database *db.DB) WebPage {
+	seriesList := models.GetSeriesForUser(sm.GetUserEmail(), database)
+	worksBySeries := make(map[int][]*models.Work, len(seriesList))
+	for _, series := range seriesList {
+		worksBySeries[series.Id] = models.GetWorksForSeries(series.Id, database)
+	}
+	return WebPage{
+		Title:         "Series",
+		Headline:      "Series",
+		Name:          "series_index",
+		SeriesList:    seriesList,
+		WorksBySeries: worksBySeries,
+		Universals:    getUniversals(sm),
+	}
+}
+
+// getSeriesDetails is what the view and export pages have in common: the
+// works in order, the bible and the word counts
+func getSeriesDetails(series *models.Series) ([]*models.Work, *models.SeriesBible, *models.SeriesStats) {
+	works := models.GetWorksForSeries(series.Id, series.DB)
+	bible, err := models.GetSeriesBible(series.Id, works, series.DB)
+	if err != nil {
+		glog.Errorf("Error getting series bible: %v", err.Error())
+		bible = &models.SeriesBible{}
+	}
+	stats, err := models.GetSeriesStats(series.Id, works, series.DB)
+	if err != nil {
+		glog.Errorf("Error getting series stats: %v", err.Error())
+		stats = models.NewSeriesStats(works, nil)
+	}
+	return works, bible, stats
+}
+
+func GetSeriesViewPage(sm sessionManager.SessionManager, verifiable interface{}) WebPage {
+	series := verifiable.(*models.Series)
+	works, bible, stats := getSeriesDetails(series)
+	return WebPage{
+		Title:       series.Title,
+		Headline:    series.Title,
+		Name:        "series_view",
+		Series:      series,
+		WorksList:   works,
+		SeriesBible: bible,
+		SeriesStats: stats,
+		Universals:  getUniversals(sm),
+	}
+}
+
+func GetSeriesEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
+	series := verifiable.(*models.Series)
+	form := forms.NewSeriesForm(sm)
+	form.Fields["title"].SetData(series.Title)
+	form.Fields["blurb"].SetData(series.Blurb)
+	return WebPage{
+		Title:      fmt.Sprintf("Edit series: %v", series.Title),
+		Headline:   series.Title,
+		Name:       "series_edit",
+		Series:     series,
+		Form:       form,
+		Universals: getUniversals(sm),
+		DeleteForm: forms.NewDeleteForm(series.Id, sm),
+	}
+}
+
+func GetSeriesNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
+	return WebPage{
+		Headline:   "Start a series",
+		Title:      "Add a series",
+		Name:       "series_new",
+		Series:     &models.Series{},
+		Form:       forms.NewSeriesForm(sm),
+		NewObj:     true,
+		Universals: getUniversals(sm),
+	}
+}
+
+// GetSeriesExportPage is every work in the series, one after another, then
+// the bible
+func GetSeriesExportPage(sm sessionManager.SessionManager, series *models.Series) WebPage {
+	works, bible, stats := getSeriesDetails(series)
+	exportWorks := make([]*SeriesExportWork, len(works))
+	for i, work := range works {
+		sections, _ := models.GetSectionDetailForExport(work.Id, series.DB)
+		exportWorks[i] = &SeriesExportWork{Work: work, Sections: sections}
+	}
+	return WebPage{
+		Title:        series.Title,
+		Series:       series,
+		WorksList:    works,
+		SeriesBible:  bible,
+		SeriesStats:  stats,
+		SeriesExport: exportWorks,
+		Universals:   getUniversals(sm),
+	}
+}
@@ -1,6 +1,10 @@
 package pages
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/forms"
 	"bitbucket.org/jtyburke/pathfork/app/models"
@@ -8,23 +12,57 @@ import (
 	"github.com/bradfitz/slice"
 )
 
+// settingParentOptions lists the user's settings in tree order, leaving out
+// settingId and everything inside it since it can't go in any of those
+func settingParentOptions(sm sessionManager.SessionManager, database *db.DB, settingId int) []map[string]string {
+	settings := models.GetSettingsForUser(sm.GetUserEmail(), database)
+	parents := models.SettingParents(settings)
+	options := []map[string]string{}
+	for _, setting := range models.FlattenSettingTree(models.BuildSettingTree(settings)) {
+		if settingId != 0 && models.SettingWithin(setting.Id, settingId, parents) {
+			continue
+		}
+		options = append(options, map[string]string{
+			"value": fmt.Sprintf("%v", setting.Id),
+			"text":  strings.Repeat("- ", setting.Depth) + setting.Name,
+		})
+	}
+	return options
+}
+
+// GetSettingViewPage shows the sections set in the setting or anywhere
+// inside it, grouped by work
 func GetSettingViewPage(sm sessionManager.SessionManager, verifiable interface{}) WebPage {
 	setting := verifiable.(*models.Setting)
 	works := models.GetWorksForSetting(setting.Id, setting.DB)
-	sections := models.GetSectionsForSetting(setting.Id, setting.DB)
-	slice.Sort(sections, func(i, j int) bool {
-		return sections[i].WorkId < sections[j].WorkId
-	})
+	sections := models.GetSectionsWithinSetting(setting.Id, setting.DB)
+	worksById := map[int]*models.Work{}
 	sectionsByWork := map[*models.Work][]*models.Section{}
-	for i := range works {
-		sectionsByWork[works[i]] = []*models.Section{}
-		for j := range sections {
-			if sections[j].WorkId != works[i].Id {
-				break
+	for _, work := range works {
+		worksById[work.Id] = work
+		sectionsByWork[work] = []*models.Section{}
+	}
+	for _, section := range sections {
+		work, ok := worksById[section.WorkId]
+		if !ok {
+			// set here without the work being linked to the setting
+			if work, ok = models.GetWorkById(section.WorkId, setting.DB).(*models.Work); !ok {
+				continue
 			}
-			sectionsByWork[works[i]] = append(sectionsByWork[works[i]], sections[j])
+			worksById[work.Id] = work
+		}
+		sectionsByWork[work] = append(sectionsByWork[work], section)
+	}
+	settings := models.GetSettingsForUser(setting.UserEmail, setting.DB)
+	children := []*models.Setting{}
+	for _, s := range settings {
+		if s.ParentId == setting.Id && s.Id != setting.Id {
+			children = append(children, s)
 		}
 	}
+	slice.Sort(children, func(i, j int) bool {
+		return children[i].Name < children[j].Name
+	})
 	return WebPage{
 		Title:          setting.Name,
 		Headline:       setting.Name,
@@ -32,48 +70,89 @@ func GetSettingViewPage(sm sessionManager.SessionManager, verifiable interface{}
 		Setting:        setting,
 		Universals:     getUniversals(sm),
 		SectionsByWork: sectionsByWork,
+		Breadcrumbs:    models.GetSettingBreadcrumbs(setting),
+		SettingsList:   children,
+		FieldValues:    models.GetFieldValuesFor("setting", setting.UserEmail, setting.Id, setting.DB),
+		Images:         models.GetImagesFor("setting", setting.Id, setting.DB),
+		ImageForm:      forms.NewImageForm("setting", setting.Id, sm),
+		Aliases:        models.GetAliases("setting", setting.Id, setting.DB),
 	}
 }
 
+// GetSettingRenamePage is GetCharacterRenamePage for settings
+func GetSettingRenamePage(sm sessionManager.SessionManager, setting *models.Setting, options *models.ReplaceOptions,
+	unlinked bool, hits []*models.ReplaceHit, fields []*models.ReplaceField) WebPage {
+	page := getRenamePage(sm, "setting", setting.Id, options, unlinked, hits, fields)
+	page.Setting = setting
+	return page
+}
+
 func GetSettingEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
 	setting := verifiable.(*models.Setting)
-	form := forms.NewSettingForm(sm)
+	form := forms.NewSettingForm(settingParentOptions(sm, database, setting.Id), sm)
 	form.Fields["name"].SetData(setting.Name)
+	if setting.ParentId != 0 {
+		form.Fields["parent"].SetData(fmt.Sprintf("%v", setting.ParentId))
+	}
 	form.Fields["blurb"].SetData(setting.Blurb)
 	form.Fields["body"].SetData(setting.Body)
+	defs := addCustomFields(form, "setting", sm, database, setting.Id, 0)
 	return WebPage{
 		Title:      setting.Name,
 		Headline:   setting.Name,
 		Name:       "setting_edit",
 		Setting:    setting,
+		FieldDefs:  defs,
 		Universals: getUniversals(sm),
 		Form:       form,
 		DeleteForm: forms.NewDeleteForm(setting.Id, sm),
 	}
 }
 
-func GetSettingIndexPage(sm sessionManager.SessionManager, settings []*models.Setting) WebPage {
-	slice.Sort(settings, func(i, j int) bool {
-		return settings[i].Name < settings[j].Name
-	})
+// GetSettingIndexPage lists the settings as a tree, each place followed by
+// the places inside it. Given a fieldId, only the settings whose custom
+// field matches query are listed.
+func GetSettingIndexPage(sm sessionManager.SessionManager, database *db.DB, settings []*models.Setting,
+	fieldId int, query string) WebPage {
+	ids := make([]int, len(settings))
+	for i := range settings {
+		ids[i] = settings[i].Id
+	}
+	keep, filter := filterByField("setting", sm, database, ids, fieldId, query)
+	filtered := []*models.Setting{}
+	for _, setting := range settings {
+		if keep[setting.Id] {
+			filtered = append(filtered, setting)
+		}
+	}
 	return WebPage{
 		Headline:     "Oh the places your stories will go!",
 		Title:        "Settings index",
 		Name:         "setting_index",
-		SettingsList: settings,
+		SettingsList: models.FlattenSettingTree(models.BuildSettingTree(filtered)),
+		FieldDefs:    entityFieldDefs("setting", sm, database),
+		FieldFilter:  filter,
 		Universals:   getUniversals(sm),
 	}
 }
 
+// GetSettingNewPage takes the id of the work the setting is for and,
+// optionally, the id of the place it's inside
 func GetSettingNewPage(sm sessionManager.SessionManager, database *db.DB, args ...string) WebPage {
-	form := forms.NewSettingForm(sm)
+	form := forms.NewSettingForm(settingParentOptions(sm, database, 0), sm)
+	if len(args) > 1 && args[1] != "" {
+		form.Fields["parent"].SetData(args[1])
+	}
 	workId := args[0]
+	workIdInt, _ := strconv.Atoi(workId)
+	defs := addCustomFields(form, "setting", sm, database, 0, workIdInt)
 	return WebPage{
 		Headline:   "So tell me about this place.",
 		Title:      "Add a setting",
 		Name:       "setting_new",
 		Setting:    &models.Setting{},
 		Form:       form,
+		FieldDefs:  defs,
 		NewObj:     true,
 		Universals: getUniversals(sm),
 		ParentId:   workId,
@@ -2,18 +2,42 @@ package pages
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"bitbucket.org/jtyburke/pathfork/app/db"
 	"bitbucket.org/jtyburke/pathfork/app/forms"
 	"bitbucket.org/jtyburke/pathfork/app/models"
 	"bitbucket.org/jtyburke/pathfork/app/sessionManager"
-	"github.com/bradfitz/slice"
 )
 
-func GetWorkViewPage(sm sessionManager.SessionManager, verifiable interface{}) WebPage {
+// statusHistoryLength is how many recent status changes the board shows
+const statusHistoryLength = 20
+
+// revisionListLength is how many past find and replaces can be undone from
+// the page
+const revisionListLength = 10
+
+// GetWorkViewPage shows only the sections with the given status, if any
+func GetWorkViewPage(sm sessionManager.SessionManager, verifiable interface{}, status string) WebPage {
 	work := verifiable.(*models.Work)
 	sm.SetCurrentWork(work.Id, work.Title)
-	sections, snippets := models.GetSectionsForWork(work.Id, work.DB)
+	statuses := []string{}
+	if status != "" {
+		statuses = append(statuses, status)
+	}
+	sections, snippets := models.GetSectionsForWork(work.Id, work.DB, statuses...)
+	// any section can be shared, whatever's showing
+	shareable := sections
+	if status != "" {
+		shareable, _ = models.GetSectionsForWork(work.Id, work.DB)
+	}
+	role := work.RoleFor(sm)
+	// share links' tokens are as good as the work, so only the owner sees them
+	var links []*models.ShareLink
+	if role == models.RoleOwner {
+		links = models.GetShareLinksForWork(work.Id, work.DB)
+	}
 	return WebPage{
 		Title:          fmt.Sprintf("View work: %v", work.Title),
 		Name:           "work_view",
@@ -22,23 +46,133 @@ func GetWorkViewPage(sm sessionManager.SessionManager, verifiable interface{}) W
 		CharactersList: models.GetCharactersForWork(work.Id, work.DB),
 		SettingsList:   models.GetSettingsForWork(work.Id, work.DB),
 		SnippetsList:   snippets,
+		StatusFilter:   status,
+		Universals:     getUniversals(sm),
+		Images:         models.GetImagesFor("work", work.Id, work.DB),
+		ImageForm:      forms.NewImageForm("work", work.Id, sm),
+		ShareLinks:     links,
+		ShareForm:      forms.NewShareLinkForm(forms.SectionsToFormOptions(models.FlattenSectionTree(shareable)), sm),
+		DeleteForm:     forms.NewDeleteForm(0, sm),
+		Role:           role,
+	}
+}
+
+// GetShareReadPage is the reader's view of a shared work. Without a link
+// it says the link is no good; Form is set when a password's needed first.
+func GetShareReadPage(sm sessionManager.SessionManager, link *models.ShareLink, work *models.Work,
+	sections []*models.Section, needPassword bool) WebPage {
+	page := WebPage{
+		Title:      "Shared work",
+		Name:       "share_read",
+		ShareLink:  link,
+		Universals: getUniversals(sm),
+	}
+	if link == nil || work == nil {
+		return page
+	}
+	page.Title = work.Title
+	if needPassword {
+		page.Form = forms.NewSharePasswordForm()
+		return page
+	}
+	page.Work = work
+	page.SectionsList = sections
+	// readers only see the threads they started
+	page.CommentThreads = map[int][]*models.Comment{}
+	for sectionId, threads := range models.GetCommentThreadsForWork(work.Id, work.DB) {
+		page.CommentThreads[sectionId] = models.ThreadsForShareLink(threads, link.Id)
+	}
+	page.CommentForm = forms.NewReaderCommentForm()
+	page.CommentForm.Fields["name"].SetData(link.Name)
+	return page
+}
+
+// GetWorkReplacePage is find and replace for the work, with the preview's
+// hits in fields once there's been one
+func GetWorkReplacePage(sm sessionManager.SessionManager, database *db.DB, work *models.Work,
+	options *models.ReplaceOptions, hits []*models.ReplaceHit, fields []*models.ReplaceField) WebPage {
+	fingerprints := make([]string, len(fields))
+	for i, field := range fields {
+		fingerprints[i] = field.Fingerprint()
+	}
+	return WebPage{
+		Title:        fmt.Sprintf("Find and replace in %v", work.Title),
+		Name:         "work_replace",
+		Work:         work,
+		Universals:   getUniversals(sm),
+		DeleteForm:   forms.NewDeleteForm(work.Id, sm),
+		Replace:      options,
+		ReplaceHits:  hits,
+		Fingerprints: fingerprints,
+		Revisions:    models.GetRevisionsForWork(work.Id, revisionListLength, database),
+		Role:         work.RoleFor(sm),
+	}
+}
+
+func GetWorkBoardPage(sm sessionManager.SessionManager, database *db.DB, work *models.Work) WebPage {
+	sections, _ := models.GetSectionsForWork(work.Id, database)
+	return WebPage{
+		Title:         fmt.Sprintf("Board for %v", work.Title),
+		Name:          "work_board",
+		Work:          work,
+		StatusColumns: models.GroupSectionsByStatus(work, models.FlattenSectionTree(sections)),
+		StatusHistory: models.GetStatusHistoryForWork(work.Id, statusHistoryLength, database),
+		Universals:    getUniversals(sm),
+		DeleteForm:    forms.NewDeleteForm(0, sm),
+	}
+}
+
+// GetWorkChronologyPage lists a work's sections in story order rather than
+// reading order, along with anyone who seems to be in two places at once
+func GetWorkChronologyPage(sm sessionManager.SessionManager, verifiable interface{}) WebPage {
+	work := verifiable.(*models.Work)
+	sections, _ := models.GetSectionsForWork(work.Id, work.DB)
+	flat := models.FlattenSectionTree(sections)
+	names := map[int]string{}
+	for _, character := range models.GetCharactersForWork(work.Id, work.DB) {
+		names[character.Id] = character.Name
+	}
+	return WebPage{
+		Title:          fmt.Sprintf("Chronology of %v", work.Title),
+		Name:           "work_chronology",
+		Work:           work,
+		SectionsList:   models.SortSectionsByStoryTime(flat),
+		StoryConflicts: models.GetStoryTimeConflictsForWork(work.Id, flat, work.DB),
+		CharacterNames: names,
 		Universals:     getUniversals(sm),
 	}
 }
 
 func GetWorkEditPage(sm sessionManager.SessionManager, database *db.DB, verifiable interface{}) WebPage {
 	work := verifiable.(*models.Work)
+	// editors pick from the owner's characters, settings and series
 	charsMap := forms.CharsToFormOptions(
-		models.GetCharactersForUser(sm.GetUserEmail(), database),
+		models.GetCharactersForUser(work.UserEmail, database),
 		models.GetCharactersForWork(work.Id, database)...,
 	)
 	settingsMap := forms.SettingsToFormOptions(
-		models.GetSettingsForUser(sm.GetUserEmail(), database),
+		models.GetSettingsForUser(work.UserEmail, database),
 		models.GetSettingsForWork(work.Id, database)...,
 	)
-	form := forms.NewWorkForm(charsMap, settingsMap, sm)
+	seriesMap := forms.SeriesToFormOptions(models.GetSeriesForUser(work.UserEmail, database))
+	form := forms.NewWorkForm(charsMap, settingsMap, seriesMap, sm)
 	form.Fields["title"].SetData(work.Title)
 	form.Fields["blurb"].SetData(work.Blurb)
+	form.Fields["statuses"].SetData(strings.Join(work.GetStatuses(), ", "))
+	form.Fields["subtitle"].SetData(work.Subtitle)
+	form.Fields["author"].SetData(work.Author)
+	if work.SeriesId != 0 {
+		form.Fields["series"].SetData(strconv.Itoa(work.SeriesId))
+	}
+	form.Fields["seriesNumber"].SetData(work.SeriesNumberStr())
+	form.Fields["language"].SetData(work.GetLanguage())
+	form.Fields["isbn"].SetData(work.ISBN)
+	if work.CopyrightYear != 0 {
+		form.Fields["copyrightYear"].SetData(strconv.Itoa(work.CopyrightYear))
+	}
+	form.Fields["dedication"].SetData(work.Dedication)
+	form.Fields["acknowledgements"].SetData(work.Acknowledgements)
+	form.Fields["aboutAuthor"].SetData(work.AboutAuthor)
 	return WebPage{
 		Title:      fmt.Sprintf("Edit work: %v", work.Title),
 		Headline:   work.Title,
@@ -57,12 +191,20 @@ func GetWorkNewPage(sm sessionManager.SessionManager, database *db.DB, args ...s
 	settingsMap := forms.SettingsToFormOptions(
 		models.GetSettingsForUser(sm.GetUserEmail(), database),
 	)
+	seriesMap := forms.SeriesToFormOptions(models.GetSeriesForUser(sm.GetUserEmail(), database))
+	form := forms.NewWorkForm(charsMap, settingsMap, seriesMap, sm)
+	form.Fields["statuses"].SetData(strings.Join(models.DefaultSectionStatuses, ", "))
+	// args[0] is the series the work's being added to, if any
+	if len(args) > 0 && args[0] != "" {
+		form.Fields["series"].SetData(args[0])
+	}
+	form.Fields["language"].SetData(models.DefaultLanguage)
 	return WebPage{
 		Headline:   "How exciting! You're starting a new work.",
 		Title:      "Add a work",
 		Name:       "work_new",
 		Work:       &models.Work{},
-		Form:       forms.NewWorkForm(charsMap, settingsMap, sm),
+		Form:       form,
 		NewObj:     true,
 		Universals: getUniversals(sm),
 	}
@@ -70,9 +212,6 @@ func GetWorkNewPage(sm sessionManager.SessionManager, database *db.DB, args ...s
 
 func GetWorkExportPage(sm sessionManager.SessionManager, work *models.Work, sections []*models.Section,
 	snippets []*models.Section, settings []*models.Setting, characters []*models.Character) WebPage {
-	slice.Sort(sections, func(i, j int) bool {
-		return sections[i].Order < sections[j].Order
-	})
 	return WebPage{
 		Work:           work,
 		SectionsList:   sections,
@@ -68,7 +68,7 @@ func NewTemplateRenderer() *TemplateRenderer {
 	for _, file := range templateFiles {
 		key := strings.TrimSuffix(filepath.Base(file), ".html")
 		newTmpl := &template.Template{}
-		if key == "work_export" {
+		if key == "work_export" || key == "series_export" {
 			newTmpl = template.New("base").Funcs(template.FuncMap{
 				"URLFor":            URLFor,
 				"StaticURL":         StaticURL,
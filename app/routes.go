@@ -13,34 +13,93 @@ type Route struct {
 
 var FrontEndRoutes = []Route{
 	Route{"/dashboard", BuildDashboardHandler, "dashboard", false},
+	Route{"/trash", BuildTrashHandler, "trash", false},
 
 	Route{"/character/new", BuildCharacterNewHandler, "character_new", false},
 	Route{"/character/edit/", BuildCharacterEditHandler, "character_edit", false},
 	Route{"/character/view/", BuildCharacterViewHandler, "character_view", false},
 	Route{"/character/index/", BuildCharacterIndexHandler, "character_index", false},
 	Route{"/character/delete/", BuildCharacterDeleteHandler, "character_delete", false},
+	Route{"/character/duplicate/", BuildCharacterDuplicateHandler, "character_duplicate", false},
+	Route{"/character/rename/", BuildCharacterRenameHandler, "character_rename", false},
+	Route{"/relationship/new", BuildRelationshipNewHandler, "relationship_new", false},
+	Route{"/relationship/edit/", BuildRelationshipEditHandler, "relationship_edit", false},
+	Route{"/relationship/delete/", BuildRelationshipDeleteHandler, "relationship_delete", false},
 
 	Route{"/section/new", BuildSectionNewHandler, "section_new", false},
 	Route{"/section/edit/", BuildSectionEditHandler, "section_edit", false},
 	Route{"/section/view/", BuildSectionViewHandler, "section_view", false},
 	Route{"/section/delete/", BuildSectionDeleteHandler, "section_delete", false},
+	Route{"/section/duplicate/", BuildSectionDuplicateHandler, "section_duplicate", false},
+	Route{"/section/split/", BuildSectionSplitHandler, "section_split", false},
+	Route{"/section/promote/", BuildSnippetPromoteHandler, "section_promote", false},
+	Route{"/section/collab/", BuildSectionCollabHandler, "section_collab", false},
 	Route{"/work/reorder/", BuildSectionReorderHandler, "section_reorder", false},
+	Route{"/work/merge/", BuildSectionMergeHandler, "section_merge", false},
+	Route{"/work/move/", BuildSectionMoveHandler, "section_move", false},
 
 	Route{"/setting/new", BuildSettingNewHandler, "setting_new", false},
 	Route{"/setting/edit/", BuildSettingEditHandler, "setting_edit", false},
 	Route{"/setting/view/", BuildSettingViewHandler, "setting_view", false},
 	Route{"/setting/index/", BuildSettingIndexHandler, "setting_index", false},
 	Route{"/setting/delete/", BuildSettingDeleteHandler, "setting_delete", false},
+	Route{"/setting/duplicate/", BuildSettingDuplicateHandler, "setting_duplicate", false},
+	Route{"/setting/rename/", BuildSettingRenameHandler, "setting_rename", false},
+
+	Route{"/event/new", BuildEventNewHandler, "event_new", false},
+	Route{"/event/edit/", BuildEventEditHandler, "event_edit", false},
+	Route{"/event/view/", BuildEventViewHandler, "event_view", false},
+	Route{"/event/delete/", BuildEventDeleteHandler, "event_delete", false},
+	Route{"/timeline", BuildTimelineHandler, "timeline", false},
+	Route{"/timeline/export", BuildTimelineExportHandler, "timeline_export", false},
+	Route{"/fields/", BuildFieldIndexHandler, "field_index", false},
+	Route{"/field/new", BuildFieldNewHandler, "field_new", false},
+	Route{"/field/edit/", BuildFieldEditHandler, "field_edit", false},
+	Route{"/field/delete/", BuildFieldDeleteHandler, "field_delete", false},
+	Route{"/image/upload", BuildImageUploadHandler, "image_upload", false},
+	Route{"/image/", BuildImageViewHandler, "image_view", false},
+	Route{"/image/thumb/", BuildImageThumbHandler, "image_thumb", false},
+	Route{"/image/delete/", BuildImageDeleteHandler, "image_delete", false},
+
+	Route{"/series/new", BuildSeriesNewHandler, "series_new", false},
+	Route{"/series/edit/", BuildSeriesEditHandler, "series_edit", false},
+	Route{"/series/view/", BuildSeriesViewHandler, "series_view", false},
+	Route{"/series/index/", BuildSeriesIndexHandler, "series_index", false},
+	Route{"/series/export/", BuildSeriesExportHandler, "series_export", false},
+	Route{"/series/delete/", BuildSeriesDeleteHandler, "series_delete", false},
+	Route{"/work/share/", BuildWorkShareHandler, "work_share", false},
+	Route{"/share/revoke/", BuildShareRevokeHandler, "share_revoke", false},
+	Route{"/section/comment/", BuildSectionCommentHandler, "section_comment", false},
+	Route{"/comment/resolve/", BuildCommentResolveHandler, "comment_resolve", false},
+	Route{"/work/feedback/", BuildWorkFeedbackHandler, "work_feedback", false},
+	Route{"/work/replace/", BuildWorkReplaceHandler, "work_replace", false},
+	Route{"/work/members/", BuildWorkMembersHandler, "work_members", false},
+	Route{"/member/edit/", BuildMemberEditHandler, "member_edit", false},
+	Route{"/invite", BuildInviteAcceptHandler, "work_invite", false},
 
 	Route{"/work/new", BuildWorkNewHandler, "work_new", false},
 	Route{"/work/edit/", BuildWorkEditHandler, "work_edit", false},
 	Route{"/work/view/", BuildWorkViewHandler, "work_view", false},
 	Route{"/work/export/", BuildWorkExportHandler, "work_export", false},
+	Route{"/work/board/", BuildWorkBoardHandler, "work_board", false},
+	Route{"/work/chronology/", BuildWorkChronologyHandler, "work_chronology", false},
+	Route{"/work/cast/", BuildWorkCastHandler, "work_cast", false},
+	Route{"/work/cast/graph/", BuildWorkCastGraphHandler, "work_cast_graph", false},
 	Route{"/work/delete/", BuildWorkDeleteHandler, "work_delete", false},
+	Route{"/work/duplicate/", BuildWorkDuplicateHandler, "work_duplicate", false},
+
+	Route{"/account/tokens", BuildAPITokensHandler, "api_tokens", false},
+	Route{"/account/sessions", BuildSessionsHandler, "sessions", false},
+	Route{"/account/2fa", BuildTwoFactorSetupHandler, "two_factor_setup", false},
+	Route{"/account/email", BuildChangeEmailHandler, "change_email", false},
 
 	Route{"/about", BuildAboutHandler, "about", true},
+	Route{"/read", BuildShareReadHandler, "share_read", true},
+	Route{"/read/comment", BuildShareCommentHandler, "share_comment", true},
+	Route{"/read/image/", BuildShareImageHandler, "share_image", true},
 	Route{"/contact", BuildContactHandler, "contact", true},
 	Route{"/auth", BuildAuthHandler, "auth", true},
+	Route{"/auth/2fa", BuildTwoFactorHandler, "two_factor", true},
 	Route{"/reset", BuildResetHandler, "reset", true},
 	Route{"/", BuildHomeHandler, "home", true},
 }
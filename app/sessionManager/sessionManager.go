@@ -1,6 +1,7 @@
 package sessionManager
 
 import (
+	"fmt"
 	"net/http"
 
 	"bitbucket.org/jtyburke/pathfork/app/config"
@@ -16,6 +17,10 @@ type SessionManager struct {
 }
 
 func (s SessionManager) Save() error {
+	if s.IsBearerAuth() {
+		// token-authenticated requests never get a cookie
+		return nil
+	}
 	return s.Session.Save(s.r, s.w)
 }
 
@@ -28,8 +33,68 @@ func (s SessionManager) GetUserEmail() string {
 	return s.Session.Values["userEmail"].(string)
 }
 
+// SetUser logs a user in. The session gets a fresh ID so that one handed out
+// before login can't be reused afterwards.
 func (s SessionManager) SetUser(email string) error {
+	s.Session.ID = ""
+	s.Session.Values["userEmail"] = email
+	return s.Save()
+}
+
+// SetRemember marks the session as "remember me", which gives it the store's
+// longer timeouts and a persistent cookie.
+func (s SessionManager) SetRemember(remember bool) {
+	s.Session.Values["remember"] = remember
+}
+
+// SetBearerUser logs a user in for the length of a single request that was
+// authenticated with a personal access token.
+func (s SessionManager) SetBearerUser(email, scope string) {
 	s.Session.Values["userEmail"] = email
+	s.Session.Values["bearerScope"] = scope
+}
+
+func (s SessionManager) IsBearerAuth() bool {
+	_, ok := s.Session.Values["bearerScope"]
+	return ok
+}
+
+// SetPendingUser remembers who's halfway through a two-factor login
+func (s SessionManager) SetPendingUser(email string, remember bool, since int64) error {
+	s.Session.Values["pendingUser"] = email
+	s.Session.Values["pendingRemember"] = remember
+	s.Session.Values["pendingSince"] = since
+	return s.Save()
+}
+
+func (s SessionManager) GetPendingUser() (string, bool, int64) {
+	email, _ := s.Session.Values["pendingUser"].(string)
+	remember, _ := s.Session.Values["pendingRemember"].(bool)
+	since, _ := s.Session.Values["pendingSince"].(int64)
+	return email, remember, since
+}
+
+func (s SessionManager) ClearPendingUser() error {
+	delete(s.Session.Values, "pendingUser")
+	delete(s.Session.Values, "pendingRemember")
+	delete(s.Session.Values, "pendingSince")
+	return s.Save()
+}
+
+// SetTOTPSetupSecret holds a new TOTP secret until the user proves their
+// authenticator app has it
+func (s SessionManager) SetTOTPSetupSecret(secret string) error {
+	s.Session.Values["totpSetupSecret"] = secret
+	return s.Save()
+}
+
+func (s SessionManager) GetTOTPSetupSecret() string {
+	secret, _ := s.Session.Values["totpSetupSecret"].(string)
+	return secret
+}
+
+func (s SessionManager) ClearTOTPSetupSecret() error {
+	delete(s.Session.Values, "totpSetupSecret")
 	return s.Save()
 }
 
@@ -38,6 +103,40 @@ func (s SessionManager) DeleteUser() error {
 	return s.Save()
 }
 
+// Destroy ends the session for good, in the store as well as in the browser
+func (s SessionManager) Destroy() error {
+	for key := range s.Session.Values {
+		delete(s.Session.Values, key)
+	}
+	if s.Session.Options == nil {
+		s.Session.Options = &sessions.Options{}
+	}
+	s.Session.Options.MaxAge = -1
+	return s.Save()
+}
+
+// Restart throws the session away and starts a fresh, logged-out one under a
+// new ID, for when the old one has been revoked server-side but we still
+// want to flash a message.
+func (s SessionManager) Restart() {
+	for key := range s.Session.Values {
+		delete(s.Session.Values, key)
+	}
+	s.Session.ID = ""
+}
+
+// UnlockShareLink remembers that this browser has given a share link's
+// password, so the reader isn't asked again
+func (s SessionManager) UnlockShareLink(id int) error {
+	s.Session.Values[fmt.Sprintf("shareLink%v", id)] = true
+	return s.Save()
+}
+
+func (s SessionManager) ShareLinkUnlocked(id int) bool {
+	unlocked, _ := s.Session.Values[fmt.Sprintf("shareLink%v", id)].(bool)
+	return unlocked
+}
+
 func (s SessionManager) SetCurrentWork(id int, title string) error {
 	s.Session.Values["workId"] = id
 	s.Session.Values["workTitle"] = title
@@ -62,7 +161,7 @@ func (s SessionManager) GetCurrentWork() (int, string) {
 	return id.(int), title.(string)
 }
 
-func New(r *http.Request, w http.ResponseWriter, s *sessions.CookieStore) SessionManager {
+func New(r *http.Request, w http.ResponseWriter, s sessions.Store) SessionManager {
 	session, err := s.Get(r, config.SessionCookieName)
 	if err != nil {
 		glog.Error(err)
@@ -0,0 +1,375 @@
+// Package sessionStore keeps sessions in Postgres so that they can be listed,
+// expired and revoked server-side. The cookie only carries a signed random ID;
+// the database only stores a hash of that ID.
+package sessionStore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Policy decides how long a session lives. A session expires once it has been
+// idle for longer than the idle timeout or once it is older than the absolute
+// timeout, whichever comes first. "Remember me" sessions get the longer pair.
+type Policy struct {
+	IdleTimeout             time.Duration
+	AbsoluteTimeout         time.Duration
+	RememberIdleTimeout     time.Duration
+	RememberAbsoluteTimeout time.Duration
+}
+
+var DefaultPolicy = Policy{
+	IdleTimeout:             2 * time.Hour,
+	AbsoluteTimeout:         24 * time.Hour,
+	RememberIdleTimeout:     14 * 24 * time.Hour,
+	RememberAbsoluteTimeout: 30 * 24 * time.Hour,
+}
+
+func (p Policy) ExpiresAt(createdAt, lastSeenAt time.Time, remember bool) time.Time {
+	idle, absolute := p.IdleTimeout, p.AbsoluteTimeout
+	if remember {
+		idle, absolute = p.RememberIdleTimeout, p.RememberAbsoluteTimeout
+	}
+	idleExpiry := lastSeenAt.Add(idle)
+	absoluteExpiry := createdAt.Add(absolute)
+	if idleExpiry.Before(absoluteExpiry) {
+		return idleExpiry
+	}
+	return absoluteExpiry
+}
+
+func (p Policy) Expired(createdAt, lastSeenAt time.Time, remember bool, now time.Time) bool {
+	return !now.Before(p.ExpiresAt(createdAt, lastSeenAt, remember))
+}
+
+// lastSeenGranularity keeps us from writing to the database on every request
+const lastSeenGranularity = time.Minute
+
+type PGStore struct {
+	DB      *db.DB
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Policy  Policy
+	Now     func() time.Time
+}
+
+func New(database *db.DB, policy Policy, keyPairs ...[]byte) *PGStore {
+	store := &PGStore{
+		DB:     database,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			HttpOnly: true,
+		},
+		Policy: policy,
+		Now:    time.Now,
+	}
+	for _, codec := range store.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(int(policy.RememberAbsoluteTimeout.Seconds()))
+		}
+	}
+	return store
+}
+
+func HashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP prefers the address our proxy reports over the proxy's own.
+// That's the last one in X-Forwarded-For, which the proxy adds; the client
+// can put anything it likes before it, and logins are throttled on this.
+func ClientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	if i := strings.LastIndex(r.RemoteAddr, ":"); i > 0 {
+		return r.RemoteAddr[:i]
+	}
+	return r.RemoteAddr
+}
+
+func (s *PGStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *PGStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	id := ""
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+	rec, err := s.load(HashID(id))
+	if err != nil || rec == nil {
+		return session, err
+	}
+	now := s.Now()
+	if s.Policy.Expired(rec.CreatedAt, rec.LastSeenAt, rec.Remember, now) {
+		s.erase(rec.TokenHash)
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, rec.Data, &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	if now.Sub(rec.LastSeenAt) > lastSeenGranularity {
+		s.touch(rec.TokenHash, now)
+	}
+	return session, nil
+}
+
+// Save writes the session to the database. A session with no ID and nothing
+// in it is never stored, so anonymous visitors don't fill up the table; a
+// negative MaxAge deletes the session.
+func (s *PGStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.erase(HashID(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	isNew := session.ID == ""
+	if isNew && len(session.Values) == 0 {
+		return nil
+	}
+	if isNew {
+		session.ID = strings.TrimRight(
+			base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	rec := &record{
+		TokenHash:  HashID(session.ID),
+		Data:       data,
+		UserAgent:  r.UserAgent(),
+		IP:         ClientIP(r),
+		LastSeenAt: s.Now(),
+	}
+	rec.UserEmail, _ = session.Values["userEmail"].(string)
+	rec.Remember, _ = session.Values["remember"].(bool)
+	if err := s.save(rec, isNew); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	opts := *session.Options
+	if rec.Remember {
+		opts.MaxAge = int(s.Policy.RememberAbsoluteTimeout.Seconds())
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, &opts))
+	return nil
+}
+
+// PurgeExpired deletes every session that has passed either of its timeouts
+func (s *PGStore) PurgeExpired() error {
+	tx, err := s.DB.DB.Begin()
+	if err == nil {
+		err = s.DB.Delete(expiredDelete{Policy: s.Policy, Now: s.Now()}, tx)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	return err
+}
+
+// PurgeEvery runs PurgeExpired on an interval until the process exits
+func (s *PGStore) PurgeEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.PurgeExpired(); err != nil {
+			glog.Errorf("Session purge error: %v", err.Error())
+		}
+	}
+}
+
+func (s *PGStore) load(tokenHash string) (*record, error) {
+	recInt, err := s.DB.Query(recordQuery{TokenHash: tokenHash})
+	if err != nil {
+		glog.Errorf("Session load error: %v", err.Error())
+		return nil, err
+	}
+	if len(recInt) == 0 {
+		return nil, nil
+	}
+	return recInt[0].(*record), nil
+}
+
+func (s *PGStore) save(rec *record, isNew bool) error {
+	tx, err := s.DB.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if isNew {
+		_, err = s.DB.Insert(rec, tx)
+	} else {
+		// a session revoked since it was loaded stays revoked, the update
+		// just won't match anything
+		err = s.DB.Update(rec, tx)
+	}
+	if err != nil {
+		glog.Errorf("Session save error: %v", err.Error())
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PGStore) touch(tokenHash string, now time.Time) {
+	tx, err := s.DB.DB.Begin()
+	if err == nil {
+		if err = s.DB.Update(lastSeenUpdate{TokenHash: tokenHash, Now: now}, tx); err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		glog.Errorf("Session touch error: %v", err.Error())
+	}
+}
+
+func (s *PGStore) erase(tokenHash string) error {
+	tx, err := s.DB.DB.Begin()
+	if err == nil {
+		err = s.DB.Delete(recordDelete{TokenHash: tokenHash}, tx)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	return err
+}
+
+/*
+.
+.
+*/
+
+type record struct {
+	TokenHash  string
+	Data       string
+	UserEmail  string
+	UserAgent  string
+	IP         string
+	Remember   bool
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+func (rec *record) GetInsertStr() string {
+	return `
+INSERT INTO tbl_session(token_hash, data, user_email, user_agent, ip, remember, created_at, last_seen_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+RETURNING session_id
+`
+}
+
+func (rec *record) GetInsertArgs() []interface{} {
+	return []interface{}{rec.TokenHash, rec.Data, db.ToNullString(rec.UserEmail), rec.UserAgent, rec.IP, rec.Remember, rec.LastSeenAt}
+}
+
+func (rec *record) GetUpdateStr() string {
+	return `
+UPDATE tbl_session
+SET data=$1, user_email=$2, user_agent=$3, ip=$4, remember=$5, last_seen_at=$6
+WHERE token_hash=$7
+`
+}
+
+func (rec *record) GetUpdateArgs() []interface{} {
+	return []interface{}{rec.Data, db.ToNullString(rec.UserEmail), rec.UserAgent, rec.IP, rec.Remember, rec.LastSeenAt, rec.TokenHash}
+}
+
+type recordQuery struct {
+	TokenHash string
+}
+
+func (q recordQuery) GetQueryStr() string {
+	return `
+SELECT token_hash, data, user_email, remember, created_at, last_seen_at
+FROM tbl_session WHERE token_hash=$1`
+}
+
+func (q recordQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.TokenHash}
+}
+
+func (q recordQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	rec := record{}
+	nullEmail := sql.NullString{}
+	if err := r.Scan(&rec.TokenHash, &rec.Data, &nullEmail, &rec.Remember, &rec.CreatedAt, &rec.LastSeenAt); err != nil {
+		return nil, err
+	}
+	rec.UserEmail = nullEmail.String
+	return &rec, nil
+}
+
+type lastSeenUpdate struct {
+	TokenHash string
+	Now       time.Time
+}
+
+func (u lastSeenUpdate) GetUpdateStr() string {
+	return "UPDATE tbl_session SET last_seen_at=$1 WHERE token_hash=$2"
+}
+
+func (u lastSeenUpdate) GetUpdateArgs() []interface{} {
+	return []interface{}{u.Now, u.TokenHash}
+}
+
+type recordDelete struct {
+	TokenHash string
+}
+
+func (d recordDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_session WHERE token_hash=$1"
+}
+
+func (d recordDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.TokenHash}
+}
+
+type expiredDelete struct {
+	Policy Policy
+	Now    time.Time
+}
+
+func (d expiredDelete) GetDeleteStr() string {
+	return `
+DELETE FROM tbl_session WHERE
+(NOT remember AND (last_seen_at < $1 OR created_at < $2))
+OR (remember AND (last_seen_at < $3 OR created_at < $4))`
+}
+
+func (d expiredDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{
+		d.Now.Add(-d.Policy.IdleTimeout), d.Now.Add(-d.Policy.AbsoluteTimeout),
+		d.Now.Add(-d.Policy.RememberIdleTimeout), d.Now.Add(-d.Policy.RememberAbsoluteTimeout),
+	}
+}
@@ -0,0 +1,70 @@
+package sessionStore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyExpired(t *testing.T) {
+	policy := Policy{
+		IdleTimeout:             time.Hour,
+		AbsoluteTimeout:         10 * time.Hour,
+		RememberIdleTimeout:     24 * time.Hour,
+		RememberAbsoluteTimeout: 48 * time.Hour,
+	}
+	created := time.Date(2017, 11, 1, 12, 0, 0, 0, time.UTC)
+	if policy.Expired(created, created, false, created.Add(59*time.Minute)) {
+		t.Error("Session expired before the idle timeout")
+	}
+	if !policy.Expired(created, created, false, created.Add(61*time.Minute)) {
+		t.Error("Idle session did not expire")
+	}
+	lastSeen := created.Add(9*time.Hour + 30*time.Minute)
+	if !policy.Expired(created, lastSeen, false, created.Add(10*time.Hour)) {
+		t.Error("Active session outlived the absolute timeout")
+	}
+	if policy.Expired(created, created, true, created.Add(23*time.Hour)) {
+		t.Error("Remembered session used the short idle timeout")
+	}
+	if !policy.Expired(created, created.Add(47*time.Hour), true, created.Add(48*time.Hour)) {
+		t.Error("Remembered session outlived its absolute timeout")
+	}
+}
+
+func TestAnonymousSessionsArentStored(t *testing.T) {
+	store := New(nil, DefaultPolicy, []byte("whatever"))
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, err := store.Get(r, "pathfork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.IsNew || session.ID != "" {
+		t.Error("Session without a cookie should be new")
+	}
+	// the store has no database, so this would panic if it tried to save
+	if err := session.Save(r, w); err != nil {
+		t.Error(err)
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Error("Empty anonymous session set a cookie")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	if ip := ClientIP(r); ip != "10.0.0.1" {
+		t.Errorf("Expected 10.0.0.1, got %v", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if ip := ClientIP(r); ip != "203.0.113.9" {
+		t.Errorf("Expected 203.0.113.9, got %v", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+	if ip := ClientIP(r); ip != "203.0.113.9" {
+		t.Errorf("Expected the proxy's 203.0.113.9 over the client's own claim, got %v", ip)
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store talks to Amazon S3 or anything that speaks its API (MinIO, Ceph,
+// DigitalOcean Spaces...) using path-style URLs, so Endpoint is just the
+// server, like https://s3.amazonaws.com. Requests are signed with AWS
+// Signature Version 4.
+type S3Store struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Client defaults to one with a 30 second timeout
+	Client *http.Client
+	// now is for tests
+	now func() time.Time
+}
+
+const s3Timeout = 30 * time.Second
+
+func (s *S3Store) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &http.Client{Timeout: s3Timeout}
+}
+
+func (s *S3Store) do(method, key, contentType string, body []byte) (*http.Response, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%v/%v/%v", s.Endpoint, s.Bucket, key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	s.sign(req, hashHex(body), now)
+	return s.client().Do(req)
+}
+
+func (s *S3Store) Put(key, contentType string, data []byte) error {
+	resp, err := s.do("PUT", key, contentType, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", key, resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("GET", key, resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Delete doesn't mind if the blob is already gone; S3 doesn't either
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotFound {
+		return s3Error("DELETE", key, resp)
+	}
+	return nil
+}
+
+func s3Error(method, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(body) > 200 {
+		body = body[:200]
+	}
+	return fmt.Errorf("storage: s3 %v %v: %v %s", method, key, resp.Status, body)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers.
+// Every header already on the request is signed along with the host.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", day, s.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hashHex([]byte(canonicalRequest)),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.AccessKey, scope, signedHeaders, signature))
+}
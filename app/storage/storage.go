@@ -0,0 +1,75 @@
+// Package storage keeps uploaded files somewhere other than the database.
+// A Store can be a directory on local disk, which is fine for development
+// but doesn't survive a Heroku dyno restart, or an S3-compatible bucket.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNotFound = errors.New("storage: no such key")
+
+// Store saves and loads blobs by key. Keys are slash-separated paths made
+// of letters, digits, '-', '_' and '.', like "images/3f9a.jpg".
+type Store interface {
+	Put(key, contentType string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return fmt.Errorf("storage: bad key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("storage: bad key %q", key)
+		}
+	}
+	for _, c := range key {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '/'
+		if !ok {
+			return fmt.Errorf("storage: bad key %q", key)
+		}
+	}
+	return nil
+}
+
+// FromEnv picks a Store from the environment, the same way the port comes
+// from $PORT. PATHFORK_STORAGE is "local" (the default) or "s3".
+//
+// local: PATHFORK_UPLOAD_DIR, default "uploads"
+//
+// s3: PATHFORK_S3_ENDPOINT (e.g. https://s3.amazonaws.com or
+// http://localhost:9000 for MinIO), PATHFORK_S3_BUCKET, PATHFORK_S3_REGION
+// (default us-east-1), PATHFORK_S3_ACCESS_KEY and PATHFORK_S3_SECRET_KEY
+func FromEnv(getenv func(string) string) (Store, error) {
+	switch kind := getenv("PATHFORK_STORAGE"); kind {
+	case "", "local":
+		dir := getenv("PATHFORK_UPLOAD_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocalStore(dir), nil
+	case "s3":
+		s := &S3Store{
+			Endpoint:  strings.TrimSuffix(getenv("PATHFORK_S3_ENDPOINT"), "/"),
+			Bucket:    getenv("PATHFORK_S3_BUCKET"),
+			Region:    getenv("PATHFORK_S3_REGION"),
+			AccessKey: getenv("PATHFORK_S3_ACCESS_KEY"),
+			SecretKey: getenv("PATHFORK_S3_SECRET_KEY"),
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+			return nil, errors.New("storage: s3 needs PATHFORK_S3_ENDPOINT, _BUCKET, _ACCESS_KEY and _SECRET_KEY")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("storage: unknown PATHFORK_STORAGE %q", kind)
+	}
+}
@@ -0,0 +1,43 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryLimiter keeps counts in process, so they're lost on restart and not
+// shared between dynos. Fine for development and tests.
+type MemoryLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]Attempts
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{attempts: make(map[string]Attempts)}
+}
+
+func (l *MemoryLimiter) Attempts(key string) (Attempts, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempts[key], nil
+}
+
+func (l *MemoryLimiter) RecordFailure(key string, now, forgetBefore time.Time) (Attempts, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := l.attempts[key]
+	if a.LastFailure.Before(forgetBefore) {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailure = now
+	l.attempts[key] = a
+	return a, nil
+}
+
+func (l *MemoryLimiter) Reset(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, key)
+	return nil
+}
@@ -0,0 +1,132 @@
+package throttle
+
+import (
+	"database/sql"
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"github.com/golang/glog"
+)
+
+// PGLimiter keeps counts in tbl_login_attempt so every dyno sees the same ones
+type PGLimiter struct {
+	DB *db.DB
+}
+
+func NewPGLimiter(database *db.DB) *PGLimiter {
+	return &PGLimiter{DB: database}
+}
+
+func (l *PGLimiter) Attempts(key string) (Attempts, error) {
+	attemptsInt, err := l.DB.Query(attemptsQuery{Key: key})
+	if err != nil {
+		return Attempts{}, err
+	}
+	if len(attemptsInt) == 0 {
+		return Attempts{}, nil
+	}
+	return *attemptsInt[0].(*Attempts), nil
+}
+
+// RecordFailure is a single upsert so that concurrent failures can't
+// overwrite each other's counts
+func (l *PGLimiter) RecordFailure(key string, now, forgetBefore time.Time) (Attempts, error) {
+	a := Attempts{}
+	err := l.DB.DB.QueryRow(`
+INSERT INTO tbl_login_attempt (attempt_key, failures, last_failure) VALUES ($1, 1, $2)
+ON CONFLICT (attempt_key) DO UPDATE SET
+failures = CASE WHEN tbl_login_attempt.last_failure < $3 THEN 1 ELSE tbl_login_attempt.failures + 1 END,
+last_failure = $2
+RETURNING failures, last_failure`, key, now, forgetBefore).Scan(&a.Failures, &a.LastFailure)
+	return a, err
+}
+
+func (l *PGLimiter) Reset(key string) error {
+	tx, err := l.DB.DB.Begin()
+	if err == nil {
+		err = l.DB.Delete(attemptsDelete{Key: key}, tx)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	return err
+}
+
+// PurgeEvery clears out keys nobody has failed on for maxAge, on an interval
+// until the process exits
+func (l *PGLimiter) PurgeEvery(interval, maxAge time.Duration) {
+	for range time.Tick(interval) {
+		tx, err := l.DB.DB.Begin()
+		if err == nil {
+			if err = l.DB.Delete(staleAttemptsDelete{Before: time.Now().Add(-maxAge)}, tx); err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			glog.Errorf("Login attempt purge error: %v", err.Error())
+		}
+	}
+}
+
+/*
+.
+.
+*/
+
+// Attempts only needs to be Insertable to come back from db.Query
+func (a *Attempts) GetInsertStr() string {
+	return ""
+}
+
+func (a *Attempts) GetInsertArgs() []interface{} {
+	return nil
+}
+
+type attemptsQuery struct {
+	Key string
+}
+
+func (q attemptsQuery) GetQueryStr() string {
+	return "SELECT failures, last_failure FROM tbl_login_attempt WHERE attempt_key=$1"
+}
+
+func (q attemptsQuery) GetQueryArgs() []interface{} {
+	return []interface{}{q.Key}
+}
+
+func (q attemptsQuery) ObjFromRow(database *db.DB, r *sql.Rows) (db.Insertable, error) {
+	a := Attempts{}
+	if err := r.Scan(&a.Failures, &a.LastFailure); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+type attemptsDelete struct {
+	Key string
+}
+
+func (d attemptsDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_login_attempt WHERE attempt_key=$1"
+}
+
+func (d attemptsDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Key}
+}
+
+// staleAttemptsDelete clears every key whose last failure was before Before
+type staleAttemptsDelete struct {
+	Before time.Time
+}
+
+func (d staleAttemptsDelete) GetDeleteStr() string {
+	return "DELETE FROM tbl_login_attempt WHERE last_failure < $1"
+}
+
+func (d staleAttemptsDelete) GetDeleteArgs() []interface{} {
+	return []interface{}{d.Before}
+}
@@ -0,0 +1,166 @@
+// Package throttle slows down and eventually locks out repeated failed logins.
+// Failures are counted per key (an account or an IP address) by a Limiter,
+// which can keep its counts in memory or in Postgres; a Policy turns those
+// counts into how long the next attempt has to wait.
+package throttle
+
+import (
+	"time"
+)
+
+// Attempts is what a Limiter knows about one key
+type Attempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+type Limiter interface {
+	Attempts(key string) (Attempts, error)
+	// RecordFailure adds a failure for key and returns the new count. Any
+	// failures from before forgetBefore are dropped first.
+	RecordFailure(key string, now, forgetBefore time.Time) (Attempts, error)
+	Reset(key string) error
+}
+
+// Policy allows a few free attempts, then doubles the wait after each failure
+// up to MaxDelay. After LockoutAfter failures the key is locked out entirely
+// for LockoutFor. Failures older than ForgetAfter don't count.
+type Policy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	LockoutFor   time.Duration
+	ForgetAfter  time.Duration
+}
+
+var AccountPolicy = Policy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockoutAfter: 10,
+	LockoutFor:   30 * time.Minute,
+	ForgetAfter:  24 * time.Hour,
+}
+
+// IPPolicy is looser than AccountPolicy since lots of people can share an IP
+var IPPolicy = Policy{
+	FreeAttempts: 20,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockoutAfter: 100,
+	LockoutFor:   time.Hour,
+	ForgetAfter:  time.Hour,
+}
+
+func (p Policy) forgotten(a Attempts, now time.Time) bool {
+	return a.Failures == 0 || now.Sub(a.LastFailure) >= p.ForgetAfter
+}
+
+func (p Policy) Locked(a Attempts, now time.Time) bool {
+	if p.forgotten(a, now) || a.Failures < p.LockoutAfter {
+		return false
+	}
+	return now.Sub(a.LastFailure) < p.LockoutFor
+}
+
+func (p Policy) Delay(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Wait is how long until the next attempt is allowed; zero means go ahead
+func (p Policy) Wait(a Attempts, now time.Time) time.Duration {
+	if p.forgotten(a, now) {
+		return 0
+	}
+	until := a.LastFailure.Add(p.Delay(a.Failures))
+	if p.Locked(a, now) {
+		until = a.LastFailure.Add(p.LockoutFor)
+	}
+	if wait := until.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+/*
+.
+.
+*/
+
+// Guard applies an account policy and an IP policy to login attempts
+type Guard struct {
+	Limiter Limiter
+	Account Policy
+	IP      Policy
+}
+
+func NewGuard(limiter Limiter) Guard {
+	return Guard{
+		Limiter: limiter,
+		Account: AccountPolicy,
+		IP:      IPPolicy,
+	}
+}
+
+// AccountKey is what failed logins to email are counted under
+func AccountKey(email string) string {
+	return "account:" + email
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Wait is how long the caller has to hold off before trying email from ip
+// again. If the limiter can't be read we let the attempt through rather than
+// lock everybody out.
+func (g Guard) Wait(email, ip string, now time.Time) (time.Duration, error) {
+	account, err := g.Limiter.Attempts(AccountKey(email))
+	if err != nil {
+		return 0, err
+	}
+	byIP, err := g.Limiter.Attempts(ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	wait := g.Account.Wait(account, now)
+	if ipWait := g.IP.Wait(byIP, now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait, nil
+}
+
+// Fail records a failed attempt. It reports whether this failure is the one
+// that locked the account, so the owner can be told exactly once.
+func (g Guard) Fail(email, ip string, now time.Time) (bool, error) {
+	if _, err := g.Limiter.RecordFailure(ipKey(ip), now, now.Add(-g.IP.ForgetAfter)); err != nil {
+		return false, err
+	}
+	account, err := g.Limiter.RecordFailure(AccountKey(email), now, now.Add(-g.Account.ForgetAfter))
+	if err != nil {
+		return false, err
+	}
+	return account.Failures == g.Account.LockoutAfter, nil
+}
+
+// Succeed clears the account's failures. The IP's failures stand, otherwise
+// one working login would let an attacker start over on every other account.
+func (g Guard) Succeed(email string) error {
+	return g.Limiter.Reset(AccountKey(email))
+}
+
+// Unlock is for the owner of a locked account, via the emailed link
+func (g Guard) Unlock(email string) error {
+	return g.Limiter.Reset(AccountKey(email))
+}
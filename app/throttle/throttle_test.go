@@ -0,0 +1,100 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts: 2,
+	BaseDelay:    time.Second,
+	MaxDelay:     10 * time.Second,
+	LockoutAfter: 6,
+	LockoutFor:   time.Minute,
+	ForgetAfter:  time.Hour,
+}
+
+func TestDelay(t *testing.T) {
+	expected := []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for failures, want := range expected {
+		if got := testPolicy.Delay(failures); got != want {
+			t.Errorf("Delay(%v) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	a := Attempts{Failures: 4, LastFailure: now}
+	if wait := testPolicy.Wait(a, now.Add(500*time.Millisecond)); wait != 1500*time.Millisecond {
+		t.Errorf("Expected 1.5s wait, got %v", wait)
+	}
+	if wait := testPolicy.Wait(a, now.Add(3*time.Second)); wait != 0 {
+		t.Errorf("Expected no wait once the delay has passed, got %v", wait)
+	}
+	a.Failures = 6
+	if !testPolicy.Locked(a, now.Add(30*time.Second)) {
+		t.Error("Not locked after LockoutAfter failures")
+	}
+	if wait := testPolicy.Wait(a, now.Add(30*time.Second)); wait != 30*time.Second {
+		t.Errorf("Expected the rest of the lockout, got %v", wait)
+	}
+	if testPolicy.Locked(a, now.Add(time.Minute)) {
+		t.Error("Still locked after LockoutFor")
+	}
+	a.Failures = 50
+	if wait := testPolicy.Wait(a, now.Add(2*time.Hour)); wait != 0 {
+		t.Errorf("Old failures still counted, wait %v", wait)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	l := NewMemoryLimiter()
+	now := time.Unix(1500000000, 0)
+	for i := 1; i <= 3; i++ {
+		if a, _ := l.RecordFailure("k", now, now.Add(-time.Hour)); a.Failures != i {
+			t.Errorf("Expected %v failures, got %v", i, a.Failures)
+		}
+	}
+	later := now.Add(2 * time.Hour)
+	if a, _ := l.RecordFailure("k", later, later.Add(-time.Hour)); a.Failures != 1 {
+		t.Errorf("Old failures weren't forgotten, got %v", a.Failures)
+	}
+	l.Reset("k")
+	if a, _ := l.Attempts("k"); a.Failures != 0 {
+		t.Errorf("Reset left %v failures", a.Failures)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	g := Guard{Limiter: NewMemoryLimiter(), Account: testPolicy, IP: testPolicy}
+	g.IP.LockoutAfter = 100
+	now := time.Unix(1500000000, 0)
+	for i := 1; i <= testPolicy.LockoutAfter; i++ {
+		locked, err := g.Fail("a@b.c", "1.2.3.4", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == testPolicy.LockoutAfter) {
+			t.Errorf("Failure %v reported locked=%v", i, locked)
+		}
+	}
+	if wait, _ := g.Wait("a@b.c", "5.6.7.8", now); wait != time.Minute {
+		t.Errorf("Locked account not locked from another IP, wait %v", wait)
+	}
+	if wait, _ := g.Wait("d@e.f", "1.2.3.4", now); wait != 8*time.Second {
+		t.Errorf("IP backoff not applied to another account, wait %v", wait)
+	}
+	if locked, _ := g.Fail("a@b.c", "1.2.3.4", now); locked {
+		t.Error("Lockout reported twice")
+	}
+	g.Unlock("a@b.c")
+	if wait, _ := g.Wait("a@b.c", "5.6.7.8", now); wait != 0 {
+		t.Errorf("Unlocked account still waiting %v", wait)
+	}
+	g.Fail("a@b.c", "5.6.7.8", now)
+	g.Succeed("a@b.c")
+	if a, _ := g.Limiter.Attempts(ipKey("5.6.7.8")); a.Failures != 1 {
+		t.Error("A successful login shouldn't clear the IP's failures")
+	}
+}
@@ -0,0 +1,51 @@
+package pathfork
+
+import (
+	"time"
+
+	"bitbucket.org/jtyburke/pathfork/app/db"
+	"bitbucket.org/jtyburke/pathfork/app/models"
+	"github.com/golang/glog"
+)
+
+// defaultTrashRetention is how long things stay in the trash unless
+// PATHFORK_TRASH_RETENTION says otherwise
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashRetentionTime is what InitApp read, for telling people on the Trash
+// page
+var trashRetentionTime time.Duration
+
+// trashRetention reads PATHFORK_TRASH_RETENTION, a duration like "720h".
+// Zero or less keeps the trash forever.
+func trashRetention(getenv func(string) string) (time.Duration, error) {
+	raw := getenv("PATHFORK_TRASH_RETENTION")
+	if raw == "" {
+		return defaultTrashRetention, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// purgeTrash deletes whatever has been in the trash longer than retention,
+// and its pictures with it
+func purgeTrash(retention time.Duration, database *db.DB) {
+	for _, item := range models.GetExpiredTrash(time.Now().Add(-retention), database) {
+		var images []*models.Image
+		if item.Entity == "work" {
+			images = models.GetImagesForWork(item.Id, database)
+		} else {
+			images = models.GetImagesFor(item.Entity, item.Id, database)
+		}
+		if success, err := models.PurgeTrashedItem(item, database); err != nil || !success {
+			glog.Errorf("Error purging %v %v from the trash: %v", item.Entity, item.Id, err)
+			continue
+		}
+		deleteStoredImages(images)
+	}
+}
+
+func purgeTrashEvery(interval, retention time.Duration, database *db.DB) {
+	for range time.Tick(interval) {
+		purgeTrash(retention, database)
+	}
+}
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoServer sends every message back, upper-cased
+func echoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage([]byte(strings.ToUpper(string(message)))); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example from RFC 6455
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Got %v", got)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+	conn, err := Dial(wsURL(server), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// short, 16 bit and 64 bit lengths
+	for _, size := range []int{5, 300, 70000} {
+		message := strings.Repeat("a", size)
+		if err := conn.WriteMessage([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != strings.ToUpper(message) {
+			t.Errorf("Got %v bytes back for %v", len(reply), size)
+		}
+	}
+}
+
+func TestUpgradeRefusals(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Plain GET got %v", resp.StatusCode)
+	}
+	header := http.Header{"Origin": {"http://evil.example.com"}}
+	if _, err := Dial(wsURL(server), header); err == nil {
+		t.Error("Cross-origin handshake should be refused")
+	}
+	header = http.Header{"Origin": {server.URL}}
+	conn, err := Dial(wsURL(server), header)
+	if err != nil {
+		t.Errorf("Same-origin handshake refused: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+	conn, err := Dial(wsURL(server), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ReadMessage(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -1,7 +1,7 @@
-drop table if exists tbl_subsection;
 drop table if exists tbl_section CASCADE;
 drop table if exists tbl_snippet;
 drop table if exists tbl_work CASCADE;
+drop table if exists tbl_series;
 drop table if exists tbl_character;
 drop table if exists tbl_setting;
 drop table if exists tbl_thing;
@@ -15,11 +15,47 @@ drop table if exists r_sections_things;
 drop table if exists r_settings_things;
 drop table if exists r_settings_characters;
 drop table if exists r_characters_things;
+drop table if exists tbl_api_token;
+drop table if exists tbl_session;
+drop table if exists tbl_recovery_code;
+drop table if exists tbl_login_attempt;
+drop table if exists tbl_section_status;
+drop table if exists tbl_event CASCADE;
+drop table if exists r_events_characters;
+drop table if exists r_events_settings;
+drop table if exists r_events_sections;
+drop table if exists tbl_character_relationship;
+drop table if exists tbl_field_def CASCADE;
+drop table if exists tbl_character_field_value;
+drop table if exists tbl_setting_field_value;
+drop table if exists tbl_character_alias;
+drop table if exists tbl_setting_alias;
+drop table if exists tbl_image;
+drop table if exists tbl_comment;
+drop table if exists tbl_work_member;
+drop table if exists tbl_activity;
+drop table if exists tbl_share_link;
+drop table if exists tbl_revision CASCADE;
+drop table if exists tbl_revision_change;
 
+/* a new table with a user_email column needs adding to models.userEmailTables */
 create table tbl_user(
 email varchar(256) primary key,
 pw varchar(64) not null,
-verified BOOLEAN DEFAULT FALSE
+verified BOOLEAN DEFAULT FALSE,
+totp_secret varchar(64),
+totp_enabled boolean not null default false,
+totp_last_step bigint not null default 0
+);
+
+/* works in a series are ordered by tbl_work.series_number */
+create table tbl_series(
+series_id serial primary key,
+title text not null,
+blurb text,
+user_email text not null,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
 );
 
 create table tbl_work(
@@ -28,8 +64,24 @@ title text not null,
 blurb text,
 user_email text not null,
 word_count integer not null default 0,
+statuses text[] not null default '{idea,drafted,revised,final}',
+/* publishing details, for title pages and e-book metadata */
+subtitle text,
+author text,
+series_id integer,
+series_number numeric,
+language text not null default 'en',
+isbn text,
+copyright_year integer,
+dedication text,
+acknowledgements text,
+about_author text,
+/* set while it's in the trash; the purge job deletes it for good later */
+deleted_at timestamp,
 foreign key (user_email) references tbl_user(email)
-	ON DELETE CASCADE
+	ON DELETE CASCADE,
+foreign key (series_id) references tbl_series(series_id)
+	ON DELETE SET NULL
 );
 
 create table tbl_section(
@@ -37,30 +89,29 @@ section_id serial primary key,
 title text not null,
 blurb text,
 body text,
-order integer,
+section_order integer,
 is_snippet boolean default false,
 work_id integer not null,
 user_email text not null,
 word_count integer not null default 0,
+/* null for top-level sections; parts, chapters and scenes nest to any depth */
+parent_id integer,
+status text not null default 'idea',
+/* one of the section's characters, see the foreign key after tbl_character */
+pov_character_id integer,
+/* free text in the story's own calendar, and a key to sort it on */
+story_time text,
+story_sort text,
+/* set while it's in the trash; the purge job deletes it for good later */
+deleted_at timestamp,
 foreign key (work_id) references tbl_work(work_id)
 	ON DELETE CASCADE,
+foreign key (parent_id) references tbl_section(section_id)
+	ON DELETE CASCADE,
 foreign key (user_email) references tbl_user(email)
 	ON DELETE CASCADE
 );
 
-/*
-create table tbl_subsection(
-subsection_id serial primary key,
-title text not null,
-blurb text,
-body text,
-section_id integer not null,
-user_email text not null,
-foreign key (section_id) references tbl_section(section_id),
-foreign key (user_email) references tbl_user(email)
-);
-*/
-
 /*
 create table tbl_snippet(
 snippet_id serial primary key,
@@ -82,10 +133,15 @@ name text not null,
 blurb text,
 body text,
 user_email text not null,
+/* set while it's in the trash; the purge job deletes it for good later */
+deleted_at timestamp,
 foreign key (user_email) references tbl_user(email)
 	ON DELETE CASCADE
 );
 
+alter table tbl_section add foreign key (pov_character_id) references tbl_character(character_id)
+	ON DELETE SET NULL;
+
 create table r_sections_characters(
 section_id serial not null,
 character_id integer not null,
@@ -111,9 +167,16 @@ setting_id serial primary key,
 name text not null,
 blurb text,
 body text,
+/* the place this one is in, null at the top; the app keeps out cycles */
+parent_id integer,
 user_email text not null,
+/* set while it's in the trash; the purge job deletes it for good later */
+deleted_at timestamp,
+foreign key (parent_id) references tbl_setting(setting_id)
+	ON DELETE SET NULL,
 foreign key (user_email) references tbl_user(email)
-	ON DELETE CASCADE
+	ON DELETE CASCADE,
+CHECK (parent_id <> setting_id)
 );
 
 create table r_sections_settings(
@@ -180,6 +243,331 @@ FOREIGN KEY (character_id) references tbl_character(character_id)
 	ON DELETE CASCADE
 );
 
+create table tbl_api_token(
+api_token_id serial primary key,
+name text not null,
+token_prefix varchar(8) not null,
+token_hash varchar(64) not null unique,
+scope varchar(16) not null default 'read',
+user_email text not null,
+created_at timestamp not null default now(),
+expires_at timestamp,
+last_used_at timestamp,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+create table tbl_session(
+session_id serial primary key,
+token_hash varchar(64) not null unique,
+data text not null,
+user_email text,
+user_agent text not null default '',
+ip varchar(64) not null default '',
+remember boolean not null default false,
+created_at timestamp not null default now(),
+last_seen_at timestamp not null default now(),
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+create table tbl_recovery_code(
+recovery_code_id serial primary key,
+user_email text not null,
+code_hash varchar(64) not null,
+used_at timestamp,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+create table tbl_section_status(
+section_status_id serial primary key,
+section_id integer not null,
+status text not null,
+changed_at timestamp not null default now(),
+user_email text not null,
+foreign key (section_id) references tbl_section(section_id)
+	ON DELETE CASCADE,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+/* keys are "account:<email>" or "ip:<address>", and the account needn't exist */
+create table tbl_login_attempt(
+attempt_key varchar(320) primary key,
+failures integer not null default 0,
+last_failure timestamp not null default now()
+);
+
+/* something that happens in the story, whether or not a section shows it */
+create table tbl_event(
+event_id serial primary key,
+title text not null,
+description text,
+story_time text,
+/* story_sort_end is only set for events that take a while */
+story_sort text,
+story_sort_end text,
+user_email text not null,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+create table r_events_characters(
+event_id integer not null,
+character_id integer not null,
+PRIMARY KEY (event_id, character_id),
+FOREIGN KEY (event_id) references tbl_event(event_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (character_id) references tbl_character(character_id)
+	ON DELETE CASCADE
+);
+
+create table r_events_settings(
+event_id integer not null,
+setting_id integer not null,
+PRIMARY KEY (event_id, setting_id),
+FOREIGN KEY (event_id) references tbl_event(event_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (setting_id) references tbl_setting(setting_id)
+	ON DELETE CASCADE
+);
+
+create table r_events_sections(
+event_id integer not null,
+section_id integer not null,
+PRIMARY KEY (event_id, section_id),
+FOREIGN KEY (event_id) references tbl_event(event_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (section_id) references tbl_section(section_id)
+	ON DELETE CASCADE
+);
+
+/* start and end are sections in reading order; NULL means the relationship
+ * holds from the beginning or to the end */
+create table tbl_character_relationship(
+character_relationship_id serial primary key,
+from_character_id integer not null,
+to_character_id integer not null,
+kind text not null,
+directed boolean not null default false,
+notes text,
+start_section_id integer,
+end_section_id integer,
+user_email text not null,
+FOREIGN KEY (from_character_id) references tbl_character(character_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (to_character_id) references tbl_character(character_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (start_section_id) references tbl_section(section_id)
+	ON DELETE SET NULL,
+FOREIGN KEY (end_section_id) references tbl_section(section_id)
+	ON DELETE SET NULL,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE,
+CHECK (from_character_id <> to_character_id)
+);
+
+/* a custom field on characters or settings; with no work_id it's on all of
+ * the user's characters or settings. choices are one per line. */
+create table tbl_field_def(
+field_def_id serial primary key,
+entity text not null,
+name text not null,
+field_type text not null,
+choices text,
+ref_entity text,
+work_id integer,
+field_order integer not null default 0,
+user_email text not null,
+FOREIGN KEY (work_id) references tbl_work(work_id)
+	ON DELETE CASCADE,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE,
+CHECK (entity IN ('character', 'setting')),
+CHECK (field_type IN ('text', 'number', 'date', 'select', 'reference')),
+CHECK (ref_entity IS NULL OR ref_entity IN ('character', 'setting'))
+);
+
+create table tbl_character_field_value(
+field_def_id integer not null,
+character_id integer not null,
+value text not null,
+PRIMARY KEY (field_def_id, character_id),
+FOREIGN KEY (field_def_id) references tbl_field_def(field_def_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (character_id) references tbl_character(character_id)
+	ON DELETE CASCADE
+);
+
+create table tbl_setting_field_value(
+field_def_id integer not null,
+setting_id integer not null,
+value text not null,
+PRIMARY KEY (field_def_id, setting_id),
+FOREIGN KEY (field_def_id) references tbl_field_def(field_def_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (setting_id) references tbl_setting(setting_id)
+	ON DELETE CASCADE
+);
+
+/* what a character or setting used to be called */
+create table tbl_character_alias(
+character_id integer not null,
+name text not null,
+created_at timestamp not null default now(),
+PRIMARY KEY (character_id, name),
+FOREIGN KEY (character_id) references tbl_character(character_id)
+	ON DELETE CASCADE
+);
+
+create table tbl_setting_alias(
+setting_id integer not null,
+name text not null,
+created_at timestamp not null default now(),
+PRIMARY KEY (setting_id, name),
+FOREIGN KEY (setting_id) references tbl_setting(setting_id)
+	ON DELETE CASCADE
+);
+
+/* the picture and its thumbnail are in upload storage under storage_key and
+ * thumb_key. Exactly one of character_id, setting_id, work_id and section_id
+ * says what it's of. */
+create table tbl_image(
+image_id serial primary key,
+character_id integer,
+setting_id integer,
+work_id integer,
+section_id integer,
+storage_key text not null,
+thumb_key text not null,
+content_type text not null,
+thumb_type text not null,
+filename text not null,
+caption text,
+width integer not null,
+height integer not null,
+size_bytes integer not null,
+created_at timestamp not null default now(),
+user_email text not null,
+FOREIGN KEY (character_id) references tbl_character(character_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (setting_id) references tbl_setting(setting_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (work_id) references tbl_work(work_id)
+	ON DELETE CASCADE,
+FOREIGN KEY (section_id) references tbl_section(section_id)
+	ON DELETE CASCADE,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE,
+CHECK ((character_id IS NOT NULL)::integer + (setting_id IS NOT NULL)::integer +
+	(work_id IS NOT NULL)::integer + (section_id IS NOT NULL)::integer = 1)
+);
+
+/* read-only links to a work; token is signed over share_link_id */
+create table tbl_share_link(
+share_link_id serial primary key,
+work_id integer not null,
+name text not null,
+token text not null default '',
+/* empty for the whole work */
+section_ids integer[] not null default '{}',
+password_hash text,
+expires_at timestamp,
+created_at timestamp not null default now(),
+user_email text not null,
+foreign key (work_id) references tbl_work(work_id)
+	ON DELETE CASCADE,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+/* feedback on sections. A thread starts with a comment anchored to quote at
+anchor_offset in the section's text; replies have a parent_id and no anchor.
+by_author is false for readers' comments, which wait for a digest email. */
+create table tbl_comment(
+comment_id serial primary key,
+section_id integer not null,
+parent_id integer,
+share_link_id integer,
+by_author boolean not null default false,
+author_name text not null default '',
+body text not null,
+quote text not null default '',
+anchor_offset integer not null default 0,
+detached boolean not null default false,
+resolved_at timestamp,
+created_at timestamp not null default now(),
+emailed boolean not null default false,
+user_email text not null,
+foreign key (section_id) references tbl_section(section_id)
+	ON DELETE CASCADE,
+foreign key (parent_id) references tbl_comment(comment_id)
+	ON DELETE CASCADE,
+foreign key (share_link_id) references tbl_share_link(share_link_id)
+	ON DELETE SET NULL,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+/* everyone but the owner with a role in a work. Invites can go to emails
+without an account yet, so user_email isn't a foreign key; accepted is set
+when the invite link is followed. */
+create table tbl_work_member(
+work_member_id serial primary key,
+work_id integer not null,
+user_email text not null,
+role text not null,
+accepted boolean not null default false,
+invited_by text not null,
+created_at timestamp not null default now(),
+unique (work_id, user_email),
+foreign key (work_id) references tbl_work(work_id)
+	ON DELETE CASCADE
+);
+
+/* who did what in a work. section_title is kept as it was at the time. */
+create table tbl_activity(
+activity_id serial primary key,
+work_id integer not null,
+section_id integer,
+section_title text not null default '',
+user_email text not null,
+action text not null,
+created_at timestamp not null default now(),
+foreign key (work_id) references tbl_work(work_id)
+	ON DELETE CASCADE,
+foreign key (section_id) references tbl_section(section_id)
+	ON DELETE SET NULL
+);
+
+/* what a find and replace changed, so that it can be undone */
+create table tbl_revision(
+revision_id serial primary key,
+work_id integer not null,
+user_email text not null,
+description text not null,
+created_at timestamp not null default now(),
+undone_at timestamp,
+foreign key (work_id) references tbl_work(work_id)
+	ON DELETE CASCADE,
+foreign key (user_email) references tbl_user(email)
+	ON DELETE CASCADE
+);
+
+/* one field's value before and after a revision. entity is section,
+ * character or setting, and object_id is its id. */
+create table tbl_revision_change(
+revision_id integer not null,
+entity text not null,
+object_id integer not null,
+field text not null,
+old_value text not null,
+new_value text not null,
+foreign key (revision_id) references tbl_revision(revision_id)
+	ON DELETE CASCADE
+);
+
 create unique index ix_characters_works on r_works_characters (character_id, work_id);
 create unique index ix_settings_works on r_works_settings (setting_id, work_id);
 create unique index ix_characters_sections on r_sections_characters (character_id, section_id);
@@ -190,8 +578,46 @@ create unique index ix_things_works on r_works_things (thing_id, work_id);
 */
 
 create index ix_work_email on tbl_work (user_email);
+create index ix_work_series on tbl_work (series_id);
+create index ix_work_deleted on tbl_work (deleted_at) where deleted_at is not null;
+create index ix_section_deleted on tbl_section (deleted_at) where deleted_at is not null;
+create index ix_character_deleted on tbl_character (deleted_at) where deleted_at is not null;
+create index ix_setting_deleted on tbl_setting (deleted_at) where deleted_at is not null;
+create index ix_series_email on tbl_series (user_email);
 create index ix_character_email on tbl_character (user_email);
 create index ix_setting_email on tbl_setting (user_email);
+create index ix_setting_parent on tbl_setting (parent_id);
+create index ix_event_email on tbl_event (user_email);
+create index ix_events_characters_character on r_events_characters (character_id);
+create index ix_events_settings_setting on r_events_settings (setting_id);
+create index ix_events_sections_section on r_events_sections (section_id);
+create index ix_character_relationship_email on tbl_character_relationship (user_email);
+create index ix_character_relationship_from on tbl_character_relationship (from_character_id);
+create index ix_character_relationship_to on tbl_character_relationship (to_character_id);
+create index ix_field_def_email on tbl_field_def (user_email);
+create index ix_character_field_value_character on tbl_character_field_value (character_id);
+create index ix_setting_field_value_setting on tbl_setting_field_value (setting_id);
+create index ix_image_email on tbl_image (user_email);
+create index ix_image_character on tbl_image (character_id);
+create index ix_image_setting on tbl_image (setting_id);
+create index ix_image_work on tbl_image (work_id);
+create index ix_image_section on tbl_image (section_id);
+create index ix_share_link_work on tbl_share_link (work_id);
+create index ix_share_link_email on tbl_share_link (user_email);
+create index ix_comment_section on tbl_comment (section_id);
+create index ix_comment_email on tbl_comment (user_email);
+create index ix_comment_undigested on tbl_comment (user_email) where not emailed;
+create index ix_work_member_email on tbl_work_member (user_email);
+create index ix_activity_work on tbl_activity (work_id, created_at);
+create index ix_revision_work on tbl_revision (work_id, created_at);
+create index ix_revision_email on tbl_revision (user_email);
+create index ix_revision_change_revision on tbl_revision_change (revision_id);
+create index ix_section_parent on tbl_section (parent_id);
+create index ix_section_status_section on tbl_section_status (section_id);
+create index ix_api_token_email on tbl_api_token (user_email);
+create index ix_session_email on tbl_session (user_email);
+create index ix_recovery_code_email on tbl_recovery_code (user_email);
+create index ix_login_attempt_last_failure on tbl_login_attempt (last_failure);
 /*create index ix_thing_email on tbl_thing (user_email);*/
 
 
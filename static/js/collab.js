@@ -0,0 +1,348 @@
+// The browser's half of app/collab: ops in the ot.js format, and a client
+// that keeps one editor in step with a section's collaborative session. A
+// positive number in an op keeps that many characters, a negative one
+// deletes that many, and a string is inserted. Lengths are in code points,
+// so documents are handled as arrays from Array.from.
+var PathforkCollab = (function() {
+  'use strict';
+
+  function isRetain(c) { return typeof c === 'number' && c > 0; }
+  function isDelete(c) { return typeof c === 'number' && c < 0; }
+  function isInsert(c) { return typeof c === 'string'; }
+  function length(s) { return Array.from(s).length; }
+
+  // Builder puts ops together the same way collab.Op does, so the server
+  // and the browser agree on what they look like
+  function Builder() {
+    this.ops = [];
+  }
+
+  Builder.prototype.retain = function(n) {
+    var last = this.ops.length - 1;
+    if (n <= 0) {
+      return this;
+    }
+    if (last >= 0 && isRetain(this.ops[last])) {
+      this.ops[last] += n;
+    } else {
+      this.ops.push(n);
+    }
+    return this;
+  };
+
+  Builder.prototype.remove = function(n) {
+    var last = this.ops.length - 1;
+    if (n <= 0) {
+      return this;
+    }
+    if (last >= 0 && isDelete(this.ops[last])) {
+      this.ops[last] -= n;
+    } else {
+      this.ops.push(-n);
+    }
+    return this;
+  };
+
+  Builder.prototype.insert = function(s) {
+    var ops = this.ops, last = ops.length - 1;
+    if (s === '') {
+      return this;
+    }
+    if (last >= 0 && isInsert(ops[last])) {
+      ops[last] += s;
+    } else if (last >= 0 && isDelete(ops[last])) {
+      if (last > 0 && isInsert(ops[last - 1])) {
+        ops[last - 1] += s;
+      } else {
+        ops.push(ops[last]);
+        ops[last] = s;
+      }
+    } else {
+      ops.push(s);
+    }
+    return this;
+  };
+
+  function isNoop(op) {
+    return op.length === 0 || (op.length === 1 && isRetain(op[0]));
+  }
+
+  function apply(op, doc) {
+    var output = [], pos = 0;
+    op.forEach(function(c) {
+      if (isRetain(c)) {
+        output = output.concat(doc.slice(pos, pos + c));
+        pos += c;
+      } else if (isDelete(c)) {
+        pos -= c;
+      } else {
+        output = output.concat(Array.from(c));
+      }
+    });
+    if (pos !== doc.length) {
+      throw new Error("op doesn't cover the document");
+    }
+    return output;
+  }
+
+  // transform is collab.Transform: a then b' is b then a', and a's inserts
+  // go first
+  function transform(a, b) {
+    var aPrime = new Builder(), bPrime = new Builder();
+    var i = 0, j = 0, ca = a[i++], cb = b[j++], n;
+    while (ca !== undefined || cb !== undefined) {
+      if (isInsert(ca)) {
+        aPrime.insert(ca);
+        bPrime.retain(length(ca));
+        ca = a[i++];
+        continue;
+      }
+      if (isInsert(cb)) {
+        aPrime.retain(length(cb));
+        bPrime.insert(cb);
+        cb = b[j++];
+        continue;
+      }
+      if (ca === undefined || cb === undefined) {
+        throw new Error("ops aren't for the same document");
+      }
+      n = Math.min(Math.abs(ca), Math.abs(cb));
+      if (isRetain(ca) && isRetain(cb)) {
+        aPrime.retain(n);
+        bPrime.retain(n);
+      } else if (isDelete(ca) && isRetain(cb)) {
+        aPrime.remove(n);
+      } else if (isRetain(ca) && isDelete(cb)) {
+        bPrime.remove(n);
+      }
+      ca = shorten(ca, n) || a[i++];
+      cb = shorten(cb, n) || b[j++];
+    }
+    return [aPrime.ops, bPrime.ops];
+  }
+
+  // shorten takes n characters off a retain or delete, leaving 0 when
+  // there's nothing left
+  function shorten(c, n) {
+    return c > 0 ? c - n : c + n;
+  }
+
+  // compose is a then b as one op
+  function compose(a, b) {
+    var output = new Builder();
+    var i = 0, j = 0, ca = a[i++], cb = b[j++], n, chars;
+    while (ca !== undefined || cb !== undefined) {
+      if (isDelete(ca)) {
+        output.remove(-ca);
+        ca = a[i++];
+        continue;
+      }
+      if (isInsert(cb)) {
+        output.insert(cb);
+        cb = b[j++];
+        continue;
+      }
+      if (ca === undefined || cb === undefined) {
+        throw new Error("ops don't follow on from each other");
+      }
+      if (isInsert(ca)) {
+        chars = Array.from(ca);
+        n = Math.min(chars.length, Math.abs(cb));
+        if (isRetain(cb)) {
+          output.insert(chars.slice(0, n).join(''));
+        }
+        ca = chars.length > n ? chars.slice(n).join('') : a[i++];
+        cb = shorten(cb, n) || b[j++];
+        continue;
+      }
+      n = Math.min(ca, Math.abs(cb));
+      if (isRetain(cb)) {
+        output.retain(n);
+      } else {
+        output.remove(n);
+      }
+      ca = shorten(ca, n) || a[i++];
+      cb = shorten(cb, n) || b[j++];
+    }
+    return output.ops;
+  }
+
+  // diff is collab.Diff: whatever's between the common beginning and end
+  // is replaced
+  function diff(oldDoc, newDoc) {
+    var prefix = 0, suffix = 0;
+    while (prefix < oldDoc.length && prefix < newDoc.length && oldDoc[prefix] === newDoc[prefix]) {
+      prefix++;
+    }
+    while (suffix < oldDoc.length - prefix && suffix < newDoc.length - prefix &&
+           oldDoc[oldDoc.length - 1 - suffix] === newDoc[newDoc.length - 1 - suffix]) {
+      suffix++;
+    }
+    return new Builder()
+      .retain(prefix)
+      .insert(newDoc.slice(prefix, newDoc.length - suffix).join(''))
+      .remove(oldDoc.length - prefix - suffix)
+      .retain(suffix)
+      .ops;
+  }
+
+  /*
+  .
+  .
+  */
+
+  // Client talks to the session at url. editor has getBody() and
+  // setBody(body), and is told about other people through
+  // onPresence(clients) and onCursor(id, cursor). onStatus(connected) hears
+  // when the socket opens and closes; once it's closed, saving goes through
+  // the form again.
+  function Client(url, editor) {
+    this.editor = editor;
+    this.doc = null;
+    this.rev = 0;
+    this.id = 0;
+    // outstanding has been sent and not acknowledged; buffer waits for it
+    this.outstanding = null;
+    this.buffer = null;
+    this.clients = {};
+    this.whenSynced = [];
+    this.connected = false;
+    this.socket = new WebSocket(url);
+    this.socket.onmessage = this.receive.bind(this);
+    this.socket.onclose = this.closed.bind(this);
+    this.heartbeat = setInterval(this.send.bind(this, {type: 'ping'}), 30 * 1000);
+  }
+
+  Client.prototype.send = function(m) {
+    if (this.socket.readyState === WebSocket.OPEN) {
+      this.socket.send(JSON.stringify(m));
+    }
+  };
+
+  Client.prototype.closed = function() {
+    clearInterval(this.heartbeat);
+    this.connected = false;
+    this.editor.onStatus(false);
+    this.runSynced();
+  };
+
+  // inStep is whether the editor's body is the session's, as far as this
+  // client knows
+  Client.prototype.inStep = function() {
+    return this.connected && this.outstanding === null && this.buffer === null &&
+      this.doc !== null && this.editor.getBody() === this.doc.join('');
+  };
+
+  // afterSync calls f once everything sent has been acknowledged, or the
+  // connection's gone
+  Client.prototype.afterSync = function(f) {
+    this.update();
+    if (!this.connected || (this.outstanding === null && this.buffer === null)) {
+      f();
+    } else {
+      this.whenSynced.push(f);
+    }
+  };
+
+  Client.prototype.runSynced = function() {
+    var waiting = this.whenSynced;
+    this.whenSynced = [];
+    waiting.forEach(function(f) { f(); });
+  };
+
+  // update sends whatever's changed in the editor since last time
+  Client.prototype.update = function() {
+    if (!this.connected) {
+      return;
+    }
+    var body = Array.from(this.editor.getBody());
+    var op = diff(this.doc, body);
+    if (isNoop(op)) {
+      return;
+    }
+    this.doc = body;
+    if (this.outstanding === null) {
+      this.outstanding = op;
+      this.send({type: 'op', rev: this.rev, op: op});
+    } else {
+      this.buffer = this.buffer === null ? op : compose(this.buffer, op);
+    }
+  };
+
+  Client.prototype.sendCursor = function(cursor) {
+    this.send({type: 'cursor', cursor: cursor});
+  };
+
+  Client.prototype.receive = function(event) {
+    var m = JSON.parse(event.data), pair;
+    switch (m.type) {
+    case 'init':
+      this.connected = true;
+      this.id = m.client;
+      this.rev = m.rev;
+      this.doc = Array.from(m.body || '');
+      this.outstanding = this.buffer = null;
+      this.editor.setBody(this.doc.join(''));
+      this.presence(m.clients);
+      this.editor.onStatus(true);
+      // the editor may have tidied the body up
+      this.update();
+      break;
+    case 'ack':
+      this.rev = m.rev;
+      this.outstanding = this.buffer;
+      this.buffer = null;
+      if (this.outstanding !== null) {
+        this.send({type: 'op', rev: this.rev, op: this.outstanding});
+      } else {
+        this.runSynced();
+      }
+      break;
+    case 'op':
+      var op = m.op;
+      if (this.outstanding !== null) {
+        pair = transform(this.outstanding, op);
+        this.outstanding = pair[0];
+        op = pair[1];
+      }
+      if (this.buffer !== null) {
+        pair = transform(this.buffer, op);
+        this.buffer = pair[0];
+        op = pair[1];
+      }
+      this.rev = m.rev;
+      this.doc = apply(op, this.doc);
+      this.editor.setBody(this.doc.join(''));
+      this.update();
+      break;
+    case 'cursor':
+      if (this.clients[m.client]) {
+        this.clients[m.client].cursor = m.cursor;
+        this.editor.onCursor(this.clients[m.client]);
+      }
+      break;
+    case 'presence':
+      this.presence(m.clients);
+      break;
+    }
+  };
+
+  Client.prototype.presence = function(list) {
+    var id = this.id, clients = {};
+    (list || []).forEach(function(c) {
+      if (c.id !== id) {
+        clients[c.id] = c;
+      }
+    });
+    this.clients = clients;
+    this.editor.onPresence(clients);
+  };
+
+  return {
+    Client: Client,
+    apply: apply,
+    transform: transform,
+    compose: compose,
+    diff: diff,
+  };
+})();